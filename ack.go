@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ACK status codes published back to devices. They follow HTTP semantics so firmware
+// can treat 2xx as "stop retransmitting" and 4xx as "do not retry this message".
+const (
+	ackProcessed = 200
+	ackDuplicate = 208
+	ackInvalid   = 400
+	ackUnhandled = 404
+)
+
+var (
+	ackTopic  = "ACK/%s"
+	ackEvents = map[string]bool{} // events to acknowledge; "*" acknowledges every event
+)
+
+var acksPublished = newCounterVec("collector_acks_published_total", "Application-level ACKs published to devices, by status code.", "status")
+
+// DeviceAck is the payload published on a device's ACK topic.
+type DeviceAck struct {
+	Event     string `json:"event"`
+	MessageID string `json:"message_id,omitempty"`
+	IngestID  string `json:"ingest_id"`
+	Status    int    `json:"status"`
+	Reason    string `json:"reason,omitempty"`
+	Time      int64  `json:"time"`
+}
+
+// parseAckEvents parses ACK_EVENTS, a comma-separated list of event names or "*".
+func parseAckEvents(spec string) map[string]bool {
+	events := map[string]bool{}
+	for _, event := range strings.Split(spec, ",") {
+		if event = strings.TrimSpace(event); event != "" {
+			events[event] = true
+		}
+	}
+	return events
+}
+
+// sendAck tells the device the outcome of processing one of its messages when ACKs are
+// enabled for the event. The device's own message_id is echoed back when it sent one.
+func sendAck(senderID, event string, msgData map[string]interface{}, ingestID string, status int, reason string) {
+	if !ackEvents[event] && !ackEvents["*"] {
+		return
+	}
+	ack := DeviceAck{Event: event, IngestID: ingestID, Status: status, Reason: reason, Time: getCurrentTimeMillis()}
+	if id, ok := msgData["message_id"]; ok {
+		ack.MessageID = fmt.Sprint(id)
+	}
+	payload, err := json.Marshal(ack)
+	if err != nil {
+		log.Printf("[%s] Failed to marshal ACK: %v", ingestID, err)
+		return
+	}
+	topic := fmt.Sprintf(ackTopic, senderID)
+	if err := mqttClient.Publish(topic, mqttPublishQoS, false, payload); err != nil {
+		log.Printf("[%s] Failed to publish ACK to %s: %v", ingestID, topic, err)
+		return
+	}
+	acksPublished.Inc(fmt.Sprint(status))
+}
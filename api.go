@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	httpAddr string
+	apiToken string // API_TOKEN, the bearer token required by routes that change anything
+)
+
+// startAPIServer serves the HTTP API in the background. Routes that send commands or
+// change configuration require apiToken and are not registered at all without one.
+// Without a Postgres db only the routes served from the Store and memory are.
+func startAPIServer(db *sql.DB) {
+	mux := http.NewServeMux()
+	handleMutating := func(pattern string, handler http.HandlerFunc) {
+		if apiToken != "" {
+			mux.Handle(pattern, requireToken(handler))
+		}
+	}
+	if apiToken == "" {
+		log.Printf("API_TOKEN is not set, serving the HTTP API read-only")
+	}
+	mux.HandleFunc("GET /metrics", handleMetrics)
+	mux.HandleFunc("GET /version", handleVersion)
+	mux.HandleFunc("GET /api/v1/devices/{id}/latest-events", func(w http.ResponseWriter, r *http.Request) {
+		handleLatestEvents(eventStore, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/debug/payloads", handleListPayloadDebug)
+	handleMutating("PUT /api/v1/devices/{id}/debug", handleEnablePayloadDebug)
+	handleMutating("DELETE /api/v1/devices/{id}/debug", handleDisablePayloadDebug)
+	if db == nil {
+		log.Printf("Serving only metrics, latest events and payload debugging over HTTP: the rest of the API needs DB_DRIVER=postgres")
+		serveAPI(mux)
+		return
+	}
+	mux.HandleFunc("GET /api/v1/instances", func(w http.ResponseWriter, r *http.Request) {
+		handleListInstances(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/devices", func(w http.ResponseWriter, r *http.Request) {
+		handleListDevices(db, w, r)
+	})
+	handleMutating("PUT /api/v1/devices/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handlePutDevice(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/filters", func(w http.ResponseWriter, r *http.Request) {
+		handleListSavedFilters(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/filters/{name}", func(w http.ResponseWriter, r *http.Request) {
+		handleGetSavedFilter(db, w, r)
+	})
+	handleMutating("PUT /api/v1/filters/{name}", func(w http.ResponseWriter, r *http.Request) {
+		handlePutSavedFilter(db, w, r)
+	})
+	handleMutating("DELETE /api/v1/filters/{name}", func(w http.ResponseWriter, r *http.Request) {
+		handleDeleteSavedFilter(db, w, r)
+	})
+	handleMutating("PUT /api/v1/devices/{id}/labels/{key}", func(w http.ResponseWriter, r *http.Request) {
+		handlePutDeviceLabel(db, w, r)
+	})
+	handleMutating("DELETE /api/v1/devices/{id}/labels/{key}", func(w http.ResponseWriter, r *http.Request) {
+		handleDeleteDeviceLabel(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/devices/{id}/commands", func(w http.ResponseWriter, r *http.Request) {
+		handleListCommands(db, w, r)
+	})
+	handleMutating("POST /api/v1/devices/{id}/commands", func(w http.ResponseWriter, r *http.Request) {
+		handleSendCommand(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/devices/{id}/shadow", func(w http.ResponseWriter, r *http.Request) {
+		handleGetShadow(db, w, r)
+	})
+	handleMutating("PUT /api/v1/devices/{id}/shadow/desired", func(w http.ResponseWriter, r *http.Request) {
+		handlePutDesired(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/device-state", func(w http.ResponseWriter, r *http.Request) {
+		handleListDeviceState(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/devices/{id}/state", func(w http.ResponseWriter, r *http.Request) {
+		handleGetDeviceState(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/devices/{id}/locations", func(w http.ResponseWriter, r *http.Request) {
+		handleDeviceLocations(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/devices/{id}/geofences", func(w http.ResponseWriter, r *http.Request) {
+		handleListGeofences(db, w, r)
+	})
+	handleMutating("PUT /api/v1/devices/{id}/geofences/{name}", func(w http.ResponseWriter, r *http.Request) {
+		handlePutGeofence(db, w, r)
+	})
+	handleMutating("DELETE /api/v1/devices/{id}/geofences/{name}", func(w http.ResponseWriter, r *http.Request) {
+		handleDeleteGeofence(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/devices/{id}/temperature-thresholds", func(w http.ResponseWriter, r *http.Request) {
+		handleGetTemperatureThresholds(db, w, r)
+	})
+	handleMutating("PUT /api/v1/devices/{id}/temperature-thresholds", func(w http.ResponseWriter, r *http.Request) {
+		handlePutTemperatureThresholds(db, w, r)
+	})
+	handleMutating("DELETE /api/v1/devices/{id}/temperature-thresholds", func(w http.ResponseWriter, r *http.Request) {
+		handleDeleteTemperatureThresholds(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/devices/{id}/data-usage", func(w http.ResponseWriter, r *http.Request) {
+		handleDeviceDataUsage(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/devices/{id}/data-quota", func(w http.ResponseWriter, r *http.Request) {
+		handleGetDataQuota(db, w, r)
+	})
+	handleMutating("PUT /api/v1/devices/{id}/data-quota", func(w http.ResponseWriter, r *http.Request) {
+		handlePutDataQuota(db, w, r)
+	})
+	handleMutating("DELETE /api/v1/devices/{id}/data-quota", func(w http.ResponseWriter, r *http.Request) {
+		handleDeleteDataQuota(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/devices/{id}/reboots", func(w http.ResponseWriter, r *http.Request) {
+		handleDeviceReboots(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/devices/{id}/series", func(w http.ResponseWriter, r *http.Request) {
+		handleDeviceSeries(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/devices/{id}/thermal", func(w http.ResponseWriter, r *http.Request) {
+		handleDeviceThermal(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/devices/{id}/processing-log", func(w http.ResponseWriter, r *http.Request) {
+		handleDeviceProcessingLog(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/dead-letters", func(w http.ResponseWriter, r *http.Request) {
+		handleListDeadLetters(db, w, r)
+	})
+	handleMutating("POST /api/v1/dead-letters/reprocess", func(w http.ResponseWriter, r *http.Request) {
+		handleReprocessDeadLetters(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/messages/{id}/trace", func(w http.ResponseWriter, r *http.Request) {
+		handleMessageTrace(db, w, r)
+	})
+	handleMutating("POST /api/v1/commands/bulk", func(w http.ResponseWriter, r *http.Request) {
+		handleStartBulk(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/commands/bulk/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handleBulkProgress(db, w, r)
+	})
+	handleMutating("POST /api/v1/commands/bulk/{id}/abort", func(w http.ResponseWriter, r *http.Request) {
+		handleAbortBulk(db, w, r)
+	})
+	handleMutating("POST /api/v1/firmware/campaigns", func(w http.ResponseWriter, r *http.Request) {
+		handleCreateCampaign(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/firmware/campaigns/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handleGetCampaign(db, w, r)
+	})
+	mux.HandleFunc("GET /api/v1/firmware/campaigns/{id}/devices", func(w http.ResponseWriter, r *http.Request) {
+		handleCampaignDevices(db, w, r)
+	})
+	handleMutating("POST /api/v1/firmware/campaigns/{id}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		handleCampaignAction(db, w, r)
+	})
+	serveAPI(mux)
+}
+
+func serveAPI(mux *http.ServeMux) {
+	go func() {
+		log.Printf("HTTP API listening on %s", httpAddr)
+		if err := http.ListenAndServe(httpAddr, compressHandler(mux)); err != nil {
+			log.Fatalf("HTTP API server failed: %v", err)
+		}
+	}()
+}
+
+// requireToken rejects requests without an "Authorization: Bearer" header carrying apiToken.
+func requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="modem_go"`)
+			writeError(w, http.StatusUnauthorized, "a valid bearer token is required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding HTTP response: %v", err)
+	}
+}
+
+// apiCacheMaxAge is how long clients may reuse a cached response without revalidating;
+// zero makes them revalidate every time, which is cheap thanks to ETags.
+var apiCacheMaxAge time.Duration
+
+// writeCachedJSON writes v like writeJSON with an ETag over the encoded body, and answers
+// 304 Not Modified when a GET request's If-None-Match already has that version.
+func writeCachedJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding HTTP response: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	if apiCacheMaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(apiCacheMaxAge.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(append(body, '\n'))
+}
+
+// etagMatches reports whether an If-None-Match header lists etag or "*".
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// queryLimit reads the limit query parameter, falling back to def and capping at max.
+func queryLimit(r *http.Request, def, max int) int {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		return def
+	}
+	if limit > max {
+		return max
+	}
+	return limit
+}
+
+func handleListCommands(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	audits, err := queryCommandAudit(db, r.PathValue("id"), queryLimit(r, 50, 1000))
+	if err != nil {
+		log.Printf("Error listing commands: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to query commands")
+		return
+	}
+	writeCachedJSON(w, r, audits)
+}
+
+func handleSendCommand(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Command string                 `json:"command"`
+		Params  map[string]interface{} `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Command == "" {
+		writeError(w, http.StatusBadRequest, "body must be JSON with a non-empty command")
+		return
+	}
+
+	audit, err := sendCommand(db, r.PathValue("id"), body.Command, body.Params, "")
+	if err != nil {
+		log.Printf("Error sending command: %v", err)
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, audit)
+}
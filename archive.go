@@ -0,0 +1,372 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Archival (ARCHIVE_AFTER, e.g. "365d") moves events older than the given age out of
+// Postgres: one UTC day at a time the events are written to a file in ARCHIVE_FORMAT
+// (gzipped CSV or Parquet), uploaded to an S3-compatible bucket (AWS S3 or MinIO) and
+// only then deleted, together with their routed and raw rows, the same way retention
+// deletes them. It runs inside the RETENTION_WINDOW, so archive with a shorter age than
+// RETENTION to keep the data.
+//
+// Objects are named <ARCHIVE_S3_PREFIX>events/YYYY/MM/DD/events-YYYYMMDD-<last id>.csv.gz
+// (or .parquet); events that arrive late for an archived day end up in a second file
+// for that day.
+type archiveConfig struct {
+	after    time.Duration
+	interval time.Duration
+	bucket   *s3Bucket
+	prefix   string
+	format   archiveFormat
+}
+
+// archiveFormat is a file format of archived events.
+type archiveFormat struct {
+	ext         string
+	contentType string
+	newWriter   func(io.Writer) (archiveWriter, error)
+}
+
+var archiveFormats = map[string]archiveFormat{
+	"csv":     {ext: ".csv.gz", contentType: "application/gzip", newWriter: newCSVArchiveWriter},
+	"parquet": {ext: ".parquet", contentType: "application/vnd.apache.parquet", newWriter: newParquetArchiveWriter},
+}
+
+// archiveWriter writes the events of one archive file; value is the event value as
+// JSON, nil when it is not valid JSON. Close finishes the file.
+type archiveWriter interface {
+	Write(id int64, e EventRecord, value []byte) error
+	Close() error
+}
+
+var archivedEvents = newCounterVec("collector_archived_events_total", "Events moved to object storage by the archiver, by result.", "result")
+
+// archiveCSVHeader are the columns of an archive file; value is the JSON-encoded event value.
+var archiveCSVHeader = []string{"id", "sender_id", "event", "tag", "value", "status", "event_time", "received_at", "ingest_id"}
+
+// loadArchiveConfig reads the ARCHIVE_* settings; it returns nil when archival is off.
+func loadArchiveConfig() (*archiveConfig, error) {
+	after := getEnvAge("ARCHIVE_AFTER", 0)
+	if after <= 0 {
+		return nil, nil
+	}
+	format, ok := archiveFormats[getEnv("ARCHIVE_FORMAT", "csv")]
+	if !ok {
+		return nil, fmt.Errorf("unknown ARCHIVE_FORMAT %q, must be csv or parquet", os.Getenv("ARCHIVE_FORMAT"))
+	}
+	bucket := &s3Bucket{
+		endpoint:     strings.TrimSuffix(os.Getenv("ARCHIVE_S3_ENDPOINT"), "/"),
+		name:         os.Getenv("ARCHIVE_S3_BUCKET"),
+		region:       getEnv("ARCHIVE_S3_REGION", "us-east-1"),
+		accessKey:    getEnv("ARCHIVE_S3_ACCESS_KEY", os.Getenv("AWS_ACCESS_KEY_ID")),
+		secretKey:    getEnv("ARCHIVE_S3_SECRET_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if bucket.endpoint == "" {
+		bucket.endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", bucket.region)
+	}
+	if bucket.name == "" || bucket.accessKey == "" || bucket.secretKey == "" {
+		return nil, fmt.Errorf("ARCHIVE_AFTER needs ARCHIVE_S3_BUCKET and S3 credentials")
+	}
+	return &archiveConfig{
+		after:    after,
+		interval: getEnvDuration("ARCHIVE_INTERVAL", time.Hour),
+		bucket:   bucket,
+		prefix:   os.Getenv("ARCHIVE_S3_PREFIX"),
+		format:   format,
+	}, nil
+}
+
+// startArchiver archives every interval while the retention window is open.
+func startArchiver(db *sql.DB, cfg *archiveConfig) {
+	if cfg == nil {
+		return
+	}
+	go func() {
+		for {
+			if retentionWindow.Contains(clock.Now()) {
+				if err := archiveExpired(db, cfg); err != nil {
+					log.Printf("Error archiving events: %v", err)
+				}
+			}
+			<-clock.After(cfg.interval)
+		}
+	}()
+}
+
+// archiveExpired archives whole days older than cfg.after, oldest first, until none are
+// left or the window closes.
+func archiveExpired(db *sql.DB, cfg *archiveConfig) error {
+	cutoff := clock.Now().Add(-cfg.after).UTC().Truncate(24 * time.Hour)
+	for retentionWindow.Contains(clock.Now()) {
+		var oldest sql.NullTime
+		if err := db.QueryRow("SELECT min(COALESCE(event_time, received_at)) FROM events WHERE COALESCE(event_time, received_at) < $1", cutoff).Scan(&oldest); err != nil {
+			return err
+		}
+		if !oldest.Valid {
+			return nil
+		}
+		if err := archiveDay(db, cfg, oldest.Time.UTC().Truncate(24*time.Hour)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveDay uploads the events of one day and deletes them once the upload succeeded.
+func archiveDay(db *sql.DB, cfg *archiveConfig, day time.Time) error {
+	end := day.Add(24 * time.Hour)
+	f, err := os.CreateTemp("", "events-archive-*"+cfg.format.ext)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha256.New()
+	count, lastID, err := writeArchive(db, cfg.format, io.MultiWriter(f, hash), day, end)
+	if err != nil {
+		return fmt.Errorf("failed to write archive for %s: %v", day.Format("2006-01-02"), err)
+	}
+	if count == 0 {
+		return nil
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%sevents/%s/events-%s-%d%s", cfg.prefix, day.Format("2006/01/02"), day.Format("20060102"), lastID, cfg.format.ext)
+	if err := cfg.bucket.Put(key, f, size, hex.EncodeToString(hash.Sum(nil)), cfg.format.contentType); err != nil {
+		archivedEvents.Add("upload_failed", float64(count))
+		return fmt.Errorf("failed to upload %s: %v", key, err)
+	}
+
+	// Only rows that made it into the file are deleted, even if more arrived meanwhile.
+	deleted := 0
+	for {
+		n, err := pruneEventBatch(db, "COALESCE(event_time, received_at) >= $1 AND COALESCE(event_time, received_at) < $2 AND id <= $3", day, end, lastID)
+		if err != nil {
+			return fmt.Errorf("uploaded %s but failed to delete the archived events: %v", key, err)
+		}
+		deleted += n
+		if n < retentionBatch {
+			break
+		}
+		<-clock.After(retentionPause)
+	}
+	archivedEvents.Add("archived", float64(deleted))
+	log.Printf("Archived %d events of %s to %s", deleted, day.Format("2006-01-02"), key)
+	return nil
+}
+
+// writeArchive writes the events in [from, to) in format and returns how many there
+// were and the highest event id.
+func writeArchive(db *sql.DB, format archiveFormat, out io.Writer, from, to time.Time) (int, int64, error) {
+	rows, err := db.Query(`SELECT id, `+storedEventColumns+` FROM events
+        WHERE COALESCE(event_time, received_at) >= $1 AND COALESCE(event_time, received_at) < $2 ORDER BY id`, from, to)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	w, err := format.newWriter(out)
+	if err != nil {
+		return 0, 0, err
+	}
+	count := 0
+	var lastID int64
+	for rows.Next() {
+		var e EventRecord
+		var value []byte
+		if err := rows.Scan(&lastID, &e.SenderID, &e.Event, &e.Tag, &value, &e.Status, &e.EventTime, &e.ReceivedAt, &e.IngestID); err != nil {
+			return 0, 0, err
+		}
+		if !json.Valid(value) {
+			value = nil
+		}
+		if err := w.Write(lastID, e, value); err != nil {
+			return 0, 0, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	return count, lastID, w.Close()
+}
+
+// csvArchiveWriter writes gzipped CSV with the archiveCSVHeader columns and times in
+// RFC 3339.
+type csvArchiveWriter struct {
+	zw *gzip.Writer
+	w  *csv.Writer
+}
+
+func newCSVArchiveWriter(out io.Writer) (archiveWriter, error) {
+	zw := gzip.NewWriter(out)
+	w := csv.NewWriter(zw)
+	return &csvArchiveWriter{zw: zw, w: w}, w.Write(archiveCSVHeader)
+}
+
+func (a *csvArchiveWriter) Write(id int64, e EventRecord, value []byte) error {
+	eventTime := ""
+	if e.EventTime != nil {
+		eventTime = e.EventTime.UTC().Format(time.RFC3339Nano)
+	}
+	return a.w.Write([]string{strconv.FormatInt(id, 10), e.SenderID, e.Event, e.Tag, string(value), strconv.FormatBool(e.Status),
+		eventTime, e.ReceivedAt.UTC().Format(time.RFC3339Nano), e.IngestID})
+}
+
+func (a *csvArchiveWriter) Close() error {
+	a.w.Flush()
+	if err := a.w.Error(); err != nil {
+		return err
+	}
+	return a.zw.Close()
+}
+
+// parquetArchiveRow is an event in a Parquet archive, with the CSV columns typed: times
+// are UTC microseconds and value stays JSON text.
+type parquetArchiveRow struct {
+	ID         int64   `parquet:"name=id, type=INT64"`
+	SenderID   string  `parquet:"name=sender_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Event      string  `parquet:"name=event, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Tag        string  `parquet:"name=tag, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Value      *string `parquet:"name=value, type=BYTE_ARRAY, convertedtype=JSON, repetitiontype=OPTIONAL"`
+	Status     bool    `parquet:"name=status, type=BOOLEAN"`
+	EventTime  *int64  `parquet:"name=event_time, type=INT64, convertedtype=TIMESTAMP_MICROS, repetitiontype=OPTIONAL"`
+	ReceivedAt int64   `parquet:"name=received_at, type=INT64, convertedtype=TIMESTAMP_MICROS"`
+	IngestID   string  `parquet:"name=ingest_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+// parquetRowGroupBytes bounds the rows buffered in memory before a row group is written.
+const parquetRowGroupBytes = 32 << 20
+
+// parquetArchiveWriter writes Snappy-compressed Parquet.
+type parquetArchiveWriter struct {
+	pw *writer.ParquetWriter
+}
+
+func newParquetArchiveWriter(out io.Writer) (archiveWriter, error) {
+	pw, err := writer.NewParquetWriterFromWriter(out, new(parquetArchiveRow), 1)
+	if err != nil {
+		return nil, err
+	}
+	pw.RowGroupSize = parquetRowGroupBytes
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	return &parquetArchiveWriter{pw: pw}, nil
+}
+
+func (a *parquetArchiveWriter) Write(id int64, e EventRecord, value []byte) error {
+	row := parquetArchiveRow{ID: id, SenderID: e.SenderID, Event: e.Event, Tag: e.Tag, Status: e.Status,
+		ReceivedAt: e.ReceivedAt.UnixMicro(), IngestID: e.IngestID}
+	if value != nil {
+		v := string(value)
+		row.Value = &v
+	}
+	if e.EventTime != nil {
+		t := e.EventTime.UnixMicro()
+		row.EventTime = &t
+	}
+	return a.pw.Write(row)
+}
+
+func (a *parquetArchiveWriter) Close() error {
+	return a.pw.WriteStop()
+}
+
+// s3Bucket uploads objects to an S3-compatible bucket with path-style URLs
+// (endpoint/bucket/key), which both AWS S3 and MinIO accept, signed with AWS
+// Signature Version 4.
+type s3Bucket struct {
+	endpoint     string
+	name         string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// Put uploads size bytes of contentType from body under key; payloadHash is the hex
+// SHA-256 of the body.
+func (b *s3Bucket) Put(key string, body io.Reader, size int64, payloadHash, contentType string) error {
+	u, err := url.Parse(b.endpoint + "/" + b.name + "/" + key)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	b.sign(req, payloadHash, clock.Now().UTC())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// sign adds the SigV4 Authorization header for req.
+func (b *s3Bucket) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	canonicalHeaders := "host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n"
+	if b.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", b.sessionToken)
+		signed = append(signed, "x-amz-security-token")
+		canonicalHeaders += "x-amz-security-token:" + b.sessionToken + "\n"
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonicalHeaders, signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + b.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + b.secretKey)
+	for _, part := range []string{date, b.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", b.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
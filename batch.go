@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// batchInsertRows caps the rows per INSERT statement, well below Postgres' limit of
+// 65535 bind parameters.
+const batchInsertRows = 500
+
+var batchFlushes = newCounterVec("collector_db_batch_flushes_total", "Batched database flushes, by result.", "result")
+
+// batchWriter groups stored events and writes them with multi-row INSERTs, flushing
+// every maxRows events or every interval, whichever comes first. A nil *batchWriter
+// means every event is written on its own (DB_BATCH_SIZE=0).
+type batchWriter struct {
+	db       *sql.DB
+	maxRows  int
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending []EventMessage
+	full    chan struct{}
+	// flushMu serializes flushes so batches reach the database in the order they were queued.
+	flushMu sync.Mutex
+}
+
+var batcher *batchWriter
+
+func newBatchWriter(db *sql.DB, maxRows int, interval time.Duration) *batchWriter {
+	b := &batchWriter{db: db, maxRows: maxRows, interval: interval, full: make(chan struct{}, 1)}
+	newGaugeFunc("collector_db_batch_pending", "Events waiting for the next batched database flush.", func() float64 {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return float64(len(b.pending))
+	})
+	go b.run()
+	log.Printf("Batching database writes: up to %d rows or every %v", maxRows, interval)
+	return b
+}
+
+// Add queues data for the next flush.
+func (b *batchWriter) Add(data EventMessage) {
+	b.mu.Lock()
+	b.pending = append(b.pending, data)
+	full := len(b.pending) >= b.maxRows
+	b.mu.Unlock()
+	if full {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *batchWriter) run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.full:
+		}
+		b.Flush()
+	}
+}
+
+// Flush writes everything queued so far. Events of a failed batch go to the spool like
+// failed single-row writes.
+func (b *batchWriter) Flush() {
+	if b == nil {
+		return
+	}
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+	b.mu.Lock()
+	batch := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := withDBRetry(dbRetryAttempts, func() error { return writeEventBatch(b.db, batch) }); err != nil {
+		batchFlushes.Inc("error")
+		log.Printf("Error saving batch of %d events: %v", len(batch), err)
+		if permanentDBError(err) {
+			// One rejected row fails the whole statement; store the rest one by one and
+			// dead-letter the ones the database rejects.
+			for _, data := range batch {
+				processAndSaveDirect(newPostgresStore(b.db), data)
+			}
+			return
+		}
+		for i := range batch {
+			outbox.Append(spoolRecord{Kind: spoolDatabase, IngestID: batch[i].IngestID, Event: &batch[i]})
+			procLog.Record(batch[i].IngestID, batch[i].Sumber, decisionStoreFailed, err.Error())
+		}
+		return
+	}
+	batchFlushes.Inc("ok")
+	for _, data := range batch {
+		table, _ := storageTable(data.EventName)
+		procLog.Record(data.IngestID, data.Sumber, decisionStored, data.EventName+" -> "+table)
+	}
+}
+
+// writeEventBatch stores a batch in one transaction: the routed rows, the normalized
+// events and the rollups each with multi-row statements.
+func writeEventBatch(db *sql.DB, batch []EventMessage) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	byTable := map[string][][]interface{}{}
+	var tables []string
+	var events [][]interface{}
+	var stored []EventMessage
+	for _, data := range batch {
+		table, ok := storageTable(data.EventName)
+		if !ok {
+			continue
+		}
+		if _, seen := byTable[table]; !seen {
+			tables = append(tables, table)
+		}
+		byTable[table] = append(byTable[table], []interface{}{data.Sumber, data.Msg, data.Time, nullIfEmpty(data.IngestID)})
+		args, err := normalizedEventArgs(data)
+		if err != nil {
+			return err
+		}
+		events = append(events, args)
+		stored = append(stored, data)
+	}
+	for _, table := range tables {
+		err := insertMultiRow(tx, fmt.Sprintf("INSERT INTO %s (sender_id, message, timestamp, ingest_id) VALUES ", table),
+			"($%d, $%d, to_timestamp($%d / 1000.0), $%d)", byTable[table], "")
+		if err != nil {
+			return fmt.Errorf("failed to insert into %s: %v", table, err)
+		}
+	}
+	err = insertMultiRow(tx, "INSERT INTO events ("+normalizedEventColumns+") VALUES ",
+		"($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)", events, "")
+	if err != nil {
+		return fmt.Errorf("failed to insert into events: %v", err)
+	}
+	if err := upsertRollups(tx, batch); err != nil {
+		return err
+	}
+	if err := upsertDeviceStates(tx, stored); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertMultiRow runs prefix followed by one rowFormat per row, in chunks of
+// batchInsertRows. rowFormat has one %d verb per column for the parameter numbers.
+func insertMultiRow(tx *sql.Tx, prefix, rowFormat string, rows [][]interface{}, suffix string) error {
+	for start := 0; start < len(rows); start += batchInsertRows {
+		chunk := rows[start:min(start+batchInsertRows, len(rows))]
+		var sb strings.Builder
+		sb.WriteString(prefix)
+		args := make([]interface{}, 0, len(chunk)*len(chunk[0]))
+		for i, row := range chunk {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			params := make([]interface{}, len(row))
+			for j := range row {
+				params[j] = len(args) + j + 1
+			}
+			fmt.Fprintf(&sb, rowFormat, params...)
+			args = append(args, row...)
+		}
+		sb.WriteString(suffix)
+		if _, err := tx.Exec(sb.String(), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
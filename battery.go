@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// BATTERY_STATUS events report the backup battery or supply of the modem:
+//
+//	{"event": "BATTERY_STATUS", "timestamp": "1718000000", "message": {"voltage": 3.71, "percentage": 64}}
+//	{"event": "BATTERY_STATUS", "timestamp": "1718000000", "message": "mv=3710,level=64"}
+//
+// The voltage is published as battery_voltage_<sender> and the charge as
+// battery_percent_<sender>. LOW_BATTERY and BATTERY_CRITICAL (tags low_battery_<sender>
+// and battery_critical_<sender>) are raised when either reading falls below their
+// threshold, and cleared once both are back above it by the margin.
+type batteryThreshold struct {
+	percent, voltage float64
+}
+
+var (
+	batteryLow      = batteryThreshold{percent: 20, voltage: 3.5}
+	batteryCritical = batteryThreshold{percent: 5, voltage: 3.3}
+	// batteryClearMargin is how far above a threshold a reading must be to clear its alarm.
+	batteryClearMargin = batteryThreshold{percent: 5, voltage: 0.1}
+)
+
+// batteryReadings returns the voltage in volts and the charge in percent found in the
+// readings of a message, under the names devices use for them.
+func batteryReadings(readings map[string]float64) (voltage, percent float64, hasVoltage, hasPercent bool) {
+	for _, key := range []string{"voltage", "volt", "v"} {
+		if v, ok := readings[key]; ok {
+			voltage, hasVoltage = v, true
+			break
+		}
+	}
+	if mv, ok := readings["mv"]; ok && !hasVoltage {
+		voltage, hasVoltage = mv/1000, true
+	}
+	for _, key := range []string{"percentage", "percent", "level", "soc", "battery"} {
+		if v, ok := readings[key]; ok {
+			percent, hasPercent = v, true
+			break
+		}
+	}
+	return voltage, percent, hasVoltage, hasPercent
+}
+
+func handleBatteryStatusEvent(store Store, messageStr, senderID, event, ingestID string, timestamp int64) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(messageStr), &payload); err != nil {
+		log.Printf("Error unmarshalling %s event message: %v", event, err)
+		return
+	}
+	voltage, percent, hasVoltage, hasPercent := batteryReadings(parseReadings(payload["message"]))
+	if !hasVoltage && !hasPercent {
+		log.Printf("[%s] Ignoring %s event from %s: no voltage or percentage in %v", ingestID, event, senderID, payload["message"])
+		return
+	}
+	detail := map[string]interface{}{}
+	if hasVoltage {
+		publishReading(store, event, fmt.Sprintf("battery_voltage_%s", senderID), voltage, senderID, messageStr, ingestID, timestamp)
+		detail["voltage"] = voltage
+	}
+	if hasPercent {
+		publishReading(store, event, fmt.Sprintf("battery_percent_%s", senderID), percent, senderID, messageStr, ingestID, timestamp)
+		detail["percentage"] = percent
+	}
+
+	below := func(alarm string, t batteryThreshold) bool {
+		_, raised := eventState.Load(senderID + "_" + alarm)
+		if raised {
+			t.percent += batteryClearMargin.percent
+			t.voltage += batteryClearMargin.voltage
+		}
+		return (hasPercent && percent < t.percent) || (hasVoltage && voltage < t.voltage)
+	}
+	setDerivedAlarm(store, "LOW_BATTERY", fmt.Sprintf("low_battery_%s", senderID), below("LOW_BATTERY", batteryLow), detail, senderID, ingestID, timestamp)
+	setDerivedAlarm(store, "BATTERY_CRITICAL", fmt.Sprintf("battery_critical_%s", senderID), below("BATTERY_CRITICAL", batteryCritical), detail, senderID, ingestID, timestamp)
+}
+
+func init() {
+	RegisterHandler(HandleEvents(func(ctx context.Context, store Store, m DeviceMessage) {
+		handleBatteryStatusEvent(store, string(m.Payload), m.SenderID, m.Event, m.IngestID, m.Timestamp)
+	}, "BATTERY_STATUS"))
+}
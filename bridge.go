@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var bridgeMessages = newCounterVec("collector_bridge_messages_total", "Raw messages mirrored to the bridge broker, by result.", "result")
+
+// bridgeMessage is a received raw message waiting to be mirrored.
+type bridgeMessage struct {
+	topic   string
+	payload []byte
+}
+
+// bridge republishes every raw inbound message to a secondary broker, e.g. at a DR site.
+// It has its own connection, credentials and buffer, so a slow or unreachable secondary
+// never holds up processing on the primary: when the buffer is full the oldest message
+// is dropped.
+type bridge struct {
+	client Broker
+	prefix string
+	qos    byte
+	queue  chan bridgeMessage
+}
+
+// bridgeConfig holds the BRIDGE_* settings.
+type bridgeConfig struct {
+	Broker      string
+	ClientID    string
+	User        string
+	Password    string
+	TopicPrefix string
+	QoS         byte
+	BufferSize  int
+}
+
+func newBridge(cfg bridgeConfig) *bridge {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(cfg.Broker)
+	opts.SetClientID(cfg.ClientID)
+	opts.SetUsername(cfg.User)
+	opts.SetPassword(cfg.Password)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(5 * time.Second)
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		log.Printf("Bridge connection to %s lost: %v", cfg.Broker, err)
+	})
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		log.Printf("Bridge connected to %s", cfg.Broker)
+	})
+	if cfg.BufferSize < 1 {
+		cfg.BufferSize = 1
+	}
+
+	b := &bridge{
+		client: newPahoBroker(opts),
+		prefix: strings.TrimSuffix(cfg.TopicPrefix, "/"),
+		qos:    cfg.QoS,
+		queue:  make(chan bridgeMessage, cfg.BufferSize),
+	}
+	// With ConnectRetry, Connect only returns once connected, so do not wait for it here.
+	go func() {
+		if err := b.client.Connect(); err != nil {
+			log.Printf("Bridge connection to %s failed: %v", cfg.Broker, err)
+		}
+	}()
+	newGaugeFunc("collector_bridge_queue_depth", "Raw messages waiting to be mirrored to the bridge broker.", func() float64 {
+		return float64(len(b.queue))
+	})
+	go b.run()
+	log.Printf("Mirroring raw traffic to %s under prefix %q (buffer %d)", cfg.Broker, b.prefix, cfg.BufferSize)
+	return b
+}
+
+// Mirror queues a raw message for the secondary broker without blocking. A nil bridge
+// does nothing.
+func (b *bridge) Mirror(topic string, payload []byte) {
+	if b == nil {
+		return
+	}
+	msg := bridgeMessage{topic: topic, payload: payload}
+	for {
+		select {
+		case b.queue <- msg:
+			return
+		default:
+		}
+		select {
+		case <-b.queue:
+			bridgeMessages.Inc("dropped")
+		default:
+		}
+	}
+}
+
+func (b *bridge) run() {
+	for msg := range b.queue {
+		topic := msg.topic
+		if b.prefix != "" {
+			topic = b.prefix + "/" + topic
+		}
+		// Hold on to the message until the secondary accepts it; the buffer absorbs the
+		// traffic received in the meantime.
+		for {
+			if !b.client.Status().Connected {
+				time.Sleep(time.Second)
+				continue
+			}
+			err := b.client.Publish(topic, b.qos, false, msg.payload)
+			if err == nil {
+				bridgeMessages.Inc("published")
+				break
+			}
+			log.Printf("Bridge publish to %s failed, retrying: %v", topic, err)
+			time.Sleep(time.Second)
+		}
+	}
+}
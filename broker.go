@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// BrokerMessage is a message delivered to a Broker subscription.
+type BrokerMessage struct {
+	Topic    string
+	Payload  []byte
+	Retained bool
+	// Properties are the MQTT v5 user properties of the message; nil with MQTT 3.1.1.
+	Properties map[string]string
+}
+
+// BrokerStatus describes the broker connection.
+type BrokerStatus struct {
+	Connected      bool `json:"connected"`
+	SessionPresent bool `json:"session_present"`
+	ConnackCode    byte `json:"connack_code"`
+}
+
+// Broker is the collector's view of the MQTT connection. pahoBroker speaks MQTT 3.1 and
+// 3.1.1, pahoV5Broker MQTT 5; other client libraries or a test double can implement it
+// without touching the handlers.
+type Broker interface {
+	Connect() error
+	// Subscribe registers handle for the messages matching filter. Handlers are called
+	// one at a time in arrival order.
+	Subscribe(filter string, qos byte, handle func(BrokerMessage)) error
+	Unsubscribe(filter string) error
+	// UnsubscribeAll stops every subscription at shutdown and refuses new ones, while
+	// publishing keeps working until Disconnect.
+	UnsubscribeAll() error
+	Disconnect()
+	// Publish sends payload and returns once the client has handed it over at qos.
+	Publish(topic string, qos byte, retained bool, payload []byte) error
+	// PublishWithExpiry is Publish with a message expiry interval, after which the broker
+	// discards the message instead of delivering it to a subscriber that was offline.
+	PublishWithExpiry(topic string, qos byte, retained bool, payload []byte, expiry time.Duration) error
+	Status() BrokerStatus
+}
+
+// pahoBroker implements Broker with the Eclipse paho v3 client.
+type pahoBroker struct {
+	client mqtt.Client
+
+	mu      sync.Mutex
+	status  BrokerStatus
+	filters map[string]bool // subscribed filters
+	closing bool
+}
+
+func newPahoBroker(opts *mqtt.ClientOptions) *pahoBroker {
+	return &pahoBroker{client: mqtt.NewClient(opts), filters: map[string]bool{}}
+}
+
+func (b *pahoBroker) Connect() error {
+	token := b.client.Connect()
+	token.Wait()
+	if ct, ok := token.(*mqtt.ConnectToken); ok {
+		log.Printf("MQTT CONNACK reason code %d (%s), session present: %v",
+			ct.ReturnCode(), packets.ConnackReturnCodes[ct.ReturnCode()], ct.SessionPresent())
+		b.mu.Lock()
+		b.status.ConnackCode, b.status.SessionPresent = ct.ReturnCode(), ct.SessionPresent()
+		b.mu.Unlock()
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("failed to connect: %v", err)
+	}
+	return nil
+}
+
+func (b *pahoBroker) Subscribe(filter string, qos byte, handle func(BrokerMessage)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closing {
+		return fmt.Errorf("not subscribing to %s while shutting down", filter)
+	}
+	token := b.client.Subscribe(filter, qos, func(client mqtt.Client, msg mqtt.Message) {
+		handle(BrokerMessage{Topic: msg.Topic(), Payload: msg.Payload(), Retained: msg.Retained()})
+	})
+	if token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	b.filters[filter] = true
+	return nil
+}
+
+func (b *pahoBroker) Unsubscribe(filter string) error {
+	token := b.client.Unsubscribe(filter)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	delete(b.filters, filter)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *pahoBroker) UnsubscribeAll() error {
+	b.mu.Lock()
+	b.closing = true
+	filters := make([]string, 0, len(b.filters))
+	for filter := range b.filters {
+		filters = append(filters, filter)
+	}
+	b.mu.Unlock()
+	if len(filters) == 0 {
+		return nil
+	}
+	token := b.client.Unsubscribe(filters...)
+	token.Wait()
+	return token.Error()
+}
+
+// Disconnect gives in-flight work a moment to complete and closes the connection.
+func (b *pahoBroker) Disconnect() {
+	b.client.Disconnect(250)
+}
+
+func (b *pahoBroker) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	token := b.client.Publish(topic, qos, retained, payload)
+	token.Wait()
+	return token.Error()
+}
+
+// PublishWithExpiry publishes without expiry: MQTT 3.1.1 has no message expiry.
+func (b *pahoBroker) PublishWithExpiry(topic string, qos byte, retained bool, payload []byte, expiry time.Duration) error {
+	return b.Publish(topic, qos, retained, payload)
+}
+
+func (b *pahoBroker) Status() BrokerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := b.status
+	status.Connected = b.client.IsConnectionOpen()
+	return status
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// defaultSysTopics are the broker statistics that help explain collector gaps.
+const defaultSysTopics = "$SYS/broker/clients/connected,$SYS/broker/clients/disconnected," +
+	"$SYS/broker/messages/received,$SYS/broker/messages/sent,$SYS/broker/publish/messages/dropped," +
+	"$SYS/broker/store/messages/count,$SYS/broker/uptime"
+
+// sysDatapointSource is the id_modem of broker statistics datapoints.
+const sysDatapointSource = "broker"
+
+var brokerSys = newGaugeVec("collector_broker_sys", "Numeric broker statistics read from $SYS topics.", "topic")
+
+// subscribeBrokerSys subscribes to the comma-separated $SYS topic filters and exports
+// every numeric value as a Prometheus gauge and, when publish is set, a BROKER_SYS datapoint.
+func subscribeBrokerSys(filters string, publish bool) {
+	for _, filter := range strings.Split(filters, ",") {
+		filter = strings.TrimSpace(filter)
+		if filter == "" {
+			continue
+		}
+		if err := mqttClient.Subscribe(filter, 0, func(msg BrokerMessage) {
+			handleBrokerSys(msg.Topic, string(msg.Payload), publish)
+		}); err != nil {
+			log.Printf("Failed to subscribe to %s: %v", filter, err)
+			continue
+		}
+		log.Printf("Monitoring broker statistics on %s", filter)
+	}
+}
+
+func handleBrokerSys(topic, payload string, publish bool) {
+	value, ok := parseSysValue(payload)
+	if !ok {
+		return
+	}
+	brokerSys.Set(topic, value)
+	if !publish {
+		return
+	}
+	tag := strings.Trim(strings.NewReplacer("$SYS/", "", "/", "_").Replace(topic), "_")
+	sendDataPoint(EventMessage{
+		EventName: "BROKER_SYS",
+		Tag:       fmt.Sprintf("broker_%s", tag),
+		Value:     value,
+		Status:    true,
+		Time:      clock.Now().UnixMilli(),
+		Sumber:    sysDatapointSource,
+	})
+}
+
+// parseSysValue reads the leading number of a $SYS payload, e.g. "3600 seconds" -> 3600.
+func parseSysValue(payload string) (float64, bool) {
+	fields := strings.Fields(payload)
+	if len(fields) == 0 {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	return value, err == nil
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gorilla/websocket"
+)
+
+// pahoV5Options are the MQTT v5 settings without a counterpart in the v3 ClientOptions.
+type pahoV5Options struct {
+	// SessionExpiry is how long the broker keeps a persistent session after the
+	// connection closed; with MQTT v5 a session without expiry ends on disconnect.
+	SessionExpiry time.Duration
+	// Unrouted receives the messages that match no subscription, such as those the
+	// broker delivers from a persistent session before Subscribe was called.
+	Unrouted func(BrokerMessage)
+	// OnConnect is called after every successful connect.
+	OnConnect func()
+}
+
+// v5Subscription is a filter subscribed through a pahoV5Broker.
+type v5Subscription struct {
+	qos    byte
+	handle func(BrokerMessage)
+}
+
+// pahoV5Broker implements Broker with the Eclipse paho.golang MQTT v5 client. It is
+// configured from the same ClientOptions as the v3 client and adds the user properties
+// of received messages, message expiry on publishes and the v5 reason codes in the
+// logs. autopaho reconnects after a lost connection; when the broker did not keep the
+// session, the subscriptions are made again.
+type pahoV5Broker struct {
+	cfg     autopaho.ClientConfig
+	options pahoV5Options
+
+	mu      sync.Mutex
+	conn    *autopaho.ConnectionManager
+	status  BrokerStatus
+	subs    map[string]v5Subscription // by filter
+	closing bool
+	first   chan error // result of the first connection attempt, nil once it is known
+}
+
+func newPahoV5Broker(opts *mqtt.ClientOptions, options pahoV5Options) *pahoV5Broker {
+	b := &pahoV5Broker{options: options, subs: map[string]v5Subscription{}}
+	b.cfg = autopaho.ClientConfig{
+		ServerUrls:                    opts.Servers,
+		TlsCfg:                        opts.TLSConfig,
+		KeepAlive:                     uint16(opts.KeepAlive),
+		CleanStartOnInitialConnection: opts.CleanSession,
+		ConnectTimeout:                opts.ConnectTimeout,
+		ConnectUsername:               opts.Username,
+		ConnectPassword:               []byte(opts.Password),
+		OnConnectionUp:                b.onConnectionUp,
+		OnConnectError:                b.onConnectError,
+		ClientConfig: paho.ClientConfig{
+			ClientID:           opts.ClientID,
+			OnPublishReceived:  []func(paho.PublishReceived) (bool, error){b.onPublishReceived},
+			OnServerDisconnect: b.onServerDisconnect,
+			OnClientError:      b.onClientError,
+		},
+	}
+	if !opts.CleanSession {
+		b.cfg.SessionExpiryInterval = uint32(options.SessionExpiry / time.Second)
+	}
+	if opts.WillEnabled {
+		b.cfg.WillMessage = &paho.WillMessage{
+			Retain:  opts.WillRetained,
+			QoS:     opts.WillQos,
+			Topic:   opts.WillTopic,
+			Payload: opts.WillPayload,
+		}
+	}
+	if ws := opts.WebsocketOptions; ws != nil && ws.Proxy != nil {
+		b.cfg.WebSocketCfg = &autopaho.WebSocketConfig{
+			Dialer: func(u *url.URL, tlsCfg *tls.Config) *websocket.Dialer {
+				d := *websocket.DefaultDialer
+				d.Proxy = ws.Proxy
+				d.TLSClientConfig = tlsCfg
+				d.Subprotocols = []string{"mqtt"}
+				return &d
+			},
+		}
+	}
+	return b
+}
+
+// Connect returns once the first connection attempt succeeded or failed; after that,
+// autopaho keeps reconnecting in the background.
+func (b *pahoV5Broker) Connect() error {
+	first := make(chan error, 1)
+	b.mu.Lock()
+	b.first = first
+	b.mu.Unlock()
+	conn, err := autopaho.NewConnection(context.Background(), b.cfg)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %v", err)
+	}
+	if err := <-first; err != nil {
+		conn.Disconnect(context.Background())
+		return fmt.Errorf("failed to connect: %v", err)
+	}
+	b.mu.Lock()
+	b.conn = conn
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *pahoV5Broker) onConnectionUp(conn *autopaho.ConnectionManager, connack *paho.Connack) {
+	log.Printf("MQTT v5 CONNACK reason code %d (%s), session present: %v",
+		connack.ReasonCode, mqttReasonCode(connack.ReasonCode), connack.SessionPresent)
+	b.mu.Lock()
+	b.status = BrokerStatus{Connected: true, SessionPresent: connack.SessionPresent, ConnackCode: connack.ReasonCode}
+	first := b.first
+	b.first = nil
+	var resubscribe []paho.SubscribeOptions
+	if !connack.SessionPresent {
+		for filter, sub := range b.subs {
+			resubscribe = append(resubscribe, paho.SubscribeOptions{Topic: filter, QoS: sub.qos})
+		}
+	}
+	b.mu.Unlock()
+	if first != nil {
+		first <- nil
+	}
+	if len(resubscribe) > 0 {
+		log.Printf("MQTT session not kept by the broker, subscribing again to %d filter(s)", len(resubscribe))
+		suback, err := conn.Subscribe(context.Background(), &paho.Subscribe{Subscriptions: resubscribe})
+		for i, sub := range resubscribe {
+			if err := subackError(sub, suback, i); err != nil {
+				log.Printf("Error subscribing again: %v", err)
+			}
+		}
+		if err != nil && suback == nil {
+			log.Printf("Error subscribing again: %v", err)
+		}
+	}
+	if b.options.OnConnect != nil {
+		b.options.OnConnect()
+	}
+}
+
+func (b *pahoV5Broker) onConnectError(err error) {
+	var refused *autopaho.ConnackError
+	if errors.As(err, &refused) {
+		log.Printf("MQTT v5 CONNACK reason code %d (%s) %s", refused.ReasonCode, mqttReasonCode(refused.ReasonCode), refused.Reason)
+	} else {
+		log.Printf("MQTT connection attempt failed: %v", err)
+	}
+	b.mu.Lock()
+	first := b.first
+	b.first = nil
+	b.mu.Unlock()
+	if first != nil {
+		first <- err
+	}
+}
+
+func (b *pahoV5Broker) onServerDisconnect(d *paho.Disconnect) {
+	reason := ""
+	if d.Properties != nil {
+		reason = d.Properties.ReasonString
+	}
+	log.Printf("MQTT broker disconnected with reason code %d (%s) %s", d.ReasonCode, mqttReasonCode(d.ReasonCode), reason)
+	b.setDisconnected()
+}
+
+func (b *pahoV5Broker) onClientError(err error) {
+	log.Printf("MQTT connection lost: %v", err)
+	b.setDisconnected()
+}
+
+func (b *pahoV5Broker) setDisconnected() {
+	b.mu.Lock()
+	b.status.Connected = false
+	b.mu.Unlock()
+}
+
+// onPublishReceived hands a message to every subscription matching its topic. paho
+// calls it for one message at a time in arrival order.
+func (b *pahoV5Broker) onPublishReceived(received paho.PublishReceived) (bool, error) {
+	p := received.Packet
+	msg := BrokerMessage{Topic: p.Topic, Payload: p.Payload, Retained: p.Retain}
+	if p.Properties != nil && len(p.Properties.User) > 0 {
+		msg.Properties = make(map[string]string, len(p.Properties.User))
+		for _, prop := range p.Properties.User {
+			msg.Properties[prop.Key] = prop.Value
+		}
+	}
+	b.mu.Lock()
+	var handlers []func(BrokerMessage)
+	for filter, sub := range b.subs {
+		if topicMatches(sharedSubscriptionFilter(filter), p.Topic) {
+			handlers = append(handlers, sub.handle)
+		}
+	}
+	b.mu.Unlock()
+	if len(handlers) == 0 && b.options.Unrouted != nil {
+		handlers = append(handlers, b.options.Unrouted)
+	}
+	for _, handle := range handlers {
+		handle(msg)
+	}
+	return true, nil
+}
+
+// sharedSubscriptionFilter strips the $share/<group>/ prefix off filter.
+func sharedSubscriptionFilter(filter string) string {
+	if !strings.HasPrefix(filter, "$share/") {
+		return filter
+	}
+	parts := strings.SplitN(filter, "/", 3)
+	if len(parts) < 3 {
+		return filter
+	}
+	return parts[2]
+}
+
+func (b *pahoV5Broker) Subscribe(filter string, qos byte, handle func(BrokerMessage)) error {
+	b.mu.Lock()
+	if b.closing {
+		b.mu.Unlock()
+		return fmt.Errorf("not subscribing to %s while shutting down", filter)
+	}
+	// Registered before the SUBACK, since retained messages may arrive ahead of it.
+	b.subs[filter] = v5Subscription{qos: qos, handle: handle}
+	conn := b.conn
+	b.mu.Unlock()
+	sub := paho.SubscribeOptions{Topic: filter, QoS: qos}
+	suback, err := conn.Subscribe(context.Background(), &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{sub}})
+	if suback != nil {
+		err = subackError(sub, suback, 0)
+	}
+	if err != nil {
+		b.mu.Lock()
+		delete(b.subs, filter)
+		b.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// subackError returns the error of the i-th subscription of a SUBACK, and logs when
+// the broker granted a lower QoS than requested.
+func subackError(sub paho.SubscribeOptions, suback *paho.Suback, i int) error {
+	if suback == nil || i >= len(suback.Reasons) {
+		return nil
+	}
+	code := suback.Reasons[i]
+	if code >= 0x80 {
+		reason := ""
+		if suback.Properties != nil {
+			reason = suback.Properties.ReasonString
+		}
+		return fmt.Errorf("subscription to %s refused with reason code %d (%s) %s", sub.Topic, code, mqttReasonCode(code), reason)
+	}
+	if code < sub.QoS {
+		log.Printf("MQTT SUBACK for %s granted QoS %d instead of %d", sub.Topic, code, sub.QoS)
+	}
+	return nil
+}
+
+func (b *pahoV5Broker) Unsubscribe(filter string) error {
+	if err := b.unsubscribe(filter); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	delete(b.subs, filter)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *pahoV5Broker) UnsubscribeAll() error {
+	b.mu.Lock()
+	b.closing = true
+	filters := make([]string, 0, len(b.subs))
+	for filter := range b.subs {
+		filters = append(filters, filter)
+	}
+	b.mu.Unlock()
+	if len(filters) == 0 {
+		return nil
+	}
+	return b.unsubscribe(filters...)
+}
+
+func (b *pahoV5Broker) unsubscribe(filters ...string) error {
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+	unsuback, err := conn.Unsubscribe(context.Background(), &paho.Unsubscribe{Topics: filters})
+	if unsuback != nil {
+		for i, code := range unsuback.Reasons {
+			if code >= 0x80 && i < len(filters) {
+				return fmt.Errorf("unsubscribe from %s refused with reason code %d (%s)", filters[i], code, mqttReasonCode(code))
+			}
+		}
+	}
+	return err
+}
+
+// Disconnect sends DISCONNECT and stops reconnecting, waiting at most a second.
+func (b *pahoV5Broker) Disconnect() {
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+	if conn == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn.Disconnect(ctx)
+}
+
+func (b *pahoV5Broker) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	return b.PublishWithExpiry(topic, qos, retained, payload, 0)
+}
+
+// PublishWithExpiry sets the message expiry interval, rounded up to whole seconds.
+func (b *pahoV5Broker) PublishWithExpiry(topic string, qos byte, retained bool, payload []byte, expiry time.Duration) error {
+	p := &paho.Publish{Topic: topic, QoS: qos, Retain: retained, Payload: payload}
+	if expiry > 0 {
+		seconds := uint32(math.Ceil(expiry.Seconds()))
+		p.Properties = &paho.PublishProperties{MessageExpiry: &seconds}
+	}
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+	resp, err := conn.Publish(context.Background(), p)
+	if resp != nil && resp.ReasonCode >= 0x80 {
+		return fmt.Errorf("publish to %s refused with reason code %d (%s)", topic, resp.ReasonCode, mqttReasonCode(resp.ReasonCode))
+	}
+	if err != nil {
+		return err
+	}
+	if resp != nil && resp.ReasonCode != 0 {
+		log.Printf("MQTT PUBACK for %s: reason code %d (%s)", topic, resp.ReasonCode, mqttReasonCode(resp.ReasonCode))
+	}
+	return nil
+}
+
+func (b *pahoV5Broker) Status() BrokerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.status
+}
+
+// mqttReasonCodes names the MQTT v5 reason codes. 0 is Success, Normal disconnection
+// or Granted QoS 0 depending on the packet.
+var mqttReasonCodes = map[byte]string{
+	0x00: "Success",
+	0x01: "Granted QoS 1",
+	0x02: "Granted QoS 2",
+	0x04: "Disconnect with Will Message",
+	0x10: "No matching subscribers",
+	0x11: "No subscription existed",
+	0x18: "Continue authentication",
+	0x19: "Re-authenticate",
+	0x80: "Unspecified error",
+	0x81: "Malformed Packet",
+	0x82: "Protocol Error",
+	0x83: "Implementation specific error",
+	0x84: "Unsupported Protocol Version",
+	0x85: "Client Identifier not valid",
+	0x86: "Bad User Name or Password",
+	0x87: "Not authorized",
+	0x88: "Server unavailable",
+	0x89: "Server busy",
+	0x8A: "Banned",
+	0x8B: "Server shutting down",
+	0x8C: "Bad authentication method",
+	0x8D: "Keep Alive timeout",
+	0x8E: "Session taken over",
+	0x8F: "Topic Filter invalid",
+	0x90: "Topic Name invalid",
+	0x91: "Packet Identifier in use",
+	0x92: "Packet Identifier not found",
+	0x93: "Receive Maximum exceeded",
+	0x94: "Topic Alias invalid",
+	0x95: "Packet too large",
+	0x96: "Message rate too high",
+	0x97: "Quota exceeded",
+	0x98: "Administrative action",
+	0x99: "Payload format invalid",
+	0x9A: "Retain not supported",
+	0x9B: "QoS not supported",
+	0x9C: "Use another server",
+	0x9D: "Server moved",
+	0x9E: "Shared Subscriptions not supported",
+	0x9F: "Connection rate exceeded",
+	0xA0: "Maximum connect time",
+	0xA1: "Subscription Identifiers not supported",
+	0xA2: "Wildcard Subscriptions not supported",
+}
+
+func mqttReasonCode(code byte) string {
+	if name, ok := mqttReasonCodes[code]; ok {
+		return name
+	}
+	return "unknown"
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Bulk dispatch states recorded in command_batches. A dispatch is interrupted when the
+// collector running it went away before it finished.
+const (
+	batchRunning     = "running"
+	batchCompleted   = "completed"
+	batchAborted     = "aborted"
+	batchInterrupted = "interrupted"
+)
+
+// bulkHeartbeat is how often a running dispatch refreshes its heartbeat_at and checks
+// that it has not been aborted from another instance. A dispatch without a heartbeat for
+// three intervals is marked interrupted.
+const bulkHeartbeat = 30 * time.Second
+
+var bulkDispatches sync.Map // batch id -> *bulkDispatch, while running
+
+// BulkCommandRequest describes a templated command sent to every device matching Filter.
+// String params may use text/template syntax with .SenderID, .Region, .Model and .Vars.
+// An empty filter is refused unless All is set, so a missing filter cannot reach the
+// whole fleet by accident.
+type BulkCommandRequest struct {
+	Command   string                 `json:"command"`
+	Params    map[string]interface{} `json:"params"`
+	Vars      map[string]interface{} `json:"vars"`
+	Filter    DeviceFilter           `json:"filter"`
+	All       bool                   `json:"all"`
+	BatchSize int                    `json:"batch_size"`
+	Interval  string                 `json:"interval"`
+}
+
+// BulkProgress reports how far a bulk dispatch has got and how devices responded.
+type BulkProgress struct {
+	ID         string         `json:"id"`
+	Command    string         `json:"command"`
+	Status     string         `json:"status"`
+	Total      int            `json:"total"`
+	Dispatched int            `json:"dispatched"`
+	Outcomes   map[string]int `json:"outcomes"`
+}
+
+type bulkDispatch struct {
+	mu      sync.Mutex
+	id      string
+	command string
+	status  string
+	total   int
+	abort   chan struct{}
+	beatAt  time.Time // last heartbeat, only touched by the dispatch goroutine
+}
+
+type templateData struct {
+	SenderID string
+	Region   string
+	Model    string
+	Vars     map[string]interface{}
+}
+
+// renderParams executes every string value in params as a template against data.
+func renderParams(params map[string]interface{}, data templateData) (map[string]interface{}, error) {
+	rendered := make(map[string]interface{}, len(params))
+	for key, value := range params {
+		v, err := renderValue(value, data)
+		if err != nil {
+			return nil, fmt.Errorf("param %s: %v", key, err)
+		}
+		rendered[key] = v
+	}
+	return rendered, nil
+}
+
+func renderValue(value interface{}, data templateData) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		if !strings.Contains(v, "{{") {
+			return v, nil
+		}
+		tmpl, err := template.New("param").Option("missingkey=error").Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		return buf.String(), nil
+	case map[string]interface{}:
+		return renderParams(v, data)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			r, err := renderValue(item, data)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = r
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
+// startBulkDispatch resolves the target devices and sends the command to them in staggered batches.
+func startBulkDispatch(db *sql.DB, req BulkCommandRequest) (*bulkDispatch, error) {
+	if req.Command == "" {
+		return nil, fmt.Errorf("command is required")
+	}
+	if req.Filter.empty() && !req.All {
+		return nil, fmt.Errorf("filter is required, or set \"all\": true to target every device")
+	}
+	interval := time.Duration(0)
+	if req.Interval != "" {
+		d, err := time.ParseDuration(req.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval: %v", err)
+		}
+		interval = d
+	}
+	if req.BatchSize <= 0 {
+		req.BatchSize = 10
+	}
+
+	devices, err := queryDevices(db, req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("no devices match the filter")
+	}
+
+	// Render every command up front so a template error aborts before anything is sent.
+	params := make([]map[string]interface{}, len(devices))
+	for i, d := range devices {
+		params[i], err = renderParams(req.Params, templateData{SenderID: d.SenderID, Region: d.Region, Model: d.Model, Vars: req.Vars})
+		if err != nil {
+			return nil, fmt.Errorf("template error for %s: %v", d.SenderID, err)
+		}
+	}
+
+	paramsJSON, _ := json.Marshal(req.Params)
+	filterJSON, _ := json.Marshal(req.Filter)
+	bd := &bulkDispatch{
+		id:      newID(),
+		command: req.Command,
+		status:  batchRunning,
+		total:   len(devices),
+		abort:   make(chan struct{}),
+		beatAt:  clock.Now(),
+	}
+	_, err = db.Exec("INSERT INTO command_batches (id, command, params, filter, total, status, heartbeat_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		bd.id, bd.command, string(paramsJSON), string(filterJSON), bd.total, bd.status, clock.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to record bulk dispatch: %v", err)
+	}
+	bulkDispatches.Store(bd.id, bd)
+
+	log.Printf("Starting bulk dispatch %s of %s to %d devices (batch size %d, interval %v)", bd.id, bd.command, bd.total, req.BatchSize, interval)
+
+	go func() {
+		for i, d := range devices {
+			if i > 0 && i%req.BatchSize == 0 {
+				if !bd.wait(db, interval) {
+					log.Printf("Bulk dispatch %s stopped after %d of %d devices", bd.id, i, bd.total)
+					return
+				}
+			} else if clock.Now().Sub(bd.beatAt) >= bulkHeartbeat && !bd.beat(db) {
+				log.Printf("Bulk dispatch %s stopped after %d of %d devices", bd.id, i, bd.total)
+				return
+			}
+			// Holding the lock while sending keeps an abort from being recorded with a
+			// command still on its way out.
+			bd.mu.Lock()
+			if bd.status != batchRunning {
+				bd.mu.Unlock()
+				log.Printf("Bulk dispatch %s aborted after %d of %d devices", bd.id, i, bd.total)
+				return
+			}
+			if _, err := sendCommand(db, d.SenderID, req.Command, params[i], bd.id); err != nil {
+				log.Printf("Bulk dispatch %s: %v", bd.id, err)
+			}
+			bd.mu.Unlock()
+		}
+		if bd.finish(db, batchCompleted) {
+			log.Printf("Bulk dispatch %s completed", bd.id)
+		}
+	}()
+
+	return bd, nil
+}
+
+// wait sleeps for interval between batches, refreshing the heartbeat meanwhile. It
+// reports false when the dispatch was aborted, here or from another instance.
+func (bd *bulkDispatch) wait(db *sql.DB, interval time.Duration) bool {
+	for {
+		if !bd.beat(db) {
+			return false
+		}
+		if interval <= 0 {
+			return true
+		}
+		step := min(interval, bulkHeartbeat)
+		select {
+		case <-bd.abort:
+			return false
+		case <-clock.After(step):
+		}
+		interval -= step
+	}
+}
+
+// beat refreshes heartbeat_at. When the row is no longer running, the dispatch was
+// aborted through another instance and stops here too.
+func (bd *bulkDispatch) beat(db *sql.DB) bool {
+	bd.beatAt = clock.Now()
+	res, err := db.Exec("UPDATE command_batches SET heartbeat_at = $2 WHERE id = $1 AND status = $3", bd.id, bd.beatAt, batchRunning)
+	if err != nil {
+		log.Printf("Error updating bulk dispatch %s: %v", bd.id, err)
+		return true
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		bd.finish(nil, batchAborted)
+		return false
+	}
+	return true
+}
+
+// finish moves a running dispatch to its final status and forgets it; it reports false
+// if it had already finished. The dispatch is stopped before the status is stored, so
+// nothing is sent once an abort has been recorded. A nil db only stops it. Progress of a
+// finished dispatch is read from command_batches.
+func (bd *bulkDispatch) finish(db *sql.DB, status string) bool {
+	bd.mu.Lock()
+	defer bd.mu.Unlock()
+	if bd.status != batchRunning {
+		return false
+	}
+	bd.status = status
+	close(bd.abort)
+	bulkDispatches.Delete(bd.id)
+	if db == nil {
+		return true
+	}
+	_, err := db.Exec("UPDATE command_batches SET status = $2, finished_at = CURRENT_TIMESTAMP WHERE id = $1 AND status = $3", bd.id, status, batchRunning)
+	if err != nil {
+		log.Printf("Error updating bulk dispatch %s: %v", bd.id, err)
+	}
+	return true
+}
+
+// abortBulkDispatch stops a running dispatch before its remaining devices are sent the
+// command. A dispatch running in another instance is aborted in command_batches, and
+// that instance stops at its next heartbeat.
+func abortBulkDispatch(db *sql.DB, id string) error {
+	if value, ok := bulkDispatches.Load(id); ok {
+		if !value.(*bulkDispatch).finish(db, batchAborted) {
+			return fmt.Errorf("bulk dispatch %s already finished", id)
+		}
+		return nil
+	}
+	res, err := db.Exec("UPDATE command_batches SET status = $2, finished_at = CURRENT_TIMESTAMP WHERE id = $1 AND status = $3", id, batchAborted, batchRunning)
+	if err != nil {
+		return fmt.Errorf("failed to abort bulk dispatch %s: %v", id, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("bulk dispatch %s is not running", id)
+	}
+	return nil
+}
+
+// startBulkSweeper marks running dispatches whose heartbeat stopped as interrupted, at
+// startup and then periodically: their collector exited or crashed part way through.
+func startBulkSweeper(db *sql.DB) {
+	go func() {
+		for {
+			sweepInterruptedBatches(db)
+			<-clock.After(bulkHeartbeat)
+		}
+	}()
+}
+
+func sweepInterruptedBatches(db *sql.DB) {
+	res, err := db.Exec(`UPDATE command_batches SET status = $1, finished_at = CURRENT_TIMESTAMP
+        WHERE status = $2 AND COALESCE(heartbeat_at, created_at) < $3`,
+		batchInterrupted, batchRunning, clock.Now().Add(-3*bulkHeartbeat))
+	if err != nil {
+		log.Printf("Error sweeping bulk dispatches: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Marked %d bulk dispatches without a heartbeat as interrupted", n)
+	}
+}
+
+// bulkProgress combines the stored dispatch row with per-outcome counts from command_audit.
+func bulkProgress(db *sql.DB, id string) (BulkProgress, error) {
+	p := BulkProgress{ID: id, Outcomes: map[string]int{}}
+	err := db.QueryRow("SELECT command, status, total FROM command_batches WHERE id = $1", id).Scan(&p.Command, &p.Status, &p.Total)
+	if err != nil {
+		return p, err
+	}
+
+	rows, err := db.Query("SELECT outcome, COUNT(*) FROM command_audit WHERE batch_id = $1 GROUP BY outcome", id)
+	if err != nil {
+		return p, fmt.Errorf("failed to query bulk outcomes: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var outcome string
+		var count int
+		if err := rows.Scan(&outcome, &count); err != nil {
+			return p, fmt.Errorf("failed to scan bulk outcome: %v", err)
+		}
+		p.Outcomes[outcome] = count
+		p.Dispatched += count
+	}
+	return p, rows.Err()
+}
+
+func handleStartBulk(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var req BulkCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be a JSON bulk command")
+		return
+	}
+	bd, err := startBulkDispatch(db, req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"id": bd.id, "total": bd.total})
+}
+
+func handleBulkProgress(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	p, err := bulkProgress(db, r.PathValue("id"))
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "bulk dispatch not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading bulk progress: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to read bulk progress")
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func handleAbortBulk(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	if err := abortBulkDispatch(db, r.PathValue("id")); err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": batchAborted})
+}
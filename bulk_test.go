@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectBulkStart expects startBulkDispatch to find senderIDs and record the dispatch.
+func expectBulkStart(mock sqlmock.Sqlmock, senderIDs ...string) {
+	rows := sqlmock.NewRows([]string{"sender_id", "region", "model", "labels", "first_seen",
+		"iccid", "imsi", "sim_at", "operator", "rat", "band", "cell_id", "network_at", "firmware_version", "firmware_at"})
+	for _, id := range senderIDs {
+		rows.AddRow(id, "west", "EC25", []byte("{}"), time.Unix(0, 0), nil, nil, nil, nil, nil, nil, nil, nil, nil, nil)
+	}
+	mock.ExpectQuery("SELECT sender_id, region, model").WithArgs("west").WillReturnRows(rows)
+	mock.ExpectExec("INSERT INTO command_batches").WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func expectBulkCommand(mock sqlmock.Sqlmock, senderID string) {
+	mock.ExpectExec("INSERT INTO command_audit").
+		WithArgs(sqlmock.AnyArg(), senderID, "REBOOT", sqlmock.AnyArg(), sqlmock.AnyArg(), commandPending, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// testBulkRequest sends REBOOT to the west region, one device per batch, a minute apart.
+var testBulkRequest = BulkCommandRequest{Command: "REBOOT", Filter: DeviceFilter{Region: "west"}, BatchSize: 1, Interval: "1m"}
+
+func TestAbortBulkDispatchStopsSending(t *testing.T) {
+	c := useFakeClock(t)
+	useCommandTopic(t, time.Hour)
+	b := captureBroker(t)
+	db, mock := mockDB(t)
+
+	expectBulkStart(mock, "m-1", "m-2")
+	expectBulkCommand(mock, "m-1")
+	mock.ExpectExec("UPDATE command_batches SET heartbeat_at").
+		WithArgs(sqlmock.AnyArg(), c.Now(), batchRunning).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	bd, err := startBulkDispatch(db, testBulkRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// m-1's ack timer and the wait for the next batch.
+	eventually(t, "the first batch", func() bool { return c.timers() == 2 })
+
+	mock.ExpectExec("UPDATE command_batches SET status").
+		WithArgs(bd.id, batchAborted, batchRunning).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := abortBulkDispatch(db, bd.id); err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(time.Minute)
+	if n := len(b.Messages("CMD/m-2")); n != 0 {
+		t.Errorf("sent %d commands to m-2 after the abort", n)
+	}
+	if err := abortBulkDispatch(db, bd.id); err == nil {
+		t.Error("aborting a finished dispatch succeeded")
+	}
+}
+
+func TestBulkDispatchStopsWhenAbortedElsewhere(t *testing.T) {
+	c := useFakeClock(t)
+	useCommandTopic(t, time.Hour)
+	b := captureBroker(t)
+	db, mock := mockDB(t)
+
+	expectBulkStart(mock, "m-1", "m-2")
+	expectBulkCommand(mock, "m-1")
+	mock.ExpectExec("UPDATE command_batches SET heartbeat_at").WillReturnResult(sqlmock.NewResult(0, 1))
+	bd, err := startBulkDispatch(db, testBulkRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the first batch", func() bool { return c.timers() == 2 })
+
+	// Another instance set the row to aborted; the next heartbeat finds it.
+	mock.ExpectExec("UPDATE command_batches SET heartbeat_at").
+		WithArgs(bd.id, c.Now().Add(bulkHeartbeat), batchRunning).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	c.Advance(bulkHeartbeat)
+	eventually(t, "the dispatch to stop", func() bool {
+		_, running := bulkDispatches.Load(bd.id)
+		return !running
+	})
+	c.Advance(time.Minute)
+	if n := len(b.Messages("CMD/m-2")); n != 0 {
+		t.Errorf("sent %d commands to m-2 after the abort", n)
+	}
+}
+
+func TestAbortBulkDispatchOfAnotherInstance(t *testing.T) {
+	db, mock := mockDB(t)
+
+	mock.ExpectExec("UPDATE command_batches SET status").
+		WithArgs("batch-1", batchAborted, batchRunning).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := abortBulkDispatch(db, "batch-1"); err != nil {
+		t.Errorf("abortBulkDispatch of a running dispatch: %v", err)
+	}
+
+	mock.ExpectExec("UPDATE command_batches SET status").
+		WithArgs("batch-2", batchAborted, batchRunning).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := abortBulkDispatch(db, "batch-2"); err == nil {
+		t.Error("abortBulkDispatch of a finished or interrupted dispatch succeeded")
+	}
+}
+
+func TestSweepInterruptedBatches(t *testing.T) {
+	c := useFakeClock(t)
+	db, mock := mockDB(t)
+
+	mock.ExpectExec(`UPDATE command_batches SET status = \$1`).
+		WithArgs(batchInterrupted, batchRunning, c.Now().Add(-3*bulkHeartbeat)).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	sweepInterruptedBatches(db)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// cellScanParser turns the message of a GEOLOCATION event into a geolocation request.
+// Modem firmwares report their cell scan in different formats; CELL_SCAN_FORMAT picks
+// one for all devices ("auto", the default, tries each in turn) and CELL_SCAN_FORMATS
+// overrides it per device model from the registry, e.g. "SIM800L=ceng,EC25=qeng".
+type cellScanParser interface {
+	Name() string
+	// Detect reports whether message looks like this parser's format.
+	Detect(message string) bool
+	Parse(message string) geoRequest
+}
+
+var cellScanParsers = []cellScanParser{jsonCellScan{}, qengCellScan{}, cengCellScan{}, bracketCellScan{}}
+
+var (
+	cellScanFormat       = "auto"
+	cellScanModelFormats = map[string]string{}
+)
+
+// parseCellScanFormats parses CELL_SCAN_FORMATS into model -> format.
+func parseCellScanFormats(spec string) (map[string]string, error) {
+	formats := map[string]string{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		model, format, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry %q, expected model=format", entry)
+		}
+		if format != "auto" && cellScanParserNamed(format) == nil {
+			return nil, fmt.Errorf("unknown cell scan format %q", format)
+		}
+		formats[strings.TrimSpace(model)] = format
+	}
+	return formats, nil
+}
+
+func cellScanParserNamed(name string) cellScanParser {
+	for _, p := range cellScanParsers {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// parseCellScan parses message in the format configured for senderID's model.
+func parseCellScan(store Store, senderID, message string) geoRequest {
+	format := cellScanFormat
+	if len(cellScanModelFormats) > 0 && store != nil {
+		model, err := store.DeviceModel(senderID)
+		if err != nil && err != errUnsupported {
+			log.Printf("Error looking up the model of %s: %v", senderID, err)
+		}
+		if f, ok := cellScanModelFormats[model]; ok {
+			format = f
+		}
+	}
+	if p := cellScanParserNamed(format); p != nil {
+		return p.Parse(message)
+	}
+	for _, p := range cellScanParsers {
+		if p.Detect(message) {
+			return p.Parse(message)
+		}
+	}
+	return geoRequest{}
+}
+
+// bracketCellScan is the original format: [mcc,mnc,lacHex,cidHex] per tower, plus
+// [bssid,rssi,channel] per Wi-Fi access point.
+type bracketCellScan struct{}
+
+func (bracketCellScan) Name() string { return "bracket" }
+
+func (bracketCellScan) Detect(message string) bool {
+	return cellTowerPattern.MatchString(message) || wifiAccessPointPattern.MatchString(message)
+}
+
+func (bracketCellScan) Parse(message string) geoRequest {
+	return geoRequest{CellTowers: parseCellTowers(message), WifiAccessPoints: parseWifiAccessPoints(message)}
+}
+
+// qengCellScan parses Quectel AT+QENG="servingcell" output, e.g.
+//
+//	+QENG: "servingcell","NOCONN","LTE","FDD",510,10,1A2D102,287,1850,3,5,5,2B5C,-95,-10,-65,14,37
+//
+// for LTE (cell ID and TAC in hex) and the GSM and WCDMA variants, where LAC and cell ID
+// follow MCC and MNC. The signal strength is the LTE RSSI, GSM RxLev or WCDMA RSCP in
+// dBm; only GSM reports the timing advance. Neighbour cell lines carry no cell ID and
+// are skipped.
+type qengCellScan struct{}
+
+var qengLinePattern = regexp.MustCompile(`\+QENG:\s*"servingcell",([^\r\n]+)`)
+
+func (qengCellScan) Name() string { return "qeng" }
+
+func (qengCellScan) Detect(message string) bool { return strings.Contains(message, "+QENG:") }
+
+func (qengCellScan) Parse(message string) geoRequest {
+	var req geoRequest
+	for _, match := range qengLinePattern.FindAllStringSubmatch(message, -1) {
+		fields := splitATFields(match[1])
+		if len(fields) < 3 {
+			continue
+		}
+		// fields[0] is the connection state, fields[1] the radio.
+		var mcc, mnc, lacHex, cidHex, radio string
+		signal, ta := -1, -1 // field indexes, -1 when not reported
+		switch fields[1] {
+		case "LTE":
+			if len(fields) < 12 {
+				continue
+			}
+			mcc, mnc, cidHex, lacHex, radio = fields[3], fields[4], fields[5], fields[11], "lte"
+			signal = 14
+		case "GSM":
+			if len(fields) < 6 {
+				continue
+			}
+			mcc, mnc, lacHex, cidHex, radio = fields[2], fields[3], fields[4], fields[5], "gsm"
+			signal, ta = 9, 18
+		case "WCDMA":
+			if len(fields) < 6 {
+				continue
+			}
+			mcc, mnc, lacHex, cidHex, radio = fields[2], fields[3], fields[4], fields[5], "wcdma"
+			signal = 9
+		default:
+			continue
+		}
+		if tower, ok := newCellTower(mcc, mnc, lacHex, cidHex, 16, radio); ok {
+			addCellMeasurements(tower, fieldAt(fields, signal), fieldAt(fields, ta))
+			req.CellTowers = append(req.CellTowers, tower)
+		}
+	}
+	return req
+}
+
+// cengCellScan parses SIMCom AT+CENG output (SIM800/SIM900), e.g.
+//
+//	+CENG: 0,"0066,44,00,510,10,39,3c4d,06,05,1a2b,255"
+//	+CENG: 1,"0070,30,20,3c4e,510,10,1a2b"
+//
+// The serving cell (0) is "arfcn,rxl,rxq,mcc,mnc,bsic,cellid,rla,txp,lac,ta" and the
+// neighbours are "arfcn,rxl,bsic,cellid,mcc,mnc,lac", cell ID and LAC in hex. rxl is
+// the RxLev (0-63), -110 dBm and up.
+type cengCellScan struct{}
+
+var cengLinePattern = regexp.MustCompile(`\+CENG:\s*(\d+),"([^"]*)"`)
+
+func (cengCellScan) Name() string { return "ceng" }
+
+func (cengCellScan) Detect(message string) bool { return strings.Contains(message, "+CENG:") }
+
+func (cengCellScan) Parse(message string) geoRequest {
+	var req geoRequest
+	for _, match := range cengLinePattern.FindAllStringSubmatch(message, -1) {
+		fields := strings.Split(match[2], ",")
+		var tower map[string]interface{}
+		var ok bool
+		switch len(fields) {
+		case 11:
+			if tower, ok = newCellTower(fields[3], fields[4], fields[9], fields[6], 16, "gsm"); ok {
+				addCellMeasurements(tower, rxLevDBm(fields[1]), fields[10])
+			}
+		case 7:
+			if tower, ok = newCellTower(fields[4], fields[5], fields[6], fields[3], 16, "gsm"); ok {
+				addCellMeasurements(tower, rxLevDBm(fields[1]), "")
+			}
+		}
+		if ok {
+			req.CellTowers = append(req.CellTowers, tower)
+		}
+	}
+	return req
+}
+
+// jsonCellScan parses a JSON array of cells, or an object with "cells" and "wifi":
+//
+//	{"cells": [{"mcc": 510, "mnc": 10, "lac": 6699, "cid": 15437, "radio": "lte", "rssi": -71, "ta": 3}],
+//	 "wifi": [{"bssid": "a4:2b:b0:11:22:33", "rssi": -67}]}
+//
+// lac and cid are decimal numbers, or hex strings with a 0x prefix; rssi (dBm) and ta
+// (timing advance) are optional.
+type jsonCellScan struct{}
+
+type jsonCell struct {
+	MCC   json.Number `json:"mcc"`
+	MNC   json.Number `json:"mnc"`
+	LAC   interface{} `json:"lac"`
+	CID   interface{} `json:"cid"`
+	Radio string      `json:"radio"`
+	RSSI  json.Number `json:"rssi"`
+	TA    json.Number `json:"ta"`
+}
+
+type jsonAccessPoint struct {
+	BSSID   string `json:"bssid"`
+	RSSI    int    `json:"rssi"`
+	Channel int    `json:"channel"`
+}
+
+func (jsonCellScan) Name() string { return "json" }
+
+func (jsonCellScan) Detect(message string) bool {
+	message = strings.TrimSpace(message)
+	return (strings.HasPrefix(message, "[{") || strings.HasPrefix(message, "{")) && json.Valid([]byte(message))
+}
+
+func (jsonCellScan) Parse(message string) geoRequest {
+	var scan struct {
+		Cells []jsonCell        `json:"cells"`
+		Wifi  []jsonAccessPoint `json:"wifi"`
+	}
+	dec := json.NewDecoder(bytes.NewReader([]byte(message)))
+	dec.UseNumber()
+	if strings.HasPrefix(strings.TrimSpace(message), "[") {
+		if err := dec.Decode(&scan.Cells); err != nil {
+			return geoRequest{}
+		}
+	} else if err := dec.Decode(&scan); err != nil {
+		return geoRequest{}
+	}
+
+	var req geoRequest
+	for _, c := range scan.Cells {
+		if tower, ok := newCellTower(c.MCC.String(), c.MNC.String(), jsonCellNumber(c.LAC), jsonCellNumber(c.CID), 10, strings.ToLower(c.Radio)); ok {
+			addCellMeasurements(tower, c.RSSI.String(), c.TA.String())
+			req.CellTowers = append(req.CellTowers, tower)
+		}
+	}
+	for _, ap := range scan.Wifi {
+		if ap.BSSID == "" {
+			continue
+		}
+		entry := map[string]interface{}{"macAddress": strings.ToLower(strings.ReplaceAll(ap.BSSID, "-", ":")), "signalStrength": ap.RSSI}
+		if ap.Channel > 0 {
+			entry["channel"] = ap.Channel
+		}
+		req.WifiAccessPoints = append(req.WifiAccessPoints, entry)
+	}
+	return req
+}
+
+// jsonCellNumber returns a LAC or cell ID as decimal digits, or "" when it is not a number.
+func jsonCellNumber(v interface{}) string {
+	switch n := v.(type) {
+	case json.Number:
+		return n.String()
+	case string:
+		if hex, ok := strings.CutPrefix(strings.ToLower(n), "0x"); ok {
+			if value, err := strconv.ParseInt(hex, 16, 64); err == nil {
+				return strconv.FormatInt(value, 10)
+			}
+			return ""
+		}
+		return n
+	}
+	return ""
+}
+
+// newCellTower builds a tower in the shape parseCellTowers produces; radio is added as
+// radioType when known. ok is false when a field is missing or not a number.
+func newCellTower(mcc, mnc, lac, cid string, base int, radio string) (map[string]interface{}, bool) {
+	mcc, mnc = strings.Trim(mcc, `" `), strings.Trim(mnc, `" `)
+	if _, err := strconv.Atoi(mcc); err != nil {
+		return nil, false
+	}
+	if _, err := strconv.Atoi(mnc); err != nil {
+		return nil, false
+	}
+	lacValue, err := strconv.ParseInt(strings.Trim(lac, `" `), base, 64)
+	if err != nil {
+		return nil, false
+	}
+	cidValue, err := strconv.ParseInt(strings.Trim(cid, `" `), base, 64)
+	if err != nil {
+		return nil, false
+	}
+	tower := map[string]interface{}{
+		"cellId":            cidValue,
+		"locationAreaCode":  lacValue,
+		"mobileCountryCode": mcc,
+		"mobileNetworkCode": mnc,
+	}
+	if radio != "" {
+		tower["radioType"] = radio
+	}
+	return tower, true
+}
+
+// addCellMeasurements adds the signal strength (dBm) and timing advance to tower, in
+// the geolocation API's signalStrength and timingAdvance, when they are reported.
+// Modems report unknown values as empty fields or out-of-range placeholders such as
+// 255 or -32768, which are left out. The timing advance goes up to 63 on GSM and 1282
+// on LTE.
+func addCellMeasurements(tower map[string]interface{}, signal, ta string) {
+	if v, err := strconv.Atoi(strings.Trim(signal, `" `)); err == nil && v < 0 && v >= -150 {
+		tower["signalStrength"] = v
+	}
+	maxTA := 1282
+	if tower["radioType"] == "gsm" {
+		maxTA = 63
+	}
+	if v, err := strconv.Atoi(strings.Trim(ta, `" `)); err == nil && v >= 0 && v <= maxTA {
+		tower["timingAdvance"] = v
+	}
+}
+
+// rxLevDBm converts a GSM RxLev (0-63) to dBm; "" when rxl is not a valid RxLev.
+func rxLevDBm(rxl string) string {
+	v, err := strconv.Atoi(strings.TrimSpace(rxl))
+	if err != nil || v < 0 || v > 63 {
+		return ""
+	}
+	return strconv.Itoa(v - 110)
+}
+
+// fieldAt returns fields[i], or "" when i is out of range.
+func fieldAt(fields []string, i int) string {
+	if i < 0 || i >= len(fields) {
+		return ""
+	}
+	return fields[i]
+}
+
+// splitATFields splits a comma-separated AT response and strips the quotes.
+func splitATFields(s string) []string {
+	fields := strings.Split(strings.TrimSpace(s), ",")
+	for i, f := range fields {
+		fields[i] = strings.Trim(strings.TrimSpace(f), `"`)
+	}
+	return fields
+}
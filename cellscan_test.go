@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// Cell scans as reported by the modem firmwares in the field.
+var (
+	bracketScan   = "[510,10,1A2B,3C4D,-71,3][510,10,1A2B,3C4E]"
+	qengLTEScan   = `+QENG: "servingcell","NOCONN","LTE","FDD",510,10,1A2D102,287,1850,3,5,5,2B5C,-95,-10,-65,14,37`
+	qengGSMScan   = `+QENG: "servingcell","NOCONN","GSM",510,10,1A2B,3C4D,39,66,0,-71,255,255,0,33,33,1,-,-,5,-,-,-,-`
+	qengWCDMAScan = `+QENG: "servingcell","NOCONN","WCDMA",510,10,1A2B,3C4D,10788,130,1,-85,-6,-,-,-,-,-`
+	cengScan      = "+CENG: 0,\"0066,44,00,510,10,39,3c4d,06,05,1a2b,255\"\r\n+CENG: 1,\"0070,30,20,3c4e,510,10,1a2b\""
+	jsonScan      = `{"cells": [{"mcc": 510, "mnc": 10, "lac": 6699, "cid": 15437, "radio": "lte", "rssi": -71, "ta": 3}], "wifi": [{"bssid": "a4:2b:b0:11:22:33", "rssi": -67}]}`
+)
+
+func FuzzParseCellScan(f *testing.F) {
+	for _, seed := range []string{
+		bracketScan, qengLTEScan, qengGSMScan, cengScan, jsonScan,
+		"[a4:2b:b0:11:22:33,-67,6]",
+		`[{"mcc": 510, "mnc": 10, "lac": "0x1A2B", "cid": "0x3C4D"}]`,
+		qengWCDMAScan,
+		`+QENG: "servingcell","NOCONN","LTE"`,
+		`+CENG: 0,"0066,44"`,
+		"",
+	} {
+		f.Add(seed)
+	}
+
+	saved := cellScanFormat
+	f.Cleanup(func() { cellScanFormat = saved })
+
+	f.Fuzz(func(t *testing.T, message string) {
+		for _, format := range []string{"auto", "bracket", "qeng", "ceng", "json"} {
+			cellScanFormat = format
+			req := parseCellScan(nil, "modem-1", message)
+			for _, tower := range req.CellTowers {
+				checkCellTower(t, format, message, tower)
+			}
+		}
+	})
+}
+
+// checkCellTower reports a tower that the geolocation API would reject.
+func checkCellTower(t *testing.T, format, message string, tower map[string]interface{}) {
+	t.Helper()
+	for _, key := range []string{"mobileCountryCode", "mobileNetworkCode"} {
+		code, _ := tower[key].(string)
+		if _, err := strconv.ParseUint(code, 10, 64); err != nil && !errors.Is(err, strconv.ErrRange) {
+			t.Errorf("%s parse of %q gave %s %#v", format, message, key, tower[key])
+		}
+	}
+	for _, key := range []string{"cellId", "locationAreaCode"} {
+		if _, ok := tower[key].(int64); !ok {
+			t.Errorf("%s parse of %q gave %s %#v", format, message, key, tower[key])
+		}
+	}
+	if v, ok := tower["signalStrength"]; ok {
+		if s, _ := v.(int); s >= 0 || s < -150 {
+			t.Errorf("%s parse of %q gave signalStrength %#v", format, message, v)
+		}
+	}
+	if v, ok := tower["timingAdvance"]; ok {
+		maxTA := 1282
+		if tower["radioType"] == "gsm" {
+			maxTA = 63
+		}
+		if ta, _ := v.(int); ta < 0 || ta > maxTA {
+			t.Errorf("%s parse of %q gave timingAdvance %#v", format, message, v)
+		}
+	}
+}
+
+// tower builds the expected shape of a parsed cell tower; signal and ta are left out when 0.
+func tower(mcc, mnc string, lac, cid int64, radio string, signal, ta int) map[string]interface{} {
+	t := map[string]interface{}{
+		"cellId":            cid,
+		"locationAreaCode":  lac,
+		"mobileCountryCode": mcc,
+		"mobileNetworkCode": mnc,
+	}
+	if radio != "" {
+		t["radioType"] = radio
+	}
+	if signal != 0 {
+		t["signalStrength"] = signal
+	}
+	if ta != 0 {
+		t["timingAdvance"] = ta
+	}
+	return t
+}
+
+// useCellScanFormats sets CELL_SCAN_FORMAT and CELL_SCAN_FORMATS for the test.
+func useCellScanFormats(t *testing.T, format string, models map[string]string) {
+	t.Helper()
+	savedFormat, savedModels := cellScanFormat, cellScanModelFormats
+	cellScanFormat, cellScanModelFormats = format, models
+	t.Cleanup(func() { cellScanFormat, cellScanModelFormats = savedFormat, savedModels })
+}
+
+// modelStore is a Store that only knows the models of devices.
+type modelStore struct {
+	Store
+	models map[string]string
+}
+
+func (s modelStore) DeviceModel(senderID string) (string, error) {
+	return s.models[senderID], nil
+}
+
+func TestCellScanParsers(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		message string
+		want    geoRequest
+	}{
+		{"bracket", "bracket", bracketScan, geoRequest{CellTowers: []map[string]interface{}{
+			tower("510", "10", 0x1A2B, 0x3C4D, "", -71, 3),
+			tower("510", "10", 0x1A2B, 0x3C4E, "", 0, 0),
+		}}},
+		{"bracket Wi-Fi", "bracket", "[A4-2B-B0-11-22-33,-67,6]", geoRequest{WifiAccessPoints: []map[string]interface{}{
+			{"macAddress": "a4:2b:b0:11:22:33", "signalStrength": -67, "channel": 6},
+		}}},
+		{"qeng LTE", "qeng", qengLTEScan, geoRequest{CellTowers: []map[string]interface{}{
+			tower("510", "10", 0x2B5C, 0x1A2D102, "lte", -65, 0),
+		}}},
+		{"qeng GSM", "qeng", qengGSMScan, geoRequest{CellTowers: []map[string]interface{}{
+			tower("510", "10", 0x1A2B, 0x3C4D, "gsm", -71, 5),
+		}}},
+		{"qeng WCDMA", "qeng", qengWCDMAScan, geoRequest{CellTowers: []map[string]interface{}{
+			tower("510", "10", 0x1A2B, 0x3C4D, "wcdma", -85, 0),
+		}}},
+		{"qeng skips neighbour cells", "qeng", qengLTEScan + "\r\n" + `+QENG: "neighbourcell intra","LTE",1850,287,-95,-10,-65,14,37`, geoRequest{CellTowers: []map[string]interface{}{
+			tower("510", "10", 0x2B5C, 0x1A2D102, "lte", -65, 0),
+		}}},
+		{"ceng serving and neighbour", "ceng", cengScan, geoRequest{CellTowers: []map[string]interface{}{
+			tower("510", "10", 0x1A2B, 0x3C4D, "gsm", -66, 0), // TA 255 means unknown
+			tower("510", "10", 0x1A2B, 0x3C4E, "gsm", -80, 0),
+		}}},
+		{"ceng RxLev bounds", "ceng", `+CENG: 0,"0066,0,00,510,10,39,3c4d,06,05,1a2b,63"` + "\r\n" + `+CENG: 1,"0070,64,20,3c4e,510,10,1a2b"`, geoRequest{CellTowers: []map[string]interface{}{
+			tower("510", "10", 0x1A2B, 0x3C4D, "gsm", -110, 63),
+			tower("510", "10", 0x1A2B, 0x3C4E, "gsm", 0, 0),
+		}}},
+		{"json object", "json", jsonScan, geoRequest{
+			CellTowers:       []map[string]interface{}{tower("510", "10", 6699, 15437, "lte", -71, 3)},
+			WifiAccessPoints: []map[string]interface{}{{"macAddress": "a4:2b:b0:11:22:33", "signalStrength": -67}},
+		}},
+		{"json array with hex", "json", `[{"mcc": 510, "mnc": 10, "lac": "0x1A2B", "cid": "0x3C4D", "radio": "GSM", "ta": 64}]`, geoRequest{CellTowers: []map[string]interface{}{
+			tower("510", "10", 0x1A2B, 0x3C4D, "gsm", 0, 0), // TA above the GSM maximum of 63
+		}}},
+		{"json LTE timing advance", "json", `[{"mcc": 510, "mnc": 10, "lac": 1, "cid": 2, "radio": "lte", "rssi": -151, "ta": 1282}]`, geoRequest{CellTowers: []map[string]interface{}{
+			tower("510", "10", 1, 2, "lte", 0, 1282),
+		}}},
+
+		{"short qeng LTE", "qeng", `+QENG: "servingcell","NOCONN","LTE","FDD",510,10`, geoRequest{}},
+		{"qeng without radio", "qeng", `+QENG: "servingcell","NOCONN"`, geoRequest{}},
+		{"qeng unknown radio", "qeng", `+QENG: "servingcell","NOCONN","NR5G-SA","TDD",510,10,1A2D102,287,1850,3,5,5,2B5C`, geoRequest{}},
+		{"qeng invalid hex", "qeng", `+QENG: "servingcell","NOCONN","GSM",510,10,ZZZZ,3C4D`, geoRequest{}},
+		{"short ceng", "ceng", `+CENG: 0,"0066,44"`, geoRequest{}},
+		{"ceng without MCC", "ceng", `+CENG: 1,"0070,30,20,3c4e,,10,1a2b"`, geoRequest{}},
+		{"json with invalid cell", "json", `{"cells": [{"mcc": "x", "mnc": 10, "lac": 1, "cid": 2}, {"mcc": 510}]}`, geoRequest{}},
+		{"truncated json", "json", `{"cells": [{"mcc": 510`, geoRequest{}},
+		{"wrong format", "ceng", qengLTEScan, geoRequest{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCellScanFormats(t, tt.format, nil)
+			if got := parseCellScan(nil, "modem-1", tt.message); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCellScan(%q)\n got %v\nwant %v", tt.message, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCellScanAutoDetect(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    geoRequest
+	}{
+		{"bracket", bracketScan, geoRequest{CellTowers: []map[string]interface{}{
+			tower("510", "10", 0x1A2B, 0x3C4D, "", -71, 3),
+			tower("510", "10", 0x1A2B, 0x3C4E, "", 0, 0),
+		}}},
+		{"qeng", qengGSMScan, geoRequest{CellTowers: []map[string]interface{}{
+			tower("510", "10", 0x1A2B, 0x3C4D, "gsm", -71, 5),
+		}}},
+		{"ceng", cengScan, geoRequest{CellTowers: []map[string]interface{}{
+			tower("510", "10", 0x1A2B, 0x3C4D, "gsm", -66, 0),
+			tower("510", "10", 0x1A2B, 0x3C4E, "gsm", -80, 0),
+		}}},
+		// JSON is tried first, so bracketed text inside it is not read as towers.
+		{"json before bracket", `{"cells": [], "note": "[510,10,1A2B,3C4D]"}`, geoRequest{}},
+		// QENG is tried before bracket, which would match the trailing set.
+		{"qeng before bracket", qengLTEScan + " [510,10,1A2B,3C4D]", geoRequest{CellTowers: []map[string]interface{}{
+			tower("510", "10", 0x2B5C, 0x1A2D102, "lte", -65, 0),
+		}}},
+		{"qeng before ceng", qengLTEScan + "\r\n" + cengScan, geoRequest{CellTowers: []map[string]interface{}{
+			tower("510", "10", 0x2B5C, 0x1A2D102, "lte", -65, 0),
+		}}},
+		{"nothing detected", "no scan", geoRequest{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCellScanFormats(t, "auto", nil)
+			if got := parseCellScan(nil, "modem-1", tt.message); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCellScan(%q)\n got %v\nwant %v", tt.message, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCellScanModelFormat(t *testing.T) {
+	store := modelStore{models: map[string]string{"m-ec25": "EC25", "m-sim800": "SIM800L", "m-other": "BG96"}}
+	useCellScanFormats(t, "bracket", map[string]string{"EC25": "qeng", "SIM800L": "auto"})
+
+	lte := geoRequest{CellTowers: []map[string]interface{}{tower("510", "10", 0x2B5C, 0x1A2D102, "lte", -65, 0)}}
+	tests := []struct {
+		sender  string
+		message string
+		want    geoRequest
+	}{
+		{"m-ec25", qengLTEScan, lte},
+		{"m-sim800", qengLTEScan, lte},         // auto for this model
+		{"m-other", qengLTEScan, geoRequest{}}, // CELL_SCAN_FORMAT for the rest
+		{"m-unknown", bracketScan, geoRequest{CellTowers: []map[string]interface{}{
+			tower("510", "10", 0x1A2B, 0x3C4D, "", -71, 3),
+			tower("510", "10", 0x1A2B, 0x3C4E, "", 0, 0),
+		}}},
+	}
+	for _, tt := range tests {
+		if got := parseCellScan(store, tt.sender, tt.message); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCellScan(%s, %q)\n got %v\nwant %v", tt.sender, tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestParseCellScanFormats(t *testing.T) {
+	got, err := parseCellScanFormats(" SIM800L=ceng, EC25=qeng ,,BG96=auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"SIM800L": "ceng", "EC25": "qeng", "BG96": "auto"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseCellScanFormats = %v, want %v", got, want)
+	}
+
+	for _, spec := range []string{"SIM800L", "SIM800L=", "SIM800L=at", "EC25=qeng,SIM800L=CENG"} {
+		if got, err := parseCellScanFormats(spec); err == nil {
+			t.Errorf("parseCellScanFormats(%q) = %v, want an error", spec, got)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// useFakeClock replaces clock with a FakeClock for the test.
+func useFakeClock(t *testing.T) *FakeClock {
+	t.Helper()
+	c := NewFakeClock(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	saved := clock
+	clock = c
+	t.Cleanup(func() { clock = saved })
+	return c
+}
+
+// timers returns how many timers are waiting on c.
+func (c *FakeClock) timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// eventually fails the test unless cond becomes true within a few seconds; it waits
+// for goroutines woken by FakeClock.Advance to catch up.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFakeClockFiresTimersInDeadlineOrder(t *testing.T) {
+	c := NewFakeClock(time.Unix(0, 0))
+	var fired []string
+	c.AfterFunc(3*time.Second, func() { fired = append(fired, "3s") })
+	c.AfterFunc(time.Second, func() { fired = append(fired, "1s") })
+	stopped := c.AfterFunc(2*time.Second, func() { fired = append(fired, "2s") })
+	after := c.After(2 * time.Second)
+
+	if !stopped.Stop() {
+		t.Fatal("Stop of a waiting timer = false")
+	}
+	if stopped.Stop() {
+		t.Fatal("second Stop = true")
+	}
+
+	c.Advance(2 * time.Second)
+	if len(fired) != 1 || fired[0] != "1s" {
+		t.Fatalf("after 2s fired %v, want [1s]", fired)
+	}
+	select {
+	case at := <-after:
+		if want := time.Unix(2, 0); !at.Equal(want) {
+			t.Errorf("After(2s) delivered %v, want %v", at, want)
+		}
+	default:
+		t.Error("After(2s) did not fire after 2s")
+	}
+
+	c.Advance(time.Second)
+	if len(fired) != 2 || fired[1] != "3s" {
+		t.Fatalf("after 3s fired %v, want [1s 3s]", fired)
+	}
+	if got, want := c.Now(), time.Unix(3, 0); !got.Equal(want) {
+		t.Errorf("Now() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Payload codecs. Every inbound payload is decoded to the same map the JSON handlers
+// use and re-encoded as JSON before it enters the event pipeline, so handlers never see
+// the wire format. The original bytes are still kept in raw_messages.
+const (
+	codecAuto     = "auto"
+	codecJSON     = "json"
+	codecCBOR     = "cbor"
+	codecProtobuf = "protobuf"
+)
+
+// codecRoute selects a codec for the topics matching an MQTT topic filter.
+type codecRoute struct {
+	filter string
+	codec  string
+}
+
+var codecRoutes []codecRoute // first match wins; unmatched topics use codecAuto
+
+var messagesDecoded = newCounterVec("collector_messages_decoded_total", "Inbound payloads by the codec that decoded them.", "codec")
+
+// parseCodecRoutes parses PAYLOAD_CODECS, a comma-separated list of filter=codec pairs,
+// e.g. "DATA/NBIOT/#=cbor,DATA/PB/+=protobuf".
+func parseCodecRoutes(spec string) ([]codecRoute, error) {
+	var routes []codecRoute
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		filter, codec, ok := strings.Cut(entry, "=")
+		filter, codec = strings.TrimSpace(filter), strings.ToLower(strings.TrimSpace(codec))
+		if !ok || filter == "" {
+			return nil, fmt.Errorf("invalid codec route %q, expected filter=codec", entry)
+		}
+		switch codec {
+		case codecAuto, codecJSON, codecCBOR, codecProtobuf:
+		default:
+			return nil, fmt.Errorf("unknown codec %q for %s", codec, filter)
+		}
+		routes = append(routes, codecRoute{filter: filter, codec: codec})
+	}
+	return routes, nil
+}
+
+// topicMatches reports whether topic matches the MQTT topic filter, which may use the
+// + and # wildcards.
+func topicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// sniffCodec guesses the codec of a payload: a JSON object starts with '{', a CBOR map
+// with major type 5, and anything else is treated as a protobuf message.
+func sniffCodec(payload []byte) string {
+	trimmed := bytes.TrimLeft(payload, " \t\r\n")
+	switch {
+	case len(trimmed) > 0 && trimmed[0] == '{':
+		return codecJSON
+	case len(payload) > 0 && payload[0]>>5 == 5:
+		return codecCBOR
+	default:
+		return codecProtobuf
+	}
+}
+
+// decodePayload converts payload from the codec configured for topic to JSON.
+func decodePayload(topic string, payload []byte) ([]byte, string, error) {
+	codec := codecAuto
+	for _, route := range codecRoutes {
+		if topicMatches(route.filter, topic) {
+			codec = route.codec
+			break
+		}
+	}
+	if codec == codecAuto {
+		codec = sniffCodec(payload)
+	}
+
+	var value interface{}
+	var err error
+	switch codec {
+	case codecJSON:
+		messagesDecoded.Inc(codec)
+		return payload, codec, nil
+	case codecCBOR:
+		value, err = decodeCBOR(payload)
+	case codecProtobuf:
+		value, err = decodeDeviceEventProto(payload)
+	}
+	if err != nil {
+		return nil, codec, fmt.Errorf("invalid %s payload: %v", codec, err)
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, codec, fmt.Errorf("failed to convert %s payload to JSON: %v", codec, err)
+	}
+	messagesDecoded.Inc(codec)
+	return encoded, codec, nil
+}
+
+// decodeCBOR decodes one RFC 8949 data item into JSON-compatible values. Tags are
+// ignored (their content is kept), byte strings become base64 strings in JSON and map
+// keys are converted to strings.
+func decodeCBOR(data []byte) (interface{}, error) {
+	d := &cborDecoder{data: data}
+	value, err := d.item(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("%d trailing bytes", len(d.data)-d.pos)
+	}
+	return value, nil
+}
+
+const cborMaxDepth = 32
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// errCBORBreak is returned for the "break" stop code that ends indefinite-length items.
+var errCBORBreak = fmt.Errorf("unexpected break")
+
+func (d *cborDecoder) next(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, fmt.Errorf("truncated data")
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// head reads an initial byte and its argument. indefinite is true for additional info 31.
+func (d *cborDecoder) head() (major byte, info byte, arg uint64, indefinite bool, err error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+	major, info = b[0]>>5, b[0]&0x1f
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24:
+		b, err = d.next(1)
+		if err == nil {
+			arg = uint64(b[0])
+		}
+	case info == 25:
+		b, err = d.next(2)
+		if err == nil {
+			arg = uint64(binary.BigEndian.Uint16(b))
+		}
+	case info == 26:
+		b, err = d.next(4)
+		if err == nil {
+			arg = uint64(binary.BigEndian.Uint32(b))
+		}
+	case info == 27:
+		b, err = d.next(8)
+		if err == nil {
+			arg = binary.BigEndian.Uint64(b)
+		}
+	case info == 31:
+		indefinite = true
+	default:
+		err = fmt.Errorf("reserved additional information %d", info)
+	}
+	return major, info, arg, indefinite, err
+}
+
+func (d *cborDecoder) item(depth int) (interface{}, error) {
+	if depth > cborMaxDepth {
+		return nil, fmt.Errorf("nesting deeper than %d", cborMaxDepth)
+	}
+	major, info, arg, indefinite, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if indefinite && (major == 0 || major == 1 || major == 6) {
+		return nil, fmt.Errorf("indefinite length not allowed for major type %d", major)
+	}
+
+	switch major {
+	case 0:
+		return arg, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return float64(-1) - float64(arg), nil
+		}
+		return -1 - int64(arg), nil
+	case 2, 3:
+		var buf []byte
+		if indefinite {
+			for {
+				chunk, err := d.item(depth + 1)
+				if err == errCBORBreak {
+					break
+				}
+				if err != nil {
+					return nil, err
+				}
+				switch c := chunk.(type) {
+				case []byte:
+					buf = append(buf, c...)
+				case string:
+					buf = append(buf, c...)
+				}
+			}
+		} else {
+			if arg > uint64(len(d.data)) {
+				return nil, fmt.Errorf("truncated data")
+			}
+			b, err := d.next(int(arg))
+			if err != nil {
+				return nil, err
+			}
+			buf = append([]byte(nil), b...)
+		}
+		if major == 3 {
+			return string(buf), nil
+		}
+		return buf, nil
+	case 4:
+		items := []interface{}{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			v, err := d.item(depth + 1)
+			if indefinite && err == errCBORBreak {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		}
+		return items, nil
+	case 5:
+		m := map[string]interface{}{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			k, err := d.item(depth + 1)
+			if indefinite && err == errCBORBreak {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(k)] = v
+		}
+		return m, nil
+	case 6:
+		return d.item(depth + 1)
+	default: // 7: floats and simple values
+		switch {
+		case indefinite:
+			return nil, errCBORBreak
+		case info == 20:
+			return false, nil
+		case info == 21:
+			return true, nil
+		case info == 22, info == 23:
+			return nil, nil
+		case info == 25:
+			return halfToFloat(uint16(arg)), nil
+		case info == 26:
+			return float64(math.Float32frombits(uint32(arg))), nil
+		case info == 27:
+			return math.Float64frombits(arg), nil
+		default:
+			return nil, fmt.Errorf("unsupported simple value %d", arg)
+		}
+	}
+}
+
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var v float64
+	switch exp {
+	case 0:
+		v = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			v = math.Inf(1)
+		} else {
+			v = math.NaN()
+		}
+	default:
+		v = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -v
+	}
+	return v
+}
+
+// deviceEventFields maps the field numbers of the DeviceEvent protobuf message in
+// schemas/device_event.proto to the JSON field names the handlers read.
+var deviceEventFields = map[uint64]string{
+	1: "event",
+	2: "timestamp",
+	3: "message",
+	4: "message_id",
+}
+
+// decodeDeviceEventProto decodes a DeviceEvent protobuf message. Unknown fields are skipped.
+func decodeDeviceEventProto(data []byte) (map[string]interface{}, error) {
+	msg := map[string]interface{}{}
+	for pos := 0; pos < len(data); {
+		key, n := binary.Uvarint(data[pos:])
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid field key at offset %d", pos)
+		}
+		pos += n
+		field, wireType := key>>3, key&7
+
+		var value interface{}
+		switch wireType {
+		case 0:
+			v, n := binary.Uvarint(data[pos:])
+			if n <= 0 {
+				return nil, fmt.Errorf("invalid varint for field %d", field)
+			}
+			pos += n
+			value = v
+		case 1:
+			if pos+8 > len(data) {
+				return nil, fmt.Errorf("truncated fixed64 field %d", field)
+			}
+			value = math.Float64frombits(binary.LittleEndian.Uint64(data[pos:]))
+			pos += 8
+		case 2:
+			length, n := binary.Uvarint(data[pos:])
+			if n <= 0 || length > uint64(len(data)-pos-n) {
+				return nil, fmt.Errorf("invalid length for field %d", field)
+			}
+			pos += n
+			value = string(data[pos : pos+int(length)])
+			pos += int(length)
+		case 5:
+			if pos+4 > len(data) {
+				return nil, fmt.Errorf("truncated fixed32 field %d", field)
+			}
+			value = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[pos:])))
+			pos += 4
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d for field %d", wireType, field)
+		}
+		if name, ok := deviceEventFields[field]; ok {
+			msg[name] = value
+		}
+	}
+	if _, ok := msg["event"]; !ok {
+		return nil, fmt.Errorf("missing event field")
+	}
+	return msg, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// cborEvent is {"event": "TEMPERATURE", "timestamp": 1700000000, "message": "23.5"}.
+var cborEvent = []byte{
+	0xa3,
+	0x65, 'e', 'v', 'e', 'n', 't',
+	0x6b, 'T', 'E', 'M', 'P', 'E', 'R', 'A', 'T', 'U', 'R', 'E',
+	0x69, 't', 'i', 'm', 'e', 's', 't', 'a', 'm', 'p',
+	0x1a, 0x65, 0x53, 0xf1, 0x00,
+	0x67, 'm', 'e', 's', 's', 'a', 'g', 'e',
+	0x64, '2', '3', '.', '5',
+}
+
+func FuzzDecodeCBOR(f *testing.F) {
+	f.Add(cborEvent)
+	f.Add([]byte{0xbf, 0x65, 'e', 'v', 'e', 'n', 't', 0x61, 'X', 0xff})       // indefinite map
+	f.Add([]byte{0x5f, 0x42, 0x01, 0x02, 0x41, 0x03, 0xff})                   // indefinite byte string
+	f.Add([]byte{0x84, 0xf9, 0x3c, 0x00, 0x38, 0x63, 0xf5, 0xf6})             // [1.0, -100, true, null]
+	f.Add([]byte{0xc1, 0x1a, 0x65, 0x53, 0xf1, 0x00})                         // tagged epoch time
+	f.Add([]byte{0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})       // below math.MinInt64
+	f.Add([]byte{0xfb, 0x7f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})       // NaN
+	f.Add([]byte{0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x00}) // nested arrays
+	f.Add([]byte{0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})       // huge length
+	f.Add([]byte{0x1c})                                                       // reserved additional information
+	f.Add([]byte{0xff})                                                       // stray break
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		value, err := decodeCBOR(data)
+		if err != nil {
+			return
+		}
+		// A data item is self-delimiting: the decoder consumed every byte, so one
+		// more is trailing garbage and one less leaves the item incomplete.
+		if _, err := decodeCBOR(append(append([]byte(nil), data...), 0x00)); err == nil {
+			t.Errorf("decodeCBOR(% x) accepted a trailing byte", data)
+		}
+		if _, err := decodeCBOR(data[:len(data)-1]); err == nil {
+			t.Errorf("decodeCBOR(% x) accepted the input without its last byte", data)
+		}
+		again, err := decodeCBOR(data)
+		if err != nil || fmt.Sprint(again) != fmt.Sprint(value) {
+			t.Errorf("decodeCBOR(% x) is not deterministic: %v then %v, %v", data, value, again, err)
+		}
+	})
+}
+
+// protoField encodes a protobuf field key followed by value.
+func protoField(field, wireType uint64, value []byte) []byte {
+	b := binary.AppendUvarint(nil, field<<3|wireType)
+	return append(b, value...)
+}
+
+func protoString(field uint64, s string) []byte {
+	return protoField(field, 2, append(binary.AppendUvarint(nil, uint64(len(s))), s...))
+}
+
+func protoVarint(field, v uint64) []byte {
+	return protoField(field, 0, binary.AppendUvarint(nil, v))
+}
+
+func protoFixed64(field uint64, v float64) []byte {
+	return protoField(field, 1, binary.LittleEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+func protoFixed32(field uint64, v float32) []byte {
+	return protoField(field, 5, binary.LittleEndian.AppendUint32(nil, math.Float32bits(v)))
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// encodeDeviceEvent is the inverse of decodeDeviceEventProto for the known fields.
+func encodeDeviceEvent(t *testing.T, msg map[string]interface{}) []byte {
+	numbers := map[string]uint64{}
+	for number, name := range deviceEventFields {
+		numbers[name] = number
+	}
+	var b []byte
+	for name, value := range msg {
+		field, ok := numbers[name]
+		if !ok {
+			t.Fatalf("decoded unknown field %q", name)
+		}
+		switch v := value.(type) {
+		case string:
+			b = append(b, protoString(field, v)...)
+		case uint64:
+			b = append(b, protoVarint(field, v)...)
+		case float64:
+			b = append(b, protoFixed64(field, v)...)
+		default:
+			t.Fatalf("decoded field %q as %T", name, value)
+		}
+	}
+	return b
+}
+
+func FuzzDecodeProtobuf(f *testing.F) {
+	f.Add(concat(protoString(1, "TEMPERATURE"), protoString(2, "1700000000"), protoString(3, "23.5"), protoString(4, "m-1")))
+	f.Add(concat(protoString(1, "GPS"), protoVarint(2, 1700000000000), protoString(99, "ignored")))
+	f.Add(concat(protoString(1, "BATTERY_STATUS"), protoFixed64(3, 3.7), protoFixed32(10, 1.5)))
+	f.Add(protoString(3, "no event"))
+	f.Add([]byte{0x0a, 0xff, 0xff, 0xff, 0xff, 0x0f, 'x'}) // length beyond the end
+	f.Add([]byte{0x0b})                                    // group start, unsupported wire type
+	f.Add([]byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := decodeDeviceEventProto(data)
+		if err != nil {
+			return
+		}
+		if _, ok := msg["event"]; !ok {
+			t.Fatalf("decodeDeviceEventProto(% x) = %v without event", data, msg)
+		}
+		again, err := decodeDeviceEventProto(encodeDeviceEvent(t, msg))
+		if err != nil {
+			t.Fatalf("re-encoded %v does not decode: %v", msg, err)
+		}
+		if fmt.Sprint(again) != fmt.Sprint(msg) {
+			t.Errorf("round trip of %v gave %v", msg, again)
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import "log"
+
+// stateChange is one update of an eventState flag; delete removes the flag.
+type stateChange struct {
+	key    string
+	value  interface{}
+	delete bool
+}
+
+// combinedWrite collects the events and eventState changes of one combined-condition
+// message (the original event, a derived POWER_PLN event and the flags behind it) so
+// they are stored in a single transaction: a crash part-way can no longer leave
+// POWER_PLN in the history without the event that caused it, or the flags out of step
+// with both. Reads see the changes made so far, so the condition logic runs unchanged.
+//
+// With the postgres state backend several instances may handle the same sender, so the
+// write opens its transaction up front and takes a per-sender advisory lock: the reads,
+// the condition logic and the writes of one sender's message run one at a time across
+// the instances. Close releases the lock of a write that is not committed.
+type combinedWrite struct {
+	store   Store
+	tx      SenderTx // holds the sender's lock, nil unless the state is shared
+	events  []EventMessage
+	quiet   map[int]bool // events Commit stores but does not publish
+	changes []stateChange
+}
+
+func newCombinedWrite(store Store, senderID string) *combinedWrite {
+	w := &combinedWrite{store: store}
+	if _, shared := eventState.(*postgresState); !shared {
+		return w
+	}
+	tx, err := store.LockSender(senderID)
+	if err != nil {
+		log.Printf("Error locking the event state of %s, continuing unlocked: %v", senderID, err)
+		return w
+	}
+	w.tx = tx
+	return w
+}
+
+// Close rolls back a write that was not committed, releasing the sender's lock.
+func (w *combinedWrite) Close() {
+	if w.tx != nil {
+		w.tx.Rollback()
+		w.tx = nil
+	}
+}
+
+// Save queues data to be stored and published on Commit.
+func (w *combinedWrite) Save(data EventMessage) {
+	w.events = append(w.events, data)
+}
+
+// SaveQuiet queues data to be stored on Commit; the caller publishes it.
+func (w *combinedWrite) SaveQuiet(data EventMessage) {
+	if w.quiet == nil {
+		w.quiet = map[int]bool{}
+	}
+	w.quiet[len(w.events)] = true
+	w.events = append(w.events, data)
+}
+
+func (w *combinedWrite) Load(key interface{}) (interface{}, bool) {
+	for i := len(w.changes) - 1; i >= 0; i-- {
+		if c := w.changes[i]; c.key == key {
+			if c.delete {
+				return nil, false
+			}
+			return c.value, true
+		}
+	}
+	if w.tx != nil {
+		return w.tx.Load(key)
+	}
+	return eventState.Load(key)
+}
+
+func (w *combinedWrite) Store(key, value interface{}) {
+	w.changes = append(w.changes, stateChange{key: key.(string), value: value})
+}
+
+func (w *combinedWrite) Delete(key interface{}) {
+	w.changes = append(w.changes, stateChange{key: key.(string), delete: true})
+}
+
+// Commit stores the queued events and state changes together and then publishes the
+// events. Combined writes bypass the batcher, which could split them across flushes,
+// and the async writers, so the datapoints are only published once the rows are stored.
+// If the transaction fails the events fall back to the usual per-event path, so they
+// are spooled or dead-lettered like any other write.
+func (w *combinedWrite) Commit() {
+	var stored []EventMessage
+	for _, data := range w.events {
+		if _, ok := storageTable(data.EventName); !ok {
+			log.Printf("[%s] Storage disabled for %s events, not saving", data.IngestID, data.EventName)
+			procLog.Record(data.IngestID, data.Sumber, decisionStorageDisabled, data.EventName)
+			continue
+		}
+		stored = append(stored, data)
+	}
+
+	var changes []stateChange
+	if persistedState() {
+		changes = w.changes
+	}
+	var err error
+	if tx := w.tx; tx != nil {
+		// The transaction holds the lock the reads were made under, so it cannot be
+		// retried from scratch.
+		w.tx = nil
+		err = tx.Commit(stored, changes)
+	} else {
+		err = withDBRetry(dbRetryAttempts, func() error { return w.store.SaveEvents(stored, changes) })
+	}
+	if err != nil {
+		log.Printf("Error saving combined-condition events in one transaction, storing them separately: %v", err)
+		for _, data := range stored {
+			processAndSaveDirect(w.store, data)
+		}
+		w.applyState()
+	} else {
+		for _, data := range stored {
+			table, _ := storageTable(data.EventName)
+			procLog.Record(data.IngestID, data.Sumber, decisionStored, data.EventName+" -> "+table)
+		}
+		log.Printf("Saved %d combined-condition events with %d state changes", len(stored), len(w.changes))
+		switch s := eventState.(type) {
+		case *postgresState:
+		case *memoryState:
+			for _, c := range w.changes {
+				s.cache(c)
+			}
+		default:
+			w.applyState()
+		}
+	}
+
+	for i, data := range w.events {
+		if !w.quiet[i] {
+			sendDataPoint(data)
+		}
+	}
+}
+
+func (w *combinedWrite) applyState() {
+	for _, c := range w.changes {
+		if c.delete {
+			eventState.Delete(c.key)
+		} else {
+			eventState.Store(c.key, c.value)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	commandTopic        string
+	commandAckSubscribe string
+	commandAckTimeout   time.Duration
+	pendingCommands     sync.Map // command_id -> *pendingCommand
+)
+
+// Command outcomes recorded in command_audit.
+const (
+	commandPending       = "pending"
+	commandAcked         = "acked"
+	commandRejected      = "rejected"
+	commandTimeout       = "timeout"
+	commandPublishFailed = "publish_failed"
+)
+
+// CommandRequest is the downlink payload published to a device's command topic.
+type CommandRequest struct {
+	CommandID string                 `json:"command_id"`
+	Command   string                 `json:"command"`
+	Params    map[string]interface{} `json:"params,omitempty"`
+	Time      int64                  `json:"time"`
+}
+
+// CommandAudit is one row of command_audit.
+type CommandAudit struct {
+	CommandID  string     `json:"command_id"`
+	SenderID   string     `json:"sender_id"`
+	Command    string     `json:"command"`
+	Request    string     `json:"request"`
+	SentAt     time.Time  `json:"sent_at"`
+	AckPayload *string    `json:"ack_payload,omitempty"`
+	AckedAt    *time.Time `json:"acked_at,omitempty"`
+	RTTMillis  *int64     `json:"rtt_ms,omitempty"`
+	Outcome    string     `json:"outcome"`
+}
+
+type pendingCommand struct {
+	senderID string
+	sentAt   time.Time
+	timer    Timer
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", clock.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// newUUID returns a random (version 4) UUID, used to trace one inbound message end to end.
+func newUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return newID()
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// sendCommand publishes a command to the device and records it in command_audit.
+// The audit row is completed when the device acknowledges or the ack timeout expires.
+// batchID links the command to a bulk dispatch and may be empty.
+func sendCommand(db *sql.DB, senderID, command string, params map[string]interface{}, batchID string) (CommandAudit, error) {
+	request := CommandRequest{
+		CommandID: newID(),
+		Command:   command,
+		Params:    params,
+		Time:      getCurrentTimeMillis(),
+	}
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return CommandAudit{}, fmt.Errorf("failed to marshal command: %v", err)
+	}
+
+	audit := CommandAudit{
+		CommandID: request.CommandID,
+		SenderID:  senderID,
+		Command:   command,
+		Request:   string(payload),
+		SentAt:    clock.Now(),
+		Outcome:   commandPending,
+	}
+
+	_, err = db.Exec("INSERT INTO command_audit (command_id, sender_id, command, request, sent_at, outcome, batch_id) VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))",
+		audit.CommandID, audit.SenderID, audit.Command, audit.Request, audit.SentAt, audit.Outcome, batchID)
+	if err != nil {
+		return CommandAudit{}, fmt.Errorf("failed to record command: %v", err)
+	}
+
+	// The timer is set before the command is visible to handleCommandAck, which stops it.
+	pending := &pendingCommand{senderID: senderID, sentAt: audit.SentAt}
+	pending.timer = clock.AfterFunc(commandAckTimeout, func() {
+		if pendingCommands.CompareAndDelete(audit.CommandID, pending) {
+			log.Printf("Command %s to %s timed out after %v without acknowledgment", audit.CommandID, senderID, commandAckTimeout)
+			finishCommand(db, audit.CommandID, commandTimeout)
+		}
+	})
+	pendingCommands.Store(audit.CommandID, pending)
+
+	topic := fmt.Sprintf(commandTopic, senderID)
+	log.Printf("Sending command %s (%s) to %s: %s", audit.CommandID, command, topic, payload)
+
+	if err := mqttClient.Publish(topic, 1, false, payload); err != nil {
+		if pendingCommands.CompareAndDelete(audit.CommandID, pending) {
+			pending.timer.Stop()
+		}
+		audit.Outcome = commandPublishFailed
+		finishCommand(db, audit.CommandID, audit.Outcome)
+		return audit, fmt.Errorf("failed to publish command: %v", err)
+	}
+
+	return audit, nil
+}
+
+// handleCommandAck matches a device acknowledgment to its pending command and completes the audit row.
+func handleCommandAck(db *sql.DB, senderID string, payload []byte) {
+	var ack map[string]interface{}
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		log.Printf("Error unmarshalling command ack from %s: %v", senderID, err)
+		return
+	}
+
+	commandID, ok := ack["command_id"].(string)
+	if !ok {
+		log.Printf("Command ack from %s has no command_id: %s", senderID, payload)
+		return
+	}
+
+	outcome := commandAcked
+	if !ackSucceeded(ack["status"]) {
+		outcome = commandRejected
+	}
+
+	value, ok := pendingCommands.Load(commandID)
+	if !ok {
+		log.Printf("Received ack for unknown or expired command %s from %s", commandID, senderID)
+		finishCommandFrom(db, commandID, senderID, string(payload), outcome)
+		return
+	}
+	pending := value.(*pendingCommand)
+	if pending.senderID != senderID {
+		// Only the device a command was sent to may complete it.
+		log.Printf("Ignoring ack of command %s from %s, it was sent to %s", commandID, senderID, pending.senderID)
+		return
+	}
+	if !pendingCommands.CompareAndDelete(commandID, pending) {
+		return // timed out meanwhile
+	}
+	pending.timer.Stop()
+
+	ackedAt := clock.Now()
+	rtt := ackedAt.Sub(pending.sentAt)
+	log.Printf("Command %s acknowledged by %s in %v: %s", commandID, senderID, rtt, outcome)
+	ackCommand(db, commandID, string(payload), outcome, ackedAt, rtt)
+	updateCampaignFromAck(db, commandID, outcome)
+}
+
+// ackSucceeded interprets the status field of an acknowledgment; a missing status counts as success.
+func ackSucceeded(status interface{}) bool {
+	switch s := status.(type) {
+	case nil:
+		return true
+	case bool:
+		return s
+	case float64:
+		return s == 0
+	case string:
+		switch strings.ToUpper(s) {
+		case "OK", "SUCCESS", "DONE", "ACK", "0":
+			return true
+		}
+	}
+	return false
+}
+
+// finishCommand records an outcome without an acknowledgment (timeout, publish failure).
+// It never overwrites an outcome that an ack, possibly handled by another instance,
+// has already recorded.
+func finishCommand(db *sql.DB, commandID string, outcome string) {
+	_, err := db.Exec("UPDATE command_audit SET outcome = $2 WHERE command_id = $1 AND outcome = $3",
+		commandID, outcome, commandPending)
+	if err != nil {
+		log.Printf("Error updating command audit for %s: %v", commandID, err)
+	}
+}
+
+// ackCommand stores the ack payload, round-trip time and outcome for a command. The
+// times come from the collector's clock, the same one that stamped sent_at.
+func ackCommand(db *sql.DB, commandID string, ackPayload string, outcome string, ackedAt time.Time, rtt time.Duration) {
+	_, err := db.Exec(`UPDATE command_audit
+            SET ack_payload = $2, acked_at = $3, rtt_ms = $4, outcome = $5
+            WHERE command_id = $1`, commandID, ackPayload, ackedAt, rtt.Milliseconds(), outcome)
+	if err != nil {
+		log.Printf("Error updating command audit for %s: %v", commandID, err)
+	}
+}
+
+// finishCommandFrom attaches an acknowledgment for a command this instance is not
+// waiting on: a late ack, or one for a command sent by another instance. The outcome is
+// only set while the command is still pending, so a recorded timeout stays a timeout.
+func finishCommandFrom(db *sql.DB, commandID, senderID, ackPayload, outcome string) {
+	_, err := db.Exec(`UPDATE command_audit
+        SET ack_payload = $3,
+            acked_at = $4,
+            rtt_ms = (EXTRACT(EPOCH FROM ($4::TIMESTAMPTZ - sent_at)) * 1000)::BIGINT,
+            outcome = CASE WHEN outcome = $6 THEN $5 ELSE outcome END
+        WHERE command_id = $1 AND sender_id = $2`, commandID, senderID, ackPayload, clock.Now(), outcome, commandPending)
+	if err != nil {
+		log.Printf("Error updating command audit for %s: %v", commandID, err)
+	}
+}
+
+// expirePendingCommands marks commands still pending from before the collector started
+// as timed out: their ack timers died with the previous process. Commands younger than
+// the ack timeout may belong to another running instance and are left alone.
+func expirePendingCommands(db *sql.DB) {
+	res, err := db.Exec("UPDATE command_audit SET outcome = $1 WHERE outcome = $2 AND sent_at < $3",
+		commandTimeout, commandPending, clock.Now().Add(-commandAckTimeout))
+	if err != nil {
+		log.Printf("Error expiring pending commands: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Marked %d commands pending since before startup as timed out", n)
+	}
+}
+
+// queryCommandAudit returns the most recent commands sent to a device, newest first.
+func queryCommandAudit(db *sql.DB, senderID string, limit int) ([]CommandAudit, error) {
+	rows, err := db.Query(`SELECT command_id, sender_id, command, request, sent_at, ack_payload, acked_at, rtt_ms, outcome
+        FROM command_audit WHERE sender_id = $1 ORDER BY sent_at DESC LIMIT $2`, senderID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query command audit: %v", err)
+	}
+	defer rows.Close()
+
+	audits := []CommandAudit{}
+	for rows.Next() {
+		var a CommandAudit
+		if err := rows.Scan(&a.CommandID, &a.SenderID, &a.Command, &a.Request, &a.SentAt, &a.AckPayload, &a.AckedAt, &a.RTTMillis, &a.Outcome); err != nil {
+			return nil, fmt.Errorf("failed to scan command audit: %v", err)
+		}
+		audits = append(audits, a)
+	}
+	return audits, rows.Err()
+}
+
+// subscribeCommandAcks listens for acknowledgments on the ack topic filter.
+func subscribeCommandAcks(db *sql.DB) {
+	if commandAckSubscribe == "" {
+		return
+	}
+	if err := mqttClient.Subscribe(commandAckSubscribe, mqttSubscribeQoS, func(msg BrokerMessage) {
+		senderID, ok := senderIDFromTopic(msg.Topic)
+		if !ok {
+			log.Printf("Unexpected command ack topic %s", msg.Topic)
+			return
+		}
+		handleCommandAck(db, senderID, msg.Payload)
+	}); err != nil {
+		log.Fatalf("Failed to subscribe to command ack topic: %v", err)
+	}
+}
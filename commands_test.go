@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// mockDB returns a sqlmock database that must have met its expectations when the test ends.
+func mockDB(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	return db, mock
+}
+
+// useCommandTopic sets the command topic and ack timeout for the test.
+func useCommandTopic(t *testing.T, timeout time.Duration) {
+	t.Helper()
+	savedTopic, savedTimeout := commandTopic, commandAckTimeout
+	commandTopic, commandAckTimeout = "CMD/%s", timeout
+	t.Cleanup(func() { commandTopic, commandAckTimeout = savedTopic, savedTimeout })
+}
+
+func TestCommandAckTimeout(t *testing.T) {
+	c := useFakeClock(t)
+	useCommandTopic(t, 30*time.Second)
+	b := captureBroker(t)
+	db, mock := mockDB(t)
+
+	mock.ExpectExec("INSERT INTO command_audit").
+		WithArgs(sqlmock.AnyArg(), "modem-1", "REBOOT", sqlmock.AnyArg(), c.Now(), commandPending, "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	audit, err := sendCommand(db, "modem-1", "REBOOT", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(b.Messages("CMD/modem-1")); got != 1 {
+		t.Fatalf("published %d commands, want 1", got)
+	}
+
+	c.Advance(29 * time.Second)
+	if _, ok := pendingCommands.Load(audit.CommandID); !ok {
+		t.Fatal("command expired before the ack timeout")
+	}
+
+	mock.ExpectExec(`UPDATE command_audit SET outcome = \$2 WHERE command_id = \$1 AND outcome = \$3`).
+		WithArgs(audit.CommandID, commandTimeout, commandPending).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	c.Advance(time.Second)
+	if _, ok := pendingCommands.Load(audit.CommandID); ok {
+		t.Fatal("command still pending after the ack timeout")
+	}
+}
+
+func TestCommandAckStopsTimeout(t *testing.T) {
+	c := useFakeClock(t)
+	useCommandTopic(t, 30*time.Second)
+	captureBroker(t)
+	db, mock := mockDB(t)
+
+	mock.ExpectExec("INSERT INTO command_audit").WillReturnResult(sqlmock.NewResult(0, 1))
+	audit, err := sendCommand(db, "modem-1", "REBOOT", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(10 * time.Second)
+
+	ack, _ := json.Marshal(map[string]interface{}{"command_id": audit.CommandID, "status": "FAILED"})
+	mock.ExpectExec(`UPDATE command_audit\s+SET ack_payload`).
+		WithArgs(audit.CommandID, string(ack), c.Now(), int64(10000), commandRejected).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE firmware_campaign_devices").
+		WithArgs(audit.CommandID, commandRejected, otaNotified).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	handleCommandAck(db, "modem-1", ack)
+
+	if n := c.timers(); n != 0 {
+		t.Fatalf("%d timers still waiting after the ack", n)
+	}
+	if _, ok := pendingCommands.Load(audit.CommandID); ok {
+		t.Fatal("command still pending after the ack")
+	}
+}
+
+func TestCommandAckFromAnotherInstance(t *testing.T) {
+	c := useFakeClock(t)
+	db, mock := mockDB(t)
+
+	// No pending entry: the command was sent by another instance or has timed out here.
+	ack := `{"command_id":"cmd-1","status":"OK"}`
+	mock.ExpectExec(`UPDATE command_audit\s+SET ack_payload = \$3.*outcome = CASE WHEN outcome = \$6 THEN \$5 ELSE outcome END`).
+		WithArgs("cmd-1", "modem-1", ack, c.Now(), commandAcked, commandPending).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	handleCommandAck(db, "modem-1", []byte(ack))
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressHandler compresses responses with zstd, gzip or deflate when the client accepts
+// it. Large exports over slow site links are the main beneficiary.
+func compressHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		w.Header().Add("Vary", "Accept-Encoding")
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if header := r.Header.Get("If-None-Match"); header != "" {
+			r = r.Clone(r.Context())
+			if header = ifNoneMatchForEncoding(header, encoding); header != "" {
+				r.Header.Set("If-None-Match", header)
+			} else {
+				r.Header.Del("If-None-Match")
+			}
+		}
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// supportedEncodings are the codings compressHandler offers, preferred first when the
+// client weighs them equally.
+var supportedEncodings = []string{"zstd", "gzip", "deflate"}
+
+// negotiateEncoding picks the supported coding with the highest q-value in an
+// Accept-Encoding header. A coding listed with q=0 is refused even when "*" is accepted.
+func negotiateEncoding(header string) string {
+	weights := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		weights[name] = q
+	}
+	best, bestQ := "", 0.0
+	for _, encoding := range supportedEncodings {
+		q, ok := weights[encoding]
+		if !ok {
+			q = weights["*"]
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// etagForEncoding gives the entity tag of a representation compressed with encoding a
+// suffix, so that caches and If-None-Match tell it apart from the identity and other codings.
+func etagForEncoding(etag, encoding string) string {
+	if !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// ifNoneMatchForEncoding rewrites an If-None-Match header for a handler that tags the
+// identity representation: tags of the encoding representation lose their suffix, and
+// tags of any other representation are dropped so they cannot match.
+func ifNoneMatchForEncoding(header, encoding string) string {
+	suffix := "-" + encoding + `"`
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			tags = append(tags, tag)
+		} else if strings.HasSuffix(tag, suffix) {
+			tags = append(tags, strings.TrimSuffix(tag, suffix)+`"`)
+		}
+	}
+	return strings.Join(tags, ", ")
+}
+
+// compressResponseWriter holds the status until the first write of a body, so that a
+// response without one (1xx, 204, 304 or simply empty) goes out without Content-Encoding.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding    string
+	writer      io.WriteCloser
+	status      int // held by WriteHeader until the header is sent
+	wroteHeader bool
+	passThrough bool
+}
+
+func (c *compressResponseWriter) WriteHeader(status int) {
+	if c.wroteHeader || c.status != 0 {
+		return
+	}
+	if status < http.StatusOK {
+		c.ResponseWriter.WriteHeader(status) // informational; the final status follows
+		return
+	}
+	c.status = status
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		c.sendHeader(false)
+	}
+}
+
+// sendHeader sends the held status, compressing the body that follows when compress is
+// true and the handler did not encode it itself.
+func (c *compressResponseWriter) sendHeader(compress bool) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	c.wroteHeader = true
+	h := c.Header()
+	if h.Get("Content-Encoding") != "" {
+		compress = false
+	} else if etag := h.Get("ETag"); etag != "" && (compress || c.status == http.StatusNotModified) {
+		// A 304 stands for the representation the client would have been sent.
+		h.Set("ETag", etagForEncoding(etag, c.encoding))
+	}
+	if compress {
+		h.Set("Content-Encoding", c.encoding)
+		h.Del("Content-Length")
+	} else {
+		c.passThrough = true
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+}
+
+func (c *compressResponseWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		c.sendHeader(true)
+	}
+	if c.passThrough {
+		return c.ResponseWriter.Write(b)
+	}
+	if c.writer == nil {
+		c.startWriter()
+	}
+	return c.writer.Write(b)
+}
+
+func (c *compressResponseWriter) startWriter() {
+	switch c.encoding {
+	case "zstd":
+		c.writer, _ = zstd.NewWriter(c.ResponseWriter)
+	case "gzip":
+		c.writer = gzip.NewWriter(c.ResponseWriter)
+	default:
+		// Content-Encoding: deflate is the zlib format (RFC 9110), not raw DEFLATE.
+		c.writer = zlib.NewWriter(c.ResponseWriter)
+	}
+}
+
+// Flush lets streaming handlers push compressed data to the client.
+func (c *compressResponseWriter) Flush() {
+	if !c.wroteHeader {
+		c.sendHeader(true)
+	}
+	if f, ok := c.writer.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close ends the compressed stream. A response whose status was set but that wrote no
+// body is sent uncompressed.
+func (c *compressResponseWriter) Close() error {
+	if !c.wroteHeader {
+		if c.status != 0 {
+			c.sendHeader(false)
+		}
+		return nil
+	}
+	if c.passThrough {
+		return nil
+	}
+	if c.writer == nil {
+		c.startWriter() // flushed before any write: the body is an empty stream
+	}
+	return c.writer.Close()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serveCompressed(t *testing.T, handler http.HandlerFunc, acceptEncoding, ifNoneMatch string) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/api/devices", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	rec := httptest.NewRecorder()
+	compressHandler(handler).ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+func TestCompressHandlerETagPerEncoding(t *testing.T) {
+	cached := func(w http.ResponseWriter, r *http.Request) {
+		writeCachedJSON(w, r, []string{"modem-1", "modem-2"})
+	}
+	identity := serveCompressed(t, cached, "", "").Header.Get("ETag")
+	gzipped := serveCompressed(t, cached, "gzip", "")
+	zstded := serveCompressed(t, cached, "zstd", "")
+	if identity == "" || gzipped.Header.Get("ETag") == identity || zstded.Header.Get("ETag") == identity ||
+		gzipped.Header.Get("ETag") == zstded.Header.Get("ETag") {
+		t.Fatalf("ETags identity %s, gzip %s, zstd %s, want three different ones",
+			identity, gzipped.Header.Get("ETag"), zstded.Header.Get("ETag"))
+	}
+	body, err := gzip.NewReader(gzipped.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(body); string(b) != `["modem-1","modem-2"]`+"\n" {
+		t.Errorf("gzip body = %q", b)
+	}
+
+	tests := []struct {
+		name, acceptEncoding, ifNoneMatch string
+		want                              int
+	}{
+		{"gzip tag, gzip request", "gzip", gzipped.Header.Get("ETag"), http.StatusNotModified},
+		{"identity tag, identity request", "", identity, http.StatusNotModified},
+		{"identity tag, gzip request", "gzip", identity, http.StatusOK},
+		{"zstd tag, gzip request", "gzip", zstded.Header.Get("ETag"), http.StatusOK},
+		{"gzip tag among others", "gzip", identity + ", " + gzipped.Header.Get("ETag"), http.StatusNotModified},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := serveCompressed(t, cached, tt.acceptEncoding, tt.ifNoneMatch)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			if resp.StatusCode == http.StatusNotModified {
+				if got := resp.Header.Get("Content-Encoding"); got != "" {
+					t.Errorf("304 has Content-Encoding %q", got)
+				}
+				if got, want := resp.Header.Get("ETag"), gzipped.Header.Get("ETag"); tt.acceptEncoding == "gzip" && got != want {
+					t.Errorf("304 ETag = %s, want %s", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressHandlerSkipsBodylessResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    int
+	}{
+		{"no content", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }, http.StatusNoContent},
+		{"empty ok", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusAccepted) }, http.StatusAccepted},
+		{"empty write", func(w http.ResponseWriter, r *http.Request) { w.Write(nil) }, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := serveCompressed(t, tt.handler, "gzip", "")
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != "" {
+				t.Errorf("Content-Encoding = %q on a response without a body", got)
+			}
+			if b, _ := io.ReadAll(resp.Body); len(b) != 0 {
+				t.Errorf("body = %q, want none", b)
+			}
+		})
+	}
+}
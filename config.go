@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// getEnv returns the value of the environment variable key or def when it is unset or empty.
+func getEnv(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// getEnvInt returns the integer value of key or def when it is unset or invalid.
+func getEnvInt(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid integer for %s=%q, using default %d", key, value, def)
+		return def
+	}
+	return n
+}
+
+// getEnvDuration parses key as a Go duration (e.g. "30s") or returns def when it is unset or invalid.
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration for %s=%q, using default %v", key, value, def)
+		return def
+	}
+	return d
+}
+
+// getEnvAge is getEnvDuration that also accepts whole days, e.g. "30d".
+func getEnvAge(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := parseAge(value)
+	if err != nil || d < 0 {
+		log.Printf("Invalid duration for %s=%q, using default %v", key, value, def)
+		return def
+	}
+	return d
+}
+
+// getEnvFloat returns the float value of key or def when it is unset or invalid.
+func getEnvFloat(key string, def float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Invalid number for %s=%q, using default %v", key, value, def)
+		return def
+	}
+	return f
+}
+
+// getEnvBool returns the boolean value of key (true/false/1/0) or def when it is unset or invalid.
+func getEnvBool(key string, def bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid boolean for %s=%q, using default %v", key, value, def)
+		return def
+	}
+	return b
+}
+
+// getEnvQoS returns the MQTT QoS level (0, 1 or 2) in key or def when it is unset or invalid.
+func getEnvQoS(key string, def byte) byte {
+	qos := getEnvInt(key, int(def))
+	if qos < 0 || qos > 2 {
+		log.Printf("Invalid QoS for %s=%d, using default %d", key, qos, def)
+		return def
+	}
+	return byte(qos)
+}
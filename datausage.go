@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// DATA_USAGE events report the bytes a device sent and received over its SIM:
+//
+//	{"event": "DATA_USAGE", "timestamp": "1718000000", "message": {"sent": 10240, "received": 52311}}
+//	{"event": "DATA_USAGE", "timestamp": "1718000000", "message": "tx=10240,rx=52311"}
+//
+// The bytes are added to the device's daily totals in dataUsageLocation, and the day
+// and month totals (sent plus received) are published on data_usage_daily_<sender> and
+// data_usage_monthly_<sender>. DATA_QUOTA_EXCEEDED (tag data_quota_exceeded_<sender>)
+// is raised while the month total is above the device's quota and cleared once it is
+// not, at the latest with the first report of the next month.
+var (
+	dataQuotaBytes      int64                     // DATA_QUOTA_MB, quota of devices without their own; 0 for none
+	dataUsageCumulative bool                      // DATA_USAGE_COUNTERS=cumulative
+	dataUsageLocation   *time.Location = time.UTC // DATA_USAGE_TIMEZONE, where days and months start
+)
+
+// DataUsageDay is the data one device sent and received on one day.
+type DataUsageDay struct {
+	Day           string `json:"day"`
+	BytesSent     int64  `json:"bytes_sent"`
+	BytesReceived int64  `json:"bytes_received"`
+	Reports       int    `json:"reports"`
+}
+
+// DataUsage is the data one device used in a month, against its quota.
+type DataUsage struct {
+	SenderID      string         `json:"sender_id"`
+	Month         string         `json:"month"`
+	BytesSent     int64          `json:"bytes_sent"`
+	BytesReceived int64          `json:"bytes_received"`
+	QuotaBytes    int64          `json:"quota_bytes,omitempty"`
+	Days          []DataUsageDay `json:"days"`
+}
+
+// DataQuota is the monthly SIM data quota of one device.
+type DataQuota struct {
+	SenderID     string    `json:"sender_id"`
+	MonthlyBytes int64     `json:"monthly_bytes"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// monthBounds returns the first day of the month of at in dataUsageLocation and of the
+// month after it.
+func monthBounds(at time.Time) (start, end time.Time) {
+	y, m, _ := at.In(dataUsageLocation).Date()
+	start = time.Date(y, m, 1, 0, 0, 0, 0, dataUsageLocation)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// recordDataUsage adds a report to the device's daily totals and returns the totals of
+// its day and month, in bytes sent plus received.
+//
+// Devices reporting cumulative counters (DATA_USAGE_COUNTERS=cumulative) send the bytes
+// since they booted instead of since their previous report. The usage is the increase
+// over the last counters, each counter on its own; a counter that went down was reset,
+// so all of it is new. The first counters of a device only set the baseline.
+func recordDataUsage(db *sql.DB, senderID string, at time.Time, sent, received int64) (day, month int64, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to begin data usage transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if dataUsageCumulative {
+		var lastSent, lastReceived int64
+		var lastAt time.Time
+		err = tx.QueryRow("SELECT bytes_sent, bytes_received, reported_at FROM data_usage_counters WHERE sender_id = $1 FOR UPDATE", senderID).
+			Scan(&lastSent, &lastReceived, &lastAt)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, 0, fmt.Errorf("failed to load data usage counters: %v", err)
+		}
+		hasPrevious := err == nil
+		if hasPrevious && !at.After(lastAt) {
+			// Older than the last counters, so already counted.
+			sent, received = 0, 0
+		} else {
+			_, err = tx.Exec(`INSERT INTO data_usage_counters (sender_id, bytes_sent, bytes_received, reported_at) VALUES ($1, $2, $3, $4)
+                ON CONFLICT (sender_id) DO UPDATE SET bytes_sent = EXCLUDED.bytes_sent, bytes_received = EXCLUDED.bytes_received,
+                    reported_at = EXCLUDED.reported_at`,
+				senderID, sent, received, at)
+			if err != nil {
+				return 0, 0, fmt.Errorf("failed to store data usage counters: %v", err)
+			}
+			if hasPrevious {
+				sent, received = counterIncrease(sent, lastSent), counterIncrease(received, lastReceived)
+			} else {
+				sent, received = 0, 0
+			}
+		}
+	}
+
+	err = tx.QueryRow(`INSERT INTO data_usage_daily (sender_id, day, bytes_sent, bytes_received, reports) VALUES ($1, $2, $3, $4, 1)
+        ON CONFLICT (sender_id, day) DO UPDATE SET
+            bytes_sent = data_usage_daily.bytes_sent + EXCLUDED.bytes_sent,
+            bytes_received = data_usage_daily.bytes_received + EXCLUDED.bytes_received,
+            reports = data_usage_daily.reports + 1
+        RETURNING bytes_sent + bytes_received`,
+		senderID, at.In(dataUsageLocation).Format(time.DateOnly), sent, received).Scan(&day)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to update data usage: %v", err)
+	}
+	start, end := monthBounds(at)
+	err = tx.QueryRow(`SELECT COALESCE(SUM(bytes_sent + bytes_received), 0) FROM data_usage_daily
+        WHERE sender_id = $1 AND day >= $2 AND day < $3`,
+		senderID, start.Format(time.DateOnly), end.Format(time.DateOnly)).Scan(&month)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to total data usage: %v", err)
+	}
+	return day, month, tx.Commit()
+}
+
+// counterIncrease returns how much a cumulative counter grew since last. A counter below
+// last was reset, so all of it is new.
+func counterIncrease(current, last int64) int64 {
+	if current >= last {
+		return current - last
+	}
+	return current
+}
+
+// effectiveDataQuota returns the monthly quota of a device: its own, or DATA_QUOTA_MB.
+// 0 means the device has none.
+func effectiveDataQuota(db *sql.DB, senderID string) (int64, error) {
+	var quota int64
+	err := db.QueryRow("SELECT monthly_bytes FROM data_quotas WHERE sender_id = $1", senderID).Scan(&quota)
+	if err == sql.ErrNoRows {
+		return dataQuotaBytes, nil
+	}
+	return quota, err
+}
+
+func handleDataUsageEvent(store Store, messageStr, senderID, event, ingestID string, timestamp int64) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(messageStr), &payload); err != nil {
+		log.Printf("Error unmarshalling %s event message: %v", event, err)
+		return
+	}
+	readings := parseReadings(payload["message"])
+	sent, hasSent := firstReading(readings, "sent", "bytes_sent", "tx", "tx_bytes", "upload")
+	received, hasReceived := firstReading(readings, "received", "bytes_received", "rx", "rx_bytes", "download")
+	if !hasSent && !hasReceived || sent < 0 || received < 0 {
+		log.Printf("[%s] Ignoring %s event from %s: no sent or received bytes in %v", ingestID, event, senderID, payload["message"])
+		return
+	}
+	at := time.UnixMilli(timestamp)
+	day, month, err := store.RecordDataUsage(senderID, at, int64(sent), int64(received))
+	if err == errUnsupported {
+		log.Printf("[%s] Not accumulating %s from %s: %v", ingestID, event, senderID, err)
+		return
+	}
+	if err != nil {
+		log.Printf("[%s] Error recording data usage of %s: %v", ingestID, senderID, err)
+		return
+	}
+	publishReading(store, event, fmt.Sprintf("data_usage_daily_%s", senderID), float64(day), senderID, messageStr, ingestID, timestamp)
+	publishReading(store, event, fmt.Sprintf("data_usage_monthly_%s", senderID), float64(month), senderID, messageStr, ingestID, timestamp)
+
+	quota, err := store.DataQuota(senderID)
+	if err != nil {
+		log.Printf("[%s] Error loading data quota of %s: %v", ingestID, senderID, err)
+		return
+	}
+	start, _ := monthBounds(at)
+	detail := map[string]interface{}{"month": start.Format("2006-01"), "bytes": month, "quota_bytes": quota}
+	setDerivedAlarm(store, "DATA_QUOTA_EXCEEDED", fmt.Sprintf("data_quota_exceeded_%s", senderID), quota > 0 && month > quota,
+		detail, senderID, ingestID, timestamp)
+}
+
+func init() {
+	RegisterHandler(HandleEvents(func(ctx context.Context, store Store, m DeviceMessage) {
+		handleDataUsageEvent(store, string(m.Payload), m.SenderID, m.Event, m.IngestID, m.Timestamp)
+	}, "DATA_USAGE"))
+}
+
+// handleDeviceDataUsage returns a device's data usage in the YYYY-MM month of the month
+// query parameter, the current month by default.
+func handleDeviceDataUsage(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	usage := DataUsage{SenderID: r.PathValue("id"), Days: []DataUsageDay{}}
+	at := clock.Now()
+	if month := r.URL.Query().Get("month"); month != "" {
+		var err error
+		if at, err = time.ParseInLocation("2006-01", month, dataUsageLocation); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid month, expected YYYY-MM")
+			return
+		}
+	}
+	start, end := monthBounds(at)
+	usage.Month = start.Format("2006-01")
+
+	rows, err := db.Query(`SELECT day, bytes_sent, bytes_received, reports FROM data_usage_daily
+        WHERE sender_id = $1 AND day >= $2 AND day < $3 ORDER BY day`,
+		usage.SenderID, start.Format(time.DateOnly), end.Format(time.DateOnly))
+	if err != nil {
+		log.Printf("Error listing data usage: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list data usage")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d DataUsageDay
+		var day time.Time
+		if err := rows.Scan(&day, &d.BytesSent, &d.BytesReceived, &d.Reports); err != nil {
+			log.Printf("Error scanning data usage: %v", err)
+			writeError(w, http.StatusInternalServerError, "failed to list data usage")
+			return
+		}
+		d.Day = day.Format(time.DateOnly)
+		usage.BytesSent += d.BytesSent
+		usage.BytesReceived += d.BytesReceived
+		usage.Days = append(usage.Days, d)
+	}
+	if usage.QuotaBytes, err = effectiveDataQuota(db, usage.SenderID); err != nil {
+		log.Printf("Error loading data quota: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load data quota")
+		return
+	}
+	writeCachedJSON(w, r, usage)
+}
+
+func handleGetDataQuota(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	q := DataQuota{SenderID: r.PathValue("id")}
+	err := db.QueryRow("SELECT monthly_bytes, updated_at FROM data_quotas WHERE sender_id = $1", q.SenderID).
+		Scan(&q.MonthlyBytes, &q.UpdatedAt)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "no data quota for this device")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading data quota: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load data quota")
+		return
+	}
+	writeJSON(w, http.StatusOK, q)
+}
+
+// handlePutDataQuota sets the monthly quota of a device. It is checked from the device's
+// next DATA_USAGE report.
+func handlePutDataQuota(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var q DataQuota
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be a JSON data quota")
+		return
+	}
+	if q.MonthlyBytes <= 0 {
+		writeError(w, http.StatusBadRequest, "monthly_bytes must be positive")
+		return
+	}
+	q.SenderID, q.UpdatedAt = r.PathValue("id"), clock.Now()
+	_, err := db.Exec(`INSERT INTO data_quotas (sender_id, monthly_bytes, updated_at) VALUES ($1, $2, $3)
+        ON CONFLICT (sender_id) DO UPDATE SET monthly_bytes = EXCLUDED.monthly_bytes, updated_at = EXCLUDED.updated_at`,
+		q.SenderID, q.MonthlyBytes, q.UpdatedAt)
+	if err != nil {
+		log.Printf("Error saving data quota: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to save data quota")
+		return
+	}
+	writeJSON(w, http.StatusOK, q)
+}
+
+func handleDeleteDataQuota(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	res, err := db.Exec("DELETE FROM data_quotas WHERE sender_id = $1", r.PathValue("id"))
+	if err != nil {
+		log.Printf("Error deleting data quota: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to delete data quota")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeError(w, http.StatusNotFound, "no data quota for this device")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRecordDataUsageCumulative(t *testing.T) {
+	saved := dataUsageCumulative
+	dataUsageCumulative = true
+	t.Cleanup(func() { dataUsageCumulative = saved })
+
+	at := time.Date(2026, 3, 14, 10, 0, 0, 0, time.UTC)
+	type counters struct{ sent, received int64 }
+	tests := []struct {
+		name         string
+		last         *counters // nil when the device has no counters yet
+		lastAt       time.Time
+		report       counters
+		wantAdded    counters
+		storeCounter bool
+	}{
+		{"baseline only", nil, time.Time{}, counters{5000, 9000}, counters{0, 0}, true},
+		{"increase", &counters{5000, 9000}, at.Add(-time.Hour), counters{5600, 9900}, counters{600, 900}, true},
+		{"both reset", &counters{5000, 9000}, at.Add(-time.Hour), counters{300, 700}, counters{300, 700}, true},
+		{"received reset", &counters{5000, 9000}, at.Add(-time.Hour), counters{5600, 700}, counters{600, 700}, true},
+		{"sent reset", &counters{5000, 9000}, at.Add(-time.Hour), counters{300, 9900}, counters{300, 900}, true},
+		{"out of order", &counters{5000, 9000}, at.Add(time.Minute), counters{4000, 8000}, counters{0, 0}, false},
+		{"same time", &counters{5000, 9000}, at, counters{5000, 9000}, counters{0, 0}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := mockDB(t)
+			mock.ExpectBegin()
+			load := mock.ExpectQuery(`SELECT bytes_sent, bytes_received, reported_at FROM data_usage_counters`).WithArgs("modem-1")
+			if tt.last == nil {
+				load.WillReturnError(sql.ErrNoRows)
+			} else {
+				load.WillReturnRows(sqlmock.NewRows([]string{"bytes_sent", "bytes_received", "reported_at"}).
+					AddRow(tt.last.sent, tt.last.received, tt.lastAt))
+			}
+			if tt.storeCounter {
+				mock.ExpectExec(`INSERT INTO data_usage_counters`).
+					WithArgs("modem-1", tt.report.sent, tt.report.received, at).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			mock.ExpectQuery(`INSERT INTO data_usage_daily`).
+				WithArgs("modem-1", "2026-03-14", tt.wantAdded.sent, tt.wantAdded.received).
+				WillReturnRows(sqlmock.NewRows([]string{"total"}).AddRow(tt.wantAdded.sent + tt.wantAdded.received))
+			mock.ExpectQuery(`FROM data_usage_daily`).
+				WithArgs("modem-1", "2026-03-01", "2026-04-01").
+				WillReturnRows(sqlmock.NewRows([]string{"total"}).AddRow(int64(123456)))
+			mock.ExpectCommit()
+
+			day, month, err := recordDataUsage(db, "modem-1", at, tt.report.sent, tt.report.received)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.wantAdded.sent + tt.wantAdded.received; day != want || month != 123456 {
+				t.Errorf("recordDataUsage = %d, %d, want %d, 123456", day, month, want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
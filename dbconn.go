@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Postgres connection settings beyond the DB_HOST/DB_PORT/... basics:
+//
+//   - DB_URL: a full connection string, either postgres://user@host/db?sslmode=verify-full
+//     or key=value pairs, used instead of the DB_* parts.
+//   - DB_SSLROOTCERT, DB_SSLCERT, DB_SSLKEY: certificates for sslmode=verify-ca/verify-full
+//     and client certificate authentication.
+//   - DB_PASSWORD_FILE: read the password from a file (Docker or Kubernetes secrets, or a
+//     file kept current by a secrets agent), re-read for every new connection.
+//   - DB_PASSWORD_COMMAND: run a command for the password, e.g. an IAM token from
+//     "aws rds generate-db-auth-token" or "gcloud sql generate-login-token"; the result is
+//     reused for DB_PASSWORD_TTL, which must be shorter than the token's lifetime.
+//
+// A password from a file or command overrides DB_PASSWORD and one embedded in DB_URL.
+
+// connectionBase returns the connection string without the password.
+func connectionBase() (string, error) {
+	if dsn := os.Getenv("DB_URL"); dsn != "" {
+		if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+			return pq.ParseURL(dsn)
+		}
+		return dsn, nil
+	}
+	parts := []string{
+		"host=" + dsnQuote(dbHost),
+		"port=" + dsnQuote(dbPort),
+		"user=" + dsnQuote(dbUser),
+		"dbname=" + dsnQuote(dbName),
+		"sslmode=" + dsnQuote(dbSSLMode),
+	}
+	for _, opt := range []struct{ key, env string }{{"sslrootcert", "DB_SSLROOTCERT"}, {"sslcert", "DB_SSLCERT"}, {"sslkey", "DB_SSLKEY"}} {
+		if value := os.Getenv(opt.env); value != "" {
+			parts = append(parts, opt.key+"="+dsnQuote(value))
+		}
+	}
+	return strings.Join(parts, " "), nil
+}
+
+// dsnQuote quotes a value for a key=value connection string.
+func dsnQuote(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// dsnValue returns the value of key in a key=value connection string, or "".
+func dsnValue(dsn, key string) string {
+	for _, field := range strings.Fields(dsn) {
+		if value, ok := strings.CutPrefix(field, key+"="); ok {
+			return strings.Trim(value, "'")
+		}
+	}
+	return ""
+}
+
+// passwordSource returns the password for a new connection; "" means none.
+type passwordSource func() (string, error)
+
+func newPasswordSource() passwordSource {
+	if command := os.Getenv("DB_PASSWORD_COMMAND"); command != "" {
+		return cachedPassword(getEnvDuration("DB_PASSWORD_TTL", 10*time.Minute), func() (string, error) {
+			out, err := exec.Command("sh", "-c", command).Output()
+			if err != nil {
+				return "", fmt.Errorf("DB_PASSWORD_COMMAND failed: %v", err)
+			}
+			return strings.TrimSpace(string(out)), nil
+		})
+	}
+	if path := os.Getenv("DB_PASSWORD_FILE"); path != "" {
+		return func() (string, error) {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return "", fmt.Errorf("failed to read DB_PASSWORD_FILE: %v", err)
+			}
+			return strings.TrimSpace(string(b)), nil
+		}
+	}
+	return func() (string, error) { return dbPassword, nil }
+}
+
+// cachedPassword reuses the result of fetch for ttl.
+func cachedPassword(ttl time.Duration, fetch passwordSource) passwordSource {
+	var mu sync.Mutex
+	var password string
+	var expires time.Time
+	return func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if password != "" && clock.Now().Before(expires) {
+			return password, nil
+		}
+		p, err := fetch()
+		if err != nil {
+			return "", err
+		}
+		password, expires = p, clock.Now().Add(ttl)
+		return password, nil
+	}
+}
+
+// pgConnector builds the connection string with a current password for every new
+// connection, so rotated secrets and short-lived IAM tokens are picked up.
+type pgConnector struct {
+	base     string
+	password passwordSource
+}
+
+func (c *pgConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	dsn := c.base
+	password, err := c.password()
+	if err != nil {
+		return nil, err
+	}
+	if password != "" {
+		// The last occurrence of a key wins.
+		dsn += " password=" + dsnQuote(password)
+	}
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
+
+func (c *pgConnector) Driver() driver.Driver { return &pq.Driver{} }
+
+// openPostgres returns a database handle using the connection settings above.
+func openPostgres() (*sql.DB, error) {
+	base, err := connectionBase()
+	if err != nil {
+		return nil, fmt.Errorf("invalid DB_URL: %v", err)
+	}
+	return sql.OpenDB(&pgConnector{base: base, password: newPasswordSource()}), nil
+}
+
+// effectiveSSLMode is the sslmode the connection will use; lib/pq defaults to require.
+func effectiveSSLMode() string {
+	base, err := connectionBase()
+	if err != nil {
+		return ""
+	}
+	if mode := dsnValue(base, "sslmode"); mode != "" {
+		return mode
+	}
+	return "require"
+}
+
+// dbPasswordConfigured reports whether any password source is set.
+func dbPasswordConfigured() bool {
+	if dbPassword != "" || os.Getenv("DB_PASSWORD_FILE") != "" || os.Getenv("DB_PASSWORD_COMMAND") != "" {
+		return true
+	}
+	base, err := connectionBase()
+	return err == nil && dsnValue(base, "password") != ""
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	dbHealthChecks = newCounterVec("collector_db_health_checks_total", "Periodic database pings, by result.", "result")
+	dbReconnects   = newCounterVec("collector_db_reconnects_total", "Times the database became reachable again after failed pings.", "database")
+	dbPoolStats    = newGaugeVec("collector_db_pool", "database/sql connection pool statistics.", "stat")
+	dbUp           atomic.Bool
+)
+
+func init() {
+	newGaugeFunc("collector_db_up", "1 while the last database ping succeeded.", func() float64 {
+		if dbUp.Load() {
+			return 1
+		}
+		return 0
+	})
+}
+
+// configurePool applies the connection pool settings. Unset values keep the
+// database/sql defaults: unlimited open connections, 2 idle, no lifetime limits.
+func configurePool(db *sql.DB) {
+	db.SetMaxOpenConns(getEnvInt("DB_MAX_OPEN_CONNS", 0))
+	db.SetMaxIdleConns(getEnvInt("DB_MAX_IDLE_CONNS", 2))
+	db.SetConnMaxLifetime(getEnvDuration("DB_CONN_MAX_LIFETIME", 0))
+	db.SetConnMaxIdleTime(getEnvDuration("DB_CONN_MAX_IDLE_TIME", 0))
+}
+
+// startDBHealthCheck pings the database every interval so a dead connection or an
+// unreachable server is noticed, and reported, before an insert fails on it.
+func startDBHealthCheck(db *sql.DB, interval, timeout time.Duration) {
+	dbUp.Store(true) // setupDatabase has just used the connection
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			<-clock.After(interval)
+			checkDBHealth(db, timeout)
+		}
+	}()
+}
+
+func checkDBHealth(db *sql.DB, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	err := db.PingContext(ctx)
+	cancel()
+	if err != nil {
+		dbHealthChecks.Inc("error")
+		if dbUp.Swap(false) {
+			log.Printf("Database health check failed: %v", err)
+		}
+	} else {
+		dbHealthChecks.Inc("ok")
+		if !dbUp.Swap(true) {
+			dbReconnects.Inc(dbName)
+			log.Printf("Database reachable again")
+			// Deliver what was spooled during the outage without waiting for the next round.
+			if outbox != nil {
+				go outbox.Replay()
+			}
+		}
+	}
+
+	stats := db.Stats()
+	dbPoolStats.Set("open", float64(stats.OpenConnections))
+	dbPoolStats.Set("in_use", float64(stats.InUse))
+	dbPoolStats.Set("idle", float64(stats.Idle))
+	dbPoolStats.Set("wait_count", float64(stats.WaitCount))
+	dbPoolStats.Set("wait_seconds", stats.WaitDuration.Seconds())
+	dbPoolStats.Set("max_idle_closed", float64(stats.MaxIdleClosed))
+	dbPoolStats.Set("max_idle_time_closed", float64(stats.MaxIdleTimeClosed))
+	dbPoolStats.Set("max_lifetime_closed", float64(stats.MaxLifetimeClosed))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned without touching the database while the breaker is open.
+var errCircuitOpen = errors.New("database circuit breaker open")
+
+var dbRetries = newCounterVec("collector_db_retries_total", "Database writes retried after a failure, by outcome.", "outcome")
+
+// Database write retry settings (DB_RETRY_ATTEMPTS, DB_RETRY_BASE, DB_RETRY_MAX).
+var (
+	dbRetryAttempts = 3
+	dbRetryBase     = 100 * time.Millisecond
+	dbRetryMax      = 2 * time.Second
+)
+
+// circuitBreaker stops database writes after threshold consecutive failed writes. Once
+// cooldown has passed a single trial write is let through; its success closes the
+// breaker again, its failure reopens it. While open, writes go straight to the spool
+// instead of piling up retries against a database that is down.
+type circuitBreaker struct {
+	name      string // for logs, e.g. "Database"
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+var dbBreaker = newCircuitBreaker(5, 30*time.Second)
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	b := &circuitBreaker{name: "Database", threshold: threshold, cooldown: cooldown}
+	newGaugeFunc("collector_db_circuit_open", "1 while the database circuit breaker is open.", func() float64 {
+		if b.Open() {
+			return 1
+		}
+		return 0
+	})
+	return b
+}
+
+// Open reports whether writes are currently being refused.
+func (b *circuitBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold && clock.Now().Before(b.openUntil)
+}
+
+// Allow reports whether a write may be attempted.
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if clock.Now().Before(b.openUntil) || b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures >= b.threshold {
+		log.Printf("%s circuit breaker closed", b.name)
+	}
+	b.failures, b.trial = 0, false
+}
+
+func (b *circuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.trial = false
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			log.Printf("%s circuit breaker opened after %d consecutive failures", b.name, b.failures)
+		}
+		b.openUntil = clock.Now().Add(b.cooldown)
+	}
+}
+
+// Trip opens the breaker at once, for failures that will not go away by retrying.
+func (b *circuitBreaker) Trip() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		log.Printf("%s circuit breaker opened", b.name)
+	}
+	b.failures = max(b.failures, b.threshold)
+	b.trial = false
+	b.openUntil = clock.Now().Add(b.cooldown)
+}
+
+// withDBRetry runs write up to attempts times with jittered exponential backoff, unless
+// the circuit breaker is open. The caller hands the data to the spool when it fails.
+func withDBRetry(attempts int, write func() error) error {
+	if !dbBreaker.Allow() {
+		return errCircuitOpen
+	}
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			// Full jitter keeps collectors that failed together from retrying together.
+			backoff := min(dbRetryBase<<(attempt-1), dbRetryMax)
+			<-clock.After(time.Duration(rand.Int63n(int64(backoff) + 1)))
+		}
+		if err = write(); err == nil {
+			if attempt > 0 {
+				dbRetries.Inc("recovered")
+			}
+			dbBreaker.Success()
+			return nil
+		}
+		if permanentDBError(err) {
+			// The database is up and rejected the data; retrying will not help. It still
+			// counts as a success for the breaker, or a rejected trial write would leave it
+			// half-open for good.
+			dbBreaker.Success()
+			return err
+		}
+	}
+	if attempts > 1 {
+		dbRetries.Inc("exhausted")
+	}
+	dbBreaker.Failure()
+	return err
+}
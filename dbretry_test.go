@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// useDBBreaker replaces dbBreaker for the test.
+func useDBBreaker(t *testing.T, threshold int, cooldown time.Duration) *circuitBreaker {
+	t.Helper()
+	saved := dbBreaker
+	dbBreaker = &circuitBreaker{name: "Database", threshold: threshold, cooldown: cooldown}
+	t.Cleanup(func() { dbBreaker = saved })
+	return dbBreaker
+}
+
+func TestWithDBRetryPermanentTrialClosesBreaker(t *testing.T) {
+	c := useFakeClock(t)
+	b := useDBBreaker(t, 2, 30*time.Second)
+	down := errors.New("connection refused")
+	for range 2 {
+		if err := withDBRetry(1, func() error { return down }); err != down {
+			t.Fatalf("withDBRetry = %v, want %v", err, down)
+		}
+	}
+	if err := withDBRetry(1, func() error { return nil }); err != errCircuitOpen {
+		t.Fatalf("withDBRetry while open = %v, want errCircuitOpen", err)
+	}
+
+	c.Advance(30 * time.Second)
+	rejected := &pq.Error{Code: "23505"}
+	if err := withDBRetry(1, func() error { return rejected }); err != rejected {
+		t.Fatalf("trial withDBRetry = %v, want the permanent error", err)
+	}
+	if !b.Allow() {
+		t.Fatal("breaker still refuses writes after a permanent error on the trial write")
+	}
+	if err := withDBRetry(1, func() error { return nil }); err != nil {
+		t.Errorf("withDBRetry after the trial = %v, want nil", err)
+	}
+}
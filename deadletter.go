@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Dead letters are messages the pipeline gave up on: payloads that could not be
+// decoded, messages without a usable timestamp, and events the database rejected. They
+// are kept in dead_letter with the failure reason so they can be reprocessed once the
+// decoder, device firmware or schema has been fixed.
+const (
+	deadLetterDecode    = "decode"    // payload as received from the broker
+	deadLetterTimestamp = "timestamp" // decoded payload
+	deadLetterStore     = "store"     // the EventMessage that failed to insert, as JSON
+)
+
+var deadLetters = newCounterVec("collector_dead_letters_total", "Messages written to the dead_letter table, by stage.", "stage")
+
+var reprocessDeadLettersFlag = flag.String("reprocess-dead-letters", "", `after connecting, reprocess the pending dead letters of this stage ("decode", "timestamp", "store" or "all")`)
+
+// resubmit hands reprocessed messages to the worker pool so they keep per-device
+// ordering with live traffic. It is set once the pool is running.
+var resubmit func(inboundMessage)
+
+// deadLetter records msg as failed at stage.
+func deadLetter(store Store, msg inboundMessage, stage string, cause error) {
+	deadLetters.Inc(stage)
+	if err := store.DeadLetter(msg, stage, cause); err != nil {
+		log.Printf("[%s] Error saving dead letter: %v", msg.IngestID, err)
+	}
+}
+
+// deadLetterEvent records an event the database rejected. It reports false when the
+// event could not be recorded either, so the caller can fall back to the spool.
+func deadLetterEvent(store Store, data EventMessage, cause error) bool {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("[%s] Failed to marshal dead letter: %v", data.IngestID, err)
+		return false
+	}
+	deadLetters.Inc(deadLetterStore)
+	msg := inboundMessage{SenderID: data.Sumber, IngestID: data.IngestID, Payload: payload, ReceivedAt: clock.Now()}
+	if err := store.DeadLetter(msg, deadLetterStore, cause); err != nil {
+		log.Printf("[%s] Error saving dead letter: %v", data.IngestID, err)
+		return false
+	}
+	return true
+}
+
+// permanentDBError reports whether err is a rejection of the data itself (a data
+// exception or constraint violation) that retrying or spooling will not fix.
+func permanentDBError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		class := pqErr.Code.Class()
+		return class == "22" || class == "23"
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		class := string(mysqlErr.SQLState[:2])
+		return class == "22" || class == "23"
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrConstraint || sqliteErr.Code == sqlite3.ErrMismatch || sqliteErr.Code == sqlite3.ErrTooBig
+	}
+	return false
+}
+
+func validDeadLetterStage(stage string) bool {
+	switch stage {
+	case "", "all", deadLetterDecode, deadLetterTimestamp, deadLetterStore:
+		return true
+	}
+	return false
+}
+
+// DeadLetter is a row of dead_letter.
+type DeadLetter struct {
+	ID            int64      `json:"id"`
+	IngestID      string     `json:"ingest_id,omitempty"`
+	SenderID      string     `json:"sender_id"`
+	Topic         string     `json:"topic,omitempty"`
+	Stage         string     `json:"stage"`
+	Payload       string     `json:"payload"`
+	Error         string     `json:"error"`
+	ReceivedAt    time.Time  `json:"received_at"`
+	FailedAt      time.Time  `json:"failed_at"`
+	ReprocessedAt *time.Time `json:"reprocessed_at,omitempty"`
+}
+
+// queryDeadLetters lists the pending dead letters of stage ("all" or "" for every
+// stage), oldest first; id limits the result to one row.
+func queryDeadLetters(db *sql.DB, stage string, id int64, limit int) ([]DeadLetter, error) {
+	where := "reprocessed_at IS NULL"
+	var args []interface{}
+	if stage != "" && stage != "all" {
+		args = append(args, stage)
+		where += fmt.Sprintf(" AND stage = $%d", len(args))
+	}
+	if id != 0 {
+		args = append(args, id)
+		where += fmt.Sprintf(" AND id = $%d", len(args))
+	}
+	args = append(args, limit)
+	rows, err := db.Query(fmt.Sprintf(`SELECT id, COALESCE(ingest_id, ''), sender_id, topic, stage, payload, error, received_at, failed_at, reprocessed_at
+		FROM dead_letter WHERE %s ORDER BY id LIMIT $%d`, where, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	letters := []DeadLetter{}
+	for rows.Next() {
+		var d DeadLetter
+		var payload []byte
+		if err := rows.Scan(&d.ID, &d.IngestID, &d.SenderID, &d.Topic, &d.Stage, &payload, &d.Error, &d.ReceivedAt, &d.FailedAt, &d.ReprocessedAt); err != nil {
+			return nil, err
+		}
+		d.Payload = string(payload)
+		letters = append(letters, d)
+	}
+	return letters, rows.Err()
+}
+
+// reprocessDeadLetters feeds pending dead letters back into the pipeline and marks them
+// reprocessed. A message that fails again is dead-lettered anew with the new error.
+func reprocessDeadLetters(db *sql.DB, stage string, id int64, limit int) (int, error) {
+	letters, err := queryDeadLetters(db, stage, id, limit)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, d := range letters {
+		// Mark first so that a failure while reprocessing is recorded as a new row rather
+		// than retried forever.
+		res, err := db.Exec("UPDATE dead_letter SET reprocessed_at = $1 WHERE id = $2 AND reprocessed_at IS NULL", clock.Now(), d.ID)
+		if err != nil {
+			return count, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue // reprocessed concurrently
+		}
+		if d.Stage == deadLetterStore {
+			var data EventMessage
+			if err := json.Unmarshal([]byte(d.Payload), &data); err != nil {
+				log.Printf("Discarding corrupt dead letter %d: %v", d.ID, err)
+				continue
+			}
+			processAndSaveDirect(eventStore, data)
+		} else {
+			msg := inboundMessage{Topic: d.Topic, SenderID: d.SenderID, IngestID: d.IngestID, Payload: []byte(d.Payload), ReceivedAt: d.ReceivedAt, Reprocessed: true}
+			if resubmit != nil {
+				resubmit(msg)
+			} else {
+				processMessage(eventStore, msg)
+			}
+		}
+		log.Printf("[%s] Reprocessing dead letter %d (%s)", d.IngestID, d.ID, d.Stage)
+		count++
+	}
+	return count, nil
+}
+
+func handleListDeadLetters(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	if !validDeadLetterStage(r.URL.Query().Get("stage")) {
+		writeError(w, http.StatusBadRequest, "unknown stage")
+		return
+	}
+	letters, err := queryDeadLetters(db, r.URL.Query().Get("stage"), 0, queryLimit(r, 100, 1000))
+	if err != nil {
+		log.Printf("Error listing dead letters: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list dead letters")
+		return
+	}
+	writeJSON(w, http.StatusOK, letters)
+}
+
+// handleReprocessDeadLetters reprocesses the pending dead letters selected by the stage
+// and id query parameters, up to limit.
+func handleReprocessDeadLetters(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	if !validDeadLetterStage(r.URL.Query().Get("stage")) {
+		writeError(w, http.StatusBadRequest, "unknown stage")
+		return
+	}
+	var id int64
+	if value := r.URL.Query().Get("id"); value != "" {
+		var err error
+		if id, err = strconv.ParseInt(value, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid id")
+			return
+		}
+	}
+	count, err := reprocessDeadLetters(db, r.URL.Query().Get("stage"), id, queryLimit(r, 1000, 10000))
+	if err != nil {
+		log.Printf("Error reprocessing dead letters: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to reprocess dead letters")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"reprocessed": count})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Alarm datapoints of mappings with debounce set go through alarmGate before they are
+// published; they are stored as they arrive either way. An alarm (any value but 0) is
+// only published once it has lasted alarmDebounce: a clear within that time drops both.
+// A tag that toggles flapThreshold times within flapWindow is flapping: one FLAPPING
+// datapoint (value 1, tag flapping_<tag>) replaces the toggles, and once the tag has
+// been quiet for flapWindow a FLAPPING clear is published with its final value. A tag
+// with nothing pending is forgotten once it has been quiet for the longer of both.
+var (
+	alarmDebounce time.Duration
+	flapWindow    time.Duration
+	flapThreshold = 5
+)
+
+var alarmsSuppressed = newCounterVec("collector_alarms_suppressed_total", "Alarm and clear datapoints not published because the alarm was shorter than ALARM_DEBOUNCE or the tag was flapping, by reason.", "reason")
+
+var alarmGate = &alarmDebouncer{tags: map[string]*alarmTag{}}
+
+type alarmDebouncer struct {
+	mu   sync.Mutex
+	tags map[string]*alarmTag
+}
+
+// alarmTag is the debounce state of one datapoint tag.
+type alarmTag struct {
+	published string        // last published value, "" before the first
+	last      string        // last value received
+	pending   *EventMessage // alarm waiting for alarmDebounce, or final value while flapping
+	timer     Timer
+	armed     int // counts arm calls, so a timer that fired as it was replaced does nothing
+	toggles   []time.Time
+	flapping  bool
+}
+
+// publish sends data now, later, or not at all.
+func (d *alarmDebouncer) publish(data EventMessage) {
+	if alarmDebounce <= 0 && flapWindow <= 0 {
+		sendDataPoint(data)
+		return
+	}
+	// Datapoints are sent after d.mu is released, so a slow broker only holds up the
+	// caller and not the alarms of every other device.
+	for _, dp := range d.admit(data) {
+		sendDataPoint(dp)
+	}
+}
+
+// admit updates the debounce state of data's tag and returns the datapoints to send now.
+func (d *alarmDebouncer) admit(data EventMessage) []EventMessage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t := d.tags[data.Tag]
+	if t == nil {
+		t = &alarmTag{}
+		d.tags[data.Tag] = t
+	}
+	value := fmt.Sprint(data.Value)
+	now := clock.Now()
+
+	if flapWindow > 0 && t.last != "" && value != t.last {
+		t.toggles = append(t.toggles, now)
+		for len(t.toggles) > 0 && now.Sub(t.toggles[0]) > flapWindow {
+			t.toggles = t.toggles[1:]
+		}
+	}
+	t.last = value
+
+	if t.flapping || (flapWindow > 0 && len(t.toggles) >= flapThreshold) {
+		var out []EventMessage
+		if !t.flapping {
+			t.flapping = true
+			log.Printf("[%s] %s is flapping: %d changes within %v", data.IngestID, data.Tag, len(t.toggles), flapWindow)
+			out = append(out, flappingDataPoint(data, 1))
+		}
+		alarmsSuppressed.Inc("flapping")
+		t.pending = &data
+		d.arm(data.Tag, t, flapWindow)
+		return out
+	}
+
+	if value != "0" && alarmDebounce > 0 && value != t.published {
+		if t.pending == nil {
+			t.pending = &data
+			d.arm(data.Tag, t, alarmDebounce)
+		}
+		return nil
+	}
+	if t.pending != nil {
+		// The alarm cleared before it lasted alarmDebounce; publish neither.
+		log.Printf("[%s] %s cleared within %v, not publishing the alarm", data.IngestID, data.Tag, alarmDebounce)
+		t.pending = nil
+		d.arm(data.Tag, t, alarmForgetAfter())
+		alarmsSuppressed.Add("debounce", 2)
+		return nil
+	}
+	t.published = value
+	d.arm(data.Tag, t, alarmForgetAfter())
+	return []EventMessage{data}
+}
+
+// alarmForgetAfter is how long the state of a tag with nothing pending is kept, so that
+// its changes still count towards flapping, before the tag is forgotten.
+func alarmForgetAfter() time.Duration {
+	return max(flapWindow, alarmDebounce)
+}
+
+// arm (re)starts the timer of the tag; t must belong to d and d.mu be held.
+func (d *alarmDebouncer) arm(tag string, t *alarmTag, after time.Duration) {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.armed++
+	armed := t.armed
+	t.timer = clock.AfterFunc(after, func() {
+		for _, dp := range d.expire(tag, t, armed) {
+			sendDataPoint(dp)
+		}
+	})
+}
+
+// expire returns the pending datapoint of a tag whose alarm lasted alarmDebounce, or
+// the end of its flapping. A tag with nothing pending has been quiet long enough to be
+// forgotten.
+func (d *alarmDebouncer) expire(tag string, t *alarmTag, armed int) []EventMessage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.tags[tag] != t || t.armed != armed {
+		return nil
+	}
+	t.timer = nil
+	if t.pending == nil {
+		delete(d.tags, tag)
+		return nil
+	}
+	data := *t.pending
+	t.pending = nil
+	var out []EventMessage
+	if t.flapping {
+		t.flapping, t.toggles = false, nil
+		log.Printf("[%s] %s stopped flapping", data.IngestID, tag)
+		out = append(out, flappingDataPoint(data, 0))
+	}
+	if value := fmt.Sprint(data.Value); value != t.published {
+		t.published = value
+		out = append(out, data)
+	}
+	d.arm(tag, t, alarmForgetAfter())
+	return out
+}
+
+func flappingDataPoint(data EventMessage, value int) EventMessage {
+	data.EventName = "FLAPPING"
+	data.Tag = "flapping_" + data.Tag
+	data.Value = value
+	data.Time = clock.Now().UnixMilli()
+	return data
+}
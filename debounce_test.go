@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// useAlarmGate sets the debounce and flapping limits and returns a fresh debouncer.
+func useAlarmGate(t *testing.T, debounce, window time.Duration, threshold int) *alarmDebouncer {
+	t.Helper()
+	savedDebounce, savedWindow, savedThreshold := alarmDebounce, flapWindow, flapThreshold
+	alarmDebounce, flapWindow, flapThreshold = debounce, window, threshold
+	t.Cleanup(func() { alarmDebounce, flapWindow, flapThreshold = savedDebounce, savedWindow, savedThreshold })
+	return &alarmDebouncer{tags: map[string]*alarmTag{}}
+}
+
+// alarm is an alarm datapoint of modem-1 with value.
+func alarm(value int) EventMessage {
+	return EventMessage{EventName: "ALARM_TEMPERATURE", Tag: "alarm_temperature_modem-1", Value: value, Status: true, Sumber: "modem-1"}
+}
+
+// publishedAlarms returns the tags and values published on DATAPOINTS, e.g.
+// "alarm_temperature_modem-1=1".
+func publishedAlarms(t *testing.T, b *recordingBroker) []string {
+	t.Helper()
+	var out []string
+	for _, m := range b.Messages("DATAPOINTS") {
+		var payload map[string]interface{}
+		if err := json.Unmarshal(m.Payload, &payload); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, fmt.Sprintf("%v=%v", payload["tag"], payload["value"]))
+	}
+	return out
+}
+
+func TestAlarmDebounce(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []interface{} // an alarm value to publish or a time.Duration to advance
+		want  []string
+	}{
+		{"cleared within the debounce", []interface{}{1, 10 * time.Second, 0, time.Minute}, nil},
+		{"lasted the debounce", []interface{}{1, 30 * time.Second, 0},
+			[]string{"alarm_temperature_modem-1=1", "alarm_temperature_modem-1=0"}},
+		{"repeated alarm keeps the first deadline", []interface{}{1, 20 * time.Second, 1, 10 * time.Second},
+			[]string{"alarm_temperature_modem-1=1"}},
+		{"clear without alarm", []interface{}{0}, []string{"alarm_temperature_modem-1=0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := useFakeClock(t)
+			d := useAlarmGate(t, 30*time.Second, 0, 5)
+			b := captureBroker(t)
+			for _, step := range tt.steps {
+				switch step := step.(type) {
+				case int:
+					d.publish(alarm(step))
+				case time.Duration:
+					c.Advance(step)
+				}
+			}
+			if got := publishedAlarms(t, b); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("published %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlarmFlappingCollapsesAndClears(t *testing.T) {
+	c := useFakeClock(t)
+	d := useAlarmGate(t, 0, time.Minute, 3)
+	b := captureBroker(t)
+	for _, value := range []int{1, 0, 1, 0, 1, 0} {
+		d.publish(alarm(value))
+		c.Advance(time.Second)
+	}
+	want := []string{
+		"alarm_temperature_modem-1=1", "alarm_temperature_modem-1=0", "alarm_temperature_modem-1=1",
+		"flapping_alarm_temperature_modem-1=1",
+	}
+	if got := publishedAlarms(t, b); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("while flapping published %v, want %v", got, want)
+	}
+
+	// Quiet for the flap window: the flapping clears with the final value.
+	c.Advance(time.Minute)
+	want = append(want, "flapping_alarm_temperature_modem-1=0", "alarm_temperature_modem-1=0")
+	if got := publishedAlarms(t, b); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("after flapping published %v, want %v", got, want)
+	}
+}
+
+func TestAlarmDebouncerForgetsQuietTags(t *testing.T) {
+	c := useFakeClock(t)
+	d := useAlarmGate(t, 30*time.Second, time.Minute, 3)
+	captureBroker(t)
+	d.publish(alarm(1))
+	c.Advance(30 * time.Second)
+	d.publish(alarm(0))
+	if len(d.tags) != 1 {
+		t.Fatalf("%d tags remembered right after the clear, want 1", len(d.tags))
+	}
+	c.Advance(time.Minute)
+	if len(d.tags) != 0 {
+		t.Errorf("%d tags remembered after a quiet flap window, want 0", len(d.tags))
+	}
+	if n := c.timers(); n != 0 {
+		t.Errorf("%d timers left, want 0", n)
+	}
+}
+
+// lockCheckingBroker records whether the debouncer's lock was held during a publish.
+type lockCheckingBroker struct {
+	recordingBroker
+	gate      *alarmDebouncer
+	publishes int
+	underLock int
+}
+
+func (b *lockCheckingBroker) PublishWithExpiry(topic string, qos byte, retained bool, payload []byte, expiry time.Duration) error {
+	b.publishes++
+	if b.gate.mu.TryLock() {
+		b.gate.mu.Unlock()
+	} else {
+		b.underLock++
+	}
+	return nil
+}
+
+func TestAlarmDebouncerPublishesWithoutLock(t *testing.T) {
+	c := useFakeClock(t)
+	d := useAlarmGate(t, 30*time.Second, time.Minute, 2)
+	b := &lockCheckingBroker{gate: d}
+	saved := mqttClient
+	mqttClient = b
+	t.Cleanup(func() { mqttClient = saved })
+
+	d.publish(alarm(0))
+	d.publish(alarm(1))
+	c.Advance(30 * time.Second) // the alarm lasted the debounce
+	d.publish(alarm(0))
+	d.publish(alarm(1)) // flapping
+	c.Advance(time.Minute)
+	if b.publishes < 4 || b.underLock != 0 {
+		t.Errorf("%d of %d datapoints published holding the debouncer lock", b.underLock, b.publishes)
+	}
+}
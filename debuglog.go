@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Payload logging. With LOG_PAYLOADS=false inbound payloads are only logged for the
+// devices that have payload debugging enabled through the API, until it expires. The
+// setting is kept in memory by the instance that received the request.
+var (
+	logAllPayloads  = true
+	payloadDebugTTL = 30 * time.Minute // DEBUG_PAYLOAD_TTL, when the request gives none
+)
+
+// maxPayloadDebugTTL keeps a forgotten debug session from logging payloads for days.
+const maxPayloadDebugTTL = 24 * time.Hour
+
+var payloadDebug = &debugSessions{until: map[string]time.Time{}}
+
+type debugSessions struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+// DebugSession is a device with payload logging enabled.
+type DebugSession struct {
+	SenderID string    `json:"sender_id"`
+	Until    time.Time `json:"until"`
+}
+
+func (d *debugSessions) Enable(senderID string, ttl time.Duration) time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	until := clock.Now().Add(ttl)
+	d.until[senderID] = until
+	return until
+}
+
+func (d *debugSessions) Disable(senderID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.until[senderID]
+	delete(d.until, senderID)
+	return ok
+}
+
+// Active reports whether senderID has an unexpired session and forgets expired ones.
+func (d *debugSessions) Active(senderID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	until, ok := d.until[senderID]
+	if !ok {
+		return false
+	}
+	if !clock.Now().Before(until) {
+		delete(d.until, senderID)
+		log.Printf("Payload logging for %s expired", senderID)
+		return false
+	}
+	return true
+}
+
+func (d *debugSessions) List() []DebugSession {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := clock.Now()
+	sessions := []DebugSession{}
+	for senderID, until := range d.until {
+		if now.Before(until) {
+			sessions = append(sessions, DebugSession{SenderID: senderID, Until: until})
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].SenderID < sessions[j].SenderID })
+	return sessions
+}
+
+// logPayloadOf reports whether the payloads of senderID are logged.
+func logPayloadOf(senderID string) bool {
+	return logAllPayloads || payloadDebug.Active(senderID)
+}
+
+func handleListPayloadDebug(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, payloadDebug.List())
+}
+
+// handleEnablePayloadDebug turns on payload logging for a device for ?ttl= (default
+// DEBUG_PAYLOAD_TTL, at most 24h).
+func handleEnablePayloadDebug(w http.ResponseWriter, r *http.Request) {
+	ttl := payloadDebugTTL
+	if value := r.URL.Query().Get("ttl"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid ttl")
+			return
+		}
+		ttl = d
+	}
+	ttl = min(ttl, maxPayloadDebugTTL)
+	senderID := r.PathValue("id")
+	until := payloadDebug.Enable(senderID, ttl)
+	log.Printf("Payload logging for %s enabled until %s", senderID, until.Format(time.RFC3339))
+	writeJSON(w, http.StatusOK, DebugSession{SenderID: senderID, Until: until})
+}
+
+func handleDisablePayloadDebug(w http.ResponseWriter, r *http.Request) {
+	senderID := r.PathValue("id")
+	if !payloadDebug.Disable(senderID) {
+		writeError(w, http.StatusNotFound, "payload logging is not enabled for this device")
+		return
+	}
+	log.Printf("Payload logging for %s disabled", senderID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Payload compression formats.
+const (
+	compressionGzip    = "gzip"
+	compressionZlib    = "zlib"
+	compressionDeflate = "deflate" // raw DEFLATE, which has no header and cannot be sniffed
+)
+
+// compressionRoutes marks topics whose payloads are always compressed with a given
+// format; other payloads are decompressed only when they start with gzip or zlib magic.
+var compressionRoutes []codecRoute
+
+// maxDecompressedBytes guards against decompression bombs.
+var maxDecompressedBytes int64 = 1 << 20
+
+// parseCompressionRoutes parses PAYLOAD_COMPRESSION, e.g. "DATA/GEO/#=deflate".
+func parseCompressionRoutes(spec string) ([]codecRoute, error) {
+	var routes []codecRoute
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		filter, format, ok := strings.Cut(entry, "=")
+		filter, format = strings.TrimSpace(filter), strings.ToLower(strings.TrimSpace(format))
+		if !ok || filter == "" {
+			return nil, fmt.Errorf("invalid compression route %q, expected filter=format", entry)
+		}
+		switch format {
+		case compressionGzip, compressionZlib, compressionDeflate:
+		default:
+			return nil, fmt.Errorf("unknown compression %q for %s", format, filter)
+		}
+		routes = append(routes, codecRoute{filter: filter, codec: format})
+	}
+	return routes, nil
+}
+
+// sniffCompression recognises the gzip magic bytes and a valid zlib header (deflate,
+// window size at most 32K, no preset dictionary).
+func sniffCompression(payload []byte) string {
+	if len(payload) < 2 {
+		return ""
+	}
+	if payload[0] == 0x1f && payload[1] == 0x8b {
+		return compressionGzip
+	}
+	if payload[0]&0x0f == 8 && payload[0]>>4 <= 7 && payload[1]&0x20 == 0 &&
+		(uint16(payload[0])<<8|uint16(payload[1]))%31 == 0 {
+		return compressionZlib
+	}
+	return ""
+}
+
+// decompressPayload returns payload decompressed according to the topic's route or its
+// magic bytes, or payload unchanged when it is not compressed.
+func decompressPayload(topic string, payload []byte) ([]byte, string, error) {
+	format := ""
+	for _, route := range compressionRoutes {
+		if topicMatches(route.filter, topic) {
+			format = route.codec
+			break
+		}
+	}
+	if format == "" {
+		format = sniffCompression(payload)
+	}
+	if format == "" {
+		return payload, "", nil
+	}
+
+	var r io.ReadCloser
+	var err error
+	switch format {
+	case compressionGzip:
+		r, err = gzip.NewReader(bytes.NewReader(payload))
+	case compressionZlib:
+		r, err = zlib.NewReader(bytes.NewReader(payload))
+	default:
+		r = flate.NewReader(bytes.NewReader(payload))
+	}
+	if err != nil {
+		return nil, format, fmt.Errorf("invalid %s payload: %v", format, err)
+	}
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, maxDecompressedBytes+1))
+	if err != nil {
+		return nil, format, fmt.Errorf("invalid %s payload: %v", format, err)
+	}
+	if int64(len(out)) > maxDecompressedBytes {
+		return nil, format, fmt.Errorf("%s payload decompresses to more than %d bytes", format, maxDecompressedBytes)
+	}
+	return out, format, nil
+}
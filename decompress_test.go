@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"testing"
+)
+
+func compress(t testing.TB, format string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch format {
+	case compressionGzip:
+		w = gzip.NewWriter(&buf)
+	case compressionZlib:
+		w = zlib.NewWriter(&buf)
+	default:
+		fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = fw
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func FuzzDecompress(f *testing.F) {
+	payload := []byte(`{"event":"TEMPERATURE","timestamp":1700000000,"message":"23.5"}`)
+	f.Add(payload)
+	f.Add(compress(f, compressionGzip, payload))
+	f.Add(compress(f, compressionZlib, payload))
+	f.Add(compress(f, compressionDeflate, payload))
+	f.Add(compress(f, compressionGzip, bytes.Repeat([]byte{'0'}, 2<<20))) // decompression bomb
+	f.Add([]byte{0x1f, 0x8b})                                             // truncated gzip header
+	f.Add([]byte{0x78, 0x9c, 0x01, 0x02, 0x03})                           // zlib header, corrupt stream
+	f.Add([]byte{})
+
+	saved := compressionRoutes
+	compressionRoutes = []codecRoute{{filter: "DATA/DEFLATE/#", codec: compressionDeflate}}
+	f.Cleanup(func() { compressionRoutes = saved })
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, topic := range []string{"DATA/MODEM/1", "DATA/DEFLATE/1"} {
+			out, format, err := decompressPayload(topic, data)
+			if err != nil {
+				continue
+			}
+			if int64(len(out)) > maxDecompressedBytes {
+				t.Errorf("%s: %s payload decompressed to %d bytes, above the limit", topic, format, len(out))
+			}
+			if format == "" && !bytes.Equal(out, data) {
+				t.Errorf("%s: uncompressed payload was changed", topic)
+			}
+		}
+
+		if int64(len(data)) > maxDecompressedBytes {
+			return
+		}
+		for _, c := range []struct{ topic, format string }{
+			{"DATA/MODEM/1", compressionGzip},
+			{"DATA/MODEM/1", compressionZlib},
+			{"DATA/DEFLATE/1", compressionDeflate},
+		} {
+			out, format, err := decompressPayload(c.topic, compress(t, c.format, data))
+			if err != nil || format != c.format || !bytes.Equal(out, data) {
+				t.Errorf("%s round trip of % x gave % x as %q, %v", c.format, data, out, format, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// deduplicator suppresses device retransmissions. A message is a duplicate when the same
+// key was seen within ttl; the key is the message ID when the payload carries one, and
+// otherwise (senderID, event, timestamp, payload hash).
+type deduplicator interface {
+	Seen(key string) bool
+}
+
+var dedup deduplicator // nil when deduplication is disabled
+
+// dedupKey builds the deduplication key for a decoded message.
+func dedupKey(senderID, event string, msgData map[string]interface{}, payload []byte) string {
+	for _, field := range []string{"message_id", "msg_id"} {
+		if id, ok := msgData[field]; ok && id != nil && fmt.Sprint(id) != "" {
+			return fmt.Sprintf("%s|id|%v", senderID, id)
+		}
+	}
+	sum := sha256.Sum256(payload)
+	return fmt.Sprintf("%s|%s|%v|%s", senderID, event, msgData["timestamp"], hex.EncodeToString(sum[:]))
+}
+
+// memoryDedup keeps keys in process memory and sweeps expired ones periodically.
+type memoryDedup struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	keys map[string]time.Time // key -> expiry
+}
+
+func newMemoryDedup(ttl time.Duration) *memoryDedup {
+	d := &memoryDedup{ttl: ttl, keys: map[string]time.Time{}}
+	go func() {
+		for {
+			<-clock.After(ttl)
+			d.sweep()
+		}
+	}()
+	return d
+}
+
+func (d *memoryDedup) Seen(key string) bool {
+	now := clock.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if expiry, ok := d.keys[key]; ok && now.Before(expiry) {
+		return true
+	}
+	d.keys[key] = now.Add(d.ttl)
+	return false
+}
+
+func (d *memoryDedup) sweep() {
+	now := clock.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, expiry := range d.keys {
+		if !now.Before(expiry) {
+			delete(d.keys, key)
+		}
+	}
+}
+
+// postgresDedup stores keys in dedup_keys so that instances sharing a subscription
+// also suppress each other's duplicates.
+type postgresDedup struct {
+	db  *sql.DB
+	ttl time.Duration
+}
+
+func (d *postgresDedup) Seen(key string) bool {
+	now := clock.Now()
+	res, err := d.db.Exec(`INSERT INTO dedup_keys (key, expires_at) VALUES ($1, $2)
+        ON CONFLICT (key) DO UPDATE SET expires_at = EXCLUDED.expires_at WHERE dedup_keys.expires_at <= $3`,
+		key, now.Add(d.ttl), now)
+	if err != nil {
+		log.Printf("Error checking duplicate key: %v", err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 0
+}
+
+func (d *postgresDedup) startSweep() {
+	go func() {
+		for {
+			<-clock.After(d.ttl)
+			if _, err := d.db.Exec("DELETE FROM dedup_keys WHERE expires_at <= $1", clock.Now()); err != nil {
+				log.Printf("Error sweeping duplicate keys: %v", err)
+			}
+		}
+	}()
+}
+
+// newDeduplicator returns the deduplicator for the event state backend in use, or nil when ttl is zero.
+func newDeduplicator(db *sql.DB, backend string, ttl time.Duration) deduplicator {
+	if ttl <= 0 {
+		return nil
+	}
+	log.Printf("Suppressing duplicate messages within %v (%s)", ttl, backend)
+	if backend == "postgres" {
+		d := &postgresDedup{db: db, ttl: ttl}
+		d.startSweep()
+		return d
+	}
+	return newMemoryDedup(ttl)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestMemoryDedupTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		want    bool
+	}{
+		{"immediately", 0, true},
+		{"just before the TTL", time.Minute - time.Nanosecond, true},
+		{"at the TTL", time.Minute, false},
+		{"after the TTL", 2 * time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := useFakeClock(t)
+			d := &memoryDedup{ttl: time.Minute, keys: map[string]time.Time{}}
+			if d.Seen("m-1|id|42") {
+				t.Fatal("first message reported as a duplicate")
+			}
+			c.Advance(tt.elapsed)
+			if got := d.Seen("m-1|id|42"); got != tt.want {
+				t.Errorf("Seen after %v = %v, want %v", tt.elapsed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryDedupSweep(t *testing.T) {
+	c := useFakeClock(t)
+	d := newMemoryDedup(time.Minute)
+	eventually(t, "the sweep to wait", func() bool { return c.timers() == 1 })
+	d.Seen("old")
+	c.Advance(30 * time.Second)
+	d.Seen("new")
+
+	size := func() int {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.keys)
+	}
+	c.Advance(30 * time.Second)
+	eventually(t, "the sweep to drop the expired key", func() bool { return size() == 1 })
+	eventually(t, "the sweep to wait again", func() bool { return c.timers() == 1 })
+	if !d.Seen("new") {
+		t.Error("sweep dropped a key within its TTL")
+	}
+}
+
+func TestPostgresDedupSweep(t *testing.T) {
+	c := useFakeClock(t)
+	db, mock := mockDB(t)
+	d := &postgresDedup{db: db, ttl: time.Minute}
+	mock.ExpectExec(`DELETE FROM dedup_keys WHERE expires_at <= \$1`).
+		WithArgs(c.Now().Add(time.Minute)).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	d.startSweep()
+	eventually(t, "the sweep to wait", func() bool { return c.timers() == 1 })
+
+	c.Advance(59 * time.Second)
+	if c.timers() != 1 {
+		t.Fatal("swept before the TTL passed")
+	}
+	c.Advance(time.Second)
+	eventually(t, "the sweep", func() bool { return mock.ExpectationsWereMet() == nil })
+	eventually(t, "the sweep to wait again", func() bool { return c.timers() == 1 })
+}
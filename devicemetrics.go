@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Per-device traffic histograms. To keep the metrics endpoint bounded, the first
+// deviceMetricsTracked devices seen get their own label value; every later device is
+// hashed into one of deviceMetricsShards "shard_NN" values.
+var (
+	deviceMetricsTracked = 100
+	deviceMetricsShards  = 16
+
+	devicePayloadBytes = newHistogramVec("collector_device_payload_bytes", "Size of inbound payloads per device.", "device",
+		[]float64{64, 128, 256, 512, 1024, 4096, 16384, 65536})
+	deviceInterArrival = newHistogramVec("collector_device_inter_arrival_seconds", "Time between consecutive messages from the same device.", "device",
+		[]float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600, 21600})
+)
+
+var (
+	deviceMetricsMu     sync.Mutex
+	deviceMetricsLabels = map[string]string{} // senderID -> label value
+	deviceLastArrival   sync.Map              // senderID -> time.Time
+)
+
+// deviceMetricLabel returns the bounded label value used for senderID.
+func deviceMetricLabel(senderID string) string {
+	deviceMetricsMu.Lock()
+	defer deviceMetricsMu.Unlock()
+	if label, ok := deviceMetricsLabels[senderID]; ok {
+		return label
+	}
+	if len(deviceMetricsLabels) < deviceMetricsTracked {
+		deviceMetricsLabels[senderID] = senderID
+		return senderID
+	}
+	h := fnv.New32a()
+	h.Write([]byte(senderID))
+	return fmt.Sprintf("shard_%02d", h.Sum32()%uint32(deviceMetricsShards))
+}
+
+// observeDeviceTraffic records the size of a message from senderID and the time since
+// its previous one.
+func observeDeviceTraffic(senderID string, size int, receivedAt time.Time) {
+	label := deviceMetricLabel(senderID)
+	devicePayloadBytes.Observe(label, float64(size))
+	if previous, ok := deviceLastArrival.Swap(senderID, receivedAt); ok {
+		deviceInterArrival.Observe(label, receivedAt.Sub(previous.(time.Time)).Seconds())
+	}
+}
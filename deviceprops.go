@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MQTT v5 user properties that describe the sending device.
+const (
+	userPropertyDeviceType = "device_type"
+	userPropertyFirmware   = "firmware"
+)
+
+// deviceProperties are the device type and firmware a device last sent in the user
+// properties of its MQTT v5 messages.
+type deviceProperties struct {
+	DeviceType string
+	Firmware   string
+	seen       time.Time
+}
+
+// Properties of a device not heard from for devicePropertiesTTL are dropped, and at most
+// devicePropertiesMax devices are remembered, the least recently seen being evicted
+// first, so that churning sender IDs do not grow the map without bound.
+var (
+	devicePropertiesTTL = 24 * time.Hour
+	devicePropertiesMax = 100000
+)
+
+var (
+	devicePropertiesMu sync.Mutex
+	devicePropertiesOf = map[string]deviceProperties{}
+)
+
+// rememberDeviceProperties records the device type and firmware in the user properties of
+// a message from senderID. A property the message does not carry keeps its earlier value.
+func rememberDeviceProperties(senderID string, properties map[string]string) {
+	deviceType, firmware := properties[userPropertyDeviceType], properties[userPropertyFirmware]
+	if deviceType == "" && firmware == "" {
+		return
+	}
+	devicePropertiesMu.Lock()
+	defer devicePropertiesMu.Unlock()
+	now := clock.Now()
+	p, ok := devicePropertiesOf[senderID]
+	if !ok && len(devicePropertiesOf) >= devicePropertiesMax {
+		evictDeviceProperties(now)
+	}
+	p.seen = now
+	if deviceType != "" {
+		p.DeviceType = deviceType
+	}
+	if firmware != "" {
+		p.Firmware = firmware
+	}
+	devicePropertiesOf[senderID] = p
+}
+
+// withDeviceProperties fills in the device type and firmware of data from the user
+// properties its device sent last, so that derived events such as alarms or geofence
+// transitions carry them as well.
+func withDeviceProperties(data EventMessage) EventMessage {
+	devicePropertiesMu.Lock()
+	p, ok := devicePropertiesOf[data.Sumber]
+	if ok && clock.Now().Sub(p.seen) > devicePropertiesTTL {
+		delete(devicePropertiesOf, data.Sumber)
+		ok = false
+	}
+	devicePropertiesMu.Unlock()
+	if !ok {
+		return data
+	}
+	if data.DeviceType == "" {
+		data.DeviceType = p.DeviceType
+	}
+	if data.Firmware == "" {
+		data.Firmware = p.Firmware
+	}
+	return data
+}
+
+// evictDeviceProperties makes room for another device: it drops expired entries and, when
+// none had expired, the least recently seen tenth, so a full map does not sort on every
+// new device. devicePropertiesMu must be held.
+func evictDeviceProperties(now time.Time) {
+	for senderID, p := range devicePropertiesOf {
+		if now.Sub(p.seen) > devicePropertiesTTL {
+			delete(devicePropertiesOf, senderID)
+		}
+	}
+	if len(devicePropertiesOf) < devicePropertiesMax {
+		return
+	}
+	senders := make([]string, 0, len(devicePropertiesOf))
+	for senderID := range devicePropertiesOf {
+		senders = append(senders, senderID)
+	}
+	sort.Slice(senders, func(i, j int) bool {
+		return devicePropertiesOf[senders[i]].seen.Before(devicePropertiesOf[senders[j]].seen)
+	})
+	for _, senderID := range senders[:len(senders)-devicePropertiesMax*9/10] {
+		delete(devicePropertiesOf, senderID)
+	}
+}
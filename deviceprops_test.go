@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// useDeviceProperties starts the test with no remembered device properties and the given
+// limits.
+func useDeviceProperties(t *testing.T, ttl time.Duration, maxEntries int) {
+	t.Helper()
+	savedTTL, savedMax, saved := devicePropertiesTTL, devicePropertiesMax, devicePropertiesOf
+	devicePropertiesTTL, devicePropertiesMax, devicePropertiesOf = ttl, maxEntries, map[string]deviceProperties{}
+	t.Cleanup(func() { devicePropertiesTTL, devicePropertiesMax, devicePropertiesOf = savedTTL, savedMax, saved })
+}
+
+func TestDevicePropertiesExpire(t *testing.T) {
+	c := useFakeClock(t)
+	useDeviceProperties(t, time.Hour, 10)
+	rememberDeviceProperties("modem-v5", map[string]string{userPropertyDeviceType: "RUT955"})
+
+	c.Advance(time.Hour)
+	if got := withDeviceProperties(EventMessage{Sumber: "modem-v5"}); got.DeviceType != "RUT955" {
+		t.Errorf("DeviceType at the TTL = %q, want RUT955", got.DeviceType)
+	}
+	c.Advance(time.Nanosecond)
+	if got := withDeviceProperties(EventMessage{Sumber: "modem-v5"}); got.DeviceType != "" {
+		t.Errorf("DeviceType after the TTL = %q, want none", got.DeviceType)
+	}
+	if len(devicePropertiesOf) != 0 {
+		t.Errorf("%d devices remembered after expiry, want 0", len(devicePropertiesOf))
+	}
+}
+
+func TestDevicePropertiesBounded(t *testing.T) {
+	c := useFakeClock(t)
+	useDeviceProperties(t, time.Hour, 10)
+	for i := 0; i < 25; i++ {
+		rememberDeviceProperties(fmt.Sprintf("modem-%d", i), map[string]string{userPropertyFirmware: "7.4.2"})
+		c.Advance(time.Second)
+		if len(devicePropertiesOf) > 10 {
+			t.Fatalf("%d devices remembered, want at most 10", len(devicePropertiesOf))
+		}
+	}
+	if got := withDeviceProperties(EventMessage{Sumber: "modem-24"}); got.Firmware != "7.4.2" {
+		t.Errorf("newest device Firmware = %q, want 7.4.2", got.Firmware)
+	}
+	if got := withDeviceProperties(EventMessage{Sumber: "modem-0"}); got.Firmware != "" {
+		t.Errorf("oldest device Firmware = %q, want it evicted", got.Firmware)
+	}
+
+	// Expired devices are dropped before any recent one is evicted.
+	c.Advance(time.Hour)
+	rememberDeviceProperties("modem-new", map[string]string{userPropertyFirmware: "7.5.0"})
+	if len(devicePropertiesOf) != 1 {
+		t.Errorf("%d devices remembered after the others expired, want 1", len(devicePropertiesOf))
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// DeviceState is the last known state of a device, kept in device_state. Each part is
+// only replaced by a newer event of its kind, so late or replayed events do not
+// overwrite fresher values.
+type DeviceState struct {
+	SenderID      string      `json:"sender_id"`
+	LastEvent     string      `json:"last_event"`
+	LastSeen      time.Time   `json:"last_seen"`
+	Temperature   *float64    `json:"temperature,omitempty"`
+	TemperatureAt *time.Time  `json:"temperature_at,omitempty"`
+	PowerStatus   *string     `json:"power_status,omitempty"` // mains, battery or pln_outage
+	PowerAt       *time.Time  `json:"power_at,omitempty"`
+	ModemStatus   *string     `json:"modem_status,omitempty"` // on or off
+	ModemAt       *time.Time  `json:"modem_at,omitempty"`
+	Location      interface{} `json:"location,omitempty"`
+	LocationAt    *time.Time  `json:"location_at,omitempty"`
+	SilentSince   *time.Time  `json:"silent_since,omitempty"` // set by the heartbeat watchdog
+}
+
+// deviceStateOf returns the state change carried by data.
+func deviceStateOf(data EventMessage) DeviceState {
+	state := DeviceState{SenderID: data.Sumber, LastEvent: data.EventName, LastSeen: clock.Now()}
+	at := state.LastSeen
+	if data.Time != 0 {
+		at = time.UnixMilli(data.Time)
+	}
+	if data.EventName == "DEVICE_SILENT" {
+		// Raised by the collector, not received from the device: last_seen is kept.
+		state.LastSeen = time.Time{}
+	}
+	status := func(s string) *string { return &s }
+	switch data.EventName {
+	case "TEMPERATURE":
+		if v, ok := numericValue(data.Value); ok {
+			state.Temperature, state.TemperatureAt = &v, &at
+		}
+	case "POWER_BACKUP_MODE":
+		state.PowerStatus, state.PowerAt = status("battery"), &at
+	case "POWER_RESTORE_MODE":
+		state.PowerStatus, state.PowerAt = status("mains"), &at
+	case "POWER_PLN":
+		if v, _ := numericValue(data.Value); v == 1 {
+			state.PowerStatus = status("pln_outage")
+		} else {
+			state.PowerStatus = status("mains")
+		}
+		state.PowerAt = &at
+	case "STATUS_MODEM_ON":
+		state.ModemStatus, state.ModemAt = status("on"), &at
+	case "STATUS_MODEM_OFF":
+		state.ModemStatus, state.ModemAt = status("off"), &at
+	case "GEOLOCATION", "GPS":
+		if data.Value != nil {
+			state.Location, state.LocationAt = data.Value, &at
+		}
+	}
+	return state
+}
+
+// newer reports whether a part of the state timestamped at should replace one at current.
+func newer(at, current *time.Time) bool {
+	return at != nil && (current == nil || !at.Before(*current))
+}
+
+// merge folds the later state change next into s, as the upsert does in the database.
+func (s DeviceState) merge(next DeviceState) DeviceState {
+	s.LastEvent = next.LastEvent
+	if next.LastSeen.After(s.LastSeen) {
+		s.LastSeen = next.LastSeen
+	}
+	if newer(next.TemperatureAt, s.TemperatureAt) {
+		s.Temperature, s.TemperatureAt = next.Temperature, next.TemperatureAt
+	}
+	if newer(next.PowerAt, s.PowerAt) {
+		s.PowerStatus, s.PowerAt = next.PowerStatus, next.PowerAt
+	}
+	if newer(next.ModemAt, s.ModemAt) {
+		s.ModemStatus, s.ModemAt = next.ModemStatus, next.ModemAt
+	}
+	if newer(next.LocationAt, s.LocationAt) {
+		s.Location, s.LocationAt = next.Location, next.LocationAt
+	}
+	return s
+}
+
+const deviceStateInsert = `INSERT INTO device_state (sender_id, last_event, last_seen, temperature, temperature_at,
+    power_status, power_at, modem_status, modem_at, location, location_at) VALUES `
+
+const deviceStateRow = "($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)"
+
+// deviceStateConflict keeps each part whose timestamp is newer, treating a NULL
+// timestamp as "no change".
+const deviceStateConflict = ` ON CONFLICT (sender_id) DO UPDATE SET
+    last_event = EXCLUDED.last_event,
+    last_seen = GREATEST(device_state.last_seen, EXCLUDED.last_seen),
+    temperature = CASE WHEN EXCLUDED.temperature_at >= device_state.temperature_at OR device_state.temperature_at IS NULL
+        THEN COALESCE(EXCLUDED.temperature, device_state.temperature) ELSE device_state.temperature END,
+    temperature_at = GREATEST(device_state.temperature_at, EXCLUDED.temperature_at),
+    power_status = CASE WHEN EXCLUDED.power_at >= device_state.power_at OR device_state.power_at IS NULL
+        THEN COALESCE(EXCLUDED.power_status, device_state.power_status) ELSE device_state.power_status END,
+    power_at = GREATEST(device_state.power_at, EXCLUDED.power_at),
+    modem_status = CASE WHEN EXCLUDED.modem_at >= device_state.modem_at OR device_state.modem_at IS NULL
+        THEN COALESCE(EXCLUDED.modem_status, device_state.modem_status) ELSE device_state.modem_status END,
+    modem_at = GREATEST(device_state.modem_at, EXCLUDED.modem_at),
+    location = CASE WHEN EXCLUDED.location_at >= device_state.location_at OR device_state.location_at IS NULL
+        THEN COALESCE(EXCLUDED.location, device_state.location) ELSE device_state.location END,
+    location_at = GREATEST(device_state.location_at, EXCLUDED.location_at)`
+
+func deviceStateArgs(s DeviceState) ([]interface{}, error) {
+	var location interface{}
+	if s.Location != nil {
+		b, err := json.Marshal(s.Location)
+		if err != nil {
+			return nil, err
+		}
+		location = string(b)
+	}
+	return []interface{}{s.SenderID, s.LastEvent, s.LastSeen, s.Temperature, s.TemperatureAt,
+		s.PowerStatus, s.PowerAt, s.ModemStatus, s.ModemAt, location, s.LocationAt}, nil
+}
+
+// updateDeviceState upserts the state change carried by data.
+func updateDeviceState(db eventsExecer, data EventMessage) error {
+	args, err := deviceStateArgs(deviceStateOf(data))
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(deviceStateInsert+"($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)"+deviceStateConflict, args...)
+	return err
+}
+
+// upsertDeviceStates applies the state changes of a batch, one row per device since a
+// statement may not update the same row twice.
+func upsertDeviceStates(tx *sql.Tx, batch []EventMessage) error {
+	bySender := map[string]DeviceState{}
+	var senders []string
+	for _, data := range batch {
+		next := deviceStateOf(data)
+		if current, ok := bySender[data.Sumber]; ok {
+			bySender[data.Sumber] = current.merge(next)
+			continue
+		}
+		senders = append(senders, data.Sumber)
+		bySender[data.Sumber] = next
+	}
+	rows := make([][]interface{}, 0, len(senders))
+	for _, senderID := range senders {
+		args, err := deviceStateArgs(bySender[senderID])
+		if err != nil {
+			return err
+		}
+		rows = append(rows, args)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return insertMultiRow(tx, deviceStateInsert, deviceStateRow, rows, deviceStateConflict)
+}
+
+const deviceStateColumns = `sender_id, last_event, last_seen, temperature, temperature_at, power_status, power_at,
+    modem_status, modem_at, location, location_at, silent_since`
+
+func scanDeviceState(row interface{ Scan(...interface{}) error }) (DeviceState, error) {
+	var s DeviceState
+	var location []byte
+	err := row.Scan(&s.SenderID, &s.LastEvent, &s.LastSeen, &s.Temperature, &s.TemperatureAt, &s.PowerStatus, &s.PowerAt,
+		&s.ModemStatus, &s.ModemAt, &location, &s.LocationAt, &s.SilentSince)
+	if err == nil && len(location) > 0 {
+		json.Unmarshal(location, &s.Location)
+	}
+	return s, err
+}
+
+func handleListDeviceState(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT "+deviceStateColumns+" FROM device_state ORDER BY sender_id LIMIT $1", queryLimit(r, 1000, 10000))
+	if err != nil {
+		log.Printf("Error listing device state: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list device state")
+		return
+	}
+	defer rows.Close()
+	states := []DeviceState{}
+	for rows.Next() {
+		s, err := scanDeviceState(rows)
+		if err != nil {
+			log.Printf("Error scanning device state: %v", err)
+			writeError(w, http.StatusInternalServerError, "failed to list device state")
+			return
+		}
+		states = append(states, s)
+	}
+	writeJSON(w, http.StatusOK, states)
+}
+
+func handleGetDeviceState(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	s, err := scanDeviceState(db.QueryRow("SELECT "+deviceStateColumns+" FROM device_state WHERE sender_id = $1", r.PathValue("id")))
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "no state recorded for this device")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading device state: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load device state")
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// edgeStore is the Store for collectors without Postgres (DB_DRIVER other than
+// postgres). It keeps events, raw payloads, dead letters, quarantined and unhandled
+// messages and the device registry. Event state stays in memory, and the features built
+// on Postgres alone (commands, campaigns, geolocation queue, retention, archiving and
+// most of the HTTP API) are not available.
+type edgeStore struct {
+	db      *sql.DB
+	dialect edgeDialect
+}
+
+// edgeDialect is the SQL that differs between the databases an edgeStore runs on.
+// Queries are otherwise written once, with ? placeholders.
+type edgeDialect interface {
+	// migrations returns the dialect's embedded migrations and their directory.
+	migrations() (fs.FS, string)
+	// lockMigrations serializes migrations between collectors on conn and returns the
+	// function releasing the lock.
+	lockMigrations(ctx context.Context, conn *sql.Conn) (func(), error)
+	// insertIgnore returns an INSERT of columns into table that skips existing keys.
+	insertIgnore(table string, columns ...string) string
+	// upsertDevice returns an INSERT of sender_id, columns and the at column into
+	// devices. For a known device it updates the non-NULL columns and at, unless the
+	// stored at is newer.
+	upsertDevice(at string, columns ...string) string
+}
+
+// setupEdgeStore migrates db with the dialect's migrations and returns the Store on it.
+func setupEdgeStore(db *sql.DB, dialect edgeDialect) (Store, error) {
+	for event, table := range storageRoutes {
+		if table != "" && table != defaultEventTable {
+			return nil, fmt.Errorf("EVENT_STORAGE routes %s events to %s, but routed tables need DB_DRIVER=postgres", event, table)
+		}
+	}
+	start, err := migrateEdge(db, dialect)
+	if err != nil {
+		return nil, fmt.Errorf("schema migration failed: %v", err)
+	}
+	if !start {
+		log.Printf("Finished --migrate=%s, exiting", *migrateFlag)
+		os.Exit(0)
+	}
+	return &edgeStore{db: db, dialect: dialect}, nil
+}
+
+// placeholders returns n comma-separated ? placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// utcArgs converts the times among args to UTC. SQLite stores times as text, which
+// only sorts in time order when every value has the same offset.
+func utcArgs(args ...interface{}) []interface{} {
+	for i, arg := range args {
+		if t, ok := arg.(time.Time); ok {
+			args[i] = t.UTC()
+		}
+	}
+	return args
+}
+
+func (s *edgeStore) exec(query string, args ...interface{}) error {
+	_, err := s.db.Exec(query, utcArgs(args...)...)
+	return err
+}
+
+func (s *edgeStore) SaveEvent(data EventMessage) error {
+	return s.SaveEvents([]EventMessage{data}, nil)
+}
+
+func (s *edgeStore) SaveEvents(events []EventMessage, changes []stateChange) error {
+	if len(changes) > 0 {
+		return fmt.Errorf("event state changes: %w", errUnsupported)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, data := range events {
+		if err := insertEdgeEvent(tx, data); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// insertEdgeEvent writes data to mqtt_data and events within tx.
+func insertEdgeEvent(tx *sql.Tx, data EventMessage) error {
+	if _, ok := storageTable(data.EventName); !ok {
+		return nil
+	}
+	_, err := tx.Exec("INSERT INTO mqtt_data (sender_id, message, timestamp, ingest_id) VALUES (?, ?, ?, ?)",
+		utcArgs(data.Sumber, data.Msg, time.UnixMilli(data.Time), nullIfEmpty(data.IngestID))...)
+	if err != nil {
+		return err
+	}
+	args, err := normalizedEventArgs(data)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO events ("+normalizedEventColumns+", received_at) VALUES ("+placeholders(len(args)+1)+")",
+		utcArgs(append(args, clock.Now())...)...)
+	return err
+}
+
+// LockSender is not supported: shared event state needs Postgres.
+func (s *edgeStore) LockSender(senderID string) (SenderTx, error) {
+	return nil, errUnsupported
+}
+
+func (s *edgeStore) SaveRaw(msg inboundMessage) error {
+	return s.exec("INSERT INTO raw_messages (ingest_id, sender_id, topic, payload, received_at) VALUES (?, ?, ?, ?, ?)",
+		msg.IngestID, msg.SenderID, msg.Topic, msg.Payload, msg.ReceivedAt)
+}
+
+func (s *edgeStore) QueryEvents(q EventQuery, fn func(EventRecord) error) error {
+	if len(q.Labels) > 0 {
+		return fmt.Errorf("device labels: %w", errUnsupported)
+	}
+	query := "SELECT " + storedEventColumns + " FROM events WHERE 1 = 1"
+	var args []interface{}
+	if q.SenderID != "" {
+		query += " AND sender_id = ?"
+		args = append(args, q.SenderID)
+	}
+	if len(q.Events) > 0 {
+		query += " AND event_name IN (" + placeholders(len(q.Events)) + ")"
+		for _, event := range q.Events {
+			args = append(args, event)
+		}
+	}
+	if !q.From.IsZero() {
+		query += " AND received_at >= ?"
+		args = append(args, q.From)
+	}
+	if !q.To.IsZero() {
+		query += " AND received_at < ?"
+		args = append(args, q.To)
+	}
+	query += " ORDER BY id"
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+	rows, err := s.db.Query(query, utcArgs(args...)...)
+	if err != nil {
+		return err
+	}
+	return eachEventRecord(rows, fn)
+}
+
+func (s *edgeStore) LastState(senderID string) ([]EventRecord, error) {
+	rows, err := s.db.Query(`SELECT `+storedEventColumns+` FROM events e
+        WHERE sender_id = ? AND id = (SELECT id FROM events
+            WHERE sender_id = e.sender_id AND event_name = e.event_name
+            ORDER BY COALESCE(event_time, received_at) DESC, id DESC LIMIT 1)
+        ORDER BY event_name`, senderID)
+	if err != nil {
+		return nil, err
+	}
+	state := []EventRecord{}
+	err = eachEventRecord(rows, func(e EventRecord) error {
+		state = append(state, e)
+		return nil
+	})
+	return state, err
+}
+
+func (s *edgeStore) DeadLetter(msg inboundMessage, stage string, cause error) error {
+	return s.exec("INSERT INTO dead_letter (ingest_id, sender_id, topic, stage, payload, error, received_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		nullIfEmpty(msg.IngestID), msg.SenderID, msg.Topic, stage, msg.Payload, cause.Error(), msg.ReceivedAt)
+}
+
+func (s *edgeStore) Quarantine(msg inboundMessage, event, reason string) error {
+	return s.exec("INSERT INTO quarantine (ingest_id, sender_id, event_name, topic, payload, error, received_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		msg.IngestID, msg.SenderID, event, msg.Topic, string(msg.Payload), reason, msg.ReceivedAt)
+}
+
+func (s *edgeStore) SaveUnhandled(msg inboundMessage, event string) error {
+	return s.exec("INSERT INTO raw_events (ingest_id, sender_id, event_name, topic, payload, received_at) VALUES (?, ?, ?, ?, ?, ?)",
+		msg.IngestID, msg.SenderID, event, msg.Topic, string(msg.Payload), msg.ReceivedAt)
+}
+
+func (s *edgeStore) RegisterDevice(senderID string) error {
+	return s.exec(s.dialect.insertIgnore("devices", "sender_id", "first_seen"), senderID, clock.Now())
+}
+
+func (s *edgeStore) DeviceModel(senderID string) (string, error) {
+	var model sql.NullString
+	err := s.db.QueryRow("SELECT model FROM devices WHERE sender_id = ?", senderID).Scan(&model)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return model.String, err
+}
+
+// DeviceLabels is unsupported: the edge registry keeps no labels.
+func (s *edgeStore) DeviceLabels(senderID string) (map[string]string, error) {
+	return nil, errUnsupported
+}
+
+func (s *edgeStore) SetDeviceFirmware(senderID, version string, at time.Time) error {
+	if err := s.exec(s.dialect.upsertDevice("firmware_at", "firmware_version"), senderID, version, at); err != nil {
+		return fmt.Errorf("failed to update firmware of %s: %v", senderID, err)
+	}
+	knownDevices.Store(senderID, struct{}{})
+	return nil
+}
+
+func (s *edgeStore) SetDeviceSIM(senderID string, sim DeviceSIM, at time.Time) error {
+	err := s.exec(s.dialect.upsertDevice("sim_at", "iccid", "imsi"), senderID, nullIfEmpty(sim.ICCID), nullIfEmpty(sim.IMSI), at)
+	if err != nil {
+		return err
+	}
+	knownDevices.Store(senderID, struct{}{})
+	return nil
+}
+
+func (s *edgeStore) SetDeviceNetwork(senderID string, network DeviceNetwork, at time.Time) error {
+	err := s.exec(s.dialect.upsertDevice("network_at", "operator", "rat", "band", "cell_id"), senderID,
+		nullIfEmpty(network.Operator), nullIfEmpty(network.RAT), nullIfEmpty(network.Band), nullIfEmpty(network.CellID), at)
+	if err != nil {
+		return err
+	}
+	knownDevices.Store(senderID, struct{}{})
+	return nil
+}
+
+func (s *edgeStore) RecordCampaignOTAStatus(senderID, campaignID, status, detail string) error {
+	return errUnsupported
+}
+
+func (s *edgeStore) RecordDataUsage(senderID string, at time.Time, sent, received int64) (int64, int64, error) {
+	return 0, 0, errUnsupported
+}
+
+func (s *edgeStore) DataQuota(senderID string) (int64, error) {
+	return 0, errUnsupported
+}
+
+func (s *edgeStore) RecordReboot(senderID string, at time.Time, reason, source string) (bool, error) {
+	return false, errUnsupported
+}
+
+func (s *edgeStore) CountReboots(senderID string, until time.Time, length time.Duration) (int, error) {
+	return 0, errUnsupported
+}
+
+func (s *edgeStore) RecordThermalReading(senderID string, at time.Time, value float64) error {
+	return errUnsupported
+}
+
+func (s *edgeStore) TemperatureThresholds(senderID string) (TemperatureThresholds, error) {
+	return TemperatureThresholds{}, errUnsupported
+}
+
+func (s *edgeStore) SetTemperatureAlarm(senderID, alarm string, at time.Time) (bool, error) {
+	return false, errUnsupported
+}
+
+func (s *edgeStore) LastPublishedLocation(senderID string) (Location, error) {
+	return Location{}, errUnsupported
+}
+
+func (s *edgeStore) SaveLocation(loc Location) error {
+	return errUnsupported
+}
+
+func (s *edgeStore) Geofences(senderID string) ([]Geofence, error) {
+	return nil, errUnsupported
+}
+
+func (s *edgeStore) SetGeofenceState(senderID, name string, inside bool, at time.Time) (bool, error) {
+	return false, errUnsupported
+}
+
+func (s *edgeStore) SetReportedConfig(senderID string, config map[string]interface{}) error {
+	return errUnsupported
+}
+
+func (s *edgeStore) SyncShadow(senderID string) error {
+	return errUnsupported
+}
+
+// migrateEdge handles the --migrate flag on an edgeStore database, like runMigrations
+// on Postgres. MySQL commits DDL implicitly, so a migration that fails there may be left
+// half applied and has to be repaired by hand.
+func migrateEdge(db *sql.DB, dialect edgeDialect) (bool, error) {
+	files, dir := dialect.migrations()
+	migrations, err := loadMigrations(files, dir)
+	if err != nil {
+		return false, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+        version INTEGER PRIMARY KEY,
+        name VARCHAR(255) NOT NULL,
+        applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+    )`)
+	if err != nil {
+		return false, fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+	if *migrateFlag == "status" {
+		applied, err := appliedMigrations(db)
+		if err != nil {
+			return false, err
+		}
+		logMigrationStatus(migrations, applied)
+		return false, nil
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	unlock, err := dialect.lockMigrations(ctx, conn)
+	if err != nil {
+		return false, fmt.Errorf("failed to lock migrations: %v", err)
+	}
+	defer unlock()
+	// Read under the lock: another collector may have applied some while we waited.
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return false, err
+	}
+	switch *migrateFlag {
+	case "up":
+		for _, mig := range migrations {
+			if applied[mig.Version] {
+				continue
+			}
+			if err := applyEdgeMigration(ctx, conn, mig.Up, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", mig.Version, mig.Name); err != nil {
+				return false, fmt.Errorf("migration %d_%s failed: %v", mig.Version, mig.Name, err)
+			}
+			log.Printf("Applied migration %d_%s", mig.Version, mig.Name)
+		}
+		return true, nil
+	case "down":
+		for i := len(migrations) - 1; i >= 0; i-- {
+			mig := migrations[i]
+			if !applied[mig.Version] {
+				continue
+			}
+			if mig.Down == "" {
+				return false, fmt.Errorf("migration %d_%s is irreversible", mig.Version, mig.Name)
+			}
+			if err := applyEdgeMigration(ctx, conn, mig.Down, "DELETE FROM schema_migrations WHERE version = ?", mig.Version); err != nil {
+				return false, fmt.Errorf("rolling back migration %d_%s failed: %v", mig.Version, mig.Name, err)
+			}
+			log.Printf("Rolled back migration %d_%s", mig.Version, mig.Name)
+			return false, nil
+		}
+		return false, fmt.Errorf("no migrations applied")
+	default:
+		return false, fmt.Errorf("unknown --migrate mode %q", *migrateFlag)
+	}
+}
+
+// applyEdgeMigration runs the statements of body and then record with args in one
+// transaction on conn.
+func applyEdgeMigration(ctx context.Context, conn *sql.Conn, body, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range splitStatements(body) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
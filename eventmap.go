@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// EventMapping describes a simple event declaratively: the datapoint it becomes and the
+// event state it sets. The built-in alarm and status events are mappings, and
+// EVENT_MAP_FILE adds or overrides mappings from a JSON file keyed by event name, so a
+// new event of this kind needs no code:
+//
+//	{"ALARM_FLOOD": {"tag": "alarm_flood_{sender}", "value": 1},
+//	 "CLEAR_ALARM_FLOOD": {"tag": "alarm_flood_{sender}", "value": 0}}
+//
+// Events with their own handler, such as TEMPERATURE or GEOLOCATION, cannot be mapped.
+type EventMapping struct {
+	// Tag is the datapoint tag; {sender} and {event} are replaced.
+	Tag string `json:"tag"`
+	// Value is the datapoint value: a constant, or "$field" for a field of the payload
+	// such as "$message".
+	Value interface{} `json:"value"`
+	// State lists event state flags set to true for the device.
+	State []string `json:"state,omitempty"`
+	// Hooks are named actions run after the datapoint is published (see eventHooks).
+	Hooks []string `json:"hooks,omitempty"`
+	// Debounce publishes the datapoint through alarmGate, which holds back short alarms
+	// and collapses flapping.
+	Debounce bool `json:"debounce,omitempty"`
+}
+
+// eventHooks are the actions a mapping can name in Hooks.
+var eventHooks = map[string]func(store Store, data EventMessage){
+	// sync_shadow pushes pending desired configuration to a device that came online.
+	"sync_shadow": func(store Store, data EventMessage) {
+		if err := store.SyncShadow(data.Sumber); err != nil && err != errUnsupported {
+			log.Printf("Error pushing desired config to %s: %v", data.Sumber, err)
+		}
+	},
+}
+
+// eventMappings maps event names to their mapping; loadEventMappings replaces it at
+// startup, before messages are handled.
+var eventMappings = defaultEventMappings()
+
+func defaultEventMappings() map[string]EventMapping {
+	return map[string]EventMapping{
+		"ALARM_METER_TEMPER":       {Tag: "alarm_meter_temper_{sender}", Value: 1, Debounce: true},
+		"CLEAR_ALARM_METER_TEMPER": {Tag: "alarm_meter_temper_{sender}", Value: 0, Debounce: true},
+		"POWER_BACKUP_MODE":        {Tag: "power_modem_{sender}", Value: 1},
+		"POWER_RESTORE_MODE":       {Tag: "power_modem_{sender}", Value: 0},
+		"STATUS_MODEM_ON":          {Tag: "status_modem_{sender}", Value: 1, Hooks: []string{"sync_shadow"}},
+		"STATUS_MODEM_OFF":         {Tag: "status_modem_{sender}", Value: 0},
+		"ALARM_TEMPERATURE":        {Tag: "alarm_temperature_{sender}", Value: 1, Debounce: true},
+		"CLEAR_ALARM_TEMPERATURE":  {Tag: "alarm_temperature_{sender}", Value: 0, Debounce: true},
+		"ALARM_METER_DEVICE":       {Tag: "alarm_connection_missing_{sender}", Value: 1, Debounce: true},
+		"CLEAR_ALARM_METER_DEVICE": {Tag: "alarm_connection_missing_{sender}", Value: 0, Debounce: true},
+		"DOOR_OPEN":                {Tag: "door_open_{sender}", Value: 1, Debounce: true},
+		"DOOR_CLOSE":               {Tag: "door_open_{sender}", Value: 0, Debounce: true},
+		"ENCLOSURE_TAMPER":         {Tag: "enclosure_tamper_{sender}", Value: 1, Debounce: true},
+		"CLEAR_ENCLOSURE_TAMPER":   {Tag: "enclosure_tamper_{sender}", Value: 0, Debounce: true},
+	}
+}
+
+// loadEventMappings returns the built-in mappings overlaid with those in path, if any.
+func loadEventMappings(path string) (map[string]EventMapping, error) {
+	mappings := defaultEventMappings()
+	if path == "" {
+		return mappings, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var custom map[string]EventMapping
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	for event, m := range custom {
+		// The first matching handler gets the event, and mappedEventHandler is the last.
+		if h := findHandler(event); h != nil {
+			if _, mapped := h.(mappedEventHandler); !mapped {
+				return nil, fmt.Errorf("%s: handled by a built-in handler, it cannot be mapped", event)
+			}
+		}
+		if m.Tag == "" {
+			return nil, fmt.Errorf("%s: tag is required", event)
+		}
+		if m.Value == nil {
+			return nil, fmt.Errorf("%s: value is required", event)
+		}
+		for _, hook := range m.Hooks {
+			if eventHooks[hook] == nil {
+				return nil, fmt.Errorf("%s: unknown hook %q", event, hook)
+			}
+		}
+		mappings[event] = m
+	}
+	return mappings, nil
+}
+
+// mappedEvents lists the mapped event names, sorted, for logging.
+func mappedEvents(mappings map[string]EventMapping) []string {
+	events := make([]string, 0, len(mappings))
+	for event := range mappings {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	return events
+}
+
+// mappedEventHandler handles every event with a mapping.
+type mappedEventHandler struct{}
+
+func (mappedEventHandler) Match(event string) bool {
+	_, ok := eventMappings[event]
+	return ok
+}
+
+func (mappedEventHandler) Handle(ctx context.Context, store Store, m DeviceMessage) {
+	handleMappedEvent(store, eventMappings[m.Event], m.SenderID, string(m.Payload), m.Event, m.IngestID, m.Timestamp)
+}
+
+func handleMappedEvent(store Store, mapping EventMapping, senderID, message, event, ingestID string, timestamp int64) {
+	var msgData map[string]interface{}
+	if err := json.Unmarshal([]byte(message), &msgData); err != nil {
+		log.Printf("Error unmarshalling %s event message: %v", event, err)
+		return
+	}
+
+	value := mapping.Value
+	if field, ok := value.(string); ok && strings.HasPrefix(field, "$") {
+		if value, ok = msgData[field[1:]]; !ok {
+			log.Printf("[%s] Error: '%s' field not found in %s message", ingestID, field[1:], event)
+			return
+		}
+	}
+
+	data := EventMessage{
+		EventName: event,
+		Tag:       strings.NewReplacer("{sender}", senderID, "{event}", event).Replace(mapping.Tag),
+		Value:     value,
+		Status:    true,
+		Msg:       message,
+		Time:      timestamp,
+		Sumber:    senderID,
+		IngestID:  ingestID,
+	}
+
+	publish := sendDataPoint
+	if mapping.Debounce {
+		publish = alarmGate.publish
+	}
+	if len(mapping.State) > 0 || rules.inputs[event] {
+		// The event, the synthetic events of the rules it changes and the state behind
+		// them are stored together.
+		w := newCombinedWrite(store, senderID)
+		defer w.Close()
+		w.SaveQuiet(data)
+		for _, flag := range mapping.State {
+			w.Store(senderID+"_"+flag, true)
+		}
+		for _, change := range rules.evaluate(w, senderID, event, timestamp, func() map[string]string {
+			labels, err := store.DeviceLabels(senderID)
+			if err != nil && err != errUnsupported {
+				log.Printf("[%s] Error loading the labels of %s: %v", ingestID, senderID, err)
+			}
+			return labels
+		}) {
+			w.Save(change.message(senderID, message, ingestID, timestamp))
+		}
+		w.Commit()
+		publish(data)
+	} else {
+		processAndSaveData(store, data)
+		publish(data)
+	}
+	for _, hook := range mapping.Hooks {
+		eventHooks[hook](store, data)
+	}
+}
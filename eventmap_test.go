@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeEventMapFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "events.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadEventMappings(t *testing.T) {
+	path := writeEventMapFile(t, `{
+		"ALARM_FLOOD": {"tag": "alarm_flood_{sender}", "value": 1},
+		"STATUS_MODEM_ON": {"tag": "modem_on_{sender}", "value": 1}
+	}`)
+	mappings, err := loadEventMappings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mappings["ALARM_FLOOD"].Tag; got != "alarm_flood_{sender}" {
+		t.Errorf("ALARM_FLOOD tag = %q, want it added", got)
+	}
+	if got := mappings["STATUS_MODEM_ON"].Tag; got != "modem_on_{sender}" {
+		t.Errorf("STATUS_MODEM_ON tag = %q, want the built-in mapping overridden", got)
+	}
+}
+
+func TestLoadEventMappingsRejects(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"built-in handler", `{"TEMPERATURE": {"tag": "temp_{sender}", "value": "$message"}}`, "built-in handler"},
+		{"another built-in handler", `{"GEOLOCATION": {"tag": "geo_{sender}", "value": 1}}`, "built-in handler"},
+		{"no tag", `{"ALARM_FLOOD": {"value": 1}}`, "tag is required"},
+		{"no value", `{"ALARM_FLOOD": {"tag": "alarm_flood_{sender}"}}`, "value is required"},
+		{"unknown hook", `{"ALARM_FLOOD": {"tag": "alarm_flood_{sender}", "value": 1, "hooks": ["page_oncall"]}}`, "unknown hook"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadEventMappings(writeEventMapFile(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("loadEventMappings error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
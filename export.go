@@ -0,0 +1,209 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	exportFlag         = flag.String("export", "", `write the normalized events table as JSON lines to this file ("-" for stdout) and exit`)
+	exportFromFlag     = flag.String("export-from", "", "only export events at or after this RFC 3339 time")
+	exportToFlag       = flag.String("export-to", "", "only export events before this RFC 3339 time")
+	exportLabelsFlag   = flag.String("export-labels", "", "only export events of devices carrying every key=value label in this comma-separated list, e.g. customer=PLN,site=BDG")
+	exportCompressFlag = flag.String("export-compress", "", `compress the export with "zstd" or "gzip", or "none"; by default a .zst or .gz file suffix picks the coding`)
+	anonymizeFlag      = flag.Bool("anonymize", false, "pseudonymize sender IDs with EXPORT_HMAC_KEY and strip free-text fields from the export")
+)
+
+// ExportRecord is one exported row of the events table.
+type ExportRecord struct {
+	SenderID  string      `json:"sender_id"`
+	Event     string      `json:"event"`
+	Tag       string      `json:"tag"`
+	Value     interface{} `json:"value,omitempty"`
+	Status    bool        `json:"status"`
+	EventTime *time.Time  `json:"event_time,omitempty"`
+	IngestID  string      `json:"ingest_id,omitempty"`
+}
+
+// exportTransform rewrites records before they are written, e.g. to anonymize them.
+// It returns false to leave a record out.
+type exportTransform interface {
+	Transform(rec ExportRecord) (ExportRecord, bool)
+}
+
+// hmacPseudonymizer replaces sender IDs with a keyed HMAC so the same device keeps the
+// same pseudonym across exports made with the same key, but the mapping cannot be
+// reversed or recomputed without it. Free text is removed: values are kept only when
+// they are numbers or booleans, and ingest IDs are dropped because they link back to
+// the raw payloads.
+type hmacPseudonymizer struct {
+	key []byte
+}
+
+func (p hmacPseudonymizer) pseudonym(senderID string) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(senderID))
+	return "dev_" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+func (p hmacPseudonymizer) Transform(rec ExportRecord) (ExportRecord, bool) {
+	pseudonym := p.pseudonym(rec.SenderID)
+	rec.Tag = pseudonymizeTag(rec.Tag, rec.SenderID, pseudonym)
+	rec.SenderID = pseudonym
+	rec.Value = scrubValue(rec.Value)
+	rec.IngestID = ""
+	return rec, true
+}
+
+// pseudonymizeTag replaces the sender ID that the tag templates append, as in
+// temperature_123, or prepend, as in 123_set_temperature. Other occurrences of the ID are
+// part of the tag text: sender 1 leaves the 1 in geofence_zone1_1 alone.
+func pseudonymizeTag(tag, senderID, pseudonym string) string {
+	if rest, ok := strings.CutSuffix(tag, "_"+senderID); ok {
+		return rest + "_" + pseudonym
+	}
+	if rest, ok := strings.CutPrefix(tag, senderID+"_"); ok {
+		return pseudonym + "_" + rest
+	}
+	return tag
+}
+
+// scrubValue keeps numeric and boolean values, including numbers sent as strings.
+func scrubValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case float64, bool:
+		return value
+	case string:
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// runExport writes the events between the --export-from and --export-to times, of the
+// devices matching --export-labels.
+func runExport(store Store) error {
+	var transforms []exportTransform
+	if *anonymizeFlag {
+		key := os.Getenv("EXPORT_HMAC_KEY")
+		if len(key) < 16 {
+			return fmt.Errorf("--anonymize needs EXPORT_HMAC_KEY of at least 16 characters")
+		}
+		transforms = append(transforms, hmacPseudonymizer{key: []byte(key)})
+	}
+
+	var q EventQuery
+	for _, bound := range []struct {
+		value string
+		dst   *time.Time
+	}{{*exportFromFlag, &q.From}, {*exportToFlag, &q.To}} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, bound.value)
+		if err != nil {
+			return fmt.Errorf("invalid export time %q: %v", bound.value, err)
+		}
+		*bound.dst = t
+	}
+	if *exportLabelsFlag != "" {
+		labels, err := parseLabelSelectors(strings.Split(*exportLabelsFlag, ","))
+		if err != nil {
+			return err
+		}
+		q.Labels = labels
+	}
+
+	compression, err := exportCompression(*exportFlag, *exportCompressFlag)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	var file *os.File
+	if *exportFlag != "-" {
+		if file, err = os.Create(*exportFlag); err != nil {
+			return fmt.Errorf("failed to create export file: %v", err)
+		}
+		defer file.Close()
+		out = file
+	}
+	var zw io.WriteCloser
+	switch compression {
+	case "zstd":
+		if zw, err = zstd.NewWriter(out); err != nil {
+			return fmt.Errorf("failed to start zstd export: %v", err)
+		}
+		out = zw
+	case "gzip":
+		zw = gzip.NewWriter(out)
+		out = zw
+	}
+
+	enc := json.NewEncoder(out)
+	count := 0
+	err = store.QueryEvents(q, func(e EventRecord) error {
+		rec := ExportRecord{SenderID: e.SenderID, Event: e.Event, Tag: e.Tag, Value: e.Value, Status: e.Status, EventTime: e.EventTime, IngestID: e.IngestID}
+		for _, t := range transforms {
+			var keep bool
+			if rec, keep = t.Transform(rec); !keep {
+				return nil
+			}
+		}
+		if err := enc.Encode(rec); err != nil {
+			return fmt.Errorf("failed to write export: %v", err)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export events: %v", err)
+	}
+	// The compressed stream has to be complete before the file is closed.
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("failed to write export: %v", err)
+		}
+	}
+	if file != nil {
+		if err := file.Close(); err != nil {
+			return fmt.Errorf("failed to write export: %v", err)
+		}
+	}
+	log.Printf("Exported %d events (anonymized: %v, compression: %s)", count, *anonymizeFlag, compression)
+	return nil
+}
+
+// exportCompression returns the coding of an export written to path: the one named by
+// --export-compress, or else the one its .zst or .gz suffix implies. It is "none" for an
+// uncompressed export.
+func exportCompression(path, coding string) (string, error) {
+	switch coding {
+	case "none", "zstd", "gzip":
+		return coding, nil
+	case "":
+	default:
+		return "", fmt.Errorf("invalid --export-compress %q: want zstd, gzip or none", coding)
+	}
+	switch {
+	case strings.HasSuffix(path, ".zst"), strings.HasSuffix(path, ".zstd"):
+		return "zstd", nil
+	case strings.HasSuffix(path, ".gz"):
+		return "gzip", nil
+	}
+	return "none", nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/klauspost/compress/zstd"
+)
+
+// useExportFlags sets the export flags for the test, writing to a file in a temp dir
+// whose path is returned.
+func useExportFlags(t *testing.T, labels string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "export.jsonl")
+	savedExport, savedLabels := *exportFlag, *exportLabelsFlag
+	*exportFlag, *exportLabelsFlag = path, labels
+	t.Cleanup(func() { *exportFlag, *exportLabelsFlag = savedExport, savedLabels })
+	return path
+}
+
+func TestRunExportLabelSelector(t *testing.T) {
+	path := useExportFlags(t, "customer=PLN, site=BDG")
+	db, mock := mockDB(t)
+
+	rows := sqlmock.NewRows([]string{"sender_id", "event_name", "tag", "value", "status", "event_time", "received_at", "ingest_id"}).
+		AddRow("m-1", "TEMPERATURE", "temperature_m-1", []byte("27.5"), true, nil, time.Unix(1700000000, 0), "")
+	mock.ExpectQuery(`FROM events WHERE true AND sender_id IN \(SELECT sender_id FROM devices WHERE labels @> \$1::jsonb\) ORDER BY id`).
+		WithArgs(`{"customer":"PLN","site":"BDG"}`).
+		WillReturnRows(rows)
+	if err := runExport(newPostgresStore(db)); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(out)), "\n"); len(lines) != 1 || !strings.Contains(lines[0], `"sender_id":"m-1"`) {
+		t.Errorf("export = %q, want the one event of m-1", out)
+	}
+}
+
+func TestRunExportRejectsLabelSelector(t *testing.T) {
+	for _, labels := range []string{"customer", "=PLN", "customer=PLN,"} {
+		useExportFlags(t, labels)
+		if err := runExport(nil); err == nil {
+			t.Errorf("runExport with --export-labels=%q succeeded", labels)
+		}
+	}
+}
+
+func TestParseLabelSelectors(t *testing.T) {
+	got, err := parseLabelSelectors([]string{"customer=PLN", " site = BDG "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"customer": "PLN", "site": "BDG"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseLabelSelectors = %v, want %v", got, want)
+	}
+}
+
+func TestRunExportCompressed(t *testing.T) {
+	tests := []struct {
+		file, compress string
+		decode         func(io.Reader) (io.Reader, error)
+	}{
+		{"export.jsonl.zst", "", func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }},
+		{"export.jsonl.gz", "", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"export.jsonl", "zstd", func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }},
+		{"export.jsonl.gz", "none", func(r io.Reader) (io.Reader, error) { return r, nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file+" "+tt.compress, func(t *testing.T) {
+			path := filepath.Join(filepath.Dir(useExportFlags(t, "")), tt.file)
+			savedExport, savedCompress := *exportFlag, *exportCompressFlag
+			*exportFlag, *exportCompressFlag = path, tt.compress
+			t.Cleanup(func() { *exportFlag, *exportCompressFlag = savedExport, savedCompress })
+			db, mock := mockDB(t)
+			rows := sqlmock.NewRows([]string{"sender_id", "event_name", "tag", "value", "status", "event_time", "received_at", "ingest_id"}).
+				AddRow("m-1", "TEMPERATURE", "temperature_m-1", []byte("27.5"), true, nil, time.Unix(1700000000, 0), "").
+				AddRow("m-2", "TEMPERATURE", "temperature_m-2", []byte("26"), true, nil, time.Unix(1700000001, 0), "")
+			mock.ExpectQuery(`FROM events WHERE true ORDER BY id`).WillReturnRows(rows)
+			if err := runExport(newPostgresStore(db)); err != nil {
+				t.Fatal(err)
+			}
+
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := tt.decode(bytes.NewReader(raw))
+			if err != nil {
+				t.Fatalf("decoding %s: %v", tt.file, err)
+			}
+			out, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("decoding %s: %v", tt.file, err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+			if len(lines) != 2 || !strings.Contains(lines[0], `"sender_id":"m-1"`) || !strings.Contains(lines[1], `"sender_id":"m-2"`) {
+				t.Errorf("export = %q, want the events of m-1 and m-2", out)
+			}
+		})
+	}
+}
+
+func TestExportCompressionRejectsUnknownCoding(t *testing.T) {
+	if _, err := exportCompression("export.jsonl", "brotli"); err == nil {
+		t.Error("exportCompression accepted brotli")
+	}
+}
+
+func TestPseudonymizeTag(t *testing.T) {
+	p := hmacPseudonymizer{key: []byte("0123456789abcdef")}
+	tests := []struct {
+		tag, senderID, want string
+	}{
+		{"temperature_123", "123", "temperature_" + p.pseudonym("123")},
+		{"123_set_temperature", "123", p.pseudonym("123") + "_set_temperature"},
+		{"temperature_1", "1", "temperature_" + p.pseudonym("1")},
+		{"geofence_zone1_1", "1", "geofence_zone1_" + p.pseudonym("1")},
+		{"1_set_temperature_1", "1", "1_set_temperature_" + p.pseudonym("1")},
+		{"collector_queue_depth", "modem-1", "collector_queue_depth"},
+	}
+	for _, tt := range tests {
+		rec, _ := p.Transform(ExportRecord{SenderID: tt.senderID, Tag: tt.tag})
+		if rec.Tag != tt.want {
+			t.Errorf("Transform tag %q of %s = %q, want %q", tt.tag, tt.senderID, rec.Tag, tt.want)
+		}
+	}
+}
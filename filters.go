@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// SavedFilter is a named DeviceFilter persisted server-side so the UI, reports and
+// notification rules can reference it by name (DeviceFilter.Saved or ?filter=name).
+type SavedFilter struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Filter      DeviceFilter `json:"filter"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+var errSavedFilterNotFound = errors.New("saved filter not found")
+
+func loadSavedFilter(db *sql.DB, name string) (SavedFilter, error) {
+	f := SavedFilter{Name: name}
+	var filter []byte
+	err := db.QueryRow("SELECT description, filter, updated_at FROM saved_filters WHERE name = $1", name).
+		Scan(&f.Description, &filter, &f.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return f, fmt.Errorf("%w: %s", errSavedFilterNotFound, name)
+	}
+	if err != nil {
+		return f, fmt.Errorf("failed to load saved filter %s: %v", name, err)
+	}
+	if err := json.Unmarshal(filter, &f.Filter); err != nil {
+		return f, fmt.Errorf("failed to decode saved filter %s: %v", name, err)
+	}
+	return f, nil
+}
+
+func listSavedFilters(db *sql.DB) ([]SavedFilter, error) {
+	rows, err := db.Query("SELECT name, description, filter, updated_at FROM saved_filters ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list saved filters: %v", err)
+	}
+	defer rows.Close()
+
+	filters := []SavedFilter{}
+	for rows.Next() {
+		var f SavedFilter
+		var filter []byte
+		if err := rows.Scan(&f.Name, &f.Description, &filter, &f.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan saved filter: %v", err)
+		}
+		if err := json.Unmarshal(filter, &f.Filter); err != nil {
+			return nil, fmt.Errorf("failed to decode saved filter %s: %v", f.Name, err)
+		}
+		filters = append(filters, f)
+	}
+	return filters, rows.Err()
+}
+
+func saveFilter(db *sql.DB, f SavedFilter) error {
+	filter, err := json.Marshal(f.Filter)
+	if err != nil {
+		return fmt.Errorf("failed to encode filter: %v", err)
+	}
+	_, err = db.Exec(`INSERT INTO saved_filters (name, description, filter, updated_at) VALUES ($1, $2, $3, $4)
+        ON CONFLICT (name) DO UPDATE SET description = EXCLUDED.description, filter = EXCLUDED.filter, updated_at = EXCLUDED.updated_at`,
+		f.Name, f.Description, string(filter), f.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save filter %s: %v", f.Name, err)
+	}
+	return nil
+}
+
+func handleListSavedFilters(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	filters, err := listSavedFilters(db)
+	if err != nil {
+		log.Printf("Error listing saved filters: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list saved filters")
+		return
+	}
+	writeCachedJSON(w, r, filters)
+}
+
+func handleGetSavedFilter(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	f, err := loadSavedFilter(db, r.PathValue("name"))
+	if errors.Is(err, errSavedFilterNotFound) {
+		writeError(w, http.StatusNotFound, "saved filter not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading saved filter: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load saved filter")
+		return
+	}
+	writeCachedJSON(w, r, f)
+}
+
+func handlePutSavedFilter(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var f SavedFilter
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be a JSON saved filter")
+		return
+	}
+	if f.Filter.Saved != "" {
+		writeError(w, http.StatusBadRequest, "a saved filter cannot reference another saved filter")
+		return
+	}
+	f.Name = r.PathValue("name")
+	f.UpdatedAt = clock.Now()
+	if err := saveFilter(db, f); err != nil {
+		log.Printf("Error saving filter: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to save filter")
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+func handleDeleteSavedFilter(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	res, err := db.Exec("DELETE FROM saved_filters WHERE name = $1", r.PathValue("name"))
+	if err != nil {
+		log.Printf("Error deleting saved filter: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to delete saved filter")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeError(w, http.StatusNotFound, "saved filter not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
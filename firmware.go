@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// FIRMWARE_INFO events report the firmware a device runs, OTA_STATUS events the
+// progress of an upgrade:
+//
+//	{"event": "FIRMWARE_INFO", "timestamp": "1718000000", "message": {"version": "1.4.2"}}
+//	{"event": "OTA_STATUS", "timestamp": "1718000000", "message": "status=downloading;version=1.5.0;campaign_id=c1"}
+//
+// The version is kept in the devices registry, only replaced by a newer report, and
+// published on firmware_<sender>. An upgrade publishes "started", "succeeded" or
+// "failed" on ota_<sender>; the intermediate stages a device reports are stored but
+// publish nothing, and a successful upgrade to a version updates the registry.
+
+// DeviceFirmware is the firmware a device last reported.
+type DeviceFirmware struct {
+	Version    string    `json:"version"`
+	ReportedAt time.Time `json:"reported_at"`
+}
+
+// OTA upgrade outcomes published on ota_<sender>.
+const (
+	otaStarted   = "started"
+	otaSucceeded = "succeeded"
+	otaFailed    = "failed"
+)
+
+// otaOutcome maps the status a device reports to the outcome it stands for, or "" for a
+// status that is neither.
+func otaOutcome(status string) string {
+	switch strings.ToLower(status) {
+	case "succeeded", "success", "done", "completed", "installed", "ok":
+		return otaSucceeded
+	case "failed", "fail", "error", "aborted", "rollback", "rolled_back":
+		return otaFailed
+	case "":
+		return ""
+	}
+	// started, downloading, verifying, installing, ...
+	return otaStarted
+}
+
+// setDeviceFirmware records the firmware version a device reported at a time, unless a
+// newer report is already stored.
+func setDeviceFirmware(db *sql.DB, senderID, version string, at time.Time) error {
+	_, err := db.Exec(`INSERT INTO devices (sender_id, firmware_version, firmware_at) VALUES ($1, $2, $3)
+        ON CONFLICT (sender_id) DO UPDATE SET firmware_version = EXCLUDED.firmware_version, firmware_at = EXCLUDED.firmware_at
+        WHERE devices.firmware_at IS NULL OR devices.firmware_at <= EXCLUDED.firmware_at`,
+		senderID, version, at)
+	if err != nil {
+		return fmt.Errorf("failed to update firmware of %s: %v", senderID, err)
+	}
+	knownDevices.Store(senderID, struct{}{})
+	return nil
+}
+
+// firmwareFields returns the fields of a FIRMWARE_INFO or OTA_STATUS message. A plain
+// string without key=value pairs, such as "1.4.2", is the version.
+func firmwareFields(message interface{}) map[string]string {
+	fields := parseFields(message)
+	if s, ok := message.(string); ok && len(fields) == 0 && strings.TrimSpace(s) != "" {
+		fields["version"] = strings.TrimSpace(s)
+	}
+	return fields
+}
+
+func handleFirmwareInfoEvent(store Store, messageStr, senderID, event, ingestID string, timestamp int64) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(messageStr), &payload); err != nil {
+		log.Printf("Error unmarshalling %s event message: %v", event, err)
+		return
+	}
+	version := firstField(firmwareFields(payload["message"]), "version", "firmware", "fw", "fw_version", "revision")
+	if version == "" {
+		log.Printf("[%s] Ignoring %s event from %s: no version in %v", ingestID, event, senderID, payload["message"])
+		return
+	}
+	if err := store.SetDeviceFirmware(senderID, version, time.UnixMilli(timestamp)); err != nil {
+		log.Printf("[%s] Error updating the registry with %s: %v", ingestID, event, err)
+	}
+	data := EventMessage{
+		EventName: event,
+		Tag:       fmt.Sprintf("firmware_%s", senderID),
+		Value:     version,
+		Status:    true,
+		Msg:       messageStr,
+		Time:      timestamp,
+		Sumber:    senderID,
+		IngestID:  ingestID,
+	}
+	processAndSaveData(store, data)
+	sendDataPoint(data)
+}
+
+// handleOTAStatusEvent records an upgrade stage reported as an event. "started" is
+// published once per upgrade: the upgrade in progress is kept in eventState as
+// <sender>_OTA_STATUS until it succeeds or fails.
+func handleOTAStatusEvent(store Store, messageStr, senderID, event, ingestID string, timestamp int64) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(messageStr), &payload); err != nil {
+		log.Printf("Error unmarshalling %s event message: %v", event, err)
+		return
+	}
+	fields := parseFields(payload["message"])
+	status := firstField(fields, "status", "state", "stage")
+	outcome := otaOutcome(status)
+	if outcome == "" {
+		log.Printf("[%s] Ignoring %s event from %s: no status in %v", ingestID, event, senderID, payload["message"])
+		return
+	}
+	version := firstField(fields, "version", "firmware", "fw")
+
+	if campaignID := firstField(fields, "campaign_id", "campaign"); campaignID != "" {
+		err := store.RecordCampaignOTAStatus(senderID, campaignID, status, firstField(fields, "detail", "error", "reason"))
+		if err != nil && err != errUnsupported {
+			log.Printf("[%s] %v", ingestID, err)
+		}
+	}
+	if outcome == otaSucceeded && version != "" {
+		if err := store.SetDeviceFirmware(senderID, version, time.UnixMilli(timestamp)); err != nil {
+			log.Printf("[%s] Error updating the registry with %s: %v", ingestID, event, err)
+		}
+	}
+
+	w := newCombinedWrite(store, senderID)
+	defer w.Close()
+	key := senderID + "_" + event
+	_, inProgress := w.Load(key)
+	data := EventMessage{
+		EventName: event,
+		Tag:       fmt.Sprintf("ota_%s", senderID),
+		Value:     outcome,
+		Status:    true,
+		Msg:       messageStr,
+		Time:      timestamp,
+		Sumber:    senderID,
+		IngestID:  ingestID,
+	}
+	if outcome == otaStarted {
+		if inProgress {
+			w.SaveQuiet(data)
+			w.Commit()
+			return
+		}
+		w.Store(key, true)
+	} else {
+		w.Delete(key)
+	}
+	log.Printf("[%s] OTA upgrade of %s %s (%s %s)", ingestID, senderID, outcome, status, version)
+	w.Save(data)
+	w.Commit()
+}
+
+func init() {
+	RegisterHandler(HandleEvents(func(ctx context.Context, store Store, m DeviceMessage) {
+		handleFirmwareInfoEvent(store, string(m.Payload), m.SenderID, m.Event, m.IngestID, m.Timestamp)
+	}, "FIRMWARE_INFO"))
+	RegisterHandler(HandleEvents(func(ctx context.Context, store Store, m DeviceMessage) {
+		handleOTAStatusEvent(store, string(m.Payload), m.SenderID, m.Event, m.IngestID, m.Timestamp)
+	}, "OTA_STATUS"))
+}
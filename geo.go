@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// geoRequest is what a GEOLOCATION event reports, in the shape of the Google
+// Geolocation API request body.
+type geoRequest struct {
+	CellTowers       []map[string]interface{} `json:"cellTowers"`
+	WifiAccessPoints []map[string]interface{} `json:"wifiAccessPoints,omitempty"`
+}
+
+// geoProvider resolves the cell towers and Wi-Fi access points of a GEOLOCATION event to
+// a location in the shape of the Google Geolocation API response:
+// {"location": {"lat", "lng"}, "accuracy"}.
+type geoProvider interface {
+	// Name identifies the provider in stored locations.
+	Name() string
+	Locate(req geoRequest) (map[string]interface{}, error)
+}
+
+// errNoCellTowers is returned by providers that only resolve cells when a request
+// has none, so a provider chain moves on to one that can use the access points.
+var errNoCellTowers = &geoStatusError{Status: http.StatusNotFound, Detail: "no cell towers"}
+
+var geolocator geoProvider = googleGeoProvider{name: "google", url: googleGeolocateURL}
+
+var geoHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+const (
+	googleGeolocateURL = "https://www.googleapis.com/geolocation/v1/geolocate"
+	unwiredLabsURL     = "https://us1.unwiredlabs.com/v2/process.php"
+	openCellIDURL      = "https://opencellid.org/cell/get"
+)
+
+// newGeoProvider returns the provider selected by GEO_PROVIDER. Each provider reads its
+// endpoint and key from GEO_<PROVIDER>_URL and GEO_<PROVIDER>_KEY; Google's key falls
+// back to API_KEY.
+func newGeoProvider(name string) (geoProvider, error) {
+	url := func(provider, def string) string { return getEnv("GEO_"+provider+"_URL", def) }
+	key := func(provider string) string { return os.Getenv("GEO_" + provider + "_KEY") }
+	switch name {
+	case "", "google":
+		return googleGeoProvider{name: "google", url: url("GOOGLE", googleGeolocateURL), key: getEnv("GEO_GOOGLE_KEY", apiKey)}, nil
+	case "mozilla":
+		// The public Mozilla Location Service was shut down in 2024; this talks to any
+		// server with its API, such as a self-hosted Ichnaea.
+		if url("MOZILLA", "") == "" {
+			return nil, fmt.Errorf("GEO_PROVIDER=mozilla needs GEO_MOZILLA_URL")
+		}
+		return googleGeoProvider{name: "mozilla", url: url("MOZILLA", ""), key: key("MOZILLA")}, nil
+	case "unwiredlabs":
+		if key("UNWIREDLABS") == "" {
+			return nil, fmt.Errorf("GEO_PROVIDER=unwiredlabs needs GEO_UNWIREDLABS_KEY")
+		}
+		return unwiredLabsProvider{url: url("UNWIREDLABS", unwiredLabsURL), token: key("UNWIREDLABS")}, nil
+	case "opencellid":
+		if key("OPENCELLID") == "" {
+			return nil, fmt.Errorf("GEO_PROVIDER=opencellid needs GEO_OPENCELLID_KEY")
+		}
+		return openCellIDProvider{url: url("OPENCELLID", openCellIDURL), key: key("OPENCELLID")}, nil
+	case "local":
+		return localCellProvider{}, nil
+	case "mock":
+		return mockGeoProvider{}, nil
+	default:
+		return nil, fmt.Errorf("unknown geolocation provider %q", name)
+	}
+}
+
+// googleGeoProvider calls the Google Geolocation API, or a service with the same API
+// such as the Mozilla Location Service.
+type googleGeoProvider struct {
+	name, url, key string
+}
+
+func (p googleGeoProvider) Name() string { return p.name }
+
+func (p googleGeoProvider) Locate(req geoRequest) (map[string]interface{}, error) {
+	url := p.url
+	if p.key != "" {
+		url += "?key=" + neturl.QueryEscape(p.key)
+	}
+	dataBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling geolocation data: %v", err)
+	}
+
+	log.Printf("Sending %s geolocation request with data: %s", p.name, string(dataBytes))
+
+	resp, err := geoHTTPClient.Post(url, "application/json", bytes.NewBuffer(dataBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to send geolocation request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, &geoStatusError{Status: resp.StatusCode, Detail: fmt.Sprintf("%+v", body)}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error decoding geolocation response: %v", err)
+	}
+	return body, nil
+}
+
+// geoStatusError is a lookup the provider answered with an error status.
+type geoStatusError struct {
+	Status int
+	Detail string
+}
+
+func (e *geoStatusError) Error() string {
+	return fmt.Sprintf("status code %d: %s", e.Status, e.Detail)
+}
+
+// geoResult builds a response in the Google shape from another provider's answer.
+func geoResult(lat, lng, accuracy float64) map[string]interface{} {
+	return map[string]interface{}{
+		"location": map[string]interface{}{"lat": lat, "lng": lng},
+		"accuracy": accuracy,
+	}
+}
+
+// unwiredLabsProvider calls the Unwired Labs LocationAPI with all towers and access
+// points in one request.
+type unwiredLabsProvider struct {
+	url, token string
+}
+
+func (unwiredLabsProvider) Name() string { return "unwiredlabs" }
+
+func (p unwiredLabsProvider) Locate(req geoRequest) (map[string]interface{}, error) {
+	if len(req.CellTowers) == 0 && len(req.WifiAccessPoints) == 0 {
+		return nil, &geoStatusError{Status: http.StatusNotFound, Detail: "no cell towers or access points"}
+	}
+	body := map[string]interface{}{"token": p.token, "address": 0}
+	if len(req.CellTowers) > 0 {
+		cells := make([]map[string]interface{}, 0, len(req.CellTowers))
+		for _, tower := range req.CellTowers {
+			cell := map[string]interface{}{"lac": tower["locationAreaCode"], "cid": tower["cellId"]}
+			if signal, ok := tower["signalStrength"]; ok {
+				cell["signal"] = signal
+			}
+			if ta, ok := tower["timingAdvance"]; ok {
+				cell["ta"] = ta
+			}
+			cells = append(cells, cell)
+		}
+		body["mcc"], _ = strconv.Atoi(fmt.Sprint(req.CellTowers[0]["mobileCountryCode"]))
+		body["mnc"], _ = strconv.Atoi(fmt.Sprint(req.CellTowers[0]["mobileNetworkCode"]))
+		body["cells"] = cells
+	}
+	if len(req.WifiAccessPoints) > 0 {
+		wifi := make([]map[string]interface{}, 0, len(req.WifiAccessPoints))
+		for _, ap := range req.WifiAccessPoints {
+			wifi = append(wifi, map[string]interface{}{"bssid": ap["macAddress"], "signal": ap["signalStrength"]})
+		}
+		body["wifi"] = wifi
+	}
+	dataBytes, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling geolocation data: %v", err)
+	}
+
+	resp, err := geoHTTPClient.Post(p.url, "application/json", bytes.NewBuffer(dataBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to send geolocation request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var answer struct {
+		Status   string  `json:"status"`
+		Message  string  `json:"message"`
+		Lat      float64 `json:"lat"`
+		Lon      float64 `json:"lon"`
+		Accuracy float64 `json:"accuracy"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&answer)
+	if resp.StatusCode != http.StatusOK {
+		return nil, &geoStatusError{Status: resp.StatusCode, Detail: answer.Message}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error decoding geolocation response: %v", err)
+	}
+	if answer.Status != "ok" {
+		// Errors come back with status 200; tell the ones the fallback cares about apart.
+		status := http.StatusBadGateway
+		switch message := strings.ToLower(answer.Message); {
+		case strings.Contains(message, "no matches"):
+			status = http.StatusNotFound
+		case strings.Contains(message, "balance"), strings.Contains(message, "limit"):
+			status = http.StatusTooManyRequests
+		}
+		return nil, &geoStatusError{Status: status, Detail: answer.Message}
+	}
+	return geoResult(answer.Lat, answer.Lon, answer.Accuracy), nil
+}
+
+// openCellIDProvider looks up the serving (first) tower in the OpenCelliD database. It
+// only knows single cells, so the accuracy is the cell's estimated range, and it
+// ignores Wi-Fi access points.
+type openCellIDProvider struct {
+	url, key string
+}
+
+func (openCellIDProvider) Name() string { return "opencellid" }
+
+func (p openCellIDProvider) Locate(req geoRequest) (map[string]interface{}, error) {
+	if len(req.CellTowers) == 0 {
+		return nil, errNoCellTowers
+	}
+	tower := req.CellTowers[0]
+	query := neturl.Values{
+		"key":    {p.key},
+		"mcc":    {fmt.Sprint(tower["mobileCountryCode"])},
+		"mnc":    {fmt.Sprint(tower["mobileNetworkCode"])},
+		"lac":    {fmt.Sprint(tower["locationAreaCode"])},
+		"cellid": {fmt.Sprint(tower["cellId"])},
+		"format": {"json"},
+	}
+	resp, err := geoHTTPClient.Get(p.url + "?" + query.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("failed to send geolocation request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Lat   *float64 `json:"lat"`
+		Lon   *float64 `json:"lon"`
+		Range float64  `json:"range"`
+		Error string   `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, &geoStatusError{Status: resp.StatusCode, Detail: body.Error}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error decoding geolocation response: %v", err)
+	}
+	if body.Lat == nil || body.Lon == nil {
+		return nil, &geoStatusError{Status: http.StatusNotFound, Detail: "cell not found " + body.Error}
+	}
+	return geoResult(*body.Lat, *body.Lon, body.Range), nil
+}
+
+// mockGeoProvider returns deterministic coordinates derived from the serving (first)
+// tower, or the first access point when there are no towers, so the geolocation path
+// can be exercised without network access or an API key.
+type mockGeoProvider struct{}
+
+func (mockGeoProvider) Name() string { return "mock" }
+
+func (mockGeoProvider) Locate(req geoRequest) (map[string]interface{}, error) {
+	h := fnv.New64a()
+	switch {
+	case len(req.CellTowers) > 0:
+		tower := req.CellTowers[0]
+		fmt.Fprintf(h, "%v/%v/%v/%v", tower["mobileCountryCode"], tower["mobileNetworkCode"], tower["locationAreaCode"], tower["cellId"])
+	case len(req.WifiAccessPoints) > 0:
+		fmt.Fprintf(h, "%v", req.WifiAccessPoints[0]["macAddress"])
+	default:
+		return nil, errNoCellTowers
+	}
+	sum := h.Sum64()
+
+	lat := float64(sum%1_000_000)/1_000_000*180 - 90
+	lng := float64((sum/1_000_000)%1_000_000)/1_000_000*360 - 180
+	return map[string]interface{}{
+		"location": map[string]interface{}{"lat": lat, "lng": lng},
+		"accuracy": float64(1000 / (len(req.CellTowers) + len(req.WifiAccessPoints))),
+	}, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var geoCacheLookups = newCounterVec("collector_geo_cache_lookups_total", "Geolocation lookups by cache result.", "result")
+
+// geoCache answers repeated lookups for the same cell towers and access points without
+// calling the provider (GEO_CACHE_TTL, default 7d; 0 disables). Answers are kept in
+// memory and, unless GEO_CACHE_DB=false, in geo_cache so they survive restarts and are
+// shared by all instances. Failed lookups are not cached.
+type geoCache struct {
+	provider geoProvider
+	db       *sql.DB // nil keeps the cache in memory only
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]geoCacheEntry
+}
+
+type geoCacheEntry struct {
+	response map[string]interface{}
+	expires  time.Time
+}
+
+func newGeoCache(provider geoProvider, db *sql.DB, ttl time.Duration) *geoCache {
+	return &geoCache{provider: provider, db: db, ttl: ttl, entries: map[string]geoCacheEntry{}}
+}
+
+func (c *geoCache) Name() string { return c.provider.Name() }
+
+// towerSetKey identifies a set of cell towers and access points regardless of the
+// order they were reported in. Signal strengths are left out, they vary between scans.
+func towerSetKey(req geoRequest) string {
+	keys := make([]string, 0, len(req.CellTowers)+len(req.WifiAccessPoints))
+	for _, t := range req.CellTowers {
+		keys = append(keys, fmt.Sprintf("%v-%v-%v-%v", t["mobileCountryCode"], t["mobileNetworkCode"], t["locationAreaCode"], t["cellId"]))
+	}
+	for _, ap := range req.WifiAccessPoints {
+		keys = append(keys, fmt.Sprintf("wifi-%v", ap["macAddress"]))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+func (c *geoCache) Locate(req geoRequest) (map[string]interface{}, error) {
+	key := towerSetKey(req)
+	now := clock.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && now.After(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if ok {
+		geoCacheLookups.Inc("memory")
+		return entry.response, nil
+	}
+
+	if c.db != nil {
+		var raw []byte
+		var resolvedAt time.Time
+		err := c.db.QueryRow("SELECT response, resolved_at FROM geo_cache WHERE tower_key = $1 AND provider = $2", key, c.provider.Name()).Scan(&raw, &resolvedAt)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error reading geolocation cache: %v", err)
+		}
+		var response map[string]interface{}
+		if err == nil && now.Before(resolvedAt.Add(c.ttl)) && json.Unmarshal(raw, &response) == nil {
+			geoCacheLookups.Inc("db")
+			c.remember(key, response, resolvedAt.Add(c.ttl))
+			return response, nil
+		}
+	}
+
+	geoCacheLookups.Inc("miss")
+	response, err := c.provider.Locate(req)
+	if err != nil {
+		return nil, err
+	}
+	c.remember(key, response, now.Add(c.ttl))
+	if c.db != nil {
+		raw, _ := json.Marshal(response)
+		_, err := c.db.Exec(`INSERT INTO geo_cache (tower_key, provider, response, resolved_at) VALUES ($1, $2, $3, $4)
+            ON CONFLICT (tower_key) DO UPDATE SET provider = EXCLUDED.provider, response = EXCLUDED.response, resolved_at = EXCLUDED.resolved_at`,
+			key, c.provider.Name(), raw, now)
+		if err != nil {
+			log.Printf("Error writing geolocation cache: %v", err)
+		}
+	}
+	return response, nil
+}
+
+// remember keeps response in memory until expires, dropping expired entries as it goes
+// so the map does not grow with towers that are never seen again.
+func (c *geoCache) remember(key string, response map[string]interface{}, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := clock.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = geoCacheEntry{response: response, expires: expires}
+}
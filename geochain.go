@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var geoLookups = newCounterVec("collector_geo_lookups_total", "Geolocation provider calls, labeled provider/outcome, e.g. google/quota.", "result")
+
+var geoCircuitOpen = newGaugeVec("collector_geo_circuit_open", "1 while a geolocation provider's circuit breaker is open.", "provider")
+
+// Geolocation retry and circuit breaker settings (GEO_RETRY_ATTEMPTS, GEO_RETRY_BASE,
+// GEO_BREAKER_THRESHOLD, GEO_BREAKER_COOLDOWN).
+var (
+	geoRetryAttempts    = 3
+	geoRetryBase        = 500 * time.Millisecond
+	geoBreakerThreshold = 5
+	geoBreakerCooldown  = 5 * time.Minute
+)
+
+// geoChain tries the providers of GEO_PROVIDER (e.g. "google,unwiredlabs") in order.
+// Transient failures (network errors, 5xx) are retried with jittered backoff; a quota
+// or key error (403, 429) opens that provider's breaker at once, since retrying only
+// burns more quota. Repeated failures open it too. While a breaker is open the provider
+// is skipped, and a lookup the provider cannot answer (404) moves on to the next one.
+// The answering provider is recorded under "provider" in the response.
+type geoChain struct {
+	providers []geoProvider
+	breakers  []*circuitBreaker
+}
+
+// newGeoChain builds the chain for a comma-separated list of providers.
+func newGeoChain(names string) (*geoChain, error) {
+	c := &geoChain{}
+	for _, name := range strings.Split(names, ",") {
+		p, err := newGeoProvider(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		c.providers = append(c.providers, p)
+		c.breakers = append(c.breakers, &circuitBreaker{name: "Geolocation provider " + p.Name(), threshold: geoBreakerThreshold, cooldown: geoBreakerCooldown})
+	}
+	return c, nil
+}
+
+func (c *geoChain) Name() string {
+	names := make([]string, len(c.providers))
+	for i, p := range c.providers {
+		names[i] = p.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+func (c *geoChain) Locate(req geoRequest) (map[string]interface{}, error) {
+	var errs []error
+	for i, p := range c.providers {
+		breaker := c.breakers[i]
+		if !breaker.Allow() {
+			geoLookups.Inc(p.Name() + "/circuit_open")
+			continue
+		}
+		response, err := locateWithRetry(p, req)
+		var outcome string
+		switch {
+		case err == nil:
+			breaker.Success()
+			response["provider"] = p.Name()
+			outcome = "ok"
+		case geoErrorStatus(err) == http.StatusNotFound:
+			breaker.Success()
+			outcome = "not_found"
+		case geoErrorStatus(err) == http.StatusForbidden || geoErrorStatus(err) == http.StatusTooManyRequests:
+			breaker.Trip()
+			outcome = "quota"
+		default:
+			breaker.Failure()
+			outcome = "error"
+		}
+		geoLookups.Inc(p.Name() + "/" + outcome)
+		geoCircuitOpen.Set(p.Name(), boolGauge(breaker.Open()))
+		if err == nil {
+			return response, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %v", p.Name(), err))
+		if i < len(c.providers)-1 {
+			log.Printf("Geolocation provider %s failed (%v), trying the next one", p.Name(), err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("all geolocation providers are unavailable (circuit open)")
+	}
+	return nil, errors.Join(errs...)
+}
+
+// locateWithRetry retries network errors and server errors; any other answer is final.
+func locateWithRetry(p geoProvider, req geoRequest) (map[string]interface{}, error) {
+	var err error
+	for attempt := 0; attempt < max(geoRetryAttempts, 1); attempt++ {
+		if attempt > 0 {
+			backoff := geoRetryBase << (attempt - 1)
+			<-clock.After(time.Duration(rand.Int63n(int64(backoff) + 1)))
+		}
+		var response map[string]interface{}
+		if response, err = p.Locate(req); err == nil {
+			return response, nil
+		}
+		if status := geoErrorStatus(err); status != 0 && status < 500 {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// geoErrorStatus is the HTTP status of a provider error, or 0 when there was none.
+func geoErrorStatus(err error) int {
+	var statusErr *geoStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Status
+	}
+	return 0
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
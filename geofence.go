@@ -0,0 +1,252 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Geofence is a circle or polygon a device is expected to stay in (or out of). Every
+// resolved location is checked against the device's fences; crossing one publishes
+// GEOFENCE_EXIT (value 1, an alarm) or GEOFENCE_ENTER (value 0, its clear) on the tag
+// geofence_<name>_<sender>. A location only counts as outside when it is further from
+// the fence than its accuracy, so an imprecise cell-tower fix does not raise an exit.
+type Geofence struct {
+	SenderID  string       `json:"sender_id"`
+	Name      string       `json:"name"`
+	Lat       *float64     `json:"lat,omitempty"`
+	Lng       *float64     `json:"lng,omitempty"`
+	RadiusM   *float64     `json:"radius_m,omitempty"`
+	Polygon   [][2]float64 `json:"polygon,omitempty"` // [lat, lng] points
+	Inside    *bool        `json:"inside"`
+	StateAt   *time.Time   `json:"state_at,omitempty"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+const earthRadiusM = 6371000.0
+
+// validate checks that f is either a circle or a polygon with valid coordinates.
+func (f Geofence) validate() error {
+	if len(f.Polygon) > 0 {
+		if f.RadiusM != nil || f.Lat != nil || f.Lng != nil {
+			return errors.New("a geofence is either a polygon or a circle (lat, lng, radius_m)")
+		}
+		if len(f.Polygon) < 3 {
+			return errors.New("a polygon needs at least 3 points")
+		}
+		for _, p := range f.Polygon {
+			if p[0] < -90 || p[0] > 90 || p[1] < -180 || p[1] > 180 {
+				return fmt.Errorf("polygon point %v out of range", p)
+			}
+		}
+		return nil
+	}
+	if f.Lat == nil || f.Lng == nil || f.RadiusM == nil {
+		return errors.New("a circle needs lat, lng and radius_m")
+	}
+	if *f.Lat < -90 || *f.Lat > 90 || *f.Lng < -180 || *f.Lng > 180 {
+		return errors.New("lat or lng out of range")
+	}
+	if *f.RadiusM <= 0 {
+		return errors.New("radius_m must be positive")
+	}
+	return nil
+}
+
+// distanceM is the great-circle distance between two points in metres.
+func distanceM(lat1, lng1, lat2, lng2 float64) float64 {
+	rad := math.Pi / 180
+	dLat, dLng := (lat2-lat1)*rad, (lng2-lng1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusM * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// contains reports whether the point is in f, and how far it is from f's boundary.
+func (f Geofence) contains(lat, lng float64) (inside bool, boundaryM float64) {
+	if len(f.Polygon) == 0 {
+		d := distanceM(*f.Lat, *f.Lng, lat, lng)
+		return d <= *f.RadiusM, math.Abs(d - *f.RadiusM)
+	}
+	// Project the polygon onto a plane around the point, in metres, with the point at
+	// the origin; fences are small enough for the distortion not to matter.
+	rad := math.Pi / 180
+	xy := func(p [2]float64) (float64, float64) {
+		return (p[1] - lng) * rad * earthRadiusM * math.Cos(lat*rad), (p[0] - lat) * rad * earthRadiusM
+	}
+	boundaryM = math.Inf(1)
+	for i := range f.Polygon {
+		x1, y1 := xy(f.Polygon[i])
+		x2, y2 := xy(f.Polygon[(i+1)%len(f.Polygon)])
+		if (y1 > 0) != (y2 > 0) && x1+(0-y1)*(x2-x1)/(y2-y1) > 0 {
+			inside = !inside
+		}
+		boundaryM = math.Min(boundaryM, segmentDistance(x1, y1, x2, y2))
+	}
+	return inside, boundaryM
+}
+
+// segmentDistance is the distance from the origin to the segment (x1,y1)-(x2,y2).
+func segmentDistance(x1, y1, x2, y2 float64) float64 {
+	dx, dy := x2-x1, y2-y1
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = math.Max(0, math.Min(1, -(x1*dx+y1*dy)/l))
+	}
+	return math.Hypot(x1+t*dx, y1+t*dy)
+}
+
+// checkGeofences compares loc with the device's fences and publishes the crossings.
+// The first location after a fence is saved only records which side the device is on.
+func checkGeofences(store Store, loc Location) {
+	fences, err := store.Geofences(loc.SenderID)
+	if err == errUnsupported {
+		return
+	}
+	if err != nil {
+		log.Printf("[%s] Error loading geofences: %v", loc.IngestID, err)
+		return
+	}
+	accuracy := 0.0
+	if loc.Accuracy != nil {
+		accuracy = *loc.Accuracy
+	}
+	for _, f := range fences {
+		inside, boundaryM := f.contains(loc.Lat, loc.Lng)
+		if !inside && boundaryM <= accuracy {
+			continue // may still be inside
+		}
+		// Only the first location to see the change publishes it, and older locations
+		// resolved late do not overwrite newer ones.
+		changed, err := store.SetGeofenceState(f.SenderID, f.Name, inside, loc.ResolvedAt)
+		if err != nil {
+			log.Printf("[%s] Error updating geofence %s: %v", loc.IngestID, f.Name, err)
+			continue
+		}
+		if !changed || f.Inside == nil {
+			continue
+		}
+		event, value, crossed := "GEOFENCE_EXIT", 1, "left"
+		if inside {
+			event, value, crossed = "GEOFENCE_ENTER", 0, "entered"
+		}
+		log.Printf("[%s] %s %s geofence %s", loc.IngestID, loc.SenderID, crossed, f.Name)
+		detail, _ := json.Marshal(map[string]interface{}{"geofence": f.Name, "lat": loc.Lat, "lng": loc.Lng, "accuracy": loc.Accuracy, "boundary_distance_m": math.Round(boundaryM)})
+		message := EventMessage{
+			EventName: event,
+			Tag:       fmt.Sprintf("geofence_%s_%s", f.Name, loc.SenderID),
+			Value:     value,
+			Status:    true,
+			Msg:       string(detail),
+			Time:      loc.ResolvedAt.UnixMilli(),
+			Sumber:    loc.SenderID,
+			IngestID:  loc.IngestID,
+		}
+		processAndSaveData(store, message)
+		sendDataPoint(message)
+	}
+}
+
+// setGeofenceState records which side of a fence a device is on, unless it already was
+// or a newer location was recorded, and reports whether it changed.
+func setGeofenceState(db *sql.DB, senderID, name string, inside bool, at time.Time) (bool, error) {
+	res, err := db.Exec(`UPDATE geofences SET inside = $3, state_at = $4
+        WHERE sender_id = $1 AND name = $2 AND inside IS DISTINCT FROM $3 AND (state_at IS NULL OR state_at <= $4)`,
+		senderID, name, inside, at)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func listGeofences(db *sql.DB, senderID string) ([]Geofence, error) {
+	rows, err := db.Query(`SELECT sender_id, name, lat, lng, radius_m, polygon, inside, state_at, updated_at
+        FROM geofences WHERE sender_id = $1 ORDER BY name`, senderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list geofences: %v", err)
+	}
+	defer rows.Close()
+	fences := []Geofence{}
+	for rows.Next() {
+		var f Geofence
+		var polygon []byte
+		if err := rows.Scan(&f.SenderID, &f.Name, &f.Lat, &f.Lng, &f.RadiusM, &polygon, &f.Inside, &f.StateAt, &f.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan geofence: %v", err)
+		}
+		if len(polygon) > 0 {
+			if err := json.Unmarshal(polygon, &f.Polygon); err != nil {
+				return nil, fmt.Errorf("failed to decode geofence %s: %v", f.Name, err)
+			}
+		}
+		fences = append(fences, f)
+	}
+	return fences, rows.Err()
+}
+
+// saveGeofence creates or replaces f; a replaced fence starts over without a state.
+func saveGeofence(db *sql.DB, f Geofence) error {
+	var polygon []byte
+	if len(f.Polygon) > 0 {
+		var err error
+		if polygon, err = json.Marshal(f.Polygon); err != nil {
+			return fmt.Errorf("failed to encode polygon: %v", err)
+		}
+	}
+	_, err := db.Exec(`INSERT INTO geofences (sender_id, name, lat, lng, radius_m, polygon, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7)
+        ON CONFLICT (sender_id, name) DO UPDATE SET lat = EXCLUDED.lat, lng = EXCLUDED.lng, radius_m = EXCLUDED.radius_m,
+            polygon = EXCLUDED.polygon, inside = NULL, state_at = NULL, updated_at = EXCLUDED.updated_at`,
+		f.SenderID, f.Name, f.Lat, f.Lng, f.RadiusM, polygon, f.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save geofence %s: %v", f.Name, err)
+	}
+	return nil
+}
+
+func handleListGeofences(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	fences, err := listGeofences(db, r.PathValue("id"))
+	if err != nil {
+		log.Printf("Error listing geofences: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list geofences")
+		return
+	}
+	writeJSON(w, http.StatusOK, fences)
+}
+
+func handlePutGeofence(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var f Geofence
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be a JSON geofence")
+		return
+	}
+	if err := f.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	f.SenderID, f.Name = r.PathValue("id"), r.PathValue("name")
+	f.Inside, f.StateAt, f.UpdatedAt = nil, nil, clock.Now()
+	if err := saveGeofence(db, f); err != nil {
+		log.Printf("Error saving geofence: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to save geofence")
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+func handleDeleteGeofence(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	res, err := db.Exec("DELETE FROM geofences WHERE sender_id = $1 AND name = $2", r.PathValue("id"), r.PathValue("name"))
+	if err != nil {
+		log.Printf("Error deleting geofence: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to delete geofence")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeError(w, http.StatusNotFound, "geofence not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+var geoRequests = newCounterVec("collector_geo_requests_total", "Queued geolocation lookups, by result.", "result")
+
+// geoJob is one geolocation lookup for a GEOLOCATION event.
+type geoJob struct {
+	ID          int64
+	SenderID    string
+	Event       string
+	IngestID    string
+	Request     geoRequest
+	RequestedAt time.Time
+}
+
+// geoQueue resolves geolocation lookups on background workers (GEO_WORKERS, default 2;
+// 0 resolves them inline on the message path). Lookups are persisted in geo_requests
+// before the handler returns, so a restart or a provider outage does not lose them:
+// failed lookups are retried with backoff up to GEO_MAX_ATTEMPTS times and every
+// instance sharing the database helps work off the queue.
+type geoQueue struct {
+	db          *sql.DB
+	store       Store
+	wake        chan struct{}
+	poll        time.Duration
+	lease       time.Duration
+	maxAttempts int
+}
+
+var geoJobs *geoQueue
+
+func newGeoQueue(db *sql.DB, store Store, workers, maxAttempts int, poll time.Duration) *geoQueue {
+	q := &geoQueue{db: db, store: store, wake: make(chan struct{}, workers), poll: poll, lease: 5 * time.Minute, maxAttempts: maxAttempts}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	log.Printf("Started %d geolocation workers", workers)
+	return q
+}
+
+// Enqueue persists job and wakes a worker.
+func (q *geoQueue) Enqueue(job geoJob) error {
+	towers, err := json.Marshal(job.Request.CellTowers)
+	if err != nil {
+		return err
+	}
+	var wifi []byte
+	if len(job.Request.WifiAccessPoints) > 0 {
+		if wifi, err = json.Marshal(job.Request.WifiAccessPoints); err != nil {
+			return err
+		}
+	}
+	_, err = q.db.Exec(`INSERT INTO geo_requests (sender_id, event, ingest_id, cell_towers, wifi_access_points, requested_at, next_attempt_at)
+        VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $6)`, job.SenderID, job.Event, job.IngestID, towers, wifi, job.RequestedAt)
+	if err != nil {
+		return err
+	}
+	geoRequests.Inc("queued")
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *geoQueue) work() {
+	for {
+		job, attempts, ok, err := q.claim()
+		if err != nil {
+			log.Printf("Error claiming geolocation request: %v", err)
+		}
+		if !ok {
+			select {
+			case <-q.wake:
+			case <-clock.After(q.poll):
+			}
+			continue
+		}
+		if err := resolveGeolocation(q.store, job); err != nil {
+			q.fail(job, attempts, err)
+			continue
+		}
+		if _, err := q.db.Exec("DELETE FROM geo_requests WHERE id = $1", job.ID); err != nil {
+			log.Printf("[%s] Error removing resolved geolocation request: %v", job.IngestID, err)
+		}
+		geoRequests.Inc("resolved")
+	}
+}
+
+// claim takes the oldest due request and leases it to this worker.
+func (q *geoQueue) claim() (geoJob, int, bool, error) {
+	var job geoJob
+	var towers, wifi []byte
+	var attempts int
+	now := clock.Now()
+	err := q.db.QueryRow(`UPDATE geo_requests SET attempts = attempts + 1, next_attempt_at = $1
+        WHERE id = (SELECT id FROM geo_requests WHERE next_attempt_at <= $2 AND attempts < $3
+                    ORDER BY next_attempt_at, id LIMIT 1 FOR UPDATE SKIP LOCKED)
+        RETURNING id, sender_id, event, COALESCE(ingest_id, ''), cell_towers, wifi_access_points, requested_at, attempts`,
+		now.Add(q.lease), now, q.maxAttempts).
+		Scan(&job.ID, &job.SenderID, &job.Event, &job.IngestID, &towers, &wifi, &job.RequestedAt, &attempts)
+	if err == sql.ErrNoRows {
+		return job, 0, false, nil
+	}
+	if err != nil {
+		return job, 0, false, err
+	}
+	// Keep cell IDs as written; float64 would print large ones in exponent form.
+	dec := json.NewDecoder(bytes.NewReader(towers))
+	dec.UseNumber()
+	if err := dec.Decode(&job.Request.CellTowers); err != nil {
+		return job, 0, false, fmt.Errorf("invalid cell towers in geolocation request %d: %v", job.ID, err)
+	}
+	if len(wifi) > 0 {
+		dec = json.NewDecoder(bytes.NewReader(wifi))
+		dec.UseNumber()
+		if err := dec.Decode(&job.Request.WifiAccessPoints); err != nil {
+			return job, 0, false, fmt.Errorf("invalid access points in geolocation request %d: %v", job.ID, err)
+		}
+	}
+	return job, attempts, true, nil
+}
+
+// fail schedules the next attempt, backing off from one minute up to an hour.
+func (q *geoQueue) fail(job geoJob, attempts int, err error) {
+	backoff := min(time.Minute<<(attempts-1), time.Hour)
+	result := "retry"
+	if attempts >= q.maxAttempts {
+		result = "failed"
+		log.Printf("[%s] Giving up geolocation for %s after %d attempts: %v", job.IngestID, job.SenderID, attempts, err)
+	} else {
+		log.Printf("[%s] Geolocation for %s failed, retrying in %v: %v", job.IngestID, job.SenderID, backoff, err)
+	}
+	geoRequests.Inc(result)
+	if _, err := q.db.Exec("UPDATE geo_requests SET next_attempt_at = $2, last_error = $3 WHERE id = $1",
+		job.ID, clock.Now().Add(backoff), err.Error()); err != nil {
+		log.Printf("[%s] Error rescheduling geolocation request: %v", job.IngestID, err)
+	}
+}
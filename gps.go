@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GPS events carry a position the modem's GNSS receiver fixed itself, so unlike
+// GEOLOCATION they need no provider lookup. The message is either NMEA sentences
+// ($GPGGA/$GPRMC, or the $GN/$GL/$GA/$BD talkers of multi-constellation receivers),
+// "lat,lng" in decimal degrees, or an object:
+//
+//	{"event": "GPS", "timestamp": "1718000000", "message": "$GPGGA,...*47\r\n$GPRMC,...*6A"}
+//	{"event": "GPS", "timestamp": "1718000000", "message": {"lat": -6.2, "lng": 106.8, "accuracy": 8}}
+//
+// lat/lng may also sit next to the message at the top level of the payload.
+
+// gnssUERE is the user equivalent range error in metres that an HDOP is scaled by to
+// estimate the horizontal accuracy of a fix.
+const gnssUERE = 5.0
+
+// gpsFix is a position reported by a device's GNSS receiver.
+type gpsFix struct {
+	Lat, Lng   float64
+	Accuracy   *float64
+	Altitude   *float64 // metres above mean sea level
+	Speed      *float64 // metres per second
+	Course     *float64 // degrees from true north
+	Satellites *int
+	Time       *time.Time // UTC time of the fix, when the receiver reported the date
+}
+
+// response returns the fix in the shape of a geolocation response, so GPS and
+// GEOLOCATION datapoints can be consumed alike.
+func (f gpsFix) response() map[string]interface{} {
+	resp := map[string]interface{}{
+		"location": map[string]interface{}{"lat": f.Lat, "lng": f.Lng},
+		"provider": "gnss",
+	}
+	if f.Accuracy != nil {
+		resp["accuracy"] = *f.Accuracy
+	}
+	if f.Altitude != nil {
+		resp["altitude"] = *f.Altitude
+	}
+	if f.Speed != nil {
+		resp["speed"] = *f.Speed
+	}
+	if f.Course != nil {
+		resp["course"] = *f.Course
+	}
+	if f.Satellites != nil {
+		resp["satellites"] = *f.Satellites
+	}
+	return resp
+}
+
+// validCoordinates rejects positions out of range and the 0,0 receivers report
+// before they have a fix.
+func validCoordinates(lat, lng float64) bool {
+	return lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180 && (lat != 0 || lng != 0)
+}
+
+// parseGPSPayload extracts the fix from a GPS event payload.
+func parseGPSPayload(payload map[string]interface{}) (gpsFix, error) {
+	if fix, ok := gpsFixFromObject(payload); ok {
+		return fix, nil
+	}
+	switch message := payload["message"].(type) {
+	case map[string]interface{}:
+		if fix, ok := gpsFixFromObject(message); ok {
+			return fix, nil
+		}
+		return gpsFix{}, fmt.Errorf("no valid lat/lng in message")
+	case string:
+		if strings.Contains(message, "$") {
+			return parseNMEA(message)
+		}
+		return parseDecimalPosition(message)
+	}
+	return gpsFix{}, fmt.Errorf("message not found")
+}
+
+// gpsFixFromObject reads lat, lng (or lon) and the optional accuracy or hdop of obj.
+func gpsFixFromObject(obj map[string]interface{}) (gpsFix, bool) {
+	lat, latOK := numericValue(obj["lat"])
+	lng, lngOK := numericValue(obj["lng"])
+	if !lngOK {
+		lng, lngOK = numericValue(obj["lon"])
+	}
+	if !latOK || !lngOK || !validCoordinates(lat, lng) {
+		return gpsFix{}, false
+	}
+	fix := gpsFix{Lat: lat, Lng: lng}
+	if accuracy, ok := numericValue(obj["accuracy"]); ok {
+		fix.Accuracy = &accuracy
+	} else if hdop, ok := numericValue(obj["hdop"]); ok {
+		accuracy := hdop * gnssUERE
+		fix.Accuracy = &accuracy
+	}
+	if altitude, ok := numericValue(obj["altitude"]); ok {
+		fix.Altitude = &altitude
+	}
+	return fix, true
+}
+
+// parseDecimalPosition parses "lat,lng" or "lat,lng,accuracy" in decimal degrees.
+func parseDecimalPosition(message string) (gpsFix, error) {
+	fields := strings.Split(strings.TrimSpace(message), ",")
+	if len(fields) < 2 || len(fields) > 3 {
+		return gpsFix{}, fmt.Errorf("expected lat,lng in %q", message)
+	}
+	var values []float64
+	for _, f := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return gpsFix{}, fmt.Errorf("invalid coordinate %q", f)
+		}
+		values = append(values, v)
+	}
+	if !validCoordinates(values[0], values[1]) {
+		return gpsFix{}, fmt.Errorf("coordinates %v,%v out of range", values[0], values[1])
+	}
+	fix := gpsFix{Lat: values[0], Lng: values[1]}
+	if len(values) == 3 {
+		fix.Accuracy = &values[2]
+	}
+	return fix, nil
+}
+
+// parseNMEA combines the GGA and RMC sentences of message into one fix: the position
+// of the first valid sentence, HDOP, altitude and satellites from GGA and the date,
+// speed and course from RMC. Sentences with a bad checksum or no fix are skipped.
+func parseNMEA(message string) (gpsFix, error) {
+	var fix gpsFix
+	found := false
+	for _, line := range strings.FieldsFunc(message, func(r rune) bool { return r == '\r' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		start := strings.IndexByte(line, '$')
+		if start < 0 {
+			continue
+		}
+		fields, err := nmeaFields(line[start:])
+		if err != nil {
+			log.Printf("Skipping NMEA sentence %q: %v", line, err)
+			continue
+		}
+		if len(fields[0]) != 5 {
+			continue
+		}
+		switch fields[0][2:] {
+		case "GGA":
+			// $GPGGA,time,lat,N,lng,E,quality,satellites,hdop,altitude,M,...
+			if len(fields) < 10 || fields[6] == "" || fields[6] == "0" {
+				continue
+			}
+			lat, lng, ok := nmeaPosition(fields[2], fields[3], fields[4], fields[5])
+			if !ok {
+				continue
+			}
+			if !found {
+				fix.Lat, fix.Lng, found = lat, lng, true
+			}
+			if satellites, err := strconv.Atoi(fields[7]); err == nil {
+				fix.Satellites = &satellites
+			}
+			if hdop, err := strconv.ParseFloat(fields[8], 64); err == nil {
+				accuracy := hdop * gnssUERE
+				fix.Accuracy = &accuracy
+			}
+			if altitude, err := strconv.ParseFloat(fields[9], 64); err == nil {
+				fix.Altitude = &altitude
+			}
+		case "RMC":
+			// $GPRMC,time,status,lat,N,lng,E,knots,course,ddmmyy,...
+			if len(fields) < 10 || fields[2] != "A" {
+				continue
+			}
+			lat, lng, ok := nmeaPosition(fields[3], fields[4], fields[5], fields[6])
+			if !ok {
+				continue
+			}
+			if !found {
+				fix.Lat, fix.Lng, found = lat, lng, true
+			}
+			if knots, err := strconv.ParseFloat(fields[7], 64); err == nil {
+				speed := knots * 1852 / 3600
+				fix.Speed = &speed
+			}
+			if course, err := strconv.ParseFloat(fields[8], 64); err == nil {
+				fix.Course = &course
+			}
+			if at, err := time.Parse("020106150405", fields[9]+strings.SplitN(fields[1], ".", 2)[0]); err == nil {
+				fix.Time = &at
+			}
+		}
+	}
+	if !found {
+		return gpsFix{}, fmt.Errorf("no valid GGA or RMC fix")
+	}
+	return fix, nil
+}
+
+// nmeaFields verifies the checksum of sentence, when it has one, and splits it into
+// its fields; the first is the talker and sentence type without the $.
+func nmeaFields(sentence string) ([]string, error) {
+	body := sentence[1:]
+	if i := strings.IndexByte(body, '*'); i >= 0 {
+		want, err := strconv.ParseUint(strings.TrimSpace(body[i+1:]), 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checksum")
+		}
+		body = body[:i]
+		var sum byte
+		for j := 0; j < len(body); j++ {
+			sum ^= body[j]
+		}
+		if sum != byte(want) {
+			return nil, fmt.Errorf("checksum %02X, expected %02X", sum, want)
+		}
+	}
+	return strings.Split(body, ","), nil
+}
+
+// nmeaPosition converts NMEA ddmm.mmmm/dddmm.mmmm coordinates and their hemispheres
+// to decimal degrees.
+func nmeaPosition(lat, ns, lng, ew string) (float64, float64, bool) {
+	latDeg, ok1 := nmeaDegrees(lat)
+	lngDeg, ok2 := nmeaDegrees(lng)
+	if !ok1 || !ok2 {
+		return 0, 0, false
+	}
+	switch ns {
+	case "S":
+		latDeg = -latDeg
+	case "N":
+	default:
+		return 0, 0, false
+	}
+	switch ew {
+	case "W":
+		lngDeg = -lngDeg
+	case "E":
+	default:
+		return 0, 0, false
+	}
+	return latDeg, lngDeg, validCoordinates(latDeg, lngDeg)
+}
+
+func nmeaDegrees(s string) (float64, bool) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, false
+	}
+	degrees := math.Floor(v / 100)
+	minutes := v - degrees*100
+	if minutes >= 60 {
+		return 0, false
+	}
+	return degrees + minutes/60, true
+}
+
+// handleGPSEvent stores and publishes a GNSS fix the way resolveGeolocation does a
+// resolved cell scan, with "gnss" as the provider.
+func handleGPSEvent(store Store, messageStr, senderID, event, ingestID string, timestamp int64) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(messageStr), &payload); err != nil {
+		log.Printf("Error unmarshaling GPS message: %v", err)
+		return
+	}
+	fix, err := parseGPSPayload(payload)
+	if err != nil {
+		log.Printf("[%s] Ignoring GPS event from %s: %v", ingestID, senderID, err)
+		return
+	}
+
+	at := time.UnixMilli(timestamp)
+	if fix.Time != nil {
+		at = *fix.Time
+	}
+
+	loc := Location{SenderID: senderID, Lat: fix.Lat, Lng: fix.Lng, Accuracy: fix.Accuracy,
+		CellTowers: []map[string]interface{}{}, Provider: "gnss", ResolvedAt: at, IngestID: ingestID}
+	publish := recordLocation(store, loc)
+
+	locationMessage := EventMessage{
+		EventName: event,
+		Tag:       fmt.Sprintf("geolocation_%s", senderID),
+		Value:     fix.response(),
+		Status:    true,
+		Sumber:    senderID,
+		IngestID:  ingestID,
+	}
+	if publish {
+		sendDataPoint(locationMessage)
+	}
+
+	stored := locationMessage
+	stored.Msg = messageStr
+	stored.Time = at.UnixMilli()
+	processAndSaveData(store, stored)
+}
+
+func init() {
+	RegisterHandler(HandleEvents(func(ctx context.Context, store Store, m DeviceMessage) {
+		handleGPSEvent(store, string(m.Payload), m.SenderID, m.Event, m.IngestID, m.Timestamp)
+	}, "GPS"))
+}
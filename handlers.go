@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DeviceMessage is a decoded inbound message as handed to a Handler.
+type DeviceMessage struct {
+	IngestID   string
+	SenderID   string
+	Topic      string
+	Event      string
+	Payload    []byte
+	Data       map[string]interface{} // decoded payload
+	Timestamp  int64                  // event time in epoch milliseconds, see eventTimestamp
+	ReceivedAt time.Time
+}
+
+// Handler processes one or more device event types. Handlers register themselves with
+// RegisterHandler, usually from an init function in their own file, and the first
+// registered handler whose Match returns true receives the message.
+type Handler interface {
+	Match(event string) bool
+	Handle(ctx context.Context, store Store, msg DeviceMessage)
+}
+
+var (
+	handlersMu sync.RWMutex
+	handlers   []Handler
+)
+
+// RegisterHandler adds h to the handler registry.
+func RegisterHandler(h Handler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	handlers = append(handlers, h)
+}
+
+// findHandler returns the handler for event, or nil when no handler matches.
+func findHandler(event string) Handler {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	for _, h := range handlers {
+		if h.Match(event) {
+			return h
+		}
+	}
+	return nil
+}
+
+// eventHandler adapts a function to a Handler for a fixed set of event names.
+type eventHandler struct {
+	events map[string]bool
+	handle func(ctx context.Context, store Store, msg DeviceMessage)
+}
+
+// HandleEvents returns a Handler that calls handle for the given event names.
+func HandleEvents(handle func(ctx context.Context, store Store, msg DeviceMessage), events ...string) Handler {
+	h := &eventHandler{events: map[string]bool{}, handle: handle}
+	for _, event := range events {
+		h.events[event] = true
+	}
+	return h
+}
+
+func (h *eventHandler) Match(event string) bool { return h.events[event] }
+
+func (h *eventHandler) Handle(ctx context.Context, store Store, msg DeviceMessage) {
+	h.handle(ctx, store, msg)
+}
+
+// The collector's built-in telemetry and alarm events. Feature-specific events such as
+// REPORTED_CONFIG register from their own files.
+func init() {
+	RegisterHandler(HandleEvents(func(ctx context.Context, store Store, m DeviceMessage) {
+		handleTemperatureEvent(store, m.SenderID, string(m.Payload), m.Event, m.IngestID, m.Timestamp)
+	}, "TEMPERATURE"))
+	RegisterHandler(HandleEvents(func(ctx context.Context, store Store, m DeviceMessage) {
+		handleSetTemperatureEvents(store, m.SenderID, string(m.Payload), m.IngestID, m.Timestamp)
+	}, "SET_TEMPERATURE"))
+	RegisterHandler(HandleEvents(func(ctx context.Context, store Store, m DeviceMessage) {
+		handleGeolocationEvent(store, string(m.Payload), m.SenderID, m.Event, m.IngestID)
+	}, "GEOLOCATION"))
+	// The alarm and status events, and any added with EVENT_MAP_FILE.
+	RegisterHandler(mappedEventHandler{})
+}
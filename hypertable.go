@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// TimescaleDB support (EVENTS_HYPERTABLE=true). The events table is converted into a
+// hypertable partitioned by received_at, so queries over a time range only touch the
+// chunks that cover it and TimescaleDB creates new chunks as time advances. Chunks older
+// than EVENTS_COMPRESS_AFTER are compressed, segmented by device. received_at is used
+// rather than event_time because it is never NULL and only moves forward.
+type hypertableConfig struct {
+	ChunkInterval time.Duration // EVENTS_CHUNK_INTERVAL
+	CompressAfter time.Duration // EVENTS_COMPRESS_AFTER, 0 disables compression
+}
+
+// setupEventsHypertable converts events on the first start with the setting enabled and
+// applies the chunk interval and compression policy on every start. Converting moves
+// the existing rows into chunks, which takes a while on a large table.
+func setupEventsHypertable(db *sql.DB, cfg hypertableConfig) error {
+	if cfg.ChunkInterval <= 0 {
+		return fmt.Errorf("EVENTS_CHUNK_INTERVAL must be positive")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Collectors starting together must not convert the table twice.
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("failed to lock schema: %v", err)
+	}
+	if _, err := tx.Exec("CREATE EXTENSION IF NOT EXISTS timescaledb"); err != nil {
+		return fmt.Errorf("TimescaleDB is not available: %v", err)
+	}
+	var converted bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM timescaledb_information.hypertables WHERE hypertable_name = 'events')").Scan(&converted); err != nil {
+		return fmt.Errorf("failed to check for the events hypertable: %v", err)
+	}
+	chunk := fmt.Sprintf("%d seconds", int64(cfg.ChunkInterval.Seconds()))
+	if !converted {
+		log.Printf("Converting events into a hypertable with %v chunks, this may take a while", cfg.ChunkInterval)
+		// Every unique index of a hypertable must contain the partitioning column.
+		for _, stmt := range []string{
+			"ALTER TABLE events DROP CONSTRAINT events_pkey",
+			"ALTER TABLE events ADD PRIMARY KEY (id, received_at)",
+		} {
+			if _, err := tx.Exec(stmt); err != nil {
+				return fmt.Errorf("failed to prepare events for conversion: %v", err)
+			}
+		}
+		if _, err := tx.Exec("SELECT create_hypertable('events', 'received_at', chunk_time_interval => $1::interval, migrate_data => true)", chunk); err != nil {
+			return fmt.Errorf("failed to create the events hypertable: %v", err)
+		}
+	} else if _, err := tx.Exec("SELECT set_chunk_time_interval('events', $1::interval)", chunk); err != nil {
+		return fmt.Errorf("failed to set the events chunk interval: %v", err)
+	}
+
+	if _, err := tx.Exec("SELECT remove_compression_policy('events', if_exists => true)"); err != nil {
+		return fmt.Errorf("failed to reset the events compression policy: %v", err)
+	}
+	if cfg.CompressAfter > 0 {
+		if _, err := tx.Exec("ALTER TABLE events SET (timescaledb.compress, timescaledb.compress_segmentby = 'sender_id', timescaledb.compress_orderby = 'received_at DESC')"); err != nil {
+			return fmt.Errorf("failed to enable events compression: %v", err)
+		}
+		if _, err := tx.Exec("SELECT add_compression_policy('events', $1::interval)", fmt.Sprintf("%d seconds", int64(cfg.CompressAfter.Seconds()))); err != nil {
+			return fmt.Errorf("failed to add the events compression policy: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("events is a TimescaleDB hypertable (chunks %v, compress after %v)", cfg.ChunkInterval, cfg.CompressAfter)
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Cold import: "datacollector import --dir ./logs" feeds device logs copied from offline
+// sites through the normal pipeline. Each line of a file is one device payload in the
+// MQTT JSON format; handlers use the timestamp inside it, so events keep their original
+// time. Files ending in .gz are decompressed.
+var (
+	importFlags     = flag.NewFlagSet("import", flag.ExitOnError)
+	importDirFlag   = importFlags.String("dir", "", "directory of device log files to import (searched recursively)")
+	importSender    = importFlags.String("sender", "", "sender ID for lines without a sender_id field (default: the file name without extensions)")
+	importTopicFlag = importFlags.String("topic", "IMPORT/MODEM/%s", "topic the imported messages are recorded under; %s is the sender ID")
+)
+
+// parseImportCommand reports whether the collector was started as "import" and parses
+// the import flags. It must run before flag.Parse.
+func parseImportCommand() bool {
+	if len(os.Args) < 2 || os.Args[1] != "import" {
+		return false
+	}
+	importFlags.Parse(os.Args[2:])
+	if *importDirFlag == "" {
+		log.Fatalf("import: --dir is required")
+	}
+	os.Args = append(os.Args[:1], importFlags.Args()...)
+	return true
+}
+
+// discardBroker stands in for the MQTT connection during an import: historical events
+// must not reach the live DATAPOINTS feed or devices.
+type discardBroker struct{}
+
+func (discardBroker) Connect() error                                                      { return nil }
+func (discardBroker) Subscribe(filter string, qos byte, handle func(BrokerMessage)) error { return nil }
+func (discardBroker) Unsubscribe(filter string) error                                     { return nil }
+func (discardBroker) UnsubscribeAll() error                                               { return nil }
+func (discardBroker) Disconnect()                                                         {}
+func (discardBroker) Publish(topic string, qos byte, retained bool, payload []byte) error { return nil }
+func (discardBroker) Status() BrokerStatus                                                { return BrokerStatus{} }
+
+func (discardBroker) PublishWithExpiry(topic string, qos byte, retained bool, payload []byte, expiry time.Duration) error {
+	return nil
+}
+
+// runImport processes every file under dir in name order, line by line.
+func runImport(store Store, dir string) error {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %v", dir, err)
+	}
+	total := 0
+	for _, file := range files {
+		n, err := importFile(store, file)
+		if err != nil {
+			return err
+		}
+		log.Printf("Imported %d messages from %s", n, file)
+		total += n
+	}
+	log.Printf("Import finished: %d messages from %d files", total, len(files))
+	return nil
+}
+
+func importFile(store Store, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	defaultSender := *importSender
+	if defaultSender == "" {
+		defaultSender, _, _ = strings.Cut(filepath.Base(path), ".")
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), max(maxPayloadBytes, 64*1024)+1)
+	count := 0
+	for line := 1; scanner.Scan(); line++ {
+		payload := []byte(strings.TrimSpace(scanner.Text()))
+		if len(payload) == 0 {
+			continue
+		}
+		var envelope struct {
+			SenderID string `json:"sender_id"`
+		}
+		json.Unmarshal(payload, &envelope)
+		senderID := envelope.SenderID
+		if senderID == "" {
+			senderID = defaultSender
+		}
+		processMessage(store, inboundMessage{
+			Topic:      fmt.Sprintf(*importTopicFlag, senderID),
+			SenderID:   senderID,
+			IngestID:   newUUID(),
+			Payload:    payload,
+			ReceivedAt: clock.Now(),
+		})
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return count, fmt.Errorf("%s: %v", path, err)
+	}
+	return count, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// CollectorInstance is one row of collector_instances, refreshed by every running collector.
+type CollectorInstance struct {
+	ClientID    string    `json:"client_id"`
+	Hostname    string    `json:"hostname"`
+	TopicFilter string    `json:"topic_filter"`
+	SharedGroup string    `json:"shared_group,omitempty"`
+	ShardIndex  int       `json:"shard_index"`
+	ShardCount  int       `json:"shard_count"`
+	Version     string    `json:"version"`
+	StartedAt   time.Time `json:"started_at"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+var overlappingInstances atomic.Int64
+
+func init() {
+	newGaugeFunc("collector_overlapping_instances", "Other live collectors whose subscription overlaps this one outside a shared group.", func() float64 {
+		return float64(overlappingInstances.Load())
+	})
+}
+
+// filtersOverlap reports whether some topic matches both MQTT topic filters.
+func filtersOverlap(a, b string) bool {
+	al, bl := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(al) && i < len(bl); i++ {
+		if al[i] == "#" || bl[i] == "#" {
+			return true
+		}
+		if al[i] != "+" && bl[i] != "+" && al[i] != bl[i] {
+			return false
+		}
+	}
+	if len(al) == len(bl) {
+		return true
+	}
+	// "a/#" also matches "a", so a filter one level longer ending in # still overlaps.
+	longer := al
+	if len(bl) > len(al) {
+		longer = bl
+	}
+	return len(longer) == min(len(al), len(bl))+1 && longer[len(longer)-1] == "#"
+}
+
+// startInstanceRegistry records this collector in collector_instances every interval and
+// warns loudly about live instances that subscribe to overlapping topics without sharing
+// a subscription group or splitting the devices into shards, since both would process, store and alarm on the same messages.
+func startInstanceRegistry(db *sql.DB, clientID, filter, group string, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	hostname, _ := os.Hostname()
+	self := CollectorInstance{ClientID: clientID, Hostname: hostname, TopicFilter: filter, SharedGroup: group,
+		ShardIndex: shardIndex, ShardCount: shardCount, Version: version, StartedAt: startedAt}
+	go func() {
+		for {
+			if err := checkInstances(db, self, 3*interval); err != nil {
+				log.Printf("Error updating instance registry: %v", err)
+			}
+			<-clock.After(interval)
+		}
+	}()
+}
+
+func checkInstances(db *sql.DB, self CollectorInstance, staleAfter time.Duration) error {
+	_, err := db.Exec(`INSERT INTO collector_instances (client_id, hostname, topic_filter, shared_group, shard_index, shard_count, version, started_at, last_seen)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, CURRENT_TIMESTAMP)
+        ON CONFLICT (client_id) DO UPDATE SET hostname = EXCLUDED.hostname, topic_filter = EXCLUDED.topic_filter,
+            shared_group = EXCLUDED.shared_group, shard_index = EXCLUDED.shard_index, shard_count = EXCLUDED.shard_count,
+            version = EXCLUDED.version, started_at = EXCLUDED.started_at, last_seen = EXCLUDED.last_seen`,
+		self.ClientID, self.Hostname, self.TopicFilter, self.SharedGroup, self.ShardIndex, self.ShardCount, self.Version, self.StartedAt)
+	if err != nil {
+		return err
+	}
+
+	instances, err := liveInstances(db, staleAfter)
+	if err != nil {
+		return err
+	}
+	var overlapping int64
+	for _, other := range instances {
+		if other.ClientID == self.ClientID || !filtersOverlap(self.TopicFilter, other.TopicFilter) {
+			continue
+		}
+		if self.SharedGroup != "" && self.SharedGroup == other.SharedGroup {
+			continue
+		}
+		if self.ShardCount > 1 && self.ShardCount == other.ShardCount && self.ShardIndex != other.ShardIndex {
+			continue
+		}
+		overlapping++
+		log.Printf("WARNING: collector %s on %s also subscribes to %s (ours: %s) outside a shared group or shard; messages will be processed twice",
+			other.ClientID, other.Hostname, other.TopicFilter, self.TopicFilter)
+	}
+	overlappingInstances.Store(overlapping)
+	return nil
+}
+
+func liveInstances(db *sql.DB, staleAfter time.Duration) ([]CollectorInstance, error) {
+	rows, err := db.Query(`SELECT client_id, hostname, topic_filter, shared_group, shard_index, shard_count, version, started_at, last_seen
+        FROM collector_instances WHERE last_seen > CURRENT_TIMESTAMP - $1 * INTERVAL '1 second' ORDER BY client_id`, staleAfter.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	instances := []CollectorInstance{}
+	for rows.Next() {
+		var i CollectorInstance
+		if err := rows.Scan(&i.ClientID, &i.Hostname, &i.TopicFilter, &i.SharedGroup, &i.ShardIndex, &i.ShardCount, &i.Version, &i.StartedAt, &i.LastSeen); err != nil {
+			return nil, err
+		}
+		instances = append(instances, i)
+	}
+	return instances, rows.Err()
+}
+
+func handleListInstances(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	instances, err := liveInstances(db, 3*getEnvDuration("INSTANCE_HEARTBEAT", 30*time.Second))
+	if err != nil {
+		log.Printf("Error listing collector instances: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list collector instances")
+		return
+	}
+	writeJSON(w, http.StatusOK, instances)
+}
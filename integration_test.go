@@ -0,0 +1,314 @@
+//go:build integration
+
+package main
+
+// End-to-end check of the collector against real Postgres and Mosquitto containers,
+// started with dockertest. Run with
+//
+//	go test -tags integration -run Integration .
+//
+// It needs a Docker daemon (DOCKER_HOST is honored).
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+const integrationSender = "INTEGRATION01"
+
+// syncBuffer collects the collector's output while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// startContainer runs image and removes it when the test ends.
+func startContainer(t *testing.T, pool *dockertest.Pool, opts *dockertest.RunOptions) *dockertest.Resource {
+	t.Helper()
+	r, err := pool.RunWithOptions(opts, func(hc *docker.HostConfig) {
+		hc.AutoRemove = true
+		hc.RestartPolicy = docker.RestartPolicy{Name: "no"}
+	})
+	if err != nil {
+		t.Fatalf("failed to start %s:%s: %v", opts.Repository, opts.Tag, err)
+	}
+	t.Cleanup(func() {
+		if err := pool.Purge(r); err != nil {
+			t.Logf("failed to remove %s: %v", opts.Repository, err)
+		}
+	})
+	return r
+}
+
+func startPostgres(t *testing.T, pool *dockertest.Pool) (*sql.DB, string, string) {
+	t.Helper()
+	r := startContainer(t, pool, &dockertest.RunOptions{
+		Repository: "postgres",
+		Tag:        "13",
+		Env:        []string{"POSTGRES_DB=collector_it", "POSTGRES_USER=collector_it", "POSTGRES_PASSWORD=collector_it"},
+	})
+	host, port, err := net.SplitHostPort(r.GetHostPort("5432/tcp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var db *sql.DB
+	err = pool.Retry(func() error {
+		var err error
+		db, err = sql.Open("postgres", fmt.Sprintf("host=%s port=%s user=collector_it password=collector_it dbname=collector_it sslmode=disable", host, port))
+		if err != nil {
+			return err
+		}
+		if err := db.Ping(); err != nil {
+			db.Close()
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Postgres did not become ready: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, host, port
+}
+
+// startMosquitto returns the broker URL and a client connected to it.
+func startMosquitto(t *testing.T, pool *dockertest.Pool) (string, mqtt.Client) {
+	t.Helper()
+	r := startContainer(t, pool, &dockertest.RunOptions{
+		Repository: "eclipse-mosquitto",
+		Tag:        "2",
+		Cmd:        []string{"mosquitto", "-c", "/mosquitto-no-auth.conf"},
+	})
+	broker := "tcp://" + r.GetHostPort("1883/tcp")
+	var client mqtt.Client
+	err := pool.Retry(func() error {
+		client = mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker).SetClientID("collector_it_probe"))
+		token := client.Connect()
+		token.Wait()
+		return token.Error()
+	})
+	if err != nil {
+		t.Fatalf("Mosquitto did not become ready: %v", err)
+	}
+	t.Cleanup(func() { client.Disconnect(250) })
+	return broker, client
+}
+
+// startCollector builds the collector and runs it with env until the test ends.
+func startCollector(t *testing.T, env []string) *syncBuffer {
+	t.Helper()
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "collector")
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("go build failed: %v\n%s", err, out)
+	}
+	// The collector refuses to start without a .env file.
+	if err := os.WriteFile(filepath.Join(dir, ".env"), []byte(strings.Join(env, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	output := &syncBuffer{}
+	cmd := exec.Command(bin)
+	cmd.Dir = dir
+	cmd.Stdout, cmd.Stderr = output, output
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("collector output:\n%s", output)
+		}
+	})
+
+	// The API starts after the collector has subscribed.
+	deadline := time.Now().Add(30 * time.Second)
+	for !strings.Contains(output.String(), "HTTP API listening") {
+		if time.Now().After(deadline) {
+			t.Fatal("collector did not start within 30s")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return output
+}
+
+// readLines returns the non-empty lines of path.
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestIntegrationFixturesReachEventsAndDatapoints(t *testing.T) {
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		t.Fatalf("failed to connect to Docker: %v", err)
+	}
+	if err := pool.Client.Ping(); err != nil {
+		t.Fatalf("Docker is not reachable: %v", err)
+	}
+	pool.MaxWait = 2 * time.Minute
+
+	db, dbHost, dbPort := startPostgres(t, pool)
+	broker, probe := startMosquitto(t, pool)
+	schema := enforceDatapointSchema(t)
+
+	datapoints := make(chan []byte, 100)
+	if token := probe.Subscribe("DATAPOINTS", 1, func(_ mqtt.Client, m mqtt.Message) {
+		datapoints <- m.Payload()
+	}); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+
+	inboundSchemas, err := filepath.Abs(filepath.Join("schemas", "inbound"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	startCollector(t, []string{
+		"MQTT_BROKER=" + broker,
+		"MQTT_SUBSCRIBE=DATA/MODEM/#",
+		"MQTT_CLIENT_ID=collector_it",
+		"DB_HOST=" + dbHost,
+		"DB_PORT=" + dbPort,
+		"DB_NAME=collector_it",
+		"DB_USER=collector_it",
+		"DB_PASSWORD=collector_it",
+		"HTTP_ADDR=127.0.0.1:0",
+		"DATAPOINT_SCHEMA_VALIDATION=enforce",
+		"INBOUND_SCHEMA_DIR=" + inboundSchemas,
+	})
+
+	fixtures, err := filepath.Glob(filepath.Join("integration", "fixtures", "*.json"))
+	if err != nil || len(fixtures) == 0 {
+		t.Fatalf("no fixtures found: %v", err)
+	}
+	sort.Strings(fixtures)
+	for _, fixture := range fixtures {
+		payload, err := os.ReadFile(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token := probe.Publish("DATA/MODEM/"+integrationSender, 1, false, bytes.TrimSpace(payload)); token.Wait() && token.Error() != nil {
+			t.Fatalf("failed to publish %s: %v", fixture, token.Error())
+		}
+		// Rules depend on the order of the events.
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	expected := readLines(t, filepath.Join("integration", "expected_datapoints.txt"))
+	want := map[string]bool{}
+	for _, tag := range expected {
+		want[tag] = true
+	}
+
+	published := map[string]bool{}
+	timeout := time.After(30 * time.Second)
+	for len(published) < len(expected) {
+		select {
+		case payload := <-datapoints:
+			var datapoint map[string]interface{}
+			if err := json.Unmarshal(payload, &datapoint); err != nil {
+				t.Fatalf("DATAPOINTS payload %s is not a JSON object: %v", payload, err)
+			}
+			if datapoint["id_modem"] != integrationSender {
+				continue
+			}
+			if errs := schema.Validate(datapoint); len(errs) > 0 {
+				t.Errorf("datapoint %s does not match %s: %s", payload, datapointSchemaName, strings.Join(errs, "; "))
+			}
+			if tag, _ := datapoint["tag"].(string); want[tag] {
+				published[tag] = true
+			}
+		case <-timeout:
+			for _, tag := range expected {
+				if !published[tag] {
+					t.Errorf("no datapoint published with tag %s", tag)
+				}
+			}
+			t.FailNow()
+		}
+	}
+
+	// Events outside combined conditions may be written asynchronously.
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		stored, err := storedTags(db)
+		if err != nil {
+			t.Fatalf("failed to query events: %v", err)
+		}
+		var missing []string
+		for _, tag := range expected {
+			if !stored[tag] {
+				missing = append(missing, tag)
+			}
+		}
+		if len(missing) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no rows in events with tags %v", missing)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// storedTags returns the tags of the events stored for the integration sender.
+func storedTags(db *sql.DB) (map[string]bool, error) {
+	rows, err := db.Query("SELECT tag FROM events WHERE sender_id = $1", integrationSender)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := map[string]bool{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags[tag] = true
+	}
+	return tags, rows.Err()
+}
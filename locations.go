@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Location is a resolved position of a device, kept in locations.
+type Location struct {
+	SenderID   string                   `json:"sender_id"`
+	Lat        float64                  `json:"lat"`
+	Lng        float64                  `json:"lng"`
+	Accuracy   *float64                 `json:"accuracy,omitempty"`
+	CellTowers []map[string]interface{} `json:"cell_towers"`
+	Wifi       []map[string]interface{} `json:"wifi_access_points,omitempty"`
+	Provider   string                   `json:"provider"`
+	ResolvedAt time.Time                `json:"resolved_at"`
+	IngestID   string                   `json:"ingest_id,omitempty"`
+	Published  bool                     `json:"published"`
+}
+
+// minDisplacement (LOCATION_MIN_DISPLACEMENT, metres) suppresses the datapoints of
+// locations that did not move away from the last published one; 0 publishes every
+// location. A location has moved when it is further than minDisplacement from the last
+// published one and further than both their accuracy radii together, so cell-tower
+// jitter within the accuracy of the fixes does not count.
+var minDisplacement float64
+
+// locationOf extracts the coordinates from a geolocation response; ok is false when the
+// response has no lat/lng.
+func locationOf(response map[string]interface{}) (loc Location, ok bool) {
+	position, _ := response["location"].(map[string]interface{})
+	lat, latOK := position["lat"].(float64)
+	lng, lngOK := position["lng"].(float64)
+	if !latOK || !lngOK {
+		return Location{}, false
+	}
+	loc.Lat, loc.Lng = lat, lng
+	if accuracy, ok := response["accuracy"].(float64); ok {
+		loc.Accuracy = &accuracy
+	}
+	return loc, true
+}
+
+func saveLocation(db *sql.DB, loc Location) error {
+	towers, err := json.Marshal(loc.CellTowers)
+	if err != nil {
+		return err
+	}
+	var wifi []byte
+	if len(loc.Wifi) > 0 {
+		if wifi, err = json.Marshal(loc.Wifi); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(`INSERT INTO locations (sender_id, lat, lng, accuracy, cell_towers, wifi_access_points, provider, resolved_at, ingest_id, published)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10)`,
+		loc.SenderID, loc.Lat, loc.Lng, loc.Accuracy, towers, wifi, loc.Provider, loc.ResolvedAt, loc.IngestID, loc.Published)
+	return err
+}
+
+// lastPublishedLocation returns the latest published location of a device.
+func lastPublishedLocation(db *sql.DB, senderID string) (Location, error) {
+	last := Location{SenderID: senderID}
+	err := db.QueryRow(`SELECT lat, lng, accuracy FROM locations WHERE sender_id = $1 AND published
+        ORDER BY resolved_at DESC, id DESC LIMIT 1`, senderID).Scan(&last.Lat, &last.Lng, &last.Accuracy)
+	return last, err
+}
+
+// recordLocation stores a resolved location, checks it against the device's geofences
+// and reports whether its datapoint should be published. When the device moved from
+// its last published location, DEVICE_MOVED is published with the distance in metres.
+func recordLocation(store Store, loc Location) bool {
+	loc.Published = true
+	var last Location
+	var moved float64
+	if minDisplacement > 0 {
+		var err error
+		last, err = store.LastPublishedLocation(loc.SenderID)
+		switch {
+		case err == nil:
+			moved = distanceM(last.Lat, last.Lng, loc.Lat, loc.Lng)
+			jitter := 0.0
+			for _, accuracy := range []*float64{last.Accuracy, loc.Accuracy} {
+				if accuracy != nil {
+					jitter += *accuracy
+				}
+			}
+			loc.Published = moved > minDisplacement && moved > jitter
+		case err != sql.ErrNoRows && err != errUnsupported:
+			log.Printf("[%s] Error loading the last location of %s: %v", loc.IngestID, loc.SenderID, err)
+		}
+	}
+	if err := store.SaveLocation(loc); err != nil && err != errUnsupported {
+		log.Printf("[%s] Error saving location: %v", loc.IngestID, err)
+	}
+	checkGeofences(store, loc)
+
+	if loc.Published && moved > 0 {
+		detail, _ := json.Marshal(map[string]interface{}{
+			"from": map[string]interface{}{"lat": last.Lat, "lng": last.Lng, "accuracy": last.Accuracy},
+			"to":   map[string]interface{}{"lat": loc.Lat, "lng": loc.Lng, "accuracy": loc.Accuracy},
+		})
+		message := EventMessage{
+			EventName: "DEVICE_MOVED",
+			Tag:       fmt.Sprintf("moved_%s", loc.SenderID),
+			Value:     math.Round(moved),
+			Status:    true,
+			Msg:       string(detail),
+			Time:      loc.ResolvedAt.UnixMilli(),
+			Sumber:    loc.SenderID,
+			IngestID:  loc.IngestID,
+		}
+		processAndSaveData(store, message)
+		sendDataPoint(message)
+	}
+	return loc.Published
+}
+
+// handleDeviceLocations lists a device's resolved locations, newest first, optionally
+// between the RFC 3339 times in the from and to query parameters. format=geojson or
+// format=gpx returns them as a track, oldest first, instead.
+func handleDeviceLocations(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "json", "geojson", "gpx":
+	default:
+		writeError(w, http.StatusBadRequest, "format must be json, geojson or gpx")
+		return
+	}
+	where := "sender_id = $1"
+	args := []interface{}{r.PathValue("id")}
+	for _, bound := range []struct{ param, op string }{{"from", ">="}, {"to", "<"}} {
+		value := r.URL.Query().Get(bound.param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s time, expected RFC 3339", bound.param))
+			return
+		}
+		args = append(args, t)
+		where += fmt.Sprintf(" AND resolved_at %s $%d", bound.op, len(args))
+	}
+	args = append(args, queryLimit(r, 100, 10000))
+
+	rows, err := db.Query(fmt.Sprintf(`SELECT sender_id, lat, lng, accuracy, cell_towers, wifi_access_points, provider, resolved_at, COALESCE(ingest_id, ''), published
+        FROM locations WHERE %s ORDER BY resolved_at DESC, id DESC LIMIT $%d`, where, len(args)), args...)
+	if err != nil {
+		log.Printf("Error listing locations: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list locations")
+		return
+	}
+	defer rows.Close()
+	locations := []Location{}
+	for rows.Next() {
+		var loc Location
+		var towers, wifi []byte
+		if err := rows.Scan(&loc.SenderID, &loc.Lat, &loc.Lng, &loc.Accuracy, &towers, &wifi, &loc.Provider, &loc.ResolvedAt, &loc.IngestID, &loc.Published); err != nil {
+			log.Printf("Error scanning location: %v", err)
+			writeError(w, http.StatusInternalServerError, "failed to list locations")
+			return
+		}
+		json.Unmarshal(towers, &loc.CellTowers)
+		if len(wifi) > 0 {
+			json.Unmarshal(wifi, &loc.Wifi)
+		}
+		locations = append(locations, loc)
+	}
+	if format == "geojson" || format == "gpx" {
+		// The newest locations within the limit, in the order they were visited.
+		slices.Reverse(locations)
+		if format == "geojson" {
+			writeGeoJSONTrack(w, r.PathValue("id"), locations)
+		} else {
+			writeGPXTrack(w, r.PathValue("id"), locations)
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, locations)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Device last-will handling. Modems register a will on a status topic such as
+// devices/{id}/status; the broker publishes it when the modem drops off without a clean
+// disconnect. The collector turns status changes into STATUS_MODEM_OFF and
+// STATUS_MODEM_ON events, so outages are recorded even when the firmware never reports them.
+
+var lastDeviceStatus sync.Map // senderID -> bool, the last status seen on the will topic
+
+// senderIDFromFilter returns the topic level matched by the first "+" in filter.
+func senderIDFromFilter(filter, topic string) (string, bool) {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "+" && i < len(topicLevels) && topicLevels[i] != "" {
+			return topicLevels[i], true
+		}
+	}
+	return "", false
+}
+
+// parseDeviceStatus maps a status payload to online (true) or offline (false).
+func parseDeviceStatus(payload string) (online bool, ok bool) {
+	switch strings.ToLower(strings.TrimSpace(payload)) {
+	case "online", "1", "true", "on", "connected":
+		return true, true
+	case "offline", "0", "false", "off", "disconnected", "lost":
+		return false, true
+	}
+	return false, false
+}
+
+// subscribeDeviceStatus listens on the will/status topic filter and submits a synthesized
+// event to the worker pool whenever a device's status changes.
+func subscribeDeviceStatus(filter string, pool *workerPool, processRetained bool) {
+	if err := mqttClient.Subscribe(filter, mqttSubscribeQoS, func(msg BrokerMessage) {
+		if msg.Retained && !processRetained {
+			return
+		}
+		senderID, ok := senderIDFromFilter(filter, msg.Topic)
+		if !ok {
+			log.Printf("Sender ID not found in status topic: %s", msg.Topic)
+			return
+		}
+		if !ownsSender(senderID) {
+			messagesOtherShard.Inc("status")
+			return
+		}
+		online, ok := parseDeviceStatus(string(msg.Payload))
+		if !ok {
+			log.Printf("Unknown device status %q on %s", msg.Payload, msg.Topic)
+			return
+		}
+		if previous, seen := lastDeviceStatus.Swap(senderID, online); seen && previous.(bool) == online {
+			return
+		}
+
+		event := "STATUS_MODEM_OFF"
+		if online {
+			event = "STATUS_MODEM_ON"
+		}
+		receivedAt := clock.Now()
+		payload, _ := json.Marshal(map[string]string{
+			"event":     event,
+			"timestamp": strconv.FormatInt(receivedAt.UnixMilli(), 10),
+			"source":    "lwt",
+		})
+		ingestID := newUUID()
+		log.Printf("[%s] Device %s reported %s on %s, synthesizing %s", ingestID, senderID, msg.Payload, msg.Topic, event)
+		pool.Submit(inboundMessage{
+			Topic:      msg.Topic,
+			SenderID:   senderID,
+			IngestID:   ingestID,
+			Payload:    payload,
+			ReceivedAt: receivedAt,
+		})
+	}); err != nil {
+		log.Fatalf("Failed to subscribe to device status topic: %v", err)
+	}
+	log.Printf("Watching device status on %s", filter)
+}
@@ -1,17 +1,18 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
+	"math"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -29,7 +30,18 @@ var (
 	dbName        string
 	dbUser        string
 	dbPassword    string
+	dbSSLMode     string
 	apiKey        string
+
+	mqttProtocolVersion uint
+	mqttSharedGroup     string
+
+	// Delivery settings; the defaults match the collector's original behaviour.
+	mqttSubscribeQoS byte = 1
+	mqttPublishQoS   byte = 0
+	mqttRetain       bool
+	// datapointExpiry is the MQTT v5 message expiry of DATAPOINTS publishes; 0 for none.
+	datapointExpiry time.Duration
 )
 
 type EventMessage struct {
@@ -40,46 +52,92 @@ type EventMessage struct {
 	Msg       string      `json:"msg"`
 	Time      int64       `json:"time"`
 	Sumber    string      `json:"sumber"`
+	IngestID  string      `json:"ingest_id,omitempty"`
+	// DeviceType and Firmware come from the MQTT v5 user properties of the device's messages.
+	DeviceType string `json:"device_type,omitempty"`
+	Firmware   string `json:"firmware,omitempty"`
 }
 
-var eventState sync.Map // A map to track the state of events for each sender
+var eventState stateStore = newMemoryState() // Tracks the state of events for each sender
 
 
 
 func getCurrentTimeMillis() int64 {
-	return time.Now().UnixNano() / int64(time.Millisecond)
+	return clock.Now().UnixNano() / int64(time.Millisecond)
 }
 
-func setupDatabase() (*sql.DB, error) {
-
-
-	postgresDSN := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		dbHost, dbPort, dbUser, dbPassword, dbName)
+// setupDatabase connects to the DB_DRIVER database, migrates it and returns the Store
+// on it with its connection pool.
+func setupDatabase() (Store, *sql.DB, error) {
+	switch driver := getEnv("DB_DRIVER", "postgres"); driver {
+	case "postgres":
+	case "sqlite":
+		db, err := openSQLite(getEnv("SQLITE_PATH", "modem.db"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error opening SQLite database: %v", err)
+		}
+		store, err := setupEdgeStore(db, sqliteDialect{})
+		return store, db, err
+	case "mysql":
+		db, err := openMySQL()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error connecting to MySQL: %v", err)
+		}
+		configurePool(db)
+		store, err := setupEdgeStore(db, mysqlDialect{})
+		return store, db, err
+	default:
+		return nil, nil, fmt.Errorf("unknown DB_DRIVER %q", driver)
+	}
 
-	db, err := sql.Open("postgres", postgresDSN)
+	db, err := openPostgres()
 	if err != nil {
-		return nil, fmt.Errorf("error connecting to database: %v", err)
-	}
-
-	query := `
-        CREATE TABLE IF NOT EXISTS mqtt_data (
-            id SERIAL PRIMARY KEY,
-            sender_id TEXT,
-            message TEXT,
-            timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
-        )
-    `
-	_, err = db.Exec(query)
+		return nil, nil, fmt.Errorf("error connecting to database: %v", err)
+	}
+	configurePool(db)
+
+	switch dbIndexMode = getEnv("DB_INDEXES", indexesManaged); dbIndexMode {
+	case indexesManaged, indexesSkip:
+	default:
+		return nil, nil, fmt.Errorf("unknown DB_INDEXES %q", dbIndexMode)
+	}
+	start, err := runMigrations(db)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create table: %v", err)
+		return nil, nil, fmt.Errorf("schema migration failed: %v", err)
+	}
+	if !start {
+		log.Printf("Finished --migrate=%s, exiting", *migrateFlag)
+		os.Exit(0)
+	}
+
+	if err := ensureRouteTables(db); err != nil {
+		return nil, nil, err
+	}
+	hypertable := getEnvBool("EVENTS_HYPERTABLE", false)
+	if hypertable {
+		cfg := hypertableConfig{
+			ChunkInterval: getEnvAge("EVENTS_CHUNK_INTERVAL", 7*24*time.Hour),
+			CompressAfter: getEnvAge("EVENTS_COMPRESS_AFTER", 30*24*time.Hour),
+		}
+		if err := setupEventsHypertable(db, cfg); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	log.Println("Connected to PostgreSQL and ensured mqtt_data table exists")
-	return db, nil
+	log.Println("Connected to PostgreSQL and ensured tables exist")
+	return newPostgresStore(db), db, nil
+}
+
+// requirePostgres stops the collector when a feature that keeps its data in Postgres is
+// enabled on another DB_DRIVER; db is nil there.
+func requirePostgres(db *sql.DB, feature string) {
+	if db == nil {
+		log.Fatalf("%s needs DB_DRIVER=postgres", feature)
+	}
 }
 
 // Handel geolocation
-func handleGeolocationEvent(db *sql.DB, messageStr string, senderID string, event string) {
+func handleGeolocationEvent(store Store, messageStr string, senderID string, event, ingestID string) {
 	var messageData map[string]interface{}
 	err := json.Unmarshal([]byte(messageStr), &messageData)
 	if err != nil {
@@ -95,18 +153,122 @@ func handleGeolocationEvent(db *sql.DB, messageStr string, senderID string, even
 
 	log.Printf("Received geolocation message: %s\n", geolocationMessage)
 
-	// Assuming the message format includes comma-separated sets of coordinates
-	re := regexp.MustCompile(`\[(\d+),(\d+),([A-Fa-f0-9]+),([A-Fa-f0-9]+)\]`)
-	matches := re.FindAllStringSubmatch(geolocationMessage, -1)
+	req := parseCellScan(store, senderID, geolocationMessage)
+	if len(req.CellTowers) == 0 && len(req.WifiAccessPoints) == 0 {
+		log.Println("Failed to parse any valid coordinate sets.")
+		return
+	}
+
+	log.Printf("Parsed Cell Towers: %+v, Wi-Fi access points: %+v", req.CellTowers, req.WifiAccessPoints)
+
+	job := geoJob{SenderID: senderID, Event: event, IngestID: ingestID, Request: req, RequestedAt: clock.Now()}
+	if geoJobs != nil {
+		err := geoJobs.Enqueue(job)
+		if err == nil {
+			return
+		}
+		log.Printf("[%s] Error queueing geolocation, resolving it now: %v", ingestID, err)
+	}
+	if err := resolveGeolocation(store, job); err != nil {
+		log.Printf("Failed to retrieve geolocation: %v", err)
+	}
+}
+
+// resolveGeolocation looks up the location of job's cell towers, stores it and
+// publishes the datapoint.
+func resolveGeolocation(store Store, job geoJob) error {
+	senderID, event, ingestID := job.SenderID, job.Event, job.IngestID
+	dataBytes, err := json.Marshal(job.Request)
+	if err != nil {
+		return fmt.Errorf("error marshaling geolocation data: %v", err)
+	}
+
+	locationData, err := geolocator.Locate(job.Request)
+	if err != nil {
+		return err
+	}
+
+	publish := true
+	if loc, ok := locationOf(locationData); ok {
+		log.Printf("[%s] Geolocation of %s: latitude %f, longitude %f", ingestID, senderID, loc.Lat, loc.Lng)
+		loc.SenderID, loc.CellTowers, loc.Wifi, loc.Provider, loc.ResolvedAt, loc.IngestID = senderID, job.Request.CellTowers, job.Request.WifiAccessPoints, geolocator.Name(), clock.Now(), ingestID
+		if provider, ok := locationData["provider"].(string); ok {
+			loc.Provider = provider
+		}
+		publish = recordLocation(store, loc)
+	} else {
+		log.Printf("[%s] Location data not found in response", ingestID)
+	}
+
+	// Format data point
+	locationMessage := EventMessage{
+		EventName: event,
+		Tag:       fmt.Sprintf("geolocation_%s", senderID),
+		Value:     locationData,
+		Status:    true,
+		Sumber:    senderID,
+		IngestID:  ingestID,
+	}
+
+	if publish {
+		sendDataPoint(locationMessage)
+	} else {
+		log.Printf("[%s] %s has not moved, not publishing its location", ingestID, senderID)
+	}
+
+	// The routed table keeps the cell towers the location was resolved from.
+	stored := locationMessage
+	stored.Msg = string(dataBytes)
+	stored.Time = job.RequestedAt.UnixMilli()
+	processAndSaveData(store, stored)
+	return nil
+}
+
+// cellTowerPattern matches [mcc,mnc,lacHex,cellIdHex] sets in a geolocation message,
+// optionally followed by the signal strength in dBm and the timing advance, e.g.
+// [510,10,1A2B,3C4D,-71,3].
+var cellTowerPattern = regexp.MustCompile(`\[(\d+),(\d+),([A-Fa-f0-9]+),([A-Fa-f0-9]+)(?:,\s*(-?\d+))?(?:,\s*(\d+))?\]`)
+
+// wifiAccessPointPattern matches [bssid,rssi] or [bssid,rssi,channel] sets, e.g.
+// [A4:2B:B0:11:22:33,-67,6], which newer modems add to the geolocation message.
+var wifiAccessPointPattern = regexp.MustCompile(`\[((?:[0-9A-Fa-f]{2}[:-]){5}[0-9A-Fa-f]{2}),\s*(-?\d+)(?:,\s*(\d+))?\]`)
+
+// parseWifiAccessPoints extracts the scanned Wi-Fi access points of a geolocation
+// message in the shape of the geolocation API's wifiAccessPoints.
+func parseWifiAccessPoints(geolocationMessage string) []map[string]interface{} {
+	var accessPoints []map[string]interface{}
+	for _, match := range wifiAccessPointPattern.FindAllStringSubmatch(geolocationMessage, -1) {
+		rssi, err := strconv.Atoi(match[2])
+		if err != nil {
+			continue
+		}
+		ap := map[string]interface{}{
+			"macAddress":     strings.ToLower(strings.ReplaceAll(match[1], "-", ":")),
+			"signalStrength": rssi,
+		}
+		if match[3] != "" {
+			if channel, err := strconv.Atoi(match[3]); err == nil {
+				ap["channel"] = channel
+			}
+		}
+		accessPoints = append(accessPoints, ap)
+	}
+	return accessPoints
+}
+
+// parseCellTowers extracts the cell towers of a geolocation message in the shape the
+// geolocation API expects. Sets whose LAC or cell ID does not fit in an int64 are skipped.
+func parseCellTowers(geolocationMessage string) []map[string]interface{} {
+	matches := cellTowerPattern.FindAllStringSubmatch(geolocationMessage, -1)
 
 	if len(matches) == 0 {
 		log.Println("No valid coordinate sets found.")
-		return
+		return nil
 	}
 
 	cellTowers := make([]map[string]interface{}, 0, len(matches))
 	for _, match := range matches {
-		if len(match) == 5 {
+		if len(match) == 7 {
 			mcc := match[1]       // Mobile Country Code
 			mnc := match[2]       // Mobile Network Code
 			lacHex := match[3]    // Location Area Code in hex
@@ -132,89 +294,18 @@ func handleGeolocationEvent(db *sql.DB, messageStr string, senderID string, even
 				"mobileNetworkCode": mnc,
 			}
 
+			addCellMeasurements(cellTower, match[5], match[6])
+
 			log.Printf("Parsed Cell Tower - MCC: %s, MNC: %s, LAC: %d, CellID: %d\n", mcc, mnc, lac, cellID)
 
 			cellTowers = append(cellTowers, cellTower)
 		}
 	}
-
-	if len(cellTowers) == 0 {
-		log.Println("Failed to parse any valid coordinate sets.")
-		return
-	}
-
-	log.Printf("Parsed Cell Towers: %+v", cellTowers)
-
-	// Example of how to proceed with sending to geolocation API and saving to database
-	url := fmt.Sprintf("https://www.googleapis.com/geolocation/v1/geolocate?key=%s", apiKey)
-	data := map[string]interface{}{
-		"cellTowers": cellTowers,
-	}
-
-	dataBytes, err := json.Marshal(data)
-	if err != nil {
-		log.Printf("Error marshaling geolocation data: %v", err)
-		return
-	}
-
-	log.Printf("Sending request to URL: %s with data: %s", url, string(dataBytes))
-
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(dataBytes))
-	if err != nil {
-		log.Printf("Failed to send geolocation request: %v", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusOK {
-		var locationData map[string]interface{}
-		err = json.NewDecoder(resp.Body).Decode(&locationData)
-		if err != nil {
-			log.Printf("Error decoding geolocation response: %v", err)
-			return
-		}
-
-		fmt.Println("Geolocation Result:")
-		if location, ok := locationData["location"].(map[string]interface{}); ok {
-			if lat, ok := location["lat"].(float64); ok {
-				if lng, ok := location["lng"].(float64); ok {
-					fmt.Printf("Latitude: %f, Longitude: %f\n", lat, lng)
-				}
-			}
-		} else {
-			log.Println("Location data not found in response.")
-		}
-
-		// Format data point
-		geolocationMessage := EventMessage{
-			EventName: event,
-			Tag:       fmt.Sprintf("geolocation_%s", senderID),
-			Value:     locationData,
-			Status:    true,
-			Sumber:    senderID,
-		}
-
-		sendDataPoint(geolocationMessage)
-
-		_, err = db.Exec("INSERT INTO mqtt_data (sender_id, message) VALUES ($1, $2)", senderID, string(dataBytes))
-		if err != nil {
-			log.Printf("Error saving geolocation data to database: %v", err)
-		}
-	} else {
-		log.Printf("Failed to retrieve geolocation, status code: %d", resp.StatusCode)
-
-		var responseBody map[string]interface{}
-		err = json.NewDecoder(resp.Body).Decode(&responseBody)
-		if err != nil {
-			log.Printf("Error decoding error response: %v", err)
-		} else {
-			log.Printf("Error response: %+v", responseBody)
-		}
-	}
+	return cellTowers
 }
 
 // Handel Temperature
-func handleTemperatureEvent(db *sql.DB, senderID, message string, event string) {
+func handleTemperatureEvent(store Store, senderID, message string, event, ingestID string, timestamp int64) {
 	var msgData map[string]interface{}
 	if err := json.Unmarshal([]byte(message), &msgData); err != nil {
 		log.Printf("Error unmarshalling temperature event message: %v", err)
@@ -227,23 +318,6 @@ func handleTemperatureEvent(db *sql.DB, senderID, message string, event string)
 		return
 	}
 
-	timestampStr, ok := msgData["timestamp"].(string)
-	if !ok {
-		log.Println("Error: 'timestamp' field not found or not a string in msgData")
-		return
-	}
-	timestampFloat, err := strconv.ParseFloat(timestampStr, 64)
-	if err != nil {
-		log.Printf("Error converting 'timestamp' to float64: %v", err)
-		return
-	}
-	timestamp := int64(timestampFloat)
-
-	// Convert 10-digit Unix timestamp to 13-digit timestamp in milliseconds
-	if len(timestampStr) == 10 {
-		timestamp *= 1000
-	}
-
 	temperatureMessage := EventMessage{
 		EventName: event,
 		Tag:       fmt.Sprintf("temperature_%s", senderID),
@@ -252,823 +326,856 @@ func handleTemperatureEvent(db *sql.DB, senderID, message string, event string)
 		Msg:       message,
 		Time:      timestamp,
 		Sumber:    senderID,
+		IngestID:  ingestID,
 	}
 
 	if temperatureMessage != (EventMessage{}) {
-		processAndSaveData(db, temperatureMessage)
+		processAndSaveData(store, temperatureMessage)
 		sendDataPoint(temperatureMessage)
+		publishSmoothedTemperature(temperatureMessage)
+		value, numeric := numericValue(msg)
+		if numeric {
+			if err := store.RecordThermalReading(senderID, time.UnixMilli(timestamp), value); err != nil && err != errUnsupported {
+				log.Printf("[%s] Error updating thermal aggregates for %s: %v", ingestID, senderID, err)
+			}
+			checkTemperatureThresholds(store, senderID, ingestID, value, time.UnixMilli(timestamp))
+		}
 	} else {
 		log.Println("Temperature message not found in MQTT data.")
 	}
 }
 
-// Handel Backup Mode
-func handlePowerBackupModeEvent(db *sql.DB, senderID, message, event string) {
+// Handel Set Temperature
+func handleSetTemperatureEvents(store Store, senderID, message, ingestID string, timestamp int64) {
 	var msgData map[string]interface{}
 	if err := json.Unmarshal([]byte(message), &msgData); err != nil {
-		log.Printf("Error unmarshalling power backup mode event message: %v", err)
+		log.Printf("Error unmarshalling status modem on  event message: %v", err)
 		return
 	}
 
-	timestampStr, ok := msgData["timestamp"].(string)
+	setpoint, ok := msgData["message"].(string)
 	if !ok {
-		log.Println("Error: 'timestamp' field not found or not a string in msgData")
+		log.Println("Error: 'message' field not found or not a string in msgData")
 		return
 	}
-	timestampFloat, err := strconv.ParseFloat(timestampStr, 64)
+	sp, err := parseSetpoints(setpoint)
 	if err != nil {
-		log.Printf("Error converting 'timestamp' to float64: %v", err)
+		log.Printf("[%s] Invalid setpoint %q from %s: %v", ingestID, setpoint, senderID, err)
+		quarantineMessage(store, inboundMessage{SenderID: senderID, IngestID: ingestID, Payload: []byte(message), ReceivedAt: clock.Now()},
+			"SET_TEMPERATURE", err.Error())
 		return
 	}
-	timestamp := int64(timestampFloat)
 
-	// Convert 10-digit Unix timestamp to 13-digit timestamp in milliseconds
-	if len(timestampStr) == 10 {
-		timestamp *= 1000
-	}
-
-	powerBackupMessage := EventMessage{
-		EventName: event,
-		Tag:       fmt.Sprintf("power_modem_%s", senderID),
-		Value:     1,
-		Status:    true,
-		Msg:       message,
-		Time:      timestamp,
-		Sumber:    senderID,
+	setTemperatureMessage := EventMessage{
+		Tag:      fmt.Sprintf("%s_set_temperature", senderID),
+		Value:    sp.Min,
+		Status:   true,
+		Msg:      message,
+		Time:     timestamp,
+		Sumber:   senderID,
+		IngestID: ingestID,
 	}
 
-	if powerBackupMessage != (EventMessage{}) {
-		processAndSaveData(db, powerBackupMessage)
-		sendDataPoint(powerBackupMessage)
-		eventState.Store(senderID+"_POWER_BACKUP_MODE", true)
-		checkCombinedConditions(db, senderID, message, event)
+	if setTemperatureMessage != (EventMessage{}) {
+		// The event name only routes storage (EVENT_STORAGE); the DATAPOINTS of set
+		// temperatures have always been published with an empty event.
+		stored := setTemperatureMessage
+		stored.EventName = "SET_TEMPERATURE"
+		processAndSaveData(store, stored)
+		sendDataPoint(setTemperatureMessage)
+		// The existing tag keeps carrying a single number (the lower bound of a range) so
+		// consumers are unaffected; the upper bound gets its own tag.
+		if sp.isRange() {
+			maxMessage := setTemperatureMessage
+			maxMessage.Tag = fmt.Sprintf("%s_set_temperature_max", senderID)
+			maxMessage.Value = sp.Max
+			sendDataPoint(maxMessage)
+		}
 	} else {
-		log.Println("Power backup mode message not found in MQTT data.")
+		log.Println("Set temperature message not found in MQTT data.")
 	}
 }
 
-// Handel Power Restore
-func handlePowerRestoreModeEvent(db *sql.DB, senderID, message string, event string) {
-	var msgData map[string]interface{}
-	if err := json.Unmarshal([]byte(message), &msgData); err != nil {
-		log.Printf("Error unmarshalling power restore mode event message: %v", err)
+func processAndSaveData(store Store, data EventMessage) {
+	data = withDeviceProperties(data)
+	if _, ok := storageTable(data.EventName); !ok {
+		log.Printf("[%s] Storage disabled for %s events, not saving", data.IngestID, data.EventName)
+		procLog.Record(data.IngestID, data.Sumber, decisionStorageDisabled, data.EventName)
 		return
 	}
-
-	timestampStr, ok := msgData["timestamp"].(string)
-	if !ok {
-		log.Println("Error: 'timestamp' field not found or not a string in msgData")
+	if batcher != nil {
+		batcher.Add(data)
 		return
 	}
-	timestampFloat, err := strconv.ParseFloat(timestampStr, 64)
-	if err != nil {
-		log.Printf("Error converting 'timestamp' to float64: %v", err)
+	if dbWriter != nil {
+		dbWriter.Add(data)
 		return
 	}
-	timestamp := int64(timestampFloat)
-
-	// Convert 10-digit Unix timestamp to 13-digit timestamp in milliseconds
-	if len(timestampStr) == 10 {
-		timestamp *= 1000
-	}
-
-	powerRestoreMessage := EventMessage{
-		EventName: event,
-		Tag:       fmt.Sprintf("power_modem_%s", senderID),
-		Value:     0,
-		Status:    true,
-		Msg:       message,
-		Time:      timestamp,
-		Sumber:    senderID,
-	}
+	processAndSaveDirect(store, data)
+}
 
-	if powerRestoreMessage != (EventMessage{}) {
-		processAndSaveData(db, powerRestoreMessage)
-		sendDataPoint(powerRestoreMessage)
-		eventState.Store(senderID+"_POWER_RESTORE_MODE", true)
-		checkCombinedConditions(db, senderID, message, event)
+// processAndSaveDirect stores data with its own transaction, bypassing the batcher.
+func processAndSaveDirect(store Store, data EventMessage) {
+	err := withDBRetry(dbRetryAttempts, func() error { return store.SaveEvent(data) })
+	if err != nil {
+		log.Printf("[%s] Error saving data to database: %v", data.IngestID, err)
+		procLog.Record(data.IngestID, data.Sumber, decisionStoreFailed, err.Error())
+		// A row the database rejects would block the spool replay forever.
+		if permanentDBError(err) && deadLetterEvent(store, data, err) {
+			return
+		}
+		outbox.Append(spoolRecord{Kind: spoolDatabase, IngestID: data.IngestID, Event: &data})
 	} else {
-		log.Println("Power restore mode message not found in MQTT data.")
+		log.Printf("[%s] Data saved successfully", data.IngestID)
+		table, _ := storageTable(data.EventName)
+		procLog.Record(data.IngestID, data.Sumber, decisionStored, data.EventName+" -> "+table)
 	}
-
 }
 
-// Handel Status Modem On
-func handleStatusModemOn(db *sql.DB, senderID, message string, event string) {
-	var msgData map[string]interface{}
-	if err := json.Unmarshal([]byte(message), &msgData); err != nil {
-		log.Printf("Error unmarshalling status modem on  event message: %v", err)
-		return
-	}
-
-	timestampStr, ok := msgData["timestamp"].(string)
+func insertEventRow(db *sql.DB, data EventMessage) error {
+	_, ok := storageTable(data.EventName)
 	if !ok {
-		log.Println("Error: 'timestamp' field not found or not a string in msgData")
-		return
+		return nil
 	}
-	timestampFloat, err := strconv.ParseFloat(timestampStr, 64)
+	tx, err := db.Begin()
 	if err != nil {
-		log.Printf("Error converting 'timestamp' to float64: %v", err)
-		return
+		return err
 	}
-	timestamp := int64(timestampFloat)
-
-	// Convert 10-digit Unix timestamp to 13-digit timestamp in milliseconds
-	if len(timestampStr) == 10 {
-		timestamp *= 1000
-	}
-
-	statusModemOnMessage := EventMessage{
-		EventName: event,
-		Tag:       fmt.Sprintf("status_modem_%s", senderID),
-		Value:     1,
-		Status:    true,
-		Msg:       message,
-		Time:      timestamp,
-		Sumber:    senderID,
-	}
-
-	if statusModemOnMessage != (EventMessage{}) {
-		processAndSaveData(db, statusModemOnMessage)
-		sendDataPoint(statusModemOnMessage)
-	} else {
-		log.Println("Power restore mode message not found in MQTT data.")
+	if err := insertEventRowTx(tx, data); err != nil {
+		tx.Rollback()
+		return err
 	}
+	return tx.Commit()
 }
 
-// Handel Status Modem Off
-func handleStatusModemOff(db *sql.DB, senderID, message string, event string) {
-	var msgData map[string]interface{}
-	if err := json.Unmarshal([]byte(message), &msgData); err != nil {
-		log.Printf("Error unmarshalling status modem off event message: %v", err)
-		return
-	}
-
-	timestampStr, ok := msgData["timestamp"].(string)
+// insertEventRowTx writes data to its routed table and to events within tx.
+func insertEventRowTx(tx eventsExecer, data EventMessage) error {
+	table, ok := storageTable(data.EventName)
 	if !ok {
-		log.Println("Error: 'timestamp' field not found or not a string in msgData")
-		return
+		return nil
 	}
-	timestampFloat, err := strconv.ParseFloat(timestampStr, 64)
+	// Convert the timestamp from milliseconds to seconds before passing it to the SQL query
+	_, err := tx.Exec(fmt.Sprintf("INSERT INTO %s (sender_id, message, timestamp, ingest_id) VALUES ($1, $2, to_timestamp($3 / 1000.0), NULLIF($4, ''))", table),
+		data.Sumber, data.Msg, data.Time, data.IngestID)
 	if err != nil {
-		log.Printf("Error converting 'timestamp' to float64: %v", err)
-		return
+		return err
 	}
-	timestamp := int64(timestampFloat)
+	return insertNormalizedEvent(tx, data)
+}
 
-	// Convert 10-digit Unix timestamp to 13-digit timestamp in milliseconds
-	if len(timestampStr) == 10 {
-		timestamp *= 1000
+func sendDataPoint(message EventMessage) {
+	message = withDeviceProperties(message)
+	datapoints := map[string]interface{}{
+		"event":    message.EventName,
+		"tag":      message.Tag,
+		"value":    message.Value,
+		"time":     message.Time,
+		"id_modem": message.Sumber,
 	}
-
-	statusModemOffMessage := EventMessage{
-		EventName: event,
-		Tag:       fmt.Sprintf("status_modem_%s", senderID),
-		Value:     0,
-		Status:    true,
-		Msg:       message,
-		Time:      timestamp,
-		Sumber:    senderID,
+	if message.IngestID != "" {
+		datapoints["ingest_id"] = message.IngestID
 	}
-
-	if statusModemOffMessage != (EventMessage{}) {
-		processAndSaveData(db, statusModemOffMessage)
-		sendDataPoint(statusModemOffMessage)
-	} else {
-		log.Println("Status Modem OFF message not found in MQTT data.")
+	if message.DeviceType != "" {
+		datapoints["device_type"] = message.DeviceType
 	}
-}
-
-// Combined Condition Check Function Power PLN
-func checkCombinedConditions(db *sql.DB, senderID, message, event string) {
-	alarmEvent, _ := eventState.Load(senderID + "_ALARM_METER_DEVICE")
-	powerEvent, _ := eventState.Load(senderID + "_POWER_BACKUP_MODE")
-
-	if alarmEvent != nil && powerEvent != nil {
-		connectionMissing := alarmEvent.(bool)
-		powerBackupMode := powerEvent.(bool)
-
-		if connectionMissing && powerBackupMode {
-			log.Println("Both POWER_BACKUP_MODE and CONNECTION_MISSING detected.")
-			handlePowerPln(db, senderID, message, event)
-			// Reset the state after processing
-
-		} else {
-			log.Println("POWER_BACKUP_MODE detected without CONNECTION_MISSING.")
-		}
+	if message.Firmware != "" {
+		datapoints["firmware"] = message.Firmware
 	}
-}
 
-// handlePowerPln processes POWER_BACKUP_MODE events and checks for CONNECTION_MISSING from ALARM_METER_DEVICE events
-func handlePowerPln(db *sql.DB, senderID, message, event string) {
-	var msgData map[string]interface{}
-	if err := json.Unmarshal([]byte(message), &msgData); err != nil {
-		log.Printf("Error unmarshalling status modem off event message: %v", err)
-		return
-	}
+	log.Printf("[%s] Data to send: %v", message.IngestID, datapoints)
 
-	timestampStr, ok := msgData["timestamp"].(string)
-	if !ok {
-		log.Println("Error: 'timestamp' field not found or not a string in msgData")
-		return
-	}
-	timestampFloat, err := strconv.ParseFloat(timestampStr, 64)
+	payload, err := json.Marshal(datapoints)
 	if err != nil {
-		log.Printf("Error converting 'timestamp' to float64: %v", err)
+		log.Printf("Failed to marshal datapoint: %v", err)
 		return
 	}
-	timestamp := int64(timestampFloat)
-
-	// Convert 10-digit Unix timestamp to 13-digit timestamp in milliseconds
-	if len(timestampStr) == 10 {
-		timestamp *= 1000
-	}
-
-	statusPowerPlnMessage := EventMessage{
-		EventName: "POWER_PLN",
-		Tag:       fmt.Sprintf("power_pln_%s", senderID),
-		Value:     1,
-		Status:    true,
-		Msg:       message,
-		Time:      timestamp,
-		Sumber:    senderID,
+	if !checkDatapoint(payload) {
+		log.Printf("Datapoint not published because it violates the DATAPOINTS schema")
+		procLog.Record(message.IngestID, message.Sumber, decisionSchemaRejected, message.Tag)
+		return
 	}
 
-	if event == "POWER_BACKUP_MODE" || event == "ALARM_METER_DEVICE" {
-		if event == "POWER_BACKUP_MODE" {
-			eventState.Store(senderID+"_POWER_BACKUP_MODE", true)
-		} else if event == "ALARM_METER_DEVICE" {
-			eventState.Store(senderID+"_ALARM_METER_DEVICE", true)
-		}
-
-		alarmEvent, _ := eventState.Load(senderID + "_ALARM_METER_DEVICE")
-		powerEvent, _ := eventState.Load(senderID + "_POWER_BACKUP_MODE")
-
-		connectionMissing := alarmEvent != nil && alarmEvent.(bool)
-		powerBackupMode := powerEvent != nil && powerEvent.(bool)
-
-		if connectionMissing && powerBackupMode {
-			log.Println("Both POWER_BACKUP_MODE and CONNECTION_MISSING detected.")
-			processAndSaveData(db, statusPowerPlnMessage)
-			sendDataPoint(statusPowerPlnMessage)
-
-			// Call handleClearPowerPlnEvent for related events
-
-		} else {
-			log.Println("POWER_BACKUP_MODE detected without CONNECTION_MISSING.")
-		}
-	} else if event == "POWER_RESTORE_MODE" || event == "CLEAR_ALARM_METER_DEVICE" {
-		handleClearPowerPlnEvent(db, senderID, message, event)
-	} else {
-		log.Println("Unhandled event type in handlePowerPln.")
+	if err := mqttClient.PublishWithExpiry("DATAPOINTS", mqttPublishQoS, mqttRetain, payload, datapointExpiry); err != nil {
+		log.Printf("Failed to send datapoint: %v", err)
+		outbox.Append(spoolRecord{Kind: spoolPublish, IngestID: message.IngestID, Topic: "DATAPOINTS", Payload: payload})
+		procLog.Record(message.IngestID, message.Sumber, decisionPublishFailed, err.Error())
+		return
 	}
+	procLog.Record(message.IngestID, message.Sumber, decisionPublished, "DATAPOINTS "+message.Tag)
 }
 
-// Handel Clear Power Pln
-func handleClearPowerPlnEvent(db *sql.DB, senderID, message string, event string) {
-	log.Printf("Received message: %s, event: %s", message, event)
-
-	var msgData map[string]interface{}
-	if err := json.Unmarshal([]byte(message), &msgData); err != nil {
-		log.Printf("Error unmarshalling clear power pln event message: %v", err)
-		return
+// decodeEvent turns a raw MQTT payload into the JSON payload and fields of an event:
+// it undoes compression and binary codecs, decodes the JSON object and reads its event
+// type. The error says which step failed.
+func decodeEvent(ingestID, senderID, topic string, raw []byte) ([]byte, map[string]interface{}, string, error) {
+	payload, compression, err := decompressPayload(topic, raw)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("decompressing MQTT message: %w", err)
 	}
-
-	timestampStr, ok := msgData["timestamp"].(string)
-	if !ok {
-		log.Println("Error: 'timestamp' field not found or not a string in msgData")
-		return
+	if compression != "" {
+		log.Printf("[%s] Decompressed %s payload from %d to %d bytes", ingestID, compression, len(raw), len(payload))
 	}
-	timestampFloat, err := strconv.ParseFloat(timestampStr, 64)
+
+	payload, codec, err := decodePayload(topic, payload)
 	if err != nil {
-		log.Printf("Error converting 'timestamp' to float64: %v", err)
-		return
+		return nil, nil, "", fmt.Errorf("decoding MQTT message: %w", err)
 	}
-	timestamp := int64(timestampFloat)
-
-	// Convert 10-digit Unix timestamp to 13-digit timestamp in milliseconds
-	if len(timestampStr) == 10 {
-		timestamp *= 1000
+	if codec != codecJSON && logPayloadOf(senderID) {
+		log.Printf("[%s] Decoded %s payload: %s", ingestID, codec, payload)
 	}
 
-	statusClearPowerPlnMessage := EventMessage{
-		EventName: "POWER_PLN",
-		Tag:       fmt.Sprintf("power_pln_%s", senderID),
-		Value:     0,
-		Status:    true,
-		Msg:       message,
-		Time:      timestamp,
-		Sumber:    senderID,
+	var msgData map[string]interface{}
+	if err := json.Unmarshal(payload, &msgData); err != nil {
+		return nil, nil, "", fmt.Errorf("unmarshalling MQTT message: %w", err)
 	}
-
-	switch event {
-	case "POWER_RESTORE_MODE":
-		eventState.Store(senderID+"_POWER_RESTORE_MODE", true)
-		log.Println("POWER_RESTORE_MODE event detected and stored.")
-	case "CLEAR_ALARM_METER_DEVICE":
-		eventState.Store(senderID+"_CLEAR_ALARM_METER_DEVICE", true)
-		log.Println("CLEAR_ALARM_METER_DEVICE event detected and stored.")
-	default:
-		log.Printf("Unhandled event type in handleClearPowerPlnEvent: %s", event)
-		return
+	event, ok := msgData["event"].(string)
+	if !ok {
+		return nil, nil, "", errors.New("event type not found")
 	}
+	msgData["event"] = event
+	return payload, msgData, event, nil
+}
 
-	// Log to check if eventState contains the correct values
-	alarmEvent, alarmEventOk := eventState.Load(senderID + "_CLEAR_ALARM_METER_DEVICE")
-	powerEvent, powerEventOk := eventState.Load(senderID + "_POWER_RESTORE_MODE")
-
-	clearAlarmMeterDevice := alarmEventOk && alarmEvent.(bool)
-	powerRestoreMode := powerEventOk && powerEvent.(bool)
-
-	log.Printf("Loaded states - clearAlarmMeterDevice: %v, powerRestoreMode: %v", clearAlarmMeterDevice, powerRestoreMode)
-
-	if clearAlarmMeterDevice || powerRestoreMode {
-		log.Println("Either POWER_RESTORE_MODE or CLEAR_ALARM_METER_DEVICE detected. Processing data.")
-
-		processAndSaveData(db, statusClearPowerPlnMessage)
-		sendDataPoint(statusClearPowerPlnMessage)
-
-		// Reset the state after processing
-		if clearAlarmMeterDevice {
-			eventState.Delete(senderID + "_CLEAR_ALARM_METER_DEVICE")
-			log.Println("Resetting state for CLEAR_ALARM_METER_DEVICE")
-		}
-		if powerRestoreMode {
-			eventState.Delete(senderID + "_POWER_RESTORE_MODE")
-			log.Println("Resetting state for POWER_RESTORE_MODE")
+// processMessage decodes one inbound message and dispatches it to the handler for its event.
+func processMessage(store Store, msg inboundMessage) {
+	// A malformed payload must never take the whole collector down.
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[%s] Recovered from panic while handling message on %s: %v\nPayload: %s", msg.IngestID, msg.Topic, r, msg.Payload)
+			procLog.Record(msg.IngestID, msg.SenderID, decisionPanic, fmt.Sprint(r))
 		}
-	} else {
-		log.Println("No relevant state detected for POWER_RESTORE_MODE or CLEAR_ALARM_METER_DEVICE.")
-	}
-}
+	}()
 
-// Handel Alarm Temper
-func handleAlarmMeterDeviceTemperEvent(db *sql.DB, senderID, message string, event string) {
-	var msgData map[string]interface{}
-	if err := json.Unmarshal([]byte(message), &msgData); err != nil {
-		log.Printf("Error unmarshalling temperature event message: %v", err)
+	ingestID := msg.IngestID
+	if !checkPayloadSize(store, msg) {
 		return
 	}
-
-	timestampStr, ok := msgData["timestamp"].(string)
-	if !ok {
-		log.Println("Error: 'timestamp' field not found or not a string in msgData")
-		return
+	if !msg.Reprocessed {
+		storeRawMessage(store, msg)
 	}
-	timestampFloat, err := strconv.ParseFloat(timestampStr, 64)
+
+	payload, msgData, event, err := decodeEvent(ingestID, msg.SenderID, msg.Topic, msg.Payload)
 	if err != nil {
-		log.Printf("Error converting 'timestamp' to float64: %v", err)
+		log.Printf("[%s] Error %v\nPayload: %s", ingestID, err, msg.Payload)
+		procLog.Record(ingestID, msg.SenderID, decisionDecodeError, err.Error())
+		deadLetter(store, msg, deadLetterDecode, err)
 		return
 	}
-	timestamp := int64(timestampFloat)
-
-	// Convert 10-digit Unix timestamp to 13-digit timestamp in milliseconds
-	if len(timestampStr) == 10 {
-		timestamp *= 1000
-	}
-
-	alarmTemperMessage := EventMessage{
-		EventName: event,
-		Tag:       fmt.Sprintf("alarm_meter_temper_%s", senderID),
-		Value:     1,
-		Status:    true,
-		Msg:       message,
-		Time:      timestamp,
-		Sumber:    senderID,
-	}
-
-	if alarmTemperMessage != (EventMessage{}) {
-		processAndSaveData(db, alarmTemperMessage)
-		sendDataPoint(alarmTemperMessage)
-	} else {
-		log.Println("Alarm meter device temper message not found in MQTT data.")
-	}
-
-}
+	msg.Payload = payload
+	senderID := msg.SenderID
 
-// Handel Clear Alarm Temper
-func handleClearAlarmMeterDeviceTemperEvent(db *sql.DB, senderID, message string, event string) {
-	var msgData map[string]interface{}
-	if err := json.Unmarshal([]byte(message), &msgData); err != nil {
-		log.Printf("Error unmarshalling Clear Alarm Meter Temper event message: %v", err)
+	if !validateInbound(store, msg, event, msgData) {
+		sendAck(msg.SenderID, event, msgData, ingestID, ackInvalid, "schema validation failed")
 		return
 	}
 
-	timestampStr, ok := msgData["timestamp"].(string)
-	if !ok {
-		log.Println("Error: 'timestamp' field not found or not a string in msgData")
+	if dedup != nil && !msg.Reprocessed && dedup.Seen(dedupKey(senderID, event, msgData, msg.Payload)) {
+		log.Printf("[%s] Dropping duplicate %s message from %s", ingestID, event, senderID)
+		messagesDropped.Inc("duplicate")
+		procLog.Record(ingestID, senderID, decisionDuplicate, event)
+		sendAck(senderID, event, msgData, ingestID, ackDuplicate, "")
 		return
 	}
-	timestampFloat, err := strconv.ParseFloat(timestampStr, 64)
+	registerDevice(store, senderID)
+	rememberDeviceProperties(senderID, msg.Properties)
+
+	timestamp, fallback, err := eventTimestamp(msgData, msg.ReceivedAt)
 	if err != nil {
-		log.Printf("Error converting 'timestamp' to float64: %v", err)
+		log.Printf("[%s] Error processing timestamp: %v\nMessage Data: %+v", ingestID, err, msgData)
+		procLog.Record(ingestID, senderID, decisionInvalidTime, err.Error())
+		deadLetter(store, msg, deadLetterTimestamp, err)
+		sendAck(senderID, event, msgData, ingestID, ackInvalid, err.Error())
 		return
 	}
-	timestamp := int64(timestampFloat)
 
-	// Convert 10-digit Unix timestamp to 13-digit timestamp in milliseconds
-	if len(timestampStr) == 10 {
-		timestamp *= 1000
+	if fallback {
+		log.Printf("[%s] Unusable timestamp %v from %s, using the server time", ingestID, msgData["timestamp"], senderID)
 	}
+	log.Printf("[%s] Processing %s from %s, timestamp %v", ingestID, event, senderID, timestamp)
 
-	clearAlarmTemperMessage := EventMessage{
-		EventName: event,
-		Tag:       fmt.Sprintf("alarm_meter_temper_%s", senderID),
-		Value:     0,
-		Status:    true,
-		Msg:       message,
-		Time:      timestamp,
-		Sumber:    senderID,
-	}
-
-	if clearAlarmTemperMessage != (EventMessage{}) {
-		processAndSaveData(db, clearAlarmTemperMessage)
-		sendDataPoint(clearAlarmTemperMessage)
-	} else {
-		log.Println("Clear alarm meter device temper message not found in MQTT data.")
+	handler := findHandler(event)
+	if handler == nil {
+		log.Printf("[%s] Unhandled message type in topic %s: %s\n", ingestID, msg.Topic, msg.Payload)
+		storeUnhandledEvent(store, msg, event)
+		procLog.Record(ingestID, senderID, decisionUnhandled, event)
+		sendAck(senderID, event, msgData, ingestID, ackUnhandled, "")
+		return
 	}
-
+	procLog.Record(ingestID, senderID, decisionDispatched, event)
+	handler.Handle(context.Background(), store, DeviceMessage{
+		IngestID:   ingestID,
+		SenderID:   senderID,
+		Topic:      msg.Topic,
+		Event:      event,
+		Payload:    msg.Payload,
+		Data:       msgData,
+		Timestamp:  timestamp,
+		ReceivedAt: msg.ReceivedAt,
+	})
+	sendAck(senderID, event, msgData, ingestID, ackProcessed, "")
 }
 
-var alarmSuhu int
+var mqttClient Broker
 
-// Handel Alarm Temperature
-func handleAlarmTemperatureEvent(db *sql.DB, senderID, message string, event string) {
-	var msgData map[string]interface{}
-	if err := json.Unmarshal([]byte(message), &msgData); err != nil {
-		log.Printf("Error unmarshalling alarm temperature event message: %v", err)
-		return
-	}
+func main() {
+	startService()
 
-	timestampStr, ok := msgData["timestamp"].(string)
-	if !ok {
-		log.Println("Error: 'timestamp' field not found or not a string in msgData")
-		return
+	info := versionInfo()
+	log.Printf("Starting collector version %s (commit %s, built %s, %s)", info.Version, info.GitSHA, info.BuildDate, info.GoVersion)
+
+	importMode := parseImportCommand()
+	flag.Parse()
+	if importMode {
+		mqttClient = discardBroker{}
 	}
-	timestampFloat, err := strconv.ParseFloat(timestampStr, 64)
+	profile, err := applyProfile()
 	if err != nil {
-		log.Printf("Error converting 'timestamp' to float64: %v", err)
-		return
+		log.Fatalf("Invalid profile: %v", err)
 	}
-	timestamp := int64(timestampFloat)
 
-	// Convert 10-digit Unix timestamp to 13-digit timestamp in milliseconds
-	if len(timestampStr) == 10 {
-		timestamp *= 1000
+	// Load environment variables from .env file
+	err = godotenv.Load()
+	if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
 	}
 
-	alarmTemperatureMessage := EventMessage{
-		EventName: event,
-		Tag:       fmt.Sprintf("alarm_temperature_%s", senderID),
-		Value:     1,
-		Status:    true,
-		Msg:       message,
-		Time:      timestamp,
-		Sumber:    senderID,
+	// Initialize global variables from environment variables
+	mqttBroker = os.Getenv("MQTT_BROKER")
+	mqttUser = os.Getenv("MQTT_USER")
+	mqttPassword = os.Getenv("MQTT_PASSWORD")
+	mqttSubscribe = os.Getenv("MQTT_SUBSCRIBE")
+	dbHost = os.Getenv("DB_HOST")
+	dbPort = os.Getenv("DB_PORT")
+	dbName = os.Getenv("DB_NAME")
+	dbUser = os.Getenv("DB_USER")
+	dbPassword = os.Getenv("DB_PASSWORD")
+	apiKey = os.Getenv("API_KEY")
+	dbSSLMode = getEnv("DB_SSLMODE", "disable")
+	geoHTTPClient.Timeout = getEnvDuration("GEO_TIMEOUT", geoHTTPClient.Timeout)
+	geoRetryAttempts = getEnvInt("GEO_RETRY_ATTEMPTS", geoRetryAttempts)
+	geoRetryBase = getEnvDuration("GEO_RETRY_BASE", geoRetryBase)
+	geoBreakerThreshold = getEnvInt("GEO_BREAKER_THRESHOLD", geoBreakerThreshold)
+	geoBreakerCooldown = getEnvDuration("GEO_BREAKER_COOLDOWN", geoBreakerCooldown)
+	minDisplacement = getEnvFloat("LOCATION_MIN_DISPLACEMENT", 0)
+	switch fallback := getEnv("TIMESTAMP_FALLBACK", "reject"); fallback {
+	case "reject", "server":
+		timestampFallback = fallback == "server"
+	default:
+		log.Fatalf("Invalid TIMESTAMP_FALLBACK %q: must be reject or server", fallback)
+	}
+	timestampMaxSkew = getEnvDuration("TIMESTAMP_MAX_SKEW", timestampMaxSkew)
+	if eventMappings, err = loadEventMappings(os.Getenv("EVENT_MAP_FILE")); err != nil {
+		log.Fatalf("Invalid EVENT_MAP_FILE: %v", err)
+	}
+	log.Printf("Mapped events: %s", strings.Join(mappedEvents(eventMappings), ", "))
+	alarmDebounce = getEnvDuration("ALARM_DEBOUNCE", 0)
+	flapWindow = getEnvDuration("FLAP_WINDOW", 0)
+	flapThreshold = getEnvInt("FLAP_THRESHOLD", flapThreshold)
+	for _, metric := range signalMetrics {
+		signalMin[metric] = getEnvFloat("SIGNAL_MIN_"+strings.ToUpper(metric), signalMin[metric])
+	}
+	signalHysteresis = getEnvFloat("SIGNAL_HYSTERESIS", signalHysteresis)
+	batteryLow.percent = getEnvFloat("BATTERY_LOW_PERCENT", batteryLow.percent)
+	batteryLow.voltage = getEnvFloat("BATTERY_LOW_VOLTAGE", batteryLow.voltage)
+	batteryCritical.percent = getEnvFloat("BATTERY_CRITICAL_PERCENT", batteryCritical.percent)
+	batteryCritical.voltage = getEnvFloat("BATTERY_CRITICAL_VOLTAGE", batteryCritical.voltage)
+	dataQuotaBytes = int64(getEnvFloat("DATA_QUOTA_MB", 0) * (1 << 20))
+	switch counters := getEnv("DATA_USAGE_COUNTERS", "delta"); counters {
+	case "delta", "cumulative":
+		dataUsageCumulative = counters == "cumulative"
+	default:
+		log.Fatalf("Invalid DATA_USAGE_COUNTERS %q: must be delta or cumulative", counters)
 	}
-
-	if alarmTemperatureMessage != (EventMessage{}) {
-		processAndSaveData(db, alarmTemperatureMessage)
-		sendDataPoint(alarmTemperatureMessage)
-	} else {
-		log.Println("Alarm temperature mode message not found in MQTT data.")
+	if dataUsageLocation, err = time.LoadLocation(getEnv("DATA_USAGE_TIMEZONE", "UTC")); err != nil {
+		log.Fatalf("Invalid DATA_USAGE_TIMEZONE: %v", err)
 	}
-}
-
-// Handel Clear Alarm Temperature
-func handleClearAlarmTemperatureEvent(db *sql.DB, senderID, message string, event string) {
-	var msgData map[string]interface{}
-	if err := json.Unmarshal([]byte(message), &msgData); err != nil {
-		log.Printf("Error unmarshalling clear alarm temperature event message: %v", err)
-		return
+	silentAfter = getEnvDuration("DEVICE_SILENT_AFTER", 0)
+	silentCheckInterval = getEnvDuration("DEVICE_SILENT_CHECK_INTERVAL", silentCheckInterval)
+	rebootLoopThreshold = getEnvInt("REBOOT_LOOP_THRESHOLD", rebootLoopThreshold)
+	rebootLoopWindow = getEnvDuration("REBOOT_LOOP_WINDOW", rebootLoopWindow)
+	if rebootCountWindows, err = parseRebootWindows(getEnv("REBOOT_COUNT_WINDOWS", "1h,24h")); err != nil {
+		log.Fatalf("Invalid REBOOT_COUNT_WINDOWS: %v", err)
 	}
-
-	timestampStr, ok := msgData["timestamp"].(string)
-	if !ok {
-		log.Println("Error: 'timestamp' field not found or not a string in msgData")
-		return
+	if rules, err = loadRules(os.Getenv("RULES_FILE")); err != nil {
+		log.Fatalf("Invalid RULES_FILE: %v", err)
 	}
-	timestampFloat, err := strconv.ParseFloat(timestampStr, 64)
-	if err != nil {
-		log.Printf("Error converting 'timestamp' to float64: %v", err)
-		return
+	if unmapped := rules.unmapped(eventMappings); len(unmapped) > 0 {
+		log.Fatalf("Invalid RULES_FILE: facts use events without a mapping: %s", strings.Join(unmapped, ", "))
 	}
-	timestamp := int64(timestampFloat)
-
-	// Convert 10-digit Unix timestamp to 13-digit timestamp in milliseconds
-	if len(timestampStr) == 10 {
-		timestamp *= 1000
+	cellScanFormat = getEnv("CELL_SCAN_FORMAT", cellScanFormat)
+	if cellScanFormat != "auto" && cellScanParserNamed(cellScanFormat) == nil {
+		log.Fatalf("Invalid CELL_SCAN_FORMAT %q: must be auto, bracket, qeng, ceng or json", cellScanFormat)
 	}
-
-	clearAlarmTemperatureMessage := EventMessage{
-		EventName: event,
-		Tag:       fmt.Sprintf("alarm_temperature_%s", senderID),
-		Value:     0,
-		Status:    true,
-		Msg:       message,
-		Time:      timestamp,
-		Sumber:    senderID,
+	if cellScanModelFormats, err = parseCellScanFormats(os.Getenv("CELL_SCAN_FORMATS")); err != nil {
+		log.Fatalf("Invalid CELL_SCAN_FORMATS: %v", err)
 	}
-
-	if clearAlarmTemperatureMessage != (EventMessage{}) {
-		processAndSaveData(db, clearAlarmTemperatureMessage)
-		sendDataPoint(clearAlarmTemperatureMessage)
-	} else {
-		log.Println("Clear Alarm temperature mode message not found in MQTT data.")
+	geolocator, err = newGeoChain(os.Getenv("GEO_PROVIDER"))
+	if err != nil {
+		log.Fatalf("Invalid GEO_PROVIDER: %v", err)
 	}
-}
-
-// Handel Set Temperature
-func handleSetTemperatureEvents(db *sql.DB, senderID, message string) {
-	var msgData map[string]interface{}
-	if err := json.Unmarshal([]byte(message), &msgData); err != nil {
-		log.Printf("Error unmarshalling status modem on  event message: %v", err)
-		return
+	if err := checkProfileInterlocks(profile); err != nil {
+		log.Fatal(err)
 	}
 
-	timestampStr, ok := msgData["timestamp"].(string)
-	if !ok {
-		log.Println("Error: 'timestamp' field not found or not a string in msgData")
-		return
-	}
-	timestampFloat, err := strconv.ParseFloat(timestampStr, 64)
+	mqttProtocolVersion, err = parseProtocolVersion(getEnv("MQTT_PROTOCOL_VERSION", "3.1.1"))
 	if err != nil {
-		log.Printf("Error converting 'timestamp' to float64: %v", err)
-		return
+		log.Fatalf("Invalid MQTT_PROTOCOL_VERSION: %v", err)
+	}
+	commandTopic = getEnv("MQTT_COMMAND_TOPIC", "COMMAND/MODEM/%s")
+	commandAckSubscribe = getEnv("MQTT_COMMAND_ACK_SUBSCRIBE", "COMMAND_ACK/MODEM/#")
+	commandAckTimeout = getEnvDuration("COMMAND_ACK_TIMEOUT", 30*time.Second)
+	httpAddr = getEnv("HTTP_ADDR", ":8080")
+	apiToken = os.Getenv("API_TOKEN")
+	apiCacheMaxAge = getEnvDuration("API_CACHE_MAX_AGE", 0)
+	heartbeatTopic = getEnv("HEARTBEAT_TOPIC", "COLLECTOR/HEARTBEAT")
+	heartbeatInterval = getEnvDuration("HEARTBEAT_INTERVAL", time.Minute)
+	if err := setupDatapointSchema(getEnv("DATAPOINT_SCHEMA_VALIDATION", schemaValidationOff)); err != nil {
+		log.Fatalf("Invalid DATAPOINT_SCHEMA_VALIDATION: %v", err)
+	}
+	mqttSharedGroup = os.Getenv("MQTT_SHARED_GROUP")
+	shardIndex, shardCount = getEnvInt("SHARD_INDEX", 0), getEnvInt("SHARD_COUNT", 1)
+	if err := validateSharding(shardIndex, shardCount, mqttSharedGroup); err != nil {
+		log.Fatalf("Invalid sharding: %v", err)
+	}
+	if shardCount > 1 {
+		log.Printf("Processing shard %d of %d of the devices", shardIndex, shardCount)
+	}
+	otaStatusSubscribe = getEnv("MQTT_OTA_STATUS_SUBSCRIBE", "OTA_STATUS/MODEM/#")
+
+	storageRoutes, err = parseStorageRoutes(os.Getenv("EVENT_STORAGE"))
+	if err != nil {
+		log.Fatalf("Invalid EVENT_STORAGE: %v", err)
 	}
-	timestamp := int64(timestampFloat)
 
-	// Convert 10-digit Unix timestamp to 13-digit timestamp in milliseconds
-	if len(timestampStr) == 10 {
-		timestamp *= 1000
+	// Setup database connection
+	store, conn, err := setupDatabase()
+	if err != nil {
+		log.Fatalf("Failed to set up database: %v", err)
 	}
-
-	setTemperatureMessage := EventMessage{
-		Tag:    fmt.Sprintf("%s_set_temperature", senderID),
-		Value:  findNumbersInSentences(msgData["message"].(string)),
-		Status: true,
-		Msg:    message,
-		Time:   timestamp,
-		Sumber: senderID,
+	defer conn.Close()
+	eventStore = store
+	// db is the Postgres database of the features beyond the Store; it is nil with the
+	// other drivers, which run without them.
+	var db *sql.DB
+	if pg, ok := store.(*postgresStore); ok {
+		db = pg.db
+	}
+	cellTowerDB = db
+	if ttl := getEnvAge("GEO_CACHE_TTL", 7*24*time.Hour); ttl > 0 {
+		var cacheDB *sql.DB
+		if getEnvBool("GEO_CACHE_DB", true) {
+			cacheDB = db
+		}
+		geolocator = newGeoCache(geolocator, cacheDB, ttl)
 	}
-
-	if setTemperatureMessage != (EventMessage{}) {
-		processAndSaveData(db, setTemperatureMessage)
-		sendDataPoint(setTemperatureMessage)
-	} else {
-		log.Println("Set temperature message not found in MQTT data.")
+	if workers := getEnvInt("GEO_WORKERS", 2); workers > 0 && db != nil {
+		geoJobs = newGeoQueue(db, eventStore, workers, getEnvInt("GEO_MAX_ATTEMPTS", 5), getEnvDuration("GEO_QUEUE_POLL", 30*time.Second))
 	}
-}
-
-// Handel Alarm Connection Missing
-func handleAlarmMeterDeviceEvent(db *sql.DB, senderID, message, event string) {
-	var msgData map[string]interface{}
-	if err := json.Unmarshal([]byte(message), &msgData); err != nil {
-		log.Printf("Error unmarshalling ALARM_METER_DEVICE event message: %v", err)
-		return
+	startDBHealthCheck(conn, getEnvDuration("DB_PING_INTERVAL", 30*time.Second), getEnvDuration("DB_PING_TIMEOUT", 5*time.Second))
+	if !validDeadLetterStage(*reprocessDeadLettersFlag) {
+		log.Fatalf("Invalid --reprocess-dead-letters %q: must be decode, timestamp, store or all", *reprocessDeadLettersFlag)
 	}
-
-	timestampStr, ok := msgData["timestamp"].(string)
-	if !ok {
-		log.Println("Error: 'timestamp' field not found or not a string in msgData")
+	if *reprocessDeadLettersFlag != "" {
+		requirePostgres(db, "--reprocess-dead-letters")
+	}
+	if silentAfter > 0 {
+		requirePostgres(db, "DEVICE_SILENT_AFTER")
+	}
+	if *exportFlag != "" {
+		if err := runExport(eventStore); err != nil {
+			log.Fatalf("Export failed: %v", err)
+		}
 		return
 	}
-	timestampFloat, err := strconv.ParseFloat(timestampStr, 64)
-	if err != nil {
-		log.Printf("Error converting 'timestamp' to float64: %v", err)
+	if *loadCellTowersFlag != "" {
+		requirePostgres(db, "--load-cell-towers")
+		if err := runLoadCellTowers(db, *loadCellTowersFlag); err != nil {
+			log.Fatalf("Loading cell towers failed: %v", err)
+		}
 		return
 	}
-	timestamp := int64(timestampFloat)
 
-	// Convert 10-digit Unix timestamp to 13-digit timestamp in milliseconds
-	if len(timestampStr) == 10 {
-		timestamp *= 1000
+	// Instances in a shared subscription group must share event state, so default to
+	// Postgres there; a single instance keeps it in memory and writes it through.
+	stateBackend := "cached"
+	if mqttSharedGroup != "" {
+		stateBackend = "postgres"
 	}
-
-	alarmMeterDeviceMessage := EventMessage{
-		EventName: event,
-		Tag:       fmt.Sprintf("alarm_connection_missing_%s", senderID),
-		Value:     1,
-		Status:    true,
-		Msg:       message,
-		Time:      timestamp,
-		Sumber:    senderID,
+	if db == nil {
+		stateBackend = "memory"
 	}
-
-	if alarmMeterDeviceMessage != (EventMessage{}) {
-		processAndSaveData(db, alarmMeterDeviceMessage)
-		sendDataPoint(alarmMeterDeviceMessage)
-		eventState.Store(senderID+"_ALARM_METER_DEVICE", true)
-		checkCombinedConditions(db, senderID, message, event)
-	} else {
-		log.Println("Alarm meter device mode message not found in MQTT data.")
+	stateBackend = getEnv("STATE_BACKEND", stateBackend)
+	stateTTL = getEnvAge("STATE_TTL", 30*24*time.Hour)
+	stateMaxEntries = getEnvInt("STATE_MAX_ENTRIES", 100000)
+	eventState, err = newStateStore(db, stateBackend)
+	if err != nil {
+		log.Fatalf("Invalid STATE_BACKEND: %v", err)
+	}
+	startStateSweep(eventState, getEnvDuration("STATE_SWEEP_INTERVAL", time.Hour))
+	rawSampleRate = getEnvFloat("RAW_SAMPLE_RATE", 1)
+	temperatureEMAAlpha = getEnvFloat("TEMPERATURE_EMA_ALPHA", 0)
+	if temperatureEMAAlpha < 0 || temperatureEMAAlpha > 1 {
+		log.Fatalf("Invalid TEMPERATURE_EMA_ALPHA %v: must be between 0 and 1", temperatureEMAAlpha)
+	}
+	thermalEnabled = getEnvBool("THERMAL_AGGREGATES", false)
+	thermalBaseTemp = getEnvFloat("THERMAL_BASE_TEMP", thermalBaseTemp)
+	thermalThreshold = getEnvFloat("THERMAL_STRESS_THRESHOLD", thermalThreshold)
+	thermalMaxGap = getEnvDuration("THERMAL_MAX_GAP", thermalMaxGap)
+	if thermalLocation, err = time.LoadLocation(getEnv("THERMAL_TIMEZONE", "UTC")); err != nil {
+		log.Fatalf("Invalid THERMAL_TIMEZONE: %v", err)
+	}
+	retentionAges, err := parseRetention(os.Getenv("RETENTION"))
+	if err != nil {
+		log.Fatalf("Invalid RETENTION: %v", err)
 	}
-}
-
-// Handel Clear Alarm Connection Missing
-func handleClearAlarmMeterDeviceEvent(db *sql.DB, senderID, message, event string) {
-	var msgData map[string]interface{}
-	if err := json.Unmarshal([]byte(message), &msgData); err != nil {
-		log.Printf("Error unmarshalling CLEAR_ALARM_METER_DEVICE event message: %v", err)
-		return
+	if retentionWindow, err = parseOffPeakWindow(os.Getenv("RETENTION_WINDOW")); err != nil {
+		log.Fatalf("Invalid RETENTION_WINDOW: %v", err)
 	}
-
-	timestampStr, ok := msgData["timestamp"].(string)
-	if !ok {
-		log.Println("Error: 'timestamp' field not found or not a string in msgData")
-		return
+	retentionBatch = getEnvInt("RETENTION_BATCH", retentionBatch)
+	archive, err := loadArchiveConfig()
+	if err != nil {
+		log.Fatalf("Invalid archive settings: %v", err)
 	}
-	timestampFloat, err := strconv.ParseFloat(timestampStr, 64)
+	if len(retentionAges) > 0 {
+		requirePostgres(db, "RETENTION")
+	}
+	if archive != nil {
+		requirePostgres(db, "ARCHIVE_AFTER")
+	}
+	logAllPayloads = getEnvBool("LOG_PAYLOADS", true)
+	payloadDebugTTL = getEnvDuration("DEBUG_PAYLOAD_TTL", payloadDebugTTL)
+	retentionPause = getEnvDuration("RETENTION_PAUSE", retentionPause)
+	codecRoutes, err = parseCodecRoutes(os.Getenv("PAYLOAD_CODECS"))
 	if err != nil {
-		log.Printf("Error converting 'timestamp' to float64: %v", err)
-		return
+		log.Fatalf("Invalid PAYLOAD_CODECS: %v", err)
 	}
-	timestamp := int64(timestampFloat)
-
-	// Convert 10-digit Unix timestamp to 13-digit timestamp in milliseconds
-	if len(timestampStr) == 10 {
-		timestamp *= 1000
+	compressionRoutes, err = parseCompressionRoutes(os.Getenv("PAYLOAD_COMPRESSION"))
+	if err != nil {
+		log.Fatalf("Invalid PAYLOAD_COMPRESSION: %v", err)
 	}
-
-	clearAlarmMeterDeviceMessage := EventMessage{
-		EventName: event,
-		Tag:       fmt.Sprintf("alarm_connection_missing_%s", senderID),
-		Value:     0,
-		Status:    true,
-		Msg:       message,
-		Time:      timestamp,
-		Sumber:    senderID,
+	maxDecompressedBytes = int64(getEnvInt("MAX_DECOMPRESSED_KB", 1024)) * 1024
+	maxPayloadBytes = getEnvInt("MAX_PAYLOAD_KB", maxPayloadBytes>>10) << 10
+	switch oversizePolicy = getEnv("MAX_PAYLOAD_POLICY", oversizeQuarantine); oversizePolicy {
+	case oversizeQuarantine, oversizeDrop:
+	default:
+		log.Fatalf("Invalid MAX_PAYLOAD_POLICY %q: must be %s or %s", oversizePolicy, oversizeQuarantine, oversizeDrop)
 	}
-
-	if clearAlarmMeterDeviceMessage != (EventMessage{}) {
-		processAndSaveData(db, clearAlarmMeterDeviceMessage)
-		sendDataPoint(clearAlarmMeterDeviceMessage)
-		eventState.Store(senderID+"_ALARM_METER_DEVICE", true)
-		checkCombinedConditions(db, senderID, message, event)
-	} else {
-		log.Println("Alarm meter device mode message not found in MQTT data.")
+	deviceMetricsTracked = getEnvInt("DEVICE_METRICS_TRACKED", deviceMetricsTracked)
+	deviceMetricsShards = getEnvInt("DEVICE_METRICS_SHARDS", deviceMetricsShards)
+	if deviceMetricsShards < 1 {
+		deviceMetricsShards = 1
 	}
-}
-
-func findNumbersInSentences(s string) int {
-	re := regexp.MustCompile(`\d+`)
-	matches := re.FindAllString(s, -1)
-	if len(matches) > 0 {
-		value, err := strconv.Atoi(matches[0])
-		if err == nil {
-			return value
+	if dir := os.Getenv("INBOUND_SCHEMA_DIR"); dir != "" {
+		inboundSchemas, err = loadInboundSchemas(dir)
+		if err != nil {
+			log.Fatalf("Invalid INBOUND_SCHEMA_DIR: %v", err)
+		}
+		log.Printf("Validating inbound payloads against %d event schemas in %s", len(inboundSchemas), dir)
+	}
+	if getEnvBool("PROCESSING_LOG", false) {
+		requirePostgres(db, "PROCESSING_LOG")
+		procLog = newProcessingLog(db, getEnvInt("PROCESSING_LOG_BUFFER", 10000))
+		log.Println("Recording per-message processing decisions in processing_log")
+	}
+	dedup = newDeduplicator(db, stateBackend, getEnvDuration("DEDUP_TTL", 10*time.Minute))
+	dbRetryAttempts = max(getEnvInt("DB_RETRY_ATTEMPTS", dbRetryAttempts), 1)
+	dbRetryBase = getEnvDuration("DB_RETRY_BASE", dbRetryBase)
+	dbRetryMax = getEnvDuration("DB_RETRY_MAX", dbRetryMax)
+	dbBreaker.threshold = getEnvInt("DB_BREAKER_THRESHOLD", dbBreaker.threshold)
+	dbBreaker.cooldown = getEnvDuration("DB_BREAKER_COOLDOWN", dbBreaker.cooldown)
+	if size := getEnvInt("DB_BATCH_SIZE", 0); size > 0 {
+		requirePostgres(db, "DB_BATCH_SIZE")
+		batcher = newBatchWriter(db, size, getEnvDuration("DB_BATCH_INTERVAL", 200*time.Millisecond))
+	} else if writers := getEnvInt("DB_WRITERS", 0); writers > 0 {
+		dbWriter = newAsyncWriter(eventStore, writers, getEnvInt("DB_WRITE_QUEUE", 10000))
+	}
+	drainTimeout := getEnvDuration("DB_DRAIN_TIMEOUT", 30*time.Second)
+
+	if spoolDir := getEnv("SPOOL_DIR", "spool"); spoolDir != "off" {
+		outbox, err = newSpool(spoolDir, int64(getEnvInt("SPOOL_MAX_MB", 100))*1024*1024, eventStore)
+		if err != nil {
+			log.Fatalf("Failed to set up spool: %v", err)
 		}
+		outbox.startReplay(getEnvDuration("SPOOL_REPLAY_INTERVAL", 10*time.Second))
 	}
-	return 0
-}
 
-func processAndSaveData(db *sql.DB, data EventMessage) {
-	// Convert the timestamp from milliseconds to seconds before passing it to the SQL query
-	_, err := db.Exec("INSERT INTO mqtt_data (sender_id, message, timestamp) VALUES ($1, $2, to_timestamp($3 / 1000.0))",
-		data.Sumber, data.Msg, data.Time)
-	if err != nil {
-		log.Printf("Error saving data to database: %v", err)
-	} else {
-		log.Println("Data saved successfully")
+	mqttSubscribeQoS = getEnvQoS("MQTT_SUBSCRIBE_QOS", mqttSubscribeQoS)
+	mqttPublishQoS = getEnvQoS("MQTT_PUBLISH_QOS", mqttPublishQoS)
+	mqttRetain = getEnvBool("MQTT_RETAIN", false)
+	datapointExpiry = getEnvDuration("MQTT_DATAPOINT_EXPIRY", 0)
+	if datapointExpiry > 0 && mqttProtocolVersion != 5 {
+		log.Printf("MQTT_DATAPOINT_EXPIRY needs MQTT_PROTOCOL_VERSION=5, DATAPOINTS are published without expiry")
 	}
-}
+	ackEvents = parseAckEvents(os.Getenv("ACK_EVENTS"))
+	ackTopic = getEnv("MQTT_ACK_TOPIC", ackTopic)
+	setpointMin = getEnvFloat("SETPOINT_MIN", setpointMin)
+	setpointMax = getEnvFloat("SETPOINT_MAX", setpointMax)
 
-func sendDataPoint(message EventMessage) {
-	datapoints := map[string]interface{}{
-		"event":    message.EventName,
-		"tag":      message.Tag,
-		"value":    message.Value,
-		"time":     message.Time,
-		"id_modem": message.Sumber,
+	if importMode {
+		if err := runImport(eventStore, *importDirFlag); err != nil {
+			log.Fatalf("Import failed: %v", err)
+		}
+		dbWriter.Close(drainTimeout)
+		batcher.Flush()
+		return
 	}
 
-	log.Printf("Data to send: %v", datapoints)
+	clientID := buildClientID(getEnv("MQTT_CLIENT_ID", "modem_client"), os.Getenv("MQTT_CLIENT_ID_SUFFIX"))
+	log.Printf("Using MQTT client ID %q", clientID)
 
-	payload, err := json.Marshal(datapoints)
+	broker, err := brokerURL(mqttBroker, os.Getenv("MQTT_WS_PATH"))
 	if err != nil {
-		log.Printf("Failed to marshal datapoint: %v", err)
-		return
+		log.Fatalf("Invalid MQTT_BROKER: %v", err)
 	}
 
-	token := mqttClient.Publish("DATAPOINTS", 0, false, payload)
-	token.Wait()
-	if token.Error() != nil {
-		log.Printf("Failed to send datapoint: %v", token.Error())
+	opts := mqtt.NewClientOptions().AddBroker(broker).SetClientID(clientID)
+	if isWebsocketBroker(broker) {
+		log.Printf("Connecting to MQTT broker over WebSocket: %s", broker)
+		if err := configureWebsocket(opts, os.Getenv("MQTT_WS_PROXY")); err != nil {
+			log.Fatalf("Invalid MQTT_WS_PROXY: %v", err)
+		}
 	}
-}
-
-var mqttClient mqtt.Client
-
-func main() {
-
-
-	// Load environment variables from .env file
-	err := godotenv.Load()
+	opts.SetUsername(mqttUser)
+	opts.SetPassword(mqttPassword)
+	if mqttProtocolVersion != 5 {
+		opts.SetProtocolVersion(mqttProtocolVersion)
+	}
+	cleanSession := getEnvBool("MQTT_CLEAN_SESSION", true)
+	if !cleanSession && os.Getenv("MQTT_CLIENT_ID_SUFFIX") == "random" {
+		log.Printf("MQTT_CLEAN_SESSION=false with a random client ID suffix: the session cannot be resumed after a restart")
+	}
+	opts.SetCleanSession(cleanSession)
+	opts.SetResumeSubs(!cleanSession)
+	opts.SetKeepAlive(getEnvDuration("MQTT_KEEPALIVE", 30*time.Second))
+	opts.SetPingTimeout(getEnvDuration("MQTT_PING_TIMEOUT", 10*time.Second))
+	opts.SetConnectTimeout(getEnvDuration("MQTT_CONNECT_TIMEOUT", 30*time.Second))
+	opts.SetWriteTimeout(getEnvDuration("MQTT_WRITE_TIMEOUT", 0))
+	// Per-device FIFO processing relies on paho calling the subscription callbacks one at a
+	// time in arrival order; the worker pool then keeps each sender on a single worker.
+	opts.SetOrderMatters(true)
+	log.Printf("MQTT delivery: subscribe QoS %d, publish QoS %d, retain %v, clean session %v",
+		mqttSubscribeQoS, mqttPublishQoS, mqttRetain, cleanSession)
+	pool, err := newWorkerPool(getEnvInt("WORKER_COUNT", 4), getEnvInt("WORKER_QUEUE_SIZE", 100), getEnv("QUEUE_FULL_POLICY", queueBlock), func(msg inboundMessage) {
+		processMessage(eventStore, msg)
+	})
 	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+		log.Fatalf("Invalid QUEUE_FULL_POLICY: %v", err)
+	}
+	resubmit = pool.Submit
+
+	var mirror *bridge
+	if bridgeBroker := os.Getenv("BRIDGE_BROKER"); bridgeBroker != "" {
+		mirror = newBridge(bridgeConfig{
+			Broker:      bridgeBroker,
+			ClientID:    getEnv("BRIDGE_CLIENT_ID", clientID+"_bridge"),
+			User:        os.Getenv("BRIDGE_USER"),
+			Password:    os.Getenv("BRIDGE_PASSWORD"),
+			TopicPrefix: os.Getenv("BRIDGE_TOPIC_PREFIX"),
+			QoS:         getEnvQoS("BRIDGE_QOS", 1),
+			BufferSize:  getEnvInt("BRIDGE_BUFFER_SIZE", 10000),
+		})
+	}
+
+	var limiter *deviceRateLimiter
+	if rate := getEnvFloat("RATE_LIMIT_PER_SECOND", 0); rate > 0 {
+		limiter = newDeviceRateLimiter(rate, getEnvInt("RATE_LIMIT_BURST", 20))
+		var throttleDB *sql.DB
+		if getEnvBool("THROTTLE_LOG", false) {
+			requirePostgres(db, "THROTTLE_LOG")
+			throttleDB = db
+		}
+		limiter.startThrottleLog(throttleDB, time.Minute)
+		log.Printf("Rate limiting each device to %.2f messages/s", rate)
 	}
 
-	// Initialize global variables from environment variables
-	mqttBroker = os.Getenv("MQTT_BROKER")
-	mqttUser = os.Getenv("MQTT_USER")
-	mqttPassword = os.Getenv("MQTT_PASSWORD")
-	mqttSubscribe = os.Getenv("MQTT_SUBSCRIBE")
-	dbHost = os.Getenv("DB_HOST")
-	dbPort = os.Getenv("DB_PORT")
-	dbName = os.Getenv("DB_NAME")
-	dbUser = os.Getenv("DB_USER")
-	dbPassword = os.Getenv("DB_PASSWORD")
-	apiKey = os.Getenv("API_KEY")
+	replayWindow := getEnvDuration("MQTT_REPLAY_WINDOW", 0)
+	orderer := newReplayOrderer(getEnvInt("MQTT_REPLAY_BUFFER", 10000), pool.Submit)
+	handleInbound := func(msg BrokerMessage) {
+		ingestID := newUUID()
+		mirror.Mirror(msg.Topic, msg.Payload)
 
-	// Setup database connection
-	db, err := setupDatabase()
-	if err != nil {
-		log.Fatalf("Failed to set up database: %v", err)
+		senderID, ok := senderIDFromTopic(msg.Topic)
+		if !ok {
+			log.Printf("[%s] Message received on topic %s: %s\n", ingestID, msg.Topic, msg.Payload)
+			log.Printf("Sender ID not found in topic: %s\n", msg.Topic)
+			return
+		}
+		if logPayloadOf(senderID) {
+			log.Printf("[%s] Message received on topic %s: %s\n", ingestID, msg.Topic, msg.Payload)
+		} else {
+			log.Printf("[%s] Message received on topic %s (%d bytes)\n", ingestID, msg.Topic, len(msg.Payload))
+		}
+		if !ownsSender(senderID) {
+			messagesOtherShard.Inc("data")
+			return
+		}
+		receivedAt := clock.Now()
+		observeDeviceTraffic(senderID, len(msg.Payload), receivedAt)
+		procLog.Record(ingestID, senderID, decisionReceived, msg.Topic)
+		if limiter != nil && !limiter.Allow(senderID) {
+			procLog.Record(ingestID, senderID, decisionRateLimited, "")
+			return
+		}
+		orderer.Submit(inboundMessage{
+			Topic:      msg.Topic,
+			SenderID:   senderID,
+			IngestID:   ingestID,
+			Payload:    msg.Payload,
+			Properties: msg.Properties,
+			ReceivedAt: receivedAt,
+		})
+	}
+
+	// With a persistent session the broker starts delivering queued messages right after
+	// CONNACK, before Subscribe has registered its handler, so they arrive here.
+	unrouted := func(msg BrokerMessage) {
+		if topicMatches(mqttSubscribe, msg.Topic) {
+			handleInbound(msg)
+			return
+		}
+		log.Printf("Received message: %s from topic: %s\n", msg.Payload, msg.Topic)
 	}
-	defer db.Close()
-
-	opts := mqtt.NewClientOptions().AddBroker(mqttBroker).SetClientID("modem_client")
-	opts.SetUsername(mqttUser)
-	opts.SetPassword(mqttPassword)
 	opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
-		log.Printf("Received message: %s from topic: %s\n", msg.Payload(), msg.Topic())
+		unrouted(BrokerMessage{Topic: msg.Topic(), Payload: msg.Payload(), Retained: msg.Retained()})
 	})
-
-	mqttClient = mqtt.NewClient(opts)
-	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatalf("Failed to connect to MQTT broker: %v", token.Error())
+	var onConnect func()
+	if !cleanSession {
+		if replayWindow > 0 {
+			onConnect = func() { orderer.Open(replayWindow) }
+			opts.SetOnConnectHandler(func(client mqtt.Client) { onConnect() })
+		}
+		log.Printf("Persistent session: messages queued while disconnected are delivered on reconnect, for as long as the broker keeps the session")
 	}
 
-	if token := mqttClient.Subscribe(mqttSubscribe, 1, func(client mqtt.Client, msg mqtt.Message) {
-		log.Printf("Message received on topic %s: %s\n", msg.Topic(), msg.Payload())
+	if mqttProtocolVersion == 5 {
+		log.Printf("Using MQTT v5")
+		mqttClient = newPahoV5Broker(opts, pahoV5Options{
+			SessionExpiry: getEnvDuration("MQTT_SESSION_EXPIRY", 24*time.Hour),
+			Unrouted:      unrouted,
+			OnConnect:     onConnect,
+		})
+	} else {
+		mqttClient = newPahoBroker(opts)
+	}
+	if err := mqttClient.Connect(); err != nil {
+		log.Fatalf("Failed to connect to MQTT broker: %v", err)
+	}
 
-		var msgData map[string]interface{}
-		if err := json.Unmarshal(msg.Payload(), &msgData); err != nil {
-			log.Printf("Error unmarshalling MQTT message: %v\nPayload: %s", err, msg.Payload())
-			return
+	topic := subscriptionTopic(mqttSubscribe, mqttSharedGroup)
+	log.Printf("Subscribing to %s", topic)
+	if mqttSharedGroup != "" {
+		log.Printf("Shared subscription %s: messages of one device may be processed by different instances, so per-device ordering only holds within this instance", mqttSharedGroup)
+	}
+	switch source := getEnv("SUBSCRIPTION_SOURCE", "wildcard"); source {
+	case "wildcard":
+		if err := mqttClient.Subscribe(topic, mqttSubscribeQoS, handleInbound); err != nil {
+			log.Fatalf("Failed to subscribe to topic: %v", err)
 		}
-
-		event, ok := msgData["event"].(string)
-		if !ok {
-			log.Printf("Event type not found in message: %s\n", msg.Payload())
-			return
+	case "registry":
+		requirePostgres(db, "SUBSCRIPTION_SOURCE=registry")
+		filter := DeviceFilter{Saved: os.Getenv("SUBSCRIPTION_DEVICE_FILTER")}
+		topic = getEnv("MQTT_DEVICE_TOPIC", "DATA/MODEM/%s")
+		log.Printf("Subscribing to %s for each registered device (filter %q)", topic, filter.Saved)
+		if err := startRegistrySubscriptions(db, topic, mqttSharedGroup, filter, getEnvDuration("SUBSCRIPTION_REFRESH", 5*time.Minute), handleInbound); err != nil {
+			log.Fatalf("Failed to subscribe to registered devices: %v", err)
 		}
-		msgData["event"] = event
-		senderID := strings.Split(msg.Topic(), "/")[2]
-		message := string(msg.Payload())
+	default:
+		log.Fatalf("Invalid SUBSCRIPTION_SOURCE %q: must be wildcard or registry", source)
+	}
 
-		timestamp, err := getTimestamp(msgData)
+	if statusTopic := os.Getenv("DEVICE_STATUS_TOPIC"); statusTopic != "" {
+		subscribeDeviceStatus(statusTopic, pool, getEnvBool("DEVICE_STATUS_RETAINED", false))
+	}
+	if db != nil {
+		expirePendingCommands(db)
+		subscribeCommandAcks(db)
+		subscribeOTAStatus(db)
+	}
+	if getEnvBool("SYS_MONITORING", false) {
+		subscribeBrokerSys(getEnv("SYS_TOPICS", defaultSysTopics), getEnvBool("SYS_DATAPOINTS", true))
+	}
+	if db != nil {
+		resumeRunningCampaigns(db)
+		startBulkSweeper(db)
+	}
+	if stage := *reprocessDeadLettersFlag; stage != "" {
+		count, err := reprocessDeadLetters(db, stage, 0, math.MaxInt32)
 		if err != nil {
-			log.Printf("Error processing timestamp: %v\nMessage Data: %+v", err, msgData)
-			return
+			log.Printf("Error reprocessing dead letters: %v", err)
 		}
+		log.Printf("Reprocessing %d dead letters (%s)", count, stage)
+	}
+	startAPIServer(db)
+	startHeartbeat(clientID)
+	startSelfMetrics(getEnv("SELF_METRICS_INSTANCE", clientID), pool, getEnvDuration("SELF_METRICS_INTERVAL", 0))
+	startRetention(db, retentionAges, getEnvDuration("RETENTION_INTERVAL", time.Hour))
+	startSilenceWatchdog(db)
+	startArchiver(db, archive)
+	if db != nil {
+		startInstanceRegistry(db, clientID, mqttSubscribe, mqttSharedGroup, getEnvDuration("INSTANCE_HEARTBEAT", 30*time.Second))
+	}
+
+	serviceReady("Connected to MQTT broker and subscribed to "+topic, func() bool { return mqttClient.Status().Connected })
+
+	stop := make(chan os.Signal, 1)
+	notifyStop(stop)
+	log.Printf("Received %v, shutting down", <-stop)
+	serviceStopping()
+	// Stop taking messages first, let the workers finish what is queued (they still
+	// publish DATAPOINTS), then drain the writers they fed and only then disconnect.
+	if err := mqttClient.UnsubscribeAll(); err != nil {
+		log.Printf("Error unsubscribing: %v", err)
+	}
+	orderer.Flush()
+	pool.Close()
+	dbWriter.Close(drainTimeout)
+	batcher.Flush()
+	mqttClient.Disconnect()
+	serviceStopped()
+}
 
-		log.Printf("Processed timestamp: %v", timestamp)
-
-		switch event {
-		case "TEMPERATURE":
-			handleTemperatureEvent(db, senderID, message, event)
-		case "ALARM_METER_TEMPER":
-			handleAlarmMeterDeviceTemperEvent(db, senderID, message, event)
-		case "CLEAR_ALARM_METER_TEMPER":
-			handleClearAlarmMeterDeviceTemperEvent(db, senderID, message, event)
-		case "POWER_BACKUP_MODE":
-			handlePowerBackupModeEvent(db, senderID, message, event)
-		case "POWER_RESTORE_MODE":
-			handlePowerRestoreModeEvent(db, senderID, message, event)
-		case "STATUS_MODEM_ON":
-			handleStatusModemOn(db, senderID, message, event)
-		case "STATUS_MODEM_OFF":
-			handleStatusModemOff(db, senderID, message, event)
-		case "ALARM_TEMPERATURE":
-			handleAlarmTemperatureEvent(db, senderID, message, event)
-		case "CLEAR_ALARM_TEMPERATURE":
-			handleClearAlarmTemperatureEvent(db, senderID, message, event)
-		case "SET_TEMPERATURE":
-			handleSetTemperatureEvents(db, senderID, message)
-		case "ALARM_METER_DEVICE":
-			handleAlarmMeterDeviceEvent(db, senderID, message, event)
-		case "CLEAR_ALARM_METER_DEVICE":
-			handleClearAlarmMeterDeviceEvent(db, senderID, message, event)
-		case "GEOLOCATION":
-			handleGeolocationEvent(db, message, senderID, event)
-		default:
-			log.Printf("Unhandled message type in topic %s: %s\n", msg.Topic(), msg.Payload())
+// buildClientID appends the configured uniqueness suffix to the base client ID so that
+// several instances do not kick each other off the broker. suffix is "hostname", "random" or empty.
+func buildClientID(base, suffix string) string {
+	switch suffix {
+	case "":
+		return base
+	case "hostname":
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Printf("Error reading hostname for client ID, using random suffix: %v", err)
+			return base + "-" + newID()[:8]
 		}
-
-	}); token.Wait() && token.Error() != nil {
-		log.Fatalf("Failed to subscribe to topic: %v", token.Error())
+		return base + "-" + hostname
+	case "random":
+		return base + "-" + newID()[:8]
+	default:
+		log.Printf("Unknown MQTT_CLIENT_ID_SUFFIX %q, using client ID without suffix", suffix)
+		return base
 	}
+}
 
-	select {}
+// parseProtocolVersion maps MQTT_PROTOCOL_VERSION to the value paho expects (3 = 3.1, 4 = 3.1.1),
+// or 5 for MQTT 5, which uses the paho.golang client.
+func parseProtocolVersion(version string) (uint, error) {
+	switch version {
+	case "3", "3.1":
+		return 3, nil
+	case "4", "3.1.1":
+		return 4, nil
+	case "5", "5.0":
+		return 5, nil
+	default:
+		return 0, fmt.Errorf("unknown protocol version %q", version)
+	}
 }
 
-func getTimestamp(msgData map[string]interface{}) (interface{}, error) {
-	if timestamp, ok := msgData["timestamp"].(float64); ok {
-		return int64(timestamp), nil
-	} else if timestamp, ok := msgData["timestamp"].(string); ok {
-		return timestamp, nil
-	} else {
-		return nil, fmt.Errorf("'timestamp' field not found or not a valid type in msgData")
+// subscriptionTopic returns the topic filter to subscribe to, wrapped in $share/<group>/ when a shared group is configured.
+func subscriptionTopic(topic, group string) string {
+	if group == "" {
+		return topic
 	}
+	return fmt.Sprintf("$share/%s/%s", group, topic)
 }
+
+
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func FuzzDecodeEvent(f *testing.F) {
+	for _, payload := range []string{
+		`{"event":"TEMPERATURE","message":"27.5","timestamp":"1700000000"}`,
+		`{"event":"ALARM_METER_DEVICE","message":"CONNECTION_MISSING","timestamp":"1700000030"}`,
+		`{"event":"GEOLOCATION","message":"[510,10,1A2B,3C4D,-71,3][510,10,1A2B,3C4E]","timestamp":1700000050}`,
+		`{"event":"GEOLOCATION","message":"+CENG: 0,\"0066,44,00,510,10,39,3c4d,06,05,1a2b,255\"","timestamp":"2023-11-14T22:13:20Z"}`,
+		`{"event":"SET_TEMPERATURE","message":"18.5,24.0","timestamp":1700000000123}`,
+		`{"event":7,"message":"27.5"}`,
+		`{"message":"27.5"}`,
+		`["TEMPERATURE"]`,
+		`null`,
+	} {
+		f.Add([]byte(payload))
+	}
+	f.Add(cborEvent)
+	f.Add(compress(f, compressionGzip, []byte(`{"event":"TEMPERATURE","message":"23.5","timestamp":1700000000}`)))
+	f.Add([]byte{})
+
+	saved := clock
+	clock = NewFakeClock(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	f.Cleanup(func() { clock = saved })
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		payload, msgData, event, err := decodeEvent("fuzz", "modem-1", "DATA/modem-1", raw)
+		if err != nil {
+			return
+		}
+		if msgData["event"] != event {
+			t.Errorf("decodeEvent(%q) returned event %q but the fields say %v", raw, event, msgData["event"])
+		}
+		// The payload handed to the handlers must decode to the same fields.
+		var again map[string]interface{}
+		if err := json.Unmarshal(payload, &again); err != nil || !reflect.DeepEqual(again, msgData) {
+			t.Errorf("decodeEvent(%q) payload %s decodes to %v, %v, want %v", raw, payload, again, err, msgData)
+		}
+		// Whatever the timestamp field holds, reading it must not panic.
+		eventTimestamp(msgData, clock.Now())
+	})
+}
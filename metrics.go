@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A minimal Prometheus text-format registry; the collector only needs counters, gauges
+// and histograms.
+
+type metric interface {
+	write(sb *strings.Builder)
+}
+
+var (
+	metricsMu       sync.Mutex
+	metricsRegistry = map[string]metric{}
+)
+
+func register(name string, m metric) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if _, exists := metricsRegistry[name]; exists {
+		panic("metric registered twice: " + name)
+	}
+	metricsRegistry[name] = m
+}
+
+// counterVec is a monotonically increasing counter partitioned by one label.
+type counterVec struct {
+	name, help, label string
+	mu                sync.Mutex
+	values            map[string]float64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	c := &counterVec{name: name, help: help, label: label, values: map[string]float64{}}
+	register(name, c)
+	return c
+}
+
+// Inc adds one to the counter for labelValue.
+func (c *counterVec) Inc(labelValue string) {
+	c.Add(labelValue, 1)
+}
+
+func (c *counterVec) Add(labelValue string, delta float64) {
+	c.mu.Lock()
+	c.values[labelValue] += delta
+	c.mu.Unlock()
+}
+
+// Value returns the current count for labelValue.
+func (c *counterVec) Value(labelValue string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelValue]
+}
+
+func (c *counterVec) write(sb *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(sb, "%s{%s=%q} %g\n", c.name, c.label, k, c.values[k])
+	}
+}
+
+// gaugeVec is a settable gauge partitioned by one label.
+type gaugeVec struct {
+	name, help, label string
+	mu                sync.Mutex
+	values            map[string]float64
+}
+
+func newGaugeVec(name, help, label string) *gaugeVec {
+	g := &gaugeVec{name: name, help: help, label: label, values: map[string]float64{}}
+	register(name, g)
+	return g
+}
+
+// Set records the current value for labelValue.
+func (g *gaugeVec) Set(labelValue string, value float64) {
+	g.mu.Lock()
+	g.values[labelValue] = value
+	g.mu.Unlock()
+}
+
+func (g *gaugeVec) write(sb *strings.Builder) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	keys := make([]string, 0, len(g.values))
+	for k := range g.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(sb, "%s{%s=%q} %g\n", g.name, g.label, k, g.values[k])
+	}
+}
+
+// histogramVec is a histogram with fixed upper bounds partitioned by one label.
+type histogramVec struct {
+	name, help, label string
+	bounds            []float64
+	mu                sync.Mutex
+	values            map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bound, non-cumulative; the last slot is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help, label string, bounds []float64) *histogramVec {
+	h := &histogramVec{name: name, help: help, label: label, bounds: bounds, values: map[string]*histogram{}}
+	register(name, h)
+	return h
+}
+
+// Observe records value for labelValue.
+func (h *histogramVec) Observe(labelValue string, value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[labelValue]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.bounds)+1)}
+		h.values[labelValue] = hist
+	}
+	i := sort.SearchFloat64s(h.bounds, value)
+	hist.counts[i]++
+	hist.sum += value
+	hist.count++
+}
+
+func (h *histogramVec) write(sb *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hist := h.values[k]
+		var cumulative uint64
+		for i, bound := range h.bounds {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(sb, "%s_bucket{%s=%q,le=\"%g\"} %d\n", h.name, h.label, k, bound, cumulative)
+		}
+		fmt.Fprintf(sb, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", h.name, h.label, k, hist.count)
+		fmt.Fprintf(sb, "%s_sum{%s=%q} %g\n%s_count{%s=%q} %d\n", h.name, h.label, k, hist.sum, h.name, h.label, k, hist.count)
+	}
+}
+
+// gaugeFunc reports a value computed at scrape time.
+type gaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+func newGaugeFunc(name, help string, fn func() float64) {
+	register(name, &gaugeFunc{name: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) write(sb *strings.Builder) {
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", g.name, g.help, g.name, g.name, g.fn())
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	metricsMu.Lock()
+	names := make([]string, 0, len(metricsRegistry))
+	for name := range metricsRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		metricsRegistry[name].write(&sb)
+	}
+	metricsMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, sb.String())
+}
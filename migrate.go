@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Schema migrations are SQL files embedded in the binary, named
+// NNNN_description.up.sql with an optional NNNN_description.down.sql. Applied versions
+// are recorded in schema_migrations. A migration without a down file is irreversible.
+// An up file starting with "-- migrate:no-transaction" runs statement by statement
+// outside a transaction, for CREATE INDEX CONCURRENTLY on large tables. A
+// "-- migrate:indexes" line marks a migration that only builds query indexes; with
+// DB_INDEXES=skip those are left pending so a DBA can build the indexes themselves.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var migrateFlag = flag.String("migrate", "up", `schema migrations: "up" applies pending migrations and starts, "down" rolls back the latest one and exits, "status" lists them and exits`)
+
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+const (
+	noTransactionDirective = "-- migrate:no-transaction"
+	indexesDirective       = "-- migrate:indexes"
+)
+
+var concurrentIndexPattern = regexp.MustCompile(`(?i)CREATE\s+(?:UNIQUE\s+)?INDEX\s+CONCURRENTLY\s+IF\s+NOT\s+EXISTS\s+(\w+)\s+ON\s+(?:ONLY\s+)?(\w+)`)
+
+var concurrentlyKeyword = regexp.MustCompile(`(?i)\s+CONCURRENTLY\b`)
+
+// Query index management (DB_INDEXES): "managed", the default, builds the query indexes
+// in migrations and on routed tables; "skip" leaves them to a DBA.
+const (
+	indexesManaged = "managed"
+	indexesSkip    = "skip"
+)
+
+var dbIndexMode = indexesManaged
+
+// migrationLockID serializes migrations between collectors starting at the same time.
+const migrationLockID = 0x6d6f64656d // "modem"
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string // empty when irreversible
+
+	NoTransaction bool
+	Indexes       bool // only builds query indexes
+}
+
+// loadMigrations returns the migrations in dir of files sorted by version.
+func loadMigrations(files fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*migration{}
+	for _, entry := range entries {
+		m := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("unexpected migration file name %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		body, err := fs.ReadFile(files, dir+"/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+			mig.NoTransaction = strings.HasPrefix(mig.Up, noTransactionDirective)
+			mig.Indexes = hasDirective(mig.Up, indexesDirective)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+	migrations := make([]migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// hasDirective reports whether one of the leading comment lines of body is directive.
+func hasDirective(body, directive string) bool {
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "--") {
+			return false
+		}
+		if line == directive {
+			return true
+		}
+	}
+	return false
+}
+
+func appliedMigrations(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}) (map[int]bool, error) {
+	rows, err := q.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %v", err)
+	}
+	defer rows.Close()
+	applied := map[int]bool{}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+        version INTEGER PRIMARY KEY,
+        name TEXT NOT NULL,
+        applied_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+    )`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+	return nil
+}
+
+// migrateUp applies every pending migration, each in its own transaction. Index
+// migrations are left pending with DB_INDEXES=skip.
+func migrateUp(db *sql.DB) error {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return err
+	}
+	if err := ensureMigrationsTable(db); err != nil {
+		return err
+	}
+	for _, mig := range migrations {
+		if mig.Indexes && dbIndexMode == indexesSkip {
+			continue
+		}
+		if err := applyMigration(db, mig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, mig migration) error {
+	if mig.NoTransaction {
+		return applyMigrationWithoutTransaction(db, mig)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("failed to lock migrations: %v", err)
+	}
+	// Another collector may have applied it while we waited for the lock.
+	var applied bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)", mig.Version).Scan(&applied); err != nil {
+		return fmt.Errorf("failed to check migration %d: %v", mig.Version, err)
+	}
+	if applied {
+		return nil
+	}
+	if _, err := tx.Exec(mig.Up); err != nil {
+		return fmt.Errorf("migration %d_%s failed: %v", mig.Version, mig.Name, err)
+	}
+	if _, err := tx.Exec("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", mig.Version, mig.Name); err != nil {
+		return fmt.Errorf("failed to record migration %d: %v", mig.Version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Applied migration %d_%s", mig.Version, mig.Name)
+	return nil
+}
+
+// applyMigrationWithoutTransaction runs the statements of a no-transaction migration one
+// at a time on a single connection holding the migration lock. An interrupted concurrent
+// build leaves an invalid index behind that IF NOT EXISTS would keep, so the indexes the
+// migration builds are dropped first when invalid.
+func applyMigrationWithoutTransaction(db *sql.DB, mig migration) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("failed to lock migrations: %v", err)
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	var applied bool
+	if err := conn.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)", mig.Version).Scan(&applied); err != nil {
+		return fmt.Errorf("failed to check migration %d: %v", mig.Version, err)
+	}
+	if applied {
+		return nil
+	}
+	for _, m := range concurrentIndexPattern.FindAllStringSubmatch(mig.Up, -1) {
+		if err := dropInvalidIndex(ctx, conn, m[1]); err != nil {
+			return err
+		}
+	}
+	for _, stmt := range splitStatements(mig.Up) {
+		// TimescaleDB cannot build hypertable indexes concurrently.
+		if m := concurrentIndexPattern.FindStringSubmatch(stmt); m != nil {
+			hypertable, err := isHypertable(ctx, conn, m[2])
+			if err != nil {
+				return err
+			}
+			if hypertable {
+				stmt = strings.Replace(stmt, m[0], concurrentlyKeyword.ReplaceAllString(m[0], ""), 1)
+			}
+		}
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("migration %d_%s failed: %v", mig.Version, mig.Name, err)
+		}
+	}
+	if _, err := conn.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", mig.Version, mig.Name); err != nil {
+		return fmt.Errorf("failed to record migration %d: %v", mig.Version, err)
+	}
+	log.Printf("Applied migration %d_%s", mig.Version, mig.Name)
+	return nil
+}
+
+// dropInvalidIndex drops index when an interrupted concurrent build left it invalid.
+func dropInvalidIndex(ctx context.Context, conn *sql.Conn, index string) error {
+	var valid bool
+	err := conn.QueryRowContext(ctx, `SELECT i.indisvalid FROM pg_index i JOIN pg_class c ON c.oid = i.indexrelid
+        WHERE c.relname = $1 AND pg_table_is_visible(c.oid)`, index).Scan(&valid)
+	if err == sql.ErrNoRows || valid {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check index %s: %v", index, err)
+	}
+	log.Printf("Dropping index %s left invalid by an interrupted build", index)
+	if _, err := conn.ExecContext(ctx, "DROP INDEX CONCURRENTLY IF EXISTS "+index); err != nil {
+		return fmt.Errorf("failed to drop invalid index %s: %v", index, err)
+	}
+	return nil
+}
+
+// isHypertable reports whether table is a TimescaleDB hypertable.
+func isHypertable(ctx context.Context, conn *sql.Conn, table string) (bool, error) {
+	var hypertable bool
+	err := conn.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')`).Scan(&hypertable)
+	if err != nil || !hypertable {
+		return false, err
+	}
+	err = conn.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM timescaledb_information.hypertables WHERE hypertable_name = $1)", table).Scan(&hypertable)
+	if err != nil {
+		return false, fmt.Errorf("failed to check for the %s hypertable: %v", table, err)
+	}
+	return hypertable, nil
+}
+
+// splitStatements splits a migration into statements at semicolons ending a line and
+// drops comment-only lines. Statements of a no-transaction migration must be sent
+// separately: several statements in one query run as an implicit transaction.
+func splitStatements(body string) []string {
+	var statements []string
+	var current strings.Builder
+	for _, line := range strings.Split(body, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSpace(current.String()))
+			current.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
+
+// migrateDown rolls back the most recently applied migration.
+func migrateDown(db *sql.DB) error {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return err
+	}
+	if err := ensureMigrationsTable(db); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("failed to lock migrations: %v", err)
+	}
+	var version int
+	err = tx.QueryRow("SELECT version FROM schema_migrations ORDER BY version DESC LIMIT 1").Scan(&version)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no migrations applied")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find the latest migration: %v", err)
+	}
+	for _, mig := range migrations {
+		if mig.Version != version {
+			continue
+		}
+		if mig.Down == "" {
+			return fmt.Errorf("migration %d_%s is irreversible", mig.Version, mig.Name)
+		}
+		if _, err := tx.Exec(mig.Down); err != nil {
+			return fmt.Errorf("rolling back migration %d_%s failed: %v", mig.Version, mig.Name, err)
+		}
+		if _, err := tx.Exec("DELETE FROM schema_migrations WHERE version = $1", version); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Rolled back migration %d_%s", mig.Version, mig.Name)
+		return nil
+	}
+	return fmt.Errorf("migration %d is applied but unknown to this build", version)
+}
+
+// printMigrationStatus logs every known migration and whether it has been applied.
+func printMigrationStatus(db *sql.DB) error {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return err
+	}
+	if err := ensureMigrationsTable(db); err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	logMigrationStatus(migrations, applied)
+	return nil
+}
+
+func logMigrationStatus(migrations []migration, applied map[int]bool) {
+	for _, mig := range migrations {
+		state := "pending"
+		if applied[mig.Version] {
+			state = "applied"
+		} else if mig.Indexes && dbIndexMode == indexesSkip {
+			state = "skipped (DB_INDEXES=skip)"
+		}
+		log.Printf("%04d_%s: %s", mig.Version, mig.Name, state)
+	}
+}
+
+// runMigrations handles the --migrate flag. It reports whether the collector should
+// go on to start.
+func runMigrations(db *sql.DB) (bool, error) {
+	switch *migrateFlag {
+	case "up":
+		return true, migrateUp(db)
+	case "down":
+		return false, migrateDown(db)
+	case "status":
+		return false, printMigrationStatus(db)
+	default:
+		return false, fmt.Errorf("unknown --migrate mode %q", *migrateFlag)
+	}
+}
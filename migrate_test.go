@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestIndexMigrationsRunConcurrently(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexes := 0
+	for _, mig := range migrations {
+		if !mig.Indexes {
+			continue
+		}
+		indexes++
+		// A plain CREATE INDEX in a migration locks writes on the table while it builds.
+		if !mig.NoTransaction {
+			t.Errorf("index migration %d_%s runs in a transaction", mig.Version, mig.Name)
+		}
+		for _, stmt := range splitStatements(mig.Up) {
+			if concurrentIndexPattern.FindString(stmt) == "" {
+				t.Errorf("index migration %d_%s has a statement that is not CREATE INDEX CONCURRENTLY IF NOT EXISTS: %s", mig.Version, mig.Name, stmt)
+			}
+		}
+	}
+	if indexes == 0 {
+		t.Error("no migration is marked -- migrate:indexes")
+	}
+}
@@ -0,0 +1,186 @@
+-- Baseline: the schema the collector created inline with CREATE TABLE IF NOT EXISTS
+-- before migrations existed. Every statement is idempotent so existing databases are
+-- adopted as version 1 without changes.
+
+CREATE TABLE IF NOT EXISTS mqtt_data (
+    id SERIAL PRIMARY KEY,
+    sender_id TEXT,
+    message TEXT,
+    timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE mqtt_data ADD COLUMN IF NOT EXISTS ingest_id TEXT;
+
+CREATE TABLE IF NOT EXISTS command_audit (
+    id SERIAL PRIMARY KEY,
+    command_id TEXT UNIQUE NOT NULL,
+    sender_id TEXT NOT NULL,
+    command TEXT NOT NULL,
+    request TEXT NOT NULL,
+    sent_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ack_payload TEXT,
+    acked_at TIMESTAMPTZ,
+    rtt_ms BIGINT,
+    outcome TEXT NOT NULL
+);
+
+ALTER TABLE command_audit ADD COLUMN IF NOT EXISTS batch_id TEXT;
+
+CREATE TABLE IF NOT EXISTS command_batches (
+    id TEXT PRIMARY KEY,
+    command TEXT NOT NULL,
+    params TEXT,
+    filter TEXT,
+    total INTEGER NOT NULL,
+    status TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS event_state (
+    key TEXT PRIMARY KEY,
+    value BOOLEAN NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS firmware_campaigns (
+    id TEXT PRIMARY KEY,
+    version TEXT NOT NULL,
+    url TEXT NOT NULL,
+    checksum TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL,
+    batch_size INTEGER NOT NULL,
+    interval_ms BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS firmware_campaign_devices (
+    campaign_id TEXT NOT NULL REFERENCES firmware_campaigns (id),
+    sender_id TEXT NOT NULL,
+    command_id TEXT,
+    status TEXT NOT NULL,
+    detail TEXT,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (campaign_id, sender_id)
+);
+
+CREATE TABLE IF NOT EXISTS device_shadows (
+    sender_id TEXT PRIMARY KEY,
+    desired JSONB NOT NULL DEFAULT '{}',
+    reported JSONB NOT NULL DEFAULT '{}',
+    desired_at TIMESTAMPTZ,
+    reported_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS device_throttle_log (
+    id SERIAL PRIMARY KEY,
+    sender_id TEXT NOT NULL,
+    dropped INTEGER NOT NULL,
+    first_dropped_at TIMESTAMPTZ NOT NULL,
+    last_dropped_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS dedup_keys (
+    key TEXT PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS raw_messages (
+    ingest_id TEXT PRIMARY KEY,
+    sender_id TEXT NOT NULL,
+    topic TEXT NOT NULL,
+    payload BYTEA NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS events (
+    id BIGSERIAL PRIMARY KEY,
+    ingest_id TEXT,
+    sender_id TEXT NOT NULL,
+    event_name TEXT NOT NULL,
+    tag TEXT NOT NULL,
+    value JSONB,
+    status BOOLEAN NOT NULL,
+    event_time TIMESTAMPTZ,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS events_ingest_id_idx ON events (ingest_id);
+
+CREATE TABLE IF NOT EXISTS raw_events (
+    id BIGSERIAL PRIMARY KEY,
+    ingest_id TEXT,
+    sender_id TEXT NOT NULL,
+    event_name TEXT NOT NULL,
+    topic TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS quarantine (
+    id BIGSERIAL PRIMARY KEY,
+    ingest_id TEXT,
+    sender_id TEXT NOT NULL,
+    event_name TEXT NOT NULL,
+    topic TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    error TEXT NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS processing_log (
+    id BIGSERIAL PRIMARY KEY,
+    ingest_id TEXT NOT NULL,
+    sender_id TEXT NOT NULL,
+    decision TEXT NOT NULL,
+    detail TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS processing_log_ingest_id_idx ON processing_log (ingest_id);
+
+CREATE INDEX IF NOT EXISTS processing_log_sender_created_idx ON processing_log (sender_id, created_at);
+
+CREATE TABLE IF NOT EXISTS saved_filters (
+    name TEXT PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT '',
+    filter JSONB NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS device_thermal_state (
+    sender_id TEXT PRIMARY KEY,
+    last_at TIMESTAMPTZ NOT NULL,
+    last_value DOUBLE PRECISION NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS thermal_daily (
+    sender_id TEXT NOT NULL,
+    day DATE NOT NULL,
+    cooling_degree_days DOUBLE PRECISION NOT NULL DEFAULT 0,
+    over_threshold_seconds DOUBLE PRECISION NOT NULL DEFAULT 0,
+    samples INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (sender_id, day)
+);
+
+CREATE TABLE IF NOT EXISTS collector_instances (
+    client_id TEXT PRIMARY KEY,
+    hostname TEXT NOT NULL,
+    topic_filter TEXT NOT NULL,
+    shared_group TEXT NOT NULL DEFAULT '',
+    version TEXT NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL,
+    last_seen TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS devices (
+    sender_id TEXT PRIMARY KEY,
+    region TEXT NOT NULL DEFAULT '',
+    model TEXT NOT NULL DEFAULT '',
+    first_seen TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS devices_labels_idx ON devices USING GIN (labels);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS events_sender_event_time_idx;
+DROP TABLE IF EXISTS metric_rollups;
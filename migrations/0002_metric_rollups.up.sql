@@ -0,0 +1,30 @@
+-- 5-minute and hourly aggregates of numeric event values for the series API.
+CREATE TABLE metric_rollups (
+    sender_id TEXT NOT NULL,
+    metric TEXT NOT NULL,
+    resolution_s INTEGER NOT NULL,
+    bucket TIMESTAMPTZ NOT NULL,
+    count BIGINT NOT NULL,
+    sum DOUBLE PRECISION NOT NULL,
+    min DOUBLE PRECISION NOT NULL,
+    max DOUBLE PRECISION NOT NULL,
+    PRIMARY KEY (sender_id, metric, resolution_s, bucket)
+);
+
+CREATE INDEX events_sender_event_time_idx ON events (sender_id, event_name, event_time);
+
+-- Backfill the rollups from the events stored so far.
+INSERT INTO metric_rollups (sender_id, metric, resolution_s, bucket, count, sum, min, max)
+SELECT sender_id, lower(event_name), r.s,
+       to_timestamp(floor(extract(epoch FROM event_time) / r.s) * r.s),
+       count(*), sum(v), min(v), max(v)
+FROM (
+    SELECT sender_id, event_name, event_time,
+           CASE WHEN jsonb_typeof(value) = 'number' THEN value::text::double precision
+                WHEN jsonb_typeof(value) = 'string' AND value #>> '{}' ~ '^-?[0-9]+(\.[0-9]+)?$' THEN (value #>> '{}')::double precision
+           END AS v
+    FROM events WHERE event_time IS NOT NULL
+) e
+CROSS JOIN (VALUES (300), (3600)) AS r (s)
+WHERE v IS NOT NULL
+GROUP BY 1, 2, 3, 4;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS events_event_name_time_idx;
+ALTER TABLE events DROP COLUMN IF EXISTS raw;
+ALTER TABLE events DROP COLUMN IF EXISTS value_num;
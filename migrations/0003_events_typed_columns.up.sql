@@ -0,0 +1,12 @@
+-- Typed numeric value and the device payload as JSONB, so events can be queried without
+-- parsing mqtt_data.message.
+ALTER TABLE events ADD COLUMN value_num DOUBLE PRECISION;
+ALTER TABLE events ADD COLUMN raw JSONB;
+
+UPDATE events SET value_num = CASE
+        WHEN jsonb_typeof(value) = 'number' THEN value::text::double precision
+        WHEN jsonb_typeof(value) = 'string' AND value #>> '{}' ~ '^-?[0-9]+(\.[0-9]+)?$' THEN (value #>> '{}')::double precision
+    END
+WHERE value IS NOT NULL;
+
+CREATE INDEX events_event_name_time_idx ON events (event_name, event_time);
@@ -0,0 +1,15 @@
+-- Messages that could not be decoded, timestamped or stored, kept for reprocessing.
+CREATE TABLE dead_letter (
+    id BIGSERIAL PRIMARY KEY,
+    ingest_id TEXT,
+    sender_id TEXT NOT NULL,
+    topic TEXT NOT NULL,
+    stage TEXT NOT NULL,
+    payload BYTEA NOT NULL,
+    error TEXT NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL,
+    failed_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    reprocessed_at TIMESTAMPTZ
+);
+
+CREATE INDEX dead_letter_pending_idx ON dead_letter (stage, id) WHERE reprocessed_at IS NULL;
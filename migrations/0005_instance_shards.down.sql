@@ -0,0 +1,2 @@
+ALTER TABLE collector_instances DROP COLUMN IF EXISTS shard_count;
+ALTER TABLE collector_instances DROP COLUMN IF EXISTS shard_index;
@@ -0,0 +1,4 @@
+-- Shard assignment of each collector, so instances splitting one topic filter by
+-- device are not reported as overlapping.
+ALTER TABLE collector_instances ADD COLUMN shard_index INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE collector_instances ADD COLUMN shard_count INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS mqtt_data_ingest_id_idx;
@@ -0,0 +1,2 @@
+-- Retention deletes mqtt_data rows by the ingest ID of their expired events.
+CREATE INDEX mqtt_data_ingest_id_idx ON mqtt_data (ingest_id);
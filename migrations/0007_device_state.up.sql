@@ -0,0 +1,48 @@
+-- Last known state of every device, upserted with each stored event, so dashboards can
+-- read the current state without scanning the event history.
+CREATE TABLE device_state (
+    sender_id TEXT PRIMARY KEY,
+    last_event TEXT NOT NULL,
+    last_seen TIMESTAMPTZ NOT NULL,
+    temperature DOUBLE PRECISION,
+    temperature_at TIMESTAMPTZ,
+    power_status TEXT,
+    power_at TIMESTAMPTZ,
+    modem_status TEXT,
+    modem_at TIMESTAMPTZ,
+    location JSONB,
+    location_at TIMESTAMPTZ
+);
+
+-- Seed from the stored events.
+INSERT INTO device_state (sender_id, last_event, last_seen)
+SELECT DISTINCT ON (sender_id) sender_id, event_name, received_at
+FROM events ORDER BY sender_id, received_at DESC, id DESC;
+
+UPDATE device_state s SET temperature = e.value_num, temperature_at = e.at
+FROM (SELECT DISTINCT ON (sender_id) sender_id, value_num, COALESCE(event_time, received_at) AS at
+      FROM events WHERE event_name = 'TEMPERATURE' AND value_num IS NOT NULL
+      ORDER BY sender_id, COALESCE(event_time, received_at) DESC, id DESC) e
+WHERE s.sender_id = e.sender_id;
+
+UPDATE device_state s SET power_status = e.status, power_at = e.at
+FROM (SELECT DISTINCT ON (sender_id) sender_id, COALESCE(event_time, received_at) AS at,
+             CASE event_name WHEN 'POWER_BACKUP_MODE' THEN 'battery'
+                             WHEN 'POWER_PLN' THEN CASE WHEN value_num = 1 THEN 'pln_outage' ELSE 'mains' END
+                             ELSE 'mains' END AS status
+      FROM events WHERE event_name IN ('POWER_BACKUP_MODE', 'POWER_RESTORE_MODE', 'POWER_PLN')
+      ORDER BY sender_id, COALESCE(event_time, received_at) DESC, id DESC) e
+WHERE s.sender_id = e.sender_id;
+
+UPDATE device_state s SET modem_status = e.status, modem_at = e.at
+FROM (SELECT DISTINCT ON (sender_id) sender_id, COALESCE(event_time, received_at) AS at,
+             CASE event_name WHEN 'STATUS_MODEM_ON' THEN 'on' ELSE 'off' END AS status
+      FROM events WHERE event_name IN ('STATUS_MODEM_ON', 'STATUS_MODEM_OFF')
+      ORDER BY sender_id, COALESCE(event_time, received_at) DESC, id DESC) e
+WHERE s.sender_id = e.sender_id;
+
+UPDATE device_state s SET location = e.value, location_at = e.at
+FROM (SELECT DISTINCT ON (sender_id) sender_id, value, COALESCE(event_time, received_at) AS at
+      FROM events WHERE event_name = 'GEOLOCATION' AND value IS NOT NULL
+      ORDER BY sender_id, COALESCE(event_time, received_at) DESC, id DESC) e
+WHERE s.sender_id = e.sender_id;
@@ -0,0 +1,15 @@
+-- Resolved device locations, one row per geolocation lookup, so location history can be
+-- queried without parsing the request JSON kept in the routed table.
+CREATE TABLE locations (
+    id BIGSERIAL PRIMARY KEY,
+    sender_id TEXT NOT NULL,
+    lat DOUBLE PRECISION NOT NULL,
+    lng DOUBLE PRECISION NOT NULL,
+    accuracy DOUBLE PRECISION,
+    cell_towers JSONB NOT NULL,
+    provider TEXT NOT NULL,
+    resolved_at TIMESTAMPTZ NOT NULL,
+    ingest_id TEXT
+);
+
+CREATE INDEX locations_sender_id_idx ON locations (sender_id, resolved_at DESC);
@@ -0,0 +1,8 @@
+-- Geolocation answers keyed by the normalized cell-tower set, shared by all collector
+-- instances so a device that does not move costs one lookup per cache TTL.
+CREATE TABLE geo_cache (
+    tower_key TEXT PRIMARY KEY,
+    provider TEXT NOT NULL,
+    response JSONB NOT NULL,
+    resolved_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,16 @@
+-- Geolocation lookups waiting to be resolved by the background workers. A row is
+-- claimed by pushing next_attempt_at out by a lease and deleted once resolved, so a
+-- lookup interrupted by a crash is picked up again when the lease runs out.
+CREATE TABLE geo_requests (
+    id BIGSERIAL PRIMARY KEY,
+    sender_id TEXT NOT NULL,
+    event TEXT NOT NULL,
+    ingest_id TEXT,
+    cell_towers JSONB NOT NULL,
+    requested_at TIMESTAMPTZ NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL,
+    last_error TEXT
+);
+
+CREATE INDEX geo_requests_next_attempt_idx ON geo_requests (next_attempt_at);
@@ -0,0 +1,2 @@
+ALTER TABLE locations DROP COLUMN IF EXISTS wifi_access_points;
+ALTER TABLE geo_requests DROP COLUMN IF EXISTS wifi_access_points;
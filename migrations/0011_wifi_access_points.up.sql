@@ -0,0 +1,3 @@
+-- Wi-Fi access points reported alongside the cell towers of a geolocation event.
+ALTER TABLE geo_requests ADD COLUMN wifi_access_points JSONB;
+ALTER TABLE locations ADD COLUMN wifi_access_points JSONB;
@@ -0,0 +1,15 @@
+-- Cell tower positions from an OpenCelliD export, for resolving cell scans offline
+-- (GEO_PROVIDER=local). Loaded with --load-cell-towers.
+CREATE TABLE cell_towers (
+    mcc INTEGER NOT NULL,
+    mnc INTEGER NOT NULL,
+    lac BIGINT NOT NULL,
+    cid BIGINT NOT NULL,
+    radio TEXT NOT NULL,
+    lat DOUBLE PRECISION NOT NULL,
+    lng DOUBLE PRECISION NOT NULL,
+    range_m DOUBLE PRECISION,
+    samples INTEGER,
+    updated_at TIMESTAMPTZ,
+    PRIMARY KEY (mcc, mnc, lac, cid, radio)
+);
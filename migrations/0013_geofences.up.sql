@@ -0,0 +1,16 @@
+-- Per-device geofences: a circle (lat, lng, radius_m) or a polygon of [lat, lng]
+-- points. inside is whether the device was last seen in the fence, NULL until the
+-- first location after the fence was saved.
+CREATE TABLE geofences (
+    sender_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    lat DOUBLE PRECISION,
+    lng DOUBLE PRECISION,
+    radius_m DOUBLE PRECISION,
+    polygon JSONB,
+    inside BOOLEAN,
+    state_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (sender_id, name),
+    CHECK ((polygon IS NULL) <> (radius_m IS NULL))
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS locations_published_idx;
+ALTER TABLE locations DROP COLUMN IF EXISTS published;
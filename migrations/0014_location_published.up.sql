@@ -0,0 +1,4 @@
+-- Whether a location moved far enough from the previous published one to be published
+-- itself (LOCATION_MIN_DISPLACEMENT); unpublished fixes are kept for the history.
+ALTER TABLE locations ADD COLUMN published BOOLEAN NOT NULL DEFAULT true;
+CREATE INDEX locations_published_idx ON locations (sender_id, resolved_at DESC) WHERE published;
@@ -0,0 +1 @@
+ALTER TABLE event_state DROP COLUMN IF EXISTS since_ms;
@@ -0,0 +1,3 @@
+-- When a rule fact was set, in epoch milliseconds of the event that set it; NULL for
+-- plain flags. Rules with a time window compare these.
+ALTER TABLE event_state ADD COLUMN since_ms BIGINT;
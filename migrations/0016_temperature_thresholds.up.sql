@@ -0,0 +1,12 @@
+-- Per-device temperature thresholds the collector raises its own alarms from. alarm is
+-- the last evaluated state ('high', 'low' or 'normal'), NULL until the first reading.
+CREATE TABLE temperature_thresholds (
+    sender_id TEXT PRIMARY KEY,
+    high DOUBLE PRECISION,
+    low DOUBLE PRECISION,
+    hysteresis DOUBLE PRECISION NOT NULL,
+    alarm TEXT,
+    state_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ NOT NULL,
+    CHECK (high IS NOT NULL OR low IS NOT NULL)
+);
@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS devices_imsi_idx;
+DROP INDEX IF EXISTS devices_iccid_idx;
+ALTER TABLE devices
+    DROP COLUMN IF EXISTS iccid,
+    DROP COLUMN IF EXISTS imsi,
+    DROP COLUMN IF EXISTS sim_at,
+    DROP COLUMN IF EXISTS operator,
+    DROP COLUMN IF EXISTS rat,
+    DROP COLUMN IF EXISTS band,
+    DROP COLUMN IF EXISTS cell_id,
+    DROP COLUMN IF EXISTS network_at;
@@ -0,0 +1,13 @@
+-- SIM and network registration last reported by each device (SIM_INFO and
+-- NETWORK_STATUS events), so the registry can tell which SIM is in which modem.
+ALTER TABLE devices
+    ADD COLUMN iccid TEXT,
+    ADD COLUMN imsi TEXT,
+    ADD COLUMN sim_at TIMESTAMPTZ,
+    ADD COLUMN operator TEXT,
+    ADD COLUMN rat TEXT,
+    ADD COLUMN band TEXT,
+    ADD COLUMN cell_id TEXT,
+    ADD COLUMN network_at TIMESTAMPTZ;
+CREATE INDEX devices_iccid_idx ON devices (iccid);
+CREATE INDEX devices_imsi_idx ON devices (imsi);
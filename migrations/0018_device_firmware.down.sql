@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS devices_firmware_version_idx;
+ALTER TABLE devices
+    DROP COLUMN IF EXISTS firmware_version,
+    DROP COLUMN IF EXISTS firmware_at;
@@ -0,0 +1,6 @@
+-- Firmware version last reported by each device (FIRMWARE_INFO events and
+-- successful OTA_STATUS reports), so rollouts can be followed in the registry.
+ALTER TABLE devices
+    ADD COLUMN firmware_version TEXT,
+    ADD COLUMN firmware_at TIMESTAMPTZ;
+CREATE INDEX devices_firmware_version_idx ON devices (firmware_version);
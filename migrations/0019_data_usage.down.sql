@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS data_quotas;
+DROP TABLE IF EXISTS data_usage_counters;
+DROP TABLE IF EXISTS data_usage_daily;
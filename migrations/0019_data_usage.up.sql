@@ -0,0 +1,23 @@
+-- Bytes each device sent and received per day (DATA_USAGE events), the last counters
+-- of devices reporting cumulative counters, and per-device monthly SIM data quotas.
+CREATE TABLE data_usage_daily (
+    sender_id TEXT NOT NULL,
+    day DATE NOT NULL,
+    bytes_sent BIGINT NOT NULL DEFAULT 0,
+    bytes_received BIGINT NOT NULL DEFAULT 0,
+    reports INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (sender_id, day)
+);
+
+CREATE TABLE data_usage_counters (
+    sender_id TEXT PRIMARY KEY,
+    bytes_sent BIGINT NOT NULL,
+    bytes_received BIGINT NOT NULL,
+    reported_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE data_quotas (
+    sender_id TEXT PRIMARY KEY,
+    monthly_bytes BIGINT NOT NULL CHECK (monthly_bytes > 0),
+    updated_at TIMESTAMPTZ NOT NULL
+);
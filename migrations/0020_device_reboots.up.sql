@@ -0,0 +1,9 @@
+-- Restarts of each device, from REBOOT events and from the boot time UPTIME events
+-- imply, so reboots can be counted over sliding windows.
+CREATE TABLE device_reboots (
+    sender_id TEXT NOT NULL,
+    at TIMESTAMPTZ NOT NULL,
+    reason TEXT,
+    source TEXT NOT NULL,
+    PRIMARY KEY (sender_id, at)
+);
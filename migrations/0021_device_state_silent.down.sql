@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS device_state_last_seen_idx;
+ALTER TABLE device_state DROP COLUMN IF EXISTS silent_since;
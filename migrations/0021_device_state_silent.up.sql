@@ -0,0 +1,4 @@
+-- When the heartbeat watchdog found a device silent: the last_seen it had then, NULL
+-- while the device is not silent.
+ALTER TABLE device_state ADD COLUMN silent_since TIMESTAMPTZ;
+CREATE INDEX device_state_last_seen_idx ON device_state (last_seen) WHERE silent_since IS NULL;
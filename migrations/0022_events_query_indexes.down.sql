@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS events_effective_time_idx;
+DROP INDEX IF EXISTS events_event_name_idx;
+DROP INDEX IF EXISTS events_sender_received_idx;
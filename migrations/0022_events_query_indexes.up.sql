@@ -0,0 +1,7 @@
+-- migrate:no-transaction
+-- migrate:indexes
+-- Device history, retention and archival queries on events, built without blocking
+-- writes. Collectors that created these at startup already have them.
+CREATE INDEX CONCURRENTLY IF NOT EXISTS events_sender_received_idx ON events (sender_id, received_at);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS events_event_name_idx ON events (event_name);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS events_effective_time_idx ON events ((COALESCE(event_time, received_at)));
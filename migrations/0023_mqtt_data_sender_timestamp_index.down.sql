@@ -0,0 +1 @@
+DROP INDEX IF EXISTS mqtt_data_sender_timestamp_idx;
@@ -0,0 +1,5 @@
+-- migrate:no-transaction
+-- migrate:indexes
+-- Device history queries on mqtt_data, built without blocking writes. Routed tables
+-- created afterwards copy it, existing ones get it when they are ensured.
+CREATE INDEX CONCURRENTLY IF NOT EXISTS mqtt_data_sender_timestamp_idx ON mqtt_data (sender_id, timestamp);
@@ -0,0 +1 @@
+ALTER TABLE command_batches DROP COLUMN IF EXISTS heartbeat_at;
@@ -0,0 +1,3 @@
+-- The instance running a bulk dispatch refreshes heartbeat_at; a running dispatch whose
+-- heartbeat stops was lost with its collector and is marked interrupted.
+ALTER TABLE command_batches ADD COLUMN IF NOT EXISTS heartbeat_at TIMESTAMPTZ;
@@ -0,0 +1,90 @@
+-- The tables a MySQL or MariaDB collector writes: events with their raw payloads, the
+-- messages it could not handle, and the device registry. Times are UTC DATETIMEs.
+
+CREATE TABLE mqtt_data (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    sender_id VARCHAR(255),
+    message MEDIUMTEXT,
+    timestamp DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+    ingest_id VARCHAR(64),
+    INDEX mqtt_data_ingest_id_idx (ingest_id),
+    INDEX mqtt_data_sender_timestamp_idx (sender_id, timestamp)
+);
+
+CREATE TABLE events (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    ingest_id VARCHAR(64),
+    sender_id VARCHAR(255) NOT NULL,
+    event_name VARCHAR(255) NOT NULL,
+    tag VARCHAR(255) NOT NULL,
+    value JSON,
+    value_num DOUBLE,
+    status BOOLEAN NOT NULL,
+    event_time DATETIME(6),
+    raw JSON,
+    received_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    INDEX events_ingest_id_idx (ingest_id),
+    INDEX events_sender_received_idx (sender_id, received_at),
+    INDEX events_sender_event_idx (sender_id, event_name),
+    INDEX events_event_name_time_idx (event_name, event_time)
+);
+
+CREATE TABLE raw_messages (
+    ingest_id VARCHAR(64) PRIMARY KEY,
+    sender_id VARCHAR(255) NOT NULL,
+    topic VARCHAR(1024) NOT NULL,
+    payload MEDIUMBLOB NOT NULL,
+    received_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
+);
+
+CREATE TABLE raw_events (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    ingest_id VARCHAR(64),
+    sender_id VARCHAR(255) NOT NULL,
+    event_name VARCHAR(255) NOT NULL,
+    topic VARCHAR(1024) NOT NULL,
+    payload MEDIUMTEXT NOT NULL,
+    received_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
+);
+
+CREATE TABLE quarantine (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    ingest_id VARCHAR(64),
+    sender_id VARCHAR(255) NOT NULL,
+    event_name VARCHAR(255) NOT NULL,
+    topic VARCHAR(1024) NOT NULL,
+    payload MEDIUMTEXT NOT NULL,
+    error TEXT NOT NULL,
+    received_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
+);
+
+CREATE TABLE dead_letter (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    ingest_id VARCHAR(64),
+    sender_id VARCHAR(255) NOT NULL,
+    topic VARCHAR(1024) NOT NULL,
+    stage VARCHAR(32) NOT NULL,
+    payload MEDIUMBLOB NOT NULL,
+    error TEXT NOT NULL,
+    received_at DATETIME(6) NOT NULL,
+    failed_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    reprocessed_at DATETIME(6),
+    INDEX dead_letter_pending_idx (stage, reprocessed_at, id)
+);
+
+CREATE TABLE devices (
+    sender_id VARCHAR(255) PRIMARY KEY,
+    region VARCHAR(255) NOT NULL DEFAULT '',
+    model VARCHAR(255) NOT NULL DEFAULT '',
+    first_seen DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    iccid VARCHAR(32),
+    imsi VARCHAR(32),
+    sim_at DATETIME(6),
+    operator VARCHAR(255),
+    rat VARCHAR(32),
+    band VARCHAR(32),
+    cell_id VARCHAR(64),
+    network_at DATETIME(6),
+    firmware_version VARCHAR(255),
+    firmware_at DATETIME(6)
+);
@@ -0,0 +1,7 @@
+DROP TABLE devices;
+DROP TABLE dead_letter;
+DROP TABLE quarantine;
+DROP TABLE raw_events;
+DROP TABLE raw_messages;
+DROP TABLE events;
+DROP TABLE mqtt_data;
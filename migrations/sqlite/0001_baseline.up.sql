@@ -0,0 +1,97 @@
+-- The tables an SQLite collector writes: events with their raw payloads, the messages
+-- it could not handle, and the device registry. Times are stored as UTC text.
+
+CREATE TABLE mqtt_data (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    sender_id TEXT,
+    message TEXT,
+    timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    ingest_id TEXT
+);
+
+CREATE INDEX mqtt_data_ingest_id_idx ON mqtt_data (ingest_id);
+
+CREATE INDEX mqtt_data_sender_timestamp_idx ON mqtt_data (sender_id, timestamp);
+
+CREATE TABLE events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    ingest_id TEXT,
+    sender_id TEXT NOT NULL,
+    event_name TEXT NOT NULL,
+    tag TEXT NOT NULL,
+    value TEXT,
+    value_num REAL,
+    status BOOLEAN NOT NULL,
+    event_time TIMESTAMP,
+    raw TEXT,
+    received_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX events_ingest_id_idx ON events (ingest_id);
+
+CREATE INDEX events_sender_received_idx ON events (sender_id, received_at);
+
+CREATE INDEX events_sender_event_idx ON events (sender_id, event_name);
+
+CREATE INDEX events_event_name_time_idx ON events (event_name, event_time);
+
+CREATE TABLE raw_messages (
+    ingest_id TEXT PRIMARY KEY,
+    sender_id TEXT NOT NULL,
+    topic TEXT NOT NULL,
+    payload BLOB NOT NULL,
+    received_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE raw_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    ingest_id TEXT,
+    sender_id TEXT NOT NULL,
+    event_name TEXT NOT NULL,
+    topic TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    received_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE quarantine (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    ingest_id TEXT,
+    sender_id TEXT NOT NULL,
+    event_name TEXT NOT NULL,
+    topic TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    error TEXT NOT NULL,
+    received_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE dead_letter (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    ingest_id TEXT,
+    sender_id TEXT NOT NULL,
+    topic TEXT NOT NULL,
+    stage TEXT NOT NULL,
+    payload BLOB NOT NULL,
+    error TEXT NOT NULL,
+    received_at TIMESTAMP NOT NULL,
+    failed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    reprocessed_at TIMESTAMP
+);
+
+CREATE INDEX dead_letter_pending_idx ON dead_letter (stage, id) WHERE reprocessed_at IS NULL;
+
+CREATE TABLE devices (
+    sender_id TEXT PRIMARY KEY,
+    region TEXT NOT NULL DEFAULT '',
+    model TEXT NOT NULL DEFAULT '',
+    first_seen TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    iccid TEXT,
+    imsi TEXT,
+    sim_at TIMESTAMP,
+    operator TEXT,
+    rat TEXT,
+    band TEXT,
+    cell_id TEXT,
+    network_at TIMESTAMP,
+    firmware_version TEXT,
+    firmware_at TIMESTAMP
+);
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// MySQL migrations mirror the Postgres ones for the tables an edgeStore keeps, in
+// MySQL types that MariaDB accepts as well.
+//
+//go:embed migrations/mysql/*.sql
+var mysqlMigrationFiles embed.FS
+
+// mysqlDialect is the SQL of DB_DRIVER=mysql, for MySQL and MariaDB.
+type mysqlDialect struct{}
+
+func (mysqlDialect) migrations() (fs.FS, string) {
+	return mysqlMigrationFiles, "migrations/mysql"
+}
+
+// mysqlMigrationLock is the name of the GET_LOCK lock serializing migrations.
+const mysqlMigrationLock = "modem_migrations"
+
+func (mysqlDialect) lockMigrations(ctx context.Context, conn *sql.Conn) (func(), error) {
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 300)", mysqlMigrationLock).Scan(&locked); err != nil {
+		return nil, err
+	}
+	if locked.Int64 != 1 {
+		return nil, fmt.Errorf("timed out waiting for lock %s", mysqlMigrationLock)
+	}
+	return func() { conn.ExecContext(ctx, "DO RELEASE_LOCK(?)", mysqlMigrationLock) }, nil
+}
+
+// insertIgnore updates the first column to itself on a duplicate key. INSERT IGNORE
+// would also turn errors such as truncated values into warnings.
+func (mysqlDialect) insertIgnore(table string, columns ...string) string {
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON DUPLICATE KEY UPDATE %s = %s",
+		table, strings.Join(columns, ", "), placeholders(len(columns)), columns[0], columns[0])
+}
+
+// upsertDevice has no WHERE on the update, so every assignment checks the stored at;
+// at is assigned last, since MySQL sees the assignments before it. VALUES() is
+// deprecated in MySQL 8 but the only form MariaDB has.
+func (mysqlDialect) upsertDevice(at string, columns ...string) string {
+	newer := fmt.Sprintf("%s IS NULL OR %s <= VALUES(%s)", at, at, at)
+	set := make([]string, 0, len(columns)+1)
+	for _, c := range columns {
+		set = append(set, fmt.Sprintf("%s = IF(%s, COALESCE(VALUES(%s), %s), %s)", c, newer, c, c, c))
+	}
+	set = append(set, fmt.Sprintf("%s = IF(%s, VALUES(%s), %s)", at, newer, at, at))
+	all := append(append([]string{"sender_id"}, columns...), at)
+	return fmt.Sprintf(`INSERT INTO devices (%s) VALUES (%s)
+        ON DUPLICATE KEY UPDATE %s`,
+		strings.Join(all, ", "), placeholders(len(all)), strings.Join(set, ", "))
+}
+
+// openMySQL connects to MySQL or MariaDB with MYSQL_DSN
+// (user:password@tcp(host:3306)/dbname) or with DB_HOST, DB_PORT (default 3306),
+// DB_NAME and DB_USER. The password comes from the same sources as for Postgres and is
+// looked up for every new connection. Sessions run in UTC, so that DATETIME columns
+// and CURRENT_TIMESTAMP agree with the times the collector writes.
+func openMySQL() (*sql.DB, error) {
+	cfg := mysql.NewConfig()
+	if dsn := os.Getenv("MYSQL_DSN"); dsn != "" {
+		parsed, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MYSQL_DSN: %v", err)
+		}
+		cfg = parsed
+	} else {
+		port := dbPort
+		if port == "" {
+			port = "3306"
+		}
+		cfg.Net = "tcp"
+		cfg.Addr = net.JoinHostPort(dbHost, port)
+		cfg.User = dbUser
+		cfg.DBName = dbName
+	}
+	cfg.ParseTime = true
+	cfg.Loc = time.UTC
+	if cfg.Params == nil {
+		cfg.Params = map[string]string{}
+	}
+	cfg.Params["time_zone"] = "'+00:00'"
+	password := newPasswordSource()
+	embedded := cfg.Passwd
+	err := cfg.Apply(mysql.BeforeConnect(func(ctx context.Context, c *mysql.Config) error {
+		p, err := password()
+		if err != nil {
+			return err
+		}
+		if p == "" {
+			p = embedded
+		}
+		c.Passwd = p
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(connector)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	log.Printf("Connected to MySQL at %s", cfg.Addr)
+	return db, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Offline geolocation for air-gapped sites: "--load-cell-towers cell_towers.csv.gz"
+// loads an OpenCelliD export into cell_towers and GEO_PROVIDER=local resolves cell
+// scans against it without any HTTP call. Loading again updates the towers that
+// changed, so a newer export can be applied on top of an older one.
+var loadCellTowersFlag = flag.String("load-cell-towers", "", "load an OpenCelliD CSV export (.csv or .csv.gz) into cell_towers and exit")
+
+// cellTowerDB is the database the local provider looks towers up in; it is set once
+// the database is connected.
+var cellTowerDB *sql.DB
+
+// localCellProvider resolves cell towers from the cell_towers table. The position is
+// the centroid of the known towers weighted by the inverse of their range, and the
+// accuracy the smallest range among them.
+type localCellProvider struct{}
+
+func (localCellProvider) Name() string { return "local" }
+
+func (localCellProvider) Locate(req geoRequest) (map[string]interface{}, error) {
+	if len(req.CellTowers) == 0 {
+		return nil, errNoCellTowers
+	}
+	if cellTowerDB == nil {
+		return nil, &geoStatusError{Status: http.StatusServiceUnavailable, Detail: "cell tower database not connected"}
+	}
+	var latSum, lngSum, weights float64
+	accuracy := -1.0
+	for _, tower := range req.CellTowers {
+		var lat, lng float64
+		var rangeM sql.NullFloat64
+		err := cellTowerDB.QueryRow(`SELECT lat, lng, range_m FROM cell_towers
+            WHERE mcc = $1 AND mnc = $2 AND lac = $3 AND cid = $4 ORDER BY samples DESC NULLS LAST LIMIT 1`,
+			fmt.Sprint(tower["mobileCountryCode"]), fmt.Sprint(tower["mobileNetworkCode"]),
+			fmt.Sprint(tower["locationAreaCode"]), fmt.Sprint(tower["cellId"])).Scan(&lat, &lng, &rangeM)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up cell tower: %v", err)
+		}
+		// Towers without a range count as 1 km.
+		r := 1000.0
+		if rangeM.Valid && rangeM.Float64 > 0 {
+			r = rangeM.Float64
+		}
+		latSum += lat / r
+		lngSum += lng / r
+		weights += 1 / r
+		if accuracy < 0 || r < accuracy {
+			accuracy = r
+		}
+	}
+	if weights == 0 {
+		return nil, &geoStatusError{Status: http.StatusNotFound, Detail: "no known cell towers"}
+	}
+	return geoResult(latSum/weights, lngSum/weights, accuracy), nil
+}
+
+// runLoadCellTowers loads the OpenCelliD CSV at path into cell_towers. The file has the
+// columns radio,mcc,net,area,cell,unit,lon,lat,range,samples,changeable,created,updated,
+// averageSignal, with or without a header line.
+func runLoadCellTowers(db *sql.DB, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var in io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		in = zr
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("CREATE TEMP TABLE cell_towers_load (LIKE cell_towers) ON COMMIT DROP"); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(pq.CopyIn("cell_towers_load", "mcc", "mnc", "lac", "cid", "radio", "lat", "lng", "range_m", "samples", "updated_at"))
+	if err != nil {
+		return err
+	}
+
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	loaded, skipped := 0, 0
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if line == 1 && record[0] == "radio" {
+			continue
+		}
+		row, err := cellTowerRow(record)
+		if err != nil {
+			skipped++
+			continue
+		}
+		if _, err := stmt.Exec(row...); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		loaded++
+		if loaded%1_000_000 == 0 {
+			log.Printf("Read %d cell towers", loaded)
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	// An export can list a cell more than once; keep its latest entry.
+	res, err := tx.Exec(`INSERT INTO cell_towers
+        SELECT DISTINCT ON (mcc, mnc, lac, cid, radio) * FROM cell_towers_load
+        ORDER BY mcc, mnc, lac, cid, radio, updated_at DESC NULLS LAST
+        ON CONFLICT (mcc, mnc, lac, cid, radio) DO UPDATE SET lat = EXCLUDED.lat, lng = EXCLUDED.lng,
+            range_m = EXCLUDED.range_m, samples = EXCLUDED.samples, updated_at = EXCLUDED.updated_at
+        WHERE cell_towers.updated_at IS NULL OR EXCLUDED.updated_at >= cell_towers.updated_at`)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	changed, _ := res.RowsAffected()
+	log.Printf("Loaded %d cell towers from %s (%d new or updated, %d invalid lines skipped)", loaded, path, changed, skipped)
+	return nil
+}
+
+// cellTowerRow converts an OpenCelliD record to the cell_towers_load columns.
+func cellTowerRow(record []string) ([]interface{}, error) {
+	if len(record) < 13 {
+		return nil, errors.New("too few columns")
+	}
+	ints := make([]int64, 4)
+	for i, field := range record[1:5] {
+		v, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ints[i] = v
+	}
+	lng, err := strconv.ParseFloat(record[6], 64)
+	if err != nil {
+		return nil, err
+	}
+	lat, err := strconv.ParseFloat(record[7], 64)
+	if err != nil {
+		return nil, err
+	}
+	if !validCoordinates(lat, lng) {
+		return nil, errors.New("coordinates out of range")
+	}
+	var rangeM, samples, updated interface{}
+	if v, err := strconv.ParseFloat(record[8], 64); err == nil {
+		rangeM = v
+	}
+	if v, err := strconv.Atoi(record[9]); err == nil {
+		samples = v
+	}
+	if v, err := strconv.ParseInt(record[12], 10, 64); err == nil {
+		updated = time.Unix(v, 0).UTC()
+	}
+	return []interface{}{ints[0], ints[1], ints[2], ints[3], strings.ToLower(record[0]), lat, lng, rangeM, samples, updated}, nil
+}
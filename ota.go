@@ -0,0 +1,419 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Firmware campaign states.
+const (
+	campaignRunning   = "running"
+	campaignPaused    = "paused"
+	campaignAborted   = "aborted"
+	campaignCompleted = "completed"
+)
+
+// Per-device OTA states. Devices report the download/apply stages on the OTA status topic.
+const (
+	otaQueued        = "queued"
+	otaNotified      = "notified"
+	otaSkipped       = "skipped"
+	otaPublishFailed = "publish_failed"
+)
+
+var (
+	otaStatusSubscribe string
+	campaignRunners    sync.Map // campaign id -> chan struct{} closed to stop the runner
+)
+
+// FirmwareCampaign describes a firmware image to roll out and how fast to roll it out.
+type FirmwareCampaign struct {
+	ID         string         `json:"id"`
+	Version    string         `json:"version"`
+	URL        string         `json:"url"`
+	Checksum   string         `json:"checksum"`
+	Status     string         `json:"status"`
+	BatchSize  int            `json:"batch_size"`
+	IntervalMs int64          `json:"interval_ms"`
+	CreatedAt  time.Time      `json:"created_at"`
+	Filter     DeviceFilter   `json:"filter,omitempty"`
+	Devices    map[string]int `json:"devices,omitempty"`
+}
+
+// CampaignDevice is the OTA progress of one device in a campaign.
+type CampaignDevice struct {
+	SenderID  string    `json:"sender_id"`
+	CommandID *string   `json:"command_id,omitempty"`
+	Status    string    `json:"status"`
+	Detail    *string   `json:"detail,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// createCampaign stores the campaign with every matching device queued and starts notifying them.
+func createCampaign(db *sql.DB, c FirmwareCampaign) (FirmwareCampaign, error) {
+	if c.Version == "" || c.URL == "" {
+		return c, fmt.Errorf("version and url are required")
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 10
+	}
+	devices, err := queryDevices(db, c.Filter)
+	if err != nil {
+		return c, err
+	}
+	if len(devices) == 0 {
+		return c, fmt.Errorf("no devices match the filter")
+	}
+
+	c.ID = newID()
+	c.Status = campaignRunning
+	c.CreatedAt = clock.Now()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return c, fmt.Errorf("failed to begin campaign transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO firmware_campaigns (id, version, url, checksum, status, batch_size, interval_ms, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		c.ID, c.Version, c.URL, c.Checksum, c.Status, c.BatchSize, c.IntervalMs, c.CreatedAt)
+	if err != nil {
+		return c, fmt.Errorf("failed to create campaign: %v", err)
+	}
+	for _, d := range devices {
+		_, err = tx.Exec("INSERT INTO firmware_campaign_devices (campaign_id, sender_id, status) VALUES ($1, $2, $3)", c.ID, d.SenderID, otaQueued)
+		if err != nil {
+			return c, fmt.Errorf("failed to queue device %s: %v", d.SenderID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return c, fmt.Errorf("failed to commit campaign: %v", err)
+	}
+
+	log.Printf("Created firmware campaign %s for version %s with %d devices", c.ID, c.Version, len(devices))
+	runCampaign(db, c)
+	return c, nil
+}
+
+// runCampaign notifies the campaign's queued devices in staggered batches until none are left or it is stopped.
+func runCampaign(db *sql.DB, c FirmwareCampaign) {
+	stop := make(chan struct{})
+	if _, running := campaignRunners.LoadOrStore(c.ID, stop); running {
+		return
+	}
+
+	go func() {
+		defer campaignRunners.CompareAndDelete(c.ID, stop)
+		interval := time.Duration(c.IntervalMs) * time.Millisecond
+		for {
+			rows, err := db.Query("SELECT sender_id FROM firmware_campaign_devices WHERE campaign_id = $1 AND status = $2 ORDER BY sender_id LIMIT $3",
+				c.ID, otaQueued, c.BatchSize)
+			if err != nil {
+				log.Printf("Error loading queued devices for campaign %s: %v", c.ID, err)
+				return
+			}
+			var batch []string
+			for rows.Next() {
+				var senderID string
+				if err := rows.Scan(&senderID); err == nil {
+					batch = append(batch, senderID)
+				}
+			}
+			rows.Close()
+
+			if len(batch) == 0 {
+				setCampaignStatus(db, c.ID, campaignRunning, campaignCompleted)
+				log.Printf("Firmware campaign %s notified all devices", c.ID)
+				return
+			}
+
+			for _, senderID := range batch {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := notifyCampaignDevice(db, c, senderID); err != nil {
+					// The device is still queued, so carrying on would notify it again on
+					// the next batch. Pause until the campaign is resumed.
+					log.Printf("Pausing firmware campaign %s: %v", c.ID, err)
+					setCampaignStatus(db, c.ID, campaignRunning, campaignPaused)
+					return
+				}
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-clock.After(interval):
+			}
+		}
+	}()
+}
+
+// notifyCampaignDevice sends OTA_UPDATE to a device and records that it left the queue.
+func notifyCampaignDevice(db *sql.DB, c FirmwareCampaign, senderID string) error {
+	params := map[string]interface{}{
+		"campaign_id": c.ID,
+		"version":     c.Version,
+		"url":         c.URL,
+		"checksum":    c.Checksum,
+	}
+	audit, err := sendCommand(db, senderID, "OTA_UPDATE", params, "")
+	status := otaNotified
+	if err != nil {
+		log.Printf("Firmware campaign %s: %v", c.ID, err)
+		status = otaPublishFailed
+	}
+	_, err = db.Exec(`UPDATE firmware_campaign_devices SET status = $3, command_id = NULLIF($4, ''), updated_at = CURRENT_TIMESTAMP
+        WHERE campaign_id = $1 AND sender_id = $2`, c.ID, senderID, status, audit.CommandID)
+	if err != nil {
+		return fmt.Errorf("failed to update campaign %s device %s: %v", c.ID, senderID, err)
+	}
+	return nil
+}
+
+// setCampaignStatus moves a campaign from one status to another and reports whether it did.
+func setCampaignStatus(db *sql.DB, id, from, to string) bool {
+	res, err := db.Exec("UPDATE firmware_campaigns SET status = $3, updated_at = CURRENT_TIMESTAMP WHERE id = $1 AND status = $2", id, from, to)
+	if err != nil {
+		log.Printf("Error updating campaign %s: %v", id, err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
+}
+
+func stopCampaignRunner(id string) {
+	if stop, ok := campaignRunners.LoadAndDelete(id); ok {
+		close(stop.(chan struct{}))
+	}
+}
+
+func pauseCampaign(db *sql.DB, id string) error {
+	if !setCampaignStatus(db, id, campaignRunning, campaignPaused) {
+		return fmt.Errorf("campaign %s is not running", id)
+	}
+	stopCampaignRunner(id)
+	return nil
+}
+
+func resumeCampaign(db *sql.DB, id string) error {
+	if !setCampaignStatus(db, id, campaignPaused, campaignRunning) {
+		return fmt.Errorf("campaign %s is not paused", id)
+	}
+	c, err := loadCampaign(db, id)
+	if err != nil {
+		return err
+	}
+	runCampaign(db, c)
+	return nil
+}
+
+// abortCampaign stops notifying devices and marks every still-queued device as skipped.
+func abortCampaign(db *sql.DB, id string) error {
+	if !setCampaignStatus(db, id, campaignRunning, campaignAborted) && !setCampaignStatus(db, id, campaignPaused, campaignAborted) {
+		return fmt.Errorf("campaign %s is not running or paused", id)
+	}
+	stopCampaignRunner(id)
+	_, err := db.Exec("UPDATE firmware_campaign_devices SET status = $3, updated_at = CURRENT_TIMESTAMP WHERE campaign_id = $1 AND status = $2",
+		id, otaQueued, otaSkipped)
+	if err != nil {
+		return fmt.Errorf("failed to skip queued devices: %v", err)
+	}
+	return nil
+}
+
+func loadCampaign(db *sql.DB, id string) (FirmwareCampaign, error) {
+	var c FirmwareCampaign
+	err := db.QueryRow("SELECT id, version, url, checksum, status, batch_size, interval_ms, created_at FROM firmware_campaigns WHERE id = $1", id).
+		Scan(&c.ID, &c.Version, &c.URL, &c.Checksum, &c.Status, &c.BatchSize, &c.IntervalMs, &c.CreatedAt)
+	if err != nil {
+		return c, err
+	}
+
+	rows, err := db.Query("SELECT status, COUNT(*) FROM firmware_campaign_devices WHERE campaign_id = $1 GROUP BY status", id)
+	if err != nil {
+		return c, fmt.Errorf("failed to count campaign devices: %v", err)
+	}
+	defer rows.Close()
+	c.Devices = map[string]int{}
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return c, fmt.Errorf("failed to scan campaign devices: %v", err)
+		}
+		c.Devices[status] = count
+	}
+	return c, rows.Err()
+}
+
+func queryCampaignDevices(db *sql.DB, id string) ([]CampaignDevice, error) {
+	rows, err := db.Query("SELECT sender_id, command_id, status, detail, updated_at FROM firmware_campaign_devices WHERE campaign_id = $1 ORDER BY sender_id", id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query campaign devices: %v", err)
+	}
+	defer rows.Close()
+
+	devices := []CampaignDevice{}
+	for rows.Next() {
+		var d CampaignDevice
+		if err := rows.Scan(&d.SenderID, &d.CommandID, &d.Status, &d.Detail, &d.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan campaign device: %v", err)
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// resumeRunningCampaigns restarts the runners of campaigns that were running when the collector stopped.
+func resumeRunningCampaigns(db *sql.DB) {
+	rows, err := db.Query("SELECT id FROM firmware_campaigns WHERE status = $1", campaignRunning)
+	if err != nil {
+		log.Printf("Error loading running campaigns: %v", err)
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		c, err := loadCampaign(db, id)
+		if err != nil {
+			log.Printf("Error loading campaign %s: %v", id, err)
+			continue
+		}
+		log.Printf("Resuming firmware campaign %s", id)
+		runCampaign(db, c)
+	}
+}
+
+// updateCampaignFromAck records a device's acknowledgment of its OTA_UPDATE command.
+func updateCampaignFromAck(db *sql.DB, commandID, outcome string) {
+	_, err := db.Exec(`UPDATE firmware_campaign_devices SET status = $2, updated_at = CURRENT_TIMESTAMP
+        WHERE command_id = $1 AND status = $3`, commandID, outcome, otaNotified)
+	if err != nil {
+		log.Printf("Error updating campaign device for command %s: %v", commandID, err)
+	}
+}
+
+// handleOTAStatus records a download/apply progress report published by a device.
+func handleOTAStatus(db *sql.DB, senderID string, payload []byte) {
+	var report struct {
+		CampaignID string `json:"campaign_id"`
+		Status     string `json:"status"`
+		Detail     string `json:"detail"`
+	}
+	if err := json.Unmarshal(payload, &report); err != nil {
+		log.Printf("Error unmarshalling OTA status from %s: %v", senderID, err)
+		return
+	}
+	if report.CampaignID == "" || report.Status == "" {
+		log.Printf("OTA status from %s is missing campaign_id or status: %s", senderID, payload)
+		return
+	}
+
+	if err := recordCampaignOTAStatus(db, senderID, report.CampaignID, report.Status, report.Detail); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// recordCampaignOTAStatus stores the progress a device reported for a campaign.
+func recordCampaignOTAStatus(db *sql.DB, senderID, campaignID, status, detail string) error {
+	status = strings.ToLower(status)
+	_, err := db.Exec(`UPDATE firmware_campaign_devices SET status = $3, detail = NULLIF($4, ''), updated_at = CURRENT_TIMESTAMP
+        WHERE campaign_id = $1 AND sender_id = $2`, campaignID, senderID, status, detail)
+	if err != nil {
+		return fmt.Errorf("failed to record OTA status for %s: %v", senderID, err)
+	}
+	log.Printf("OTA status for %s in campaign %s: %s", senderID, campaignID, status)
+	return nil
+}
+
+func subscribeOTAStatus(db *sql.DB) {
+	if otaStatusSubscribe == "" {
+		return
+	}
+	if err := mqttClient.Subscribe(otaStatusSubscribe, mqttSubscribeQoS, func(msg BrokerMessage) {
+		senderID, ok := senderIDFromTopic(msg.Topic)
+		if !ok {
+			log.Printf("Unexpected OTA status topic %s", msg.Topic)
+			return
+		}
+		handleOTAStatus(db, senderID, msg.Payload)
+	}); err != nil {
+		log.Fatalf("Failed to subscribe to OTA status topic: %v", err)
+	}
+}
+
+func handleCreateCampaign(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var c FirmwareCampaign
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be a JSON firmware campaign")
+		return
+	}
+	c, err := createCampaign(db, c)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, c)
+}
+
+func handleGetCampaign(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	c, err := loadCampaign(db, r.PathValue("id"))
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "campaign not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading campaign: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load campaign")
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+func handleCampaignDevices(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	devices, err := queryCampaignDevices(db, r.PathValue("id"))
+	if err != nil {
+		log.Printf("Error listing campaign devices: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list campaign devices")
+		return
+	}
+	writeJSON(w, http.StatusOK, devices)
+}
+
+func handleCampaignAction(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var err error
+	switch r.PathValue("action") {
+	case "pause":
+		err = pauseCampaign(db, id)
+	case "resume":
+		err = resumeCampaign(db, id)
+	case "abort":
+		err = abortCampaign(db, id)
+	default:
+		writeError(w, http.StatusNotFound, "unknown campaign action")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	handleGetCampaign(db, w, r)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectCampaignBatch expects runCampaign to load senderIDs as the next batch of c and notify each.
+func expectCampaignBatch(mock sqlmock.Sqlmock, c FirmwareCampaign, senderIDs ...string) {
+	rows := sqlmock.NewRows([]string{"sender_id"})
+	for _, id := range senderIDs {
+		rows.AddRow(id)
+	}
+	mock.ExpectQuery("SELECT sender_id FROM firmware_campaign_devices").
+		WithArgs(c.ID, otaQueued, c.BatchSize).
+		WillReturnRows(rows)
+	for _, id := range senderIDs {
+		mock.ExpectExec("INSERT INTO command_audit").
+			WithArgs(sqlmock.AnyArg(), id, "OTA_UPDATE", sqlmock.AnyArg(), sqlmock.AnyArg(), commandPending, "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE firmware_campaign_devices SET status").
+			WithArgs(c.ID, id, otaNotified, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+}
+
+func TestRunCampaignWaitsIntervalBetweenBatches(t *testing.T) {
+	clk := useFakeClock(t)
+	useCommandTopic(t, time.Hour)
+	b := captureBroker(t)
+	db, mock := mockDB(t)
+	c := FirmwareCampaign{ID: "campaign-1", Version: "2.0.0", URL: "https://example.com/fw.bin", BatchSize: 2, IntervalMs: 60000}
+
+	notified := func() int {
+		return len(b.Messages("CMD/m-1")) + len(b.Messages("CMD/m-2")) + len(b.Messages("CMD/m-3"))
+	}
+
+	// Each notified device holds an ack timer, and the runner waits on one more.
+	expectCampaignBatch(mock, c, "m-1", "m-2")
+	runCampaign(db, c)
+	eventually(t, "the first batch", func() bool { return clk.timers() == 3 })
+	if n := notified(); n != 2 {
+		t.Fatalf("first batch notified %d devices, want 2", n)
+	}
+
+	clk.Advance(59 * time.Second)
+	if n := notified(); n != 2 {
+		t.Fatalf("notified %d devices before the interval passed, want 2", n)
+	}
+
+	expectCampaignBatch(mock, c, "m-3")
+	clk.Advance(time.Second)
+	eventually(t, "the second batch", func() bool { return clk.timers() == 4 })
+	if n := len(b.Messages("CMD/m-3")); n != 1 {
+		t.Fatalf("second batch sent %d commands to m-3, want 1", n)
+	}
+
+	expectCampaignBatch(mock, c)
+	mock.ExpectExec("UPDATE firmware_campaigns SET status").
+		WithArgs(c.ID, campaignRunning, campaignCompleted).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	clk.Advance(time.Minute)
+	eventually(t, "the campaign to complete", func() bool {
+		_, running := campaignRunners.Load(c.ID)
+		return !running
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Queue-full policies for the worker pool.
+const (
+	// queueBlock blocks the MQTT callback until there is room. Paho only acknowledges
+	// QoS 1 messages after the callback returns, so the broker holds back further deliveries.
+	queueBlock = "block"
+	// queueDropOldest discards the oldest queued message of that worker to make room.
+	queueDropOldest = "drop_oldest"
+)
+
+var messagesDropped = newCounterVec("collector_messages_dropped_total", "Inbound messages dropped because the worker queue was full.", "reason")
+
+// inboundMessage is a received MQTT message waiting to be processed.
+type inboundMessage struct {
+	Topic      string
+	SenderID   string
+	IngestID   string
+	Payload    []byte
+	Properties map[string]string // MQTT v5 user properties
+	ReceivedAt time.Time
+
+	Reprocessed bool // replayed from dead_letter: already in raw_messages and dedup
+}
+
+// workerPool processes messages on a fixed number of goroutines. Each sender is hashed
+// to one worker, so messages from the same device are handled in arrival order while
+// different devices are processed concurrently. The combined-condition logic (e.g.
+// POWER_BACKUP_MODE followed by POWER_RESTORE_MODE) depends on this: every message that
+// touches a sender's state must go through Submit, never straight to processMessage.
+type workerPool struct {
+	queues []chan inboundMessage
+	policy string
+
+	mu      sync.RWMutex // held for reading while submitting, for writing to close
+	closed  bool
+	workers sync.WaitGroup
+}
+
+func newWorkerPool(workers, queueSize int, policy string, handle func(inboundMessage)) (*workerPool, error) {
+	if policy != queueBlock && policy != queueDropOldest {
+		return nil, fmt.Errorf("unknown queue policy %q", policy)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	p := &workerPool{queues: make([]chan inboundMessage, workers), policy: policy}
+	for i := range p.queues {
+		queue := make(chan inboundMessage, queueSize)
+		p.queues[i] = queue
+		p.workers.Add(1)
+		go func() {
+			defer p.workers.Done()
+			for msg := range queue {
+				handle(msg)
+			}
+		}()
+	}
+	newGaugeFunc("collector_queue_depth", "Messages waiting in the worker queues.", func() float64 {
+		return float64(p.Depth())
+	})
+	log.Printf("Started %d message workers with queue size %d (%s when full)", workers, queueSize, policy)
+	return p, nil
+}
+
+// Submit queues msg on its sender's worker. When that queue is full it either blocks
+// or drops the oldest queued message, depending on the pool's policy. Messages submitted
+// after Close are dropped.
+func (p *workerPool) Submit(msg inboundMessage) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		messagesDropped.Inc("shutdown")
+		log.Printf("[%s] Worker pool closed, dropped message from %s", msg.IngestID, msg.SenderID)
+		procLog.Record(msg.IngestID, msg.SenderID, decisionQueueFull, "shutdown")
+		return
+	}
+	queue := p.queues[workerIndex(msg.SenderID, len(p.queues))]
+	if p.policy == queueBlock {
+		queue <- msg
+		return
+	}
+	for {
+		select {
+		case queue <- msg:
+			return
+		default:
+		}
+		select {
+		case old := <-queue:
+			messagesDropped.Inc("queue_full")
+			log.Printf("[%s] Worker queue full, dropped oldest message from %s received at %v", old.IngestID, old.SenderID, old.ReceivedAt)
+			procLog.Record(old.IngestID, old.SenderID, decisionQueueFull, "")
+		default:
+		}
+	}
+}
+
+// Close stops accepting messages and waits for the workers to process the queued ones.
+func (p *workerPool) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, queue := range p.queues {
+			close(queue)
+		}
+	}
+	p.mu.Unlock()
+	p.workers.Wait()
+}
+
+// Depth is the number of messages queued across all workers.
+func (p *workerPool) Depth() int {
+	depth := 0
+	for _, queue := range p.queues {
+		depth += len(queue)
+	}
+	return depth
+}
+
+func workerIndex(senderID string, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(senderID))
+	return int(h.Sum32() % uint32(workers))
+}
+
+// senderIDFromTopic returns the third topic level, e.g. "123" in DATA/MODEM/123.
+func senderIDFromTopic(topic string) (string, bool) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 3 || parts[2] == "" {
+		return "", false
+	}
+	return parts[2], true
+}
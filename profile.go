@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A profiles file selects brokers, databases and keys per environment from one place:
+//
+//	{
+//	  "staging": {"MQTT_BROKER": "tcp://mqtt.staging:1883", "DB_HOST": "db.staging"},
+//	  "prod":    {"MQTT_BROKER": "ssl://mqtt.example.com:8883", "DB_SSLMODE": "verify-full"}
+//	}
+//
+// Values of the selected profile override .env but never variables already set in the
+// process environment.
+
+var (
+	profileFlag     = flag.String("profile", "", "configuration profile to load from the profiles file (default $PROFILE)")
+	profileFileFlag = flag.String("profiles", "", "path of the profiles file (default $PROFILES_FILE or profiles.json)")
+)
+
+// productionProfiles are the profile names the safety interlocks apply to.
+var productionProfiles = map[string]bool{"prod": true, "production": true}
+
+// applyProfile loads the selected profile into the environment and returns its name,
+// or "" when no profile was selected. It must run before .env is loaded.
+func applyProfile() (string, error) {
+	name := *profileFlag
+	if name == "" {
+		name = os.Getenv("PROFILE")
+	}
+	if name == "" {
+		return "", nil
+	}
+	path := *profileFileFlag
+	if path == "" {
+		path = getEnv("PROFILES_FILE", "profiles.json")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read profiles file: %v", err)
+	}
+	var profiles map[string]map[string]string
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return "", fmt.Errorf("invalid profiles file %s: %v", path, err)
+	}
+	values, ok := profiles[name]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for n := range profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("profile %q not found in %s (have %s)", name, path, strings.Join(names, ", "))
+	}
+	for key, value := range values {
+		if _, set := os.LookupEnv(key); set {
+			log.Printf("Profile %s: keeping %s from the environment", name, key)
+			continue
+		}
+		os.Setenv(key, value)
+	}
+	log.Printf("Loaded profile %s from %s", name, path)
+	return name, nil
+}
+
+// checkProfileInterlocks refuses configurations that must never run in production.
+func checkProfileInterlocks(profile string) error {
+	if !productionProfiles[profile] {
+		return nil
+	}
+	var problems []string
+	if effectiveSSLMode() == "disable" {
+		problems = append(problems, "sslmode=disable")
+	}
+	if !dbPasswordConfigured() {
+		problems = append(problems, "no database password (DB_PASSWORD, DB_PASSWORD_FILE or DB_PASSWORD_COMMAND)")
+	}
+	if mqttUser == "" {
+		problems = append(problems, "anonymous MQTT connection (MQTT_USER is empty)")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("refusing to run profile %s with %s", profile, strings.Join(problems, ", "))
+	}
+	return nil
+}
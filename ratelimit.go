@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// deviceRateLimiter applies a token bucket per sender so one flooding modem cannot starve
+// the pipeline. Throttled messages are counted per device and optionally logged to
+// device_throttle_log once per flush interval.
+type deviceRateLimiter struct {
+	rate    float64 // tokens added per second
+	burst   float64
+	buckets sync.Map // senderID -> *tokenBucket
+}
+
+type tokenBucket struct {
+	mu        sync.Mutex
+	tokens    float64
+	last      time.Time
+	dropped   int
+	firstDrop time.Time
+	lastDrop  time.Time
+}
+
+func newDeviceRateLimiter(rate float64, burst int) *deviceRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &deviceRateLimiter{rate: rate, burst: float64(burst)}
+}
+
+// Allow takes a token from the sender's bucket and reports whether the message may be processed.
+func (l *deviceRateLimiter) Allow(senderID string) bool {
+	now := clock.Now()
+	value, _ := l.buckets.LoadOrStore(senderID, &tokenBucket{tokens: l.burst, last: now})
+	b := value.(*tokenBucket)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true
+	}
+
+	if b.dropped == 0 {
+		b.firstDrop = now
+		log.Printf("Rate limiting messages from %s", senderID)
+	}
+	b.dropped++
+	b.lastDrop = now
+	messagesDropped.Inc("rate_limited")
+	return false
+}
+
+// flushThrottleLog writes one device_throttle_log row per device throttled since the last flush.
+func (l *deviceRateLimiter) flushThrottleLog(db *sql.DB) {
+	l.buckets.Range(func(key, value interface{}) bool {
+		b := value.(*tokenBucket)
+		b.mu.Lock()
+		dropped, first, last := b.dropped, b.firstDrop, b.lastDrop
+		b.dropped = 0
+		b.mu.Unlock()
+
+		if dropped == 0 {
+			return true
+		}
+		log.Printf("Throttled %d messages from %v between %v and %v", dropped, key, first, last)
+		if db == nil {
+			return true
+		}
+		_, err := db.Exec("INSERT INTO device_throttle_log (sender_id, dropped, first_dropped_at, last_dropped_at) VALUES ($1, $2, $3, $4)",
+			key, dropped, first, last)
+		if err != nil {
+			log.Printf("Error writing throttle log for %v: %v", key, err)
+		}
+		return true
+	})
+}
+
+// startThrottleLog flushes the per-device drop counts every interval; db may be nil to only log them.
+func (l *deviceRateLimiter) startThrottleLog(db *sql.DB, interval time.Duration) {
+	go func() {
+		for {
+			<-clock.After(interval)
+			l.flushThrottleLog(db)
+		}
+	}()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// rawSampleRate is the fraction of inbound payloads kept in raw_messages; 1 keeps every
+// payload and 0 disables raw storage. Normalized rows in events are always written.
+var rawSampleRate = 1.0
+
+// storeRawMessage keeps the original payload of msg under its ingest ID so a normalized
+// event can be traced back to exactly what the device sent.
+func storeRawMessage(store Store, msg inboundMessage) {
+	if rawSampleRate <= 0 || (rawSampleRate < 1 && rand.Float64() >= rawSampleRate) {
+		return
+	}
+	if err := store.SaveRaw(msg); err != nil {
+		log.Printf("[%s] Error saving raw message: %v", msg.IngestID, err)
+	}
+}
+
+var unhandledEvents = newCounterVec("collector_unhandled_events_total", "Inbound messages whose event type has no handler, by event name.", "event")
+
+// maxUnhandledEventLabels bounds the label values of unhandledEvents so a device sending
+// garbage event names cannot grow the metrics endpoint without limit.
+const maxUnhandledEventLabels = 100
+
+var (
+	unhandledLabelsMu sync.Mutex
+	unhandledLabels   = map[string]bool{}
+)
+
+// storeUnhandledEvent keeps a message whose event type the collector does not know in
+// raw_events, so new firmware events can be discovered and backfilled later.
+func storeUnhandledEvent(store Store, msg inboundMessage, event string) {
+	unhandledLabelsMu.Lock()
+	label := event
+	if !unhandledLabels[event] {
+		if len(unhandledLabels) < maxUnhandledEventLabels {
+			unhandledLabels[event] = true
+		} else {
+			label = "other"
+		}
+	}
+	unhandledLabelsMu.Unlock()
+	unhandledEvents.Inc(label)
+
+	if err := store.SaveUnhandled(msg, event); err != nil {
+		log.Printf("[%s] Error saving unhandled %s event: %v", msg.IngestID, event, err)
+	}
+}
+
+// eventsExecer is satisfied by both *sql.DB and *sql.Tx.
+type eventsExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// normalizedEventColumns are the events columns written for each EventMessage, in the
+// order of normalizedEventArgs.
+const normalizedEventColumns = "ingest_id, sender_id, event_name, tag, value, value_num, status, event_time, raw"
+
+// insertNormalizedEvent writes data as a typed row in events, linked to its raw payload by ingest ID.
+func insertNormalizedEvent(db eventsExecer, data EventMessage) error {
+	args, err := normalizedEventArgs(data)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO events ("+normalizedEventColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)", args...)
+	if err != nil {
+		return err
+	}
+	if err := updateDeviceState(db, data); err != nil {
+		return err
+	}
+	return updateRollups(db, data)
+}
+
+func normalizedEventArgs(data EventMessage) ([]interface{}, error) {
+	value, err := json.Marshal(data.Value)
+	if err != nil {
+		return nil, err
+	}
+	var eventTime interface{}
+	if data.Time != 0 {
+		eventTime = time.UnixMilli(data.Time)
+	}
+	var ingestID interface{}
+	if data.IngestID != "" {
+		ingestID = data.IngestID
+	}
+	var valueNum interface{}
+	if v, ok := numericValue(data.Value); ok {
+		valueNum = v
+	}
+	// Msg is the device payload, normally JSON; anything else is kept only in mqtt_data.
+	var raw interface{}
+	if json.Valid([]byte(data.Msg)) {
+		raw = data.Msg
+	}
+	return []interface{}{ingestID, data.Sumber, data.EventName, data.Tag, string(value), valueNum, data.Status, eventTime, raw}, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Helpers for events that report several fields, such as SIGNAL_QUALITY or SIM_INFO,
+// and derive alarms from them.
+
+// parseFields returns the fields of an event's message, which devices send either as a
+// JSON object ({"rsrp": -95, "operator": "Telkomsel"}) or as key=value (or key:value)
+// pairs separated by commas or semicolons ("rsrp=-95;operator=Telkomsel"). Keys are
+// lower-cased. Numbers keep their digits, so long identifiers such as ICCIDs are exact.
+func parseFields(message interface{}) map[string]string {
+	fields := map[string]string{}
+	switch m := message.(type) {
+	case map[string]interface{}:
+		for key, v := range m {
+			switch v := v.(type) {
+			case string:
+				fields[strings.ToLower(key)] = strings.TrimSpace(v)
+			case json.Number:
+				fields[strings.ToLower(key)] = v.String()
+			case float64:
+				fields[strings.ToLower(key)] = strconv.FormatFloat(v, 'f', -1, 64)
+			}
+		}
+	case string:
+		if strings.HasPrefix(strings.TrimSpace(m), "{") {
+			dec := json.NewDecoder(strings.NewReader(m))
+			dec.UseNumber()
+			var object map[string]interface{}
+			if dec.Decode(&object) == nil {
+				return parseFields(object)
+			}
+		}
+		for _, field := range strings.FieldsFunc(m, func(r rune) bool { return r == ',' || r == ';' || r == '\n' }) {
+			key, v, ok := strings.Cut(field, "=")
+			if !ok {
+				key, v, ok = strings.Cut(field, ":")
+			}
+			if ok && strings.TrimSpace(key) != "" {
+				fields[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(v)
+			}
+		}
+	}
+	return fields
+}
+
+// parseReadings returns the numeric fields of an event's message (see parseFields).
+func parseReadings(message interface{}) map[string]float64 {
+	readings := map[string]float64{}
+	for key, v := range parseFields(message) {
+		if value, err := strconv.ParseFloat(v, 64); err == nil {
+			readings[key] = value
+		}
+	}
+	return readings
+}
+
+// firstReading returns the first of the names present in readings.
+func firstReading(readings map[string]float64, names ...string) (float64, bool) {
+	for _, name := range names {
+		if v, ok := readings[name]; ok {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// publishReading stores and publishes one numeric reading of an event.
+func publishReading(store Store, event, tag string, value float64, senderID, message, ingestID string, timestamp int64) {
+	data := EventMessage{
+		EventName: event,
+		Tag:       tag,
+		Value:     value,
+		Status:    true,
+		Msg:       message,
+		Time:      timestamp,
+		Sumber:    senderID,
+		IngestID:  ingestID,
+	}
+	processAndSaveData(store, data)
+	sendDataPoint(data)
+}
+
+// setDerivedAlarm raises (value 1) or clears (value 0) an alarm the collector derives
+// from readings, when that changes its state; the state is kept in eventState as
+// <sender>_<event> and stored together with the event. A device whose alarm was never
+// raised gets no clear. The datapoint goes through the alarm debounce.
+func setDerivedAlarm(store Store, event, tag string, raised bool, detail interface{}, senderID, ingestID string, timestamp int64) {
+	w := newCombinedWrite(store, senderID)
+	defer w.Close()
+	key := senderID + "_" + event
+	if _, ok := w.Load(key); ok == raised {
+		return
+	}
+	value, verb := 0, "cleared"
+	if raised {
+		value, verb = 1, "raised"
+		w.Store(key, true)
+	} else {
+		w.Delete(key)
+	}
+	msg, _ := json.Marshal(detail)
+	data := EventMessage{
+		EventName: event,
+		Tag:       tag,
+		Value:     value,
+		Status:    true,
+		Msg:       string(msg),
+		Time:      timestamp,
+		Sumber:    senderID,
+		IngestID:  ingestID,
+	}
+	log.Printf("[%s] %s %s for %s", ingestID, event, verb, senderID)
+	w.SaveQuiet(data)
+	w.Commit()
+	alarmGate.publish(data)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// REBOOT events report that a device restarted, UPTIME events how long it has been up:
+//
+//	{"event": "REBOOT", "timestamp": "1718000000", "message": {"reason": "watchdog"}}
+//	{"event": "UPTIME", "timestamp": "1718000000", "message": {"uptime": 3600}}
+//
+// Both record a reboot in device_reboots: REBOOT at its timestamp, UPTIME at the boot
+// time it implies (timestamp - uptime seconds), so restarts are counted even when the
+// REBOOT event was lost. A reboot within rebootMatchWindow of a recorded one is the
+// same reboot. After each event the reboots in every rebootCountWindows window up to
+// the event are published on reboots_<window>_<sender>, and REBOOT_LOOP (tag
+// reboot_loop_<sender>) is raised while more than rebootLoopThreshold reboots fall in
+// rebootLoopWindow. UPTIME is also published on uptime_<sender>, in seconds.
+var (
+	rebootLoopThreshold = 3                                                          // REBOOT_LOOP_THRESHOLD
+	rebootLoopWindow    = time.Hour                                                  // REBOOT_LOOP_WINDOW
+	rebootCountWindows  = []rebootWindow{{"1h", time.Hour}, {"24h", 24 * time.Hour}} // REBOOT_COUNT_WINDOWS
+	rebootMatchWindow   = 2 * time.Minute
+)
+
+type rebootWindow struct {
+	label  string
+	length time.Duration
+}
+
+// parseRebootWindows parses REBOOT_COUNT_WINDOWS, a comma-separated list of durations
+// such as "1h,24h,7d" that also label the published counts.
+func parseRebootWindows(spec string) ([]rebootWindow, error) {
+	var windows []rebootWindow
+	for _, label := range strings.Split(spec, ",") {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			continue
+		}
+		length, err := parseAge(label)
+		if err != nil || length <= 0 {
+			return nil, fmt.Errorf("invalid window %q", label)
+		}
+		windows = append(windows, rebootWindow{label, length})
+	}
+	return windows, nil
+}
+
+// Reboot is one restart of a device.
+type Reboot struct {
+	At     time.Time `json:"at"`
+	Reason *string   `json:"reason,omitempty"`
+	Source string    `json:"source"` // REBOOT or UPTIME
+}
+
+// recordReboot stores a reboot unless one is already recorded within rebootMatchWindow
+// of it, and reports whether it did.
+func recordReboot(db *sql.DB, senderID string, at time.Time, reason, source string) (bool, error) {
+	res, err := db.Exec(`INSERT INTO device_reboots (sender_id, at, reason, source)
+        SELECT $1, $2::timestamptz, NULLIF($3, ''), $4
+        WHERE NOT EXISTS (SELECT 1 FROM device_reboots WHERE sender_id = $1 AND at BETWEEN $5 AND $6)
+        ON CONFLICT (sender_id, at) DO NOTHING`,
+		senderID, at, reason, source, at.Add(-rebootMatchWindow), at.Add(rebootMatchWindow))
+	if err != nil {
+		return false, fmt.Errorf("failed to record reboot of %s: %v", senderID, err)
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// countReboots returns the reboots of a device in the window of the given length ending at until.
+func countReboots(db *sql.DB, senderID string, until time.Time, length time.Duration) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM device_reboots WHERE sender_id = $1 AND at > $2 AND at <= $3",
+		senderID, until.Add(-length), until).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count reboots of %s: %v", senderID, err)
+	}
+	return n, nil
+}
+
+func handleRebootEvent(store Store, messageStr, senderID, event, ingestID string, timestamp int64) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(messageStr), &payload); err != nil {
+		log.Printf("Error unmarshalling %s event message: %v", event, err)
+		return
+	}
+	at := time.UnixMilli(timestamp)
+	bootAt, reason := at, ""
+	switch event {
+	case "REBOOT":
+		fields := parseFields(payload["message"])
+		reason = firstField(fields, "reason", "cause")
+		if s, ok := payload["message"].(string); ok && len(fields) == 0 {
+			reason = strings.TrimSpace(s)
+		}
+	case "UPTIME":
+		uptime, ok := numericValue(payload["message"])
+		if !ok {
+			uptime, ok = firstReading(parseReadings(payload["message"]), "uptime", "seconds", "uptime_s")
+		}
+		if !ok || uptime < 0 {
+			log.Printf("[%s] Ignoring %s event from %s: no uptime in %v", ingestID, event, senderID, payload["message"])
+			return
+		}
+		publishReading(store, event, fmt.Sprintf("uptime_%s", senderID), uptime, senderID, messageStr, ingestID, timestamp)
+		bootAt = at.Add(-time.Duration(uptime * float64(time.Second))).Truncate(time.Second)
+	}
+
+	recorded, err := store.RecordReboot(senderID, bootAt, reason, event)
+	if err == errUnsupported {
+		return
+	}
+	if err != nil {
+		log.Printf("[%s] %v", ingestID, err)
+		return
+	}
+	if recorded {
+		log.Printf("[%s] %s rebooted at %s (%s %s)", ingestID, senderID, bootAt.Format(time.RFC3339), event, reason)
+	}
+	for _, window := range rebootCountWindows {
+		n, err := store.CountReboots(senderID, at, window.length)
+		if err != nil {
+			log.Printf("[%s] %v", ingestID, err)
+			return
+		}
+		publishReading(store, event, fmt.Sprintf("reboots_%s_%s", window.label, senderID), float64(n), senderID, messageStr, ingestID, timestamp)
+	}
+	n, err := store.CountReboots(senderID, at, rebootLoopWindow)
+	if err != nil {
+		log.Printf("[%s] %v", ingestID, err)
+		return
+	}
+	setDerivedAlarm(store, "REBOOT_LOOP", fmt.Sprintf("reboot_loop_%s", senderID), n > rebootLoopThreshold,
+		map[string]interface{}{"reboots": n, "window": rebootLoopWindow.String()}, senderID, ingestID, timestamp)
+}
+
+func init() {
+	RegisterHandler(HandleEvents(func(ctx context.Context, store Store, m DeviceMessage) {
+		handleRebootEvent(store, string(m.Payload), m.SenderID, m.Event, m.IngestID, m.Timestamp)
+	}, "REBOOT", "UPTIME"))
+}
+
+// handleDeviceReboots lists a device's latest reboots with the counts of the
+// REBOOT_COUNT_WINDOWS windows ending now.
+func handleDeviceReboots(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	senderID := r.PathValue("id")
+	rows, err := db.Query("SELECT at, reason, source FROM device_reboots WHERE sender_id = $1 ORDER BY at DESC LIMIT $2",
+		senderID, queryLimit(r, 100, 1000))
+	if err != nil {
+		log.Printf("Error listing reboots: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list reboots")
+		return
+	}
+	defer rows.Close()
+	reboots := []Reboot{}
+	for rows.Next() {
+		var rb Reboot
+		if err := rows.Scan(&rb.At, &rb.Reason, &rb.Source); err != nil {
+			log.Printf("Error scanning reboots: %v", err)
+			writeError(w, http.StatusInternalServerError, "failed to list reboots")
+			return
+		}
+		reboots = append(reboots, rb)
+	}
+	counts := map[string]int{}
+	for _, window := range rebootCountWindows {
+		if counts[window.label], err = countReboots(db, senderID, clock.Now(), window.length); err != nil {
+			log.Printf("Error counting reboots: %v", err)
+			writeError(w, http.StatusInternalServerError, "failed to count reboots")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sender_id": senderID, "counts": counts, "reboots": reboots})
+}
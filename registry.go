@@ -0,0 +1,281 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var knownDevices sync.Map // senderID -> struct{}, devices already present in the registry
+
+// Device is one row of the devices registry.
+type Device struct {
+	SenderID  string            `json:"sender_id"`
+	Region    string            `json:"region"`
+	Model     string            `json:"model"`
+	Labels    map[string]string `json:"labels"`
+	FirstSeen time.Time         `json:"first_seen"`
+	// Reported by the device; PUT /api/v1/devices/{id} does not change them.
+	SIM      *DeviceSIM      `json:"sim,omitempty"`
+	Network  *DeviceNetwork  `json:"network,omitempty"`
+	Firmware *DeviceFirmware `json:"firmware,omitempty"`
+}
+
+// DeviceFilter selects devices from the registry. Empty fields match every device;
+// Labels matches devices that carry every listed key=value label.
+type DeviceFilter struct {
+	Region   string            `json:"region,omitempty"`
+	Model    string            `json:"model,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Devices  []string          `json:"devices,omitempty"`
+	ICCID    string            `json:"iccid,omitempty"`
+	IMSI     string            `json:"imsi,omitempty"`
+	Firmware string            `json:"firmware,omitempty"` // last reported firmware version
+	Saved    string            `json:"saved,omitempty"`    // name of a saved filter that must also match
+}
+
+// empty reports whether the filter matches every device.
+func (f DeviceFilter) empty() bool {
+	return f.Region == "" && f.Model == "" && len(f.Labels) == 0 && len(f.Devices) == 0 &&
+		f.ICCID == "" && f.IMSI == "" && f.Firmware == "" && f.Saved == ""
+}
+
+// parseLabelSelectors parses repeated key=value label selectors such as customer=PLN.
+func parseLabelSelectors(selectors []string) (map[string]string, error) {
+	if len(selectors) == 0 {
+		return nil, nil
+	}
+	labels := map[string]string{}
+	for _, selector := range selectors {
+		key, value, ok := strings.Cut(selector, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid label selector %q, expected key=value", selector)
+		}
+		labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return labels, nil
+}
+
+// registerDevice adds a sender to the registry the first time it is seen by this process.
+func registerDevice(store Store, senderID string) {
+	if _, ok := knownDevices.Load(senderID); ok {
+		return
+	}
+	if err := store.RegisterDevice(senderID); err != nil {
+		log.Printf("Error registering device %s: %v", senderID, err)
+		return
+	}
+	knownDevices.Store(senderID, struct{}{})
+}
+
+// upsertDevice creates or updates the registry metadata of a device, replacing its labels.
+func upsertDevice(db *sql.DB, device Device) error {
+	if device.Labels == nil {
+		device.Labels = map[string]string{}
+	}
+	labels, err := json.Marshal(device.Labels)
+	if err != nil {
+		return fmt.Errorf("failed to encode labels: %v", err)
+	}
+	_, err = db.Exec(`INSERT INTO devices (sender_id, region, model, labels) VALUES ($1, $2, $3, $4)
+        ON CONFLICT (sender_id) DO UPDATE SET region = EXCLUDED.region, model = EXCLUDED.model, labels = EXCLUDED.labels`,
+		device.SenderID, device.Region, device.Model, string(labels))
+	if err != nil {
+		return fmt.Errorf("failed to upsert device: %v", err)
+	}
+	knownDevices.Store(device.SenderID, struct{}{})
+	return nil
+}
+
+// queryDevices returns the registered devices matching filter, ordered by sender ID.
+func queryDevices(db *sql.DB, filter DeviceFilter) ([]Device, error) {
+	var args []interface{}
+	conditions, err := filterConditions(filter, &args)
+	if err != nil {
+		return nil, err
+	}
+	if filter.Saved != "" {
+		saved, err := loadSavedFilter(db, filter.Saved)
+		if err != nil {
+			return nil, err
+		}
+		savedConditions, err := filterConditions(saved.Filter, &args)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, savedConditions...)
+	}
+	return queryDevicesWhere(db, conditions, args)
+}
+
+// filterConditions returns the SQL conditions for filter, appending their arguments to args.
+func filterConditions(filter DeviceFilter, args *[]interface{}) ([]string, error) {
+	var conditions []string
+	if filter.Region != "" {
+		*args = append(*args, filter.Region)
+		conditions = append(conditions, fmt.Sprintf("region = $%d", len(*args)))
+	}
+	if filter.Model != "" {
+		*args = append(*args, filter.Model)
+		conditions = append(conditions, fmt.Sprintf("model = $%d", len(*args)))
+	}
+	if filter.ICCID != "" {
+		*args = append(*args, filter.ICCID)
+		conditions = append(conditions, fmt.Sprintf("iccid = $%d", len(*args)))
+	}
+	if filter.IMSI != "" {
+		*args = append(*args, filter.IMSI)
+		conditions = append(conditions, fmt.Sprintf("imsi = $%d", len(*args)))
+	}
+	if filter.Firmware != "" {
+		*args = append(*args, filter.Firmware)
+		conditions = append(conditions, fmt.Sprintf("firmware_version = $%d", len(*args)))
+	}
+	if len(filter.Labels) > 0 {
+		labels, err := json.Marshal(filter.Labels)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode label filter: %v", err)
+		}
+		*args = append(*args, string(labels))
+		conditions = append(conditions, fmt.Sprintf("labels @> $%d::jsonb", len(*args)))
+	}
+	if len(filter.Devices) > 0 {
+		placeholders := make([]string, len(filter.Devices))
+		for i, id := range filter.Devices {
+			*args = append(*args, id)
+			placeholders[i] = fmt.Sprintf("$%d", len(*args))
+		}
+		conditions = append(conditions, fmt.Sprintf("sender_id IN (%s)", strings.Join(placeholders, ", ")))
+	}
+	return conditions, nil
+}
+
+func queryDevicesWhere(db *sql.DB, conditions []string, args []interface{}) ([]Device, error) {
+	query := `SELECT sender_id, region, model, labels, first_seen,
+        iccid, imsi, sim_at, operator, rat, band, cell_id, network_at,
+        firmware_version, firmware_at FROM devices`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY sender_id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query devices: %v", err)
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var d Device
+		var labels []byte
+		var iccid, imsi, operator, rat, band, cellID, firmware sql.NullString
+		var simAt, networkAt, firmwareAt sql.NullTime
+		if err := rows.Scan(&d.SenderID, &d.Region, &d.Model, &labels, &d.FirstSeen,
+			&iccid, &imsi, &simAt, &operator, &rat, &band, &cellID, &networkAt,
+			&firmware, &firmwareAt); err != nil {
+			return nil, fmt.Errorf("failed to scan device: %v", err)
+		}
+		if simAt.Valid {
+			d.SIM = &DeviceSIM{ICCID: iccid.String, IMSI: imsi.String, ReportedAt: simAt.Time}
+		}
+		if networkAt.Valid {
+			d.Network = &DeviceNetwork{Operator: operator.String, RAT: rat.String, Band: band.String, CellID: cellID.String, ReportedAt: networkAt.Time}
+		}
+		if firmwareAt.Valid {
+			d.Firmware = &DeviceFirmware{Version: firmware.String, ReportedAt: firmwareAt.Time}
+		}
+		if err := json.Unmarshal(labels, &d.Labels); err != nil {
+			return nil, fmt.Errorf("failed to decode labels of %s: %v", d.SenderID, err)
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+func handleListDevices(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := DeviceFilter{Region: q.Get("region"), Model: q.Get("model"), Saved: q.Get("filter"), ICCID: q.Get("iccid"), IMSI: q.Get("imsi"), Firmware: q.Get("firmware")}
+	labels, err := parseLabelSelectors(q["label"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter.Labels = labels
+	devices, err := queryDevices(db, filter)
+	if errors.Is(err, errSavedFilterNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error listing devices: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to query devices")
+		return
+	}
+	writeCachedJSON(w, r, devices)
+}
+
+func handlePutDevice(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var device Device
+	if err := json.NewDecoder(r.Body).Decode(&device); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be a JSON device")
+		return
+	}
+	device.SenderID = r.PathValue("id")
+	if device.Labels == nil {
+		device.Labels = map[string]string{}
+	}
+	if err := upsertDevice(db, device); err != nil {
+		log.Printf("Error saving device: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to save device")
+		return
+	}
+	writeJSON(w, http.StatusOK, device)
+}
+
+// setDeviceLabel sets one label on a device, registering the device if needed. An empty
+// value removes the label.
+func setDeviceLabel(db *sql.DB, senderID, key, value string) error {
+	var err error
+	if value == "" {
+		_, err = db.Exec("UPDATE devices SET labels = labels - $2 WHERE sender_id = $1", senderID, key)
+	} else {
+		_, err = db.Exec(`INSERT INTO devices (sender_id, labels) VALUES ($1, jsonb_build_object($2::text, $3::text))
+            ON CONFLICT (sender_id) DO UPDATE SET labels = devices.labels || EXCLUDED.labels`, senderID, key, value)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set label %s on %s: %v", key, senderID, err)
+	}
+	return nil
+}
+
+func handlePutDeviceLabel(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Value == "" {
+		writeError(w, http.StatusBadRequest, `body must be {"value": "..."} with a non-empty value`)
+		return
+	}
+	if err := setDeviceLabel(db, r.PathValue("id"), r.PathValue("key"), body.Value); err != nil {
+		log.Printf("Error setting device label: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to set label")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleDeleteDeviceLabel(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	if err := setDeviceLabel(db, r.PathValue("id"), r.PathValue("key"), ""); err != nil {
+		log.Printf("Error removing device label: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to remove label")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
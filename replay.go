@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// replayOrderer holds back inbound messages for a short window after (re)connecting
+// with a persistent session. The broker delivers the messages it queued while the
+// collector was down interleaved with live traffic, so everything received in the
+// window is sorted by the timestamp embedded in the payload before it is submitted.
+// Outside the window messages pass straight through.
+type replayOrderer struct {
+	submit func(inboundMessage)
+	max    int
+
+	mu      sync.Mutex
+	open    bool
+	pending []inboundMessage
+}
+
+func newReplayOrderer(max int, submit func(inboundMessage)) *replayOrderer {
+	return &replayOrderer{submit: submit, max: max}
+}
+
+// Open starts buffering for window. It does nothing when a window is already open.
+func (o *replayOrderer) Open(window time.Duration) {
+	if window <= 0 {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.open {
+		return
+	}
+	o.open = true
+	clock.AfterFunc(window, o.Flush)
+	log.Printf("Ordering replayed and live messages by device timestamp for %v", window)
+}
+
+// Submit buffers msg while a window is open and submits it directly otherwise. A full
+// buffer is flushed early so a large backlog cannot exhaust memory.
+func (o *replayOrderer) Submit(msg inboundMessage) {
+	o.mu.Lock()
+	if !o.open {
+		o.mu.Unlock()
+		o.submit(msg)
+		return
+	}
+	o.pending = append(o.pending, msg)
+	full := len(o.pending) >= o.max
+	o.mu.Unlock()
+	if full {
+		o.Flush()
+	}
+}
+
+// Flush closes the window and submits the buffered messages in timestamp order.
+func (o *replayOrderer) Flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.open {
+		return
+	}
+	o.open = false
+	pending := o.pending
+	o.pending = nil
+
+	keys := make([]int64, len(pending))
+	for i, msg := range pending {
+		keys[i] = messageOrderKey(msg)
+	}
+	sort.Stable(byOrderKey{pending, keys})
+	log.Printf("Submitting %d messages received during the replay window", len(pending))
+	// Submitting under the lock keeps messages that arrive meanwhile behind the sorted batch.
+	for _, msg := range pending {
+		o.submit(msg)
+	}
+}
+
+type byOrderKey struct {
+	msgs []inboundMessage
+	keys []int64
+}
+
+func (b byOrderKey) Len() int           { return len(b.msgs) }
+func (b byOrderKey) Less(i, j int) bool { return b.keys[i] < b.keys[j] }
+func (b byOrderKey) Swap(i, j int) {
+	b.msgs[i], b.msgs[j] = b.msgs[j], b.msgs[i]
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+}
+
+// messageOrderKey returns the device timestamp of a JSON payload in milliseconds, or the
+// time the collector received the message when the payload has no usable timestamp
+// (e.g. it is compressed or binary).
+func messageOrderKey(msg inboundMessage) int64 {
+	var payload struct {
+		Timestamp interface{} `json:"timestamp"`
+	}
+	if json.Unmarshal(msg.Payload, &payload) == nil {
+		if t, err := parseTimestamp(payload.Timestamp); err == nil {
+			return t.UnixMilli()
+		}
+	}
+	return msg.ReceivedAt.UnixMilli()
+}
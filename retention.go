@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Retention (RETENTION, e.g. "GEOLOCATION=7d,TEMPERATURE=30d,*=180d") deletes stored
+// events older than a per-event age. Events are selected by event_name in the events
+// table and their rows in the routed table and raw_messages are deleted with them,
+// linked by ingest ID. The "*" age applies to every other event and also to legacy
+// mqtt_data rows without an ingest ID. Deleting runs in small batches, only inside
+// the off-peak RETENTION_WINDOW, so it never competes with ingest for long.
+var (
+	retentionBatch  = 1000        // RETENTION_BATCH, rows per delete
+	retentionPause  = time.Second // RETENTION_PAUSE, between batches
+	retentionWindow offPeakWindow // RETENTION_WINDOW, e.g. "01:00-05:00" local time
+)
+
+var retentionDeleted = newCounterVec("collector_retention_deleted_total", "Events deleted by the retention job, by event.", "event")
+
+// parseRetention parses RETENTION into event -> maximum age.
+func parseRetention(spec string) (map[string]time.Duration, error) {
+	ages := map[string]time.Duration{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		event, age, ok := strings.Cut(entry, "=")
+		event = strings.TrimSpace(event)
+		if !ok || event == "" {
+			return nil, fmt.Errorf("invalid retention %q, expected EVENT=age", entry)
+		}
+		d, err := parseAge(strings.TrimSpace(age))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid age %q for %s", age, event)
+		}
+		ages[event] = d
+	}
+	return ages, nil
+}
+
+// parseAge parses a Go duration, or a whole number of days such as "30d".
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// offPeakWindow is a daily local time range; the zero value is always open.
+type offPeakWindow struct {
+	start, end time.Duration // since midnight
+	set        bool
+}
+
+func parseOffPeakWindow(spec string) (offPeakWindow, error) {
+	if spec == "" {
+		return offPeakWindow{}, nil
+	}
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return offPeakWindow{}, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", spec)
+	}
+	var w offPeakWindow
+	for _, part := range []struct {
+		value string
+		dst   *time.Duration
+	}{{from, &w.start}, {to, &w.end}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(part.value))
+		if err != nil {
+			return offPeakWindow{}, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", spec)
+		}
+		*part.dst = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	w.set = true
+	return w, nil
+}
+
+// Contains reports whether t falls inside the window; windows may wrap past midnight.
+func (w offPeakWindow) Contains(t time.Time) bool {
+	if !w.set {
+		return true
+	}
+	now := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.start <= w.end {
+		return now >= w.start && now < w.end
+	}
+	return now >= w.start || now < w.end
+}
+
+// startRetention checks every interval whether the window is open and prunes a round.
+func startRetention(db *sql.DB, ages map[string]time.Duration, interval time.Duration) {
+	if len(ages) == 0 || interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			if retentionWindow.Contains(clock.Now()) {
+				pruneExpired(db, ages)
+			}
+			<-clock.After(interval)
+		}
+	}()
+}
+
+// pruneExpired deletes everything past its age, batch by batch, and stops early when
+// the window closes.
+func pruneExpired(db *sql.DB, ages map[string]time.Duration) {
+	var explicit []string
+	for event := range ages {
+		if event != "*" {
+			explicit = append(explicit, event)
+		}
+	}
+	sort.Strings(explicit)
+	type rule struct {
+		label, where string
+		arg          interface{}
+		age          time.Duration
+	}
+	var rules []rule
+	for _, event := range explicit {
+		rules = append(rules, rule{event, "event_name = $1 AND COALESCE(event_time, received_at) < $2", event, ages[event]})
+	}
+	if age, ok := ages["*"]; ok {
+		rules = append(rules, rule{"*", "event_name <> ALL($1) AND COALESCE(event_time, received_at) < $2", pq.Array(explicit), age})
+	}
+
+	for _, r := range rules {
+		cutoff := clock.Now().Add(-r.age)
+		total := 0
+		for retentionWindow.Contains(clock.Now()) {
+			n, err := pruneEventBatch(db, r.where, r.arg, cutoff)
+			if err != nil {
+				log.Printf("Error pruning %s events: %v", r.label, err)
+				break
+			}
+			total += n
+			retentionDeleted.Add(r.label, float64(n))
+			if n < retentionBatch {
+				break
+			}
+			<-clock.After(retentionPause)
+		}
+		if total > 0 {
+			log.Printf("Retention deleted %d %s events older than %s", total, r.label, cutoff.Format(time.RFC3339))
+		}
+	}
+	if age, ok := ages["*"]; ok {
+		pruneLegacyRows(db, clock.Now().Add(-age))
+	}
+}
+
+// pruneEventBatch deletes up to retentionBatch events matching where (with args as $1,
+// $2, ...), together with their stored and raw rows.
+func pruneEventBatch(db *sql.DB, where string, args ...interface{}) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	args = append(args, retentionBatch)
+	rows, err := tx.Query(fmt.Sprintf(`DELETE FROM events WHERE id IN (
+            SELECT id FROM events WHERE %s ORDER BY id LIMIT $%d)
+        RETURNING event_name, COALESCE(ingest_id, '')`, where, len(args)), args...)
+	if err != nil {
+		return 0, err
+	}
+	byTable := map[string][]string{}
+	var ingestIDs []string
+	count := 0
+	for rows.Next() {
+		var event, ingestID string
+		if err := rows.Scan(&event, &ingestID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		count++
+		if ingestID == "" {
+			continue
+		}
+		ingestIDs = append(ingestIDs, ingestID)
+		if table, ok := storageTable(event); ok {
+			byTable[table] = append(byTable[table], ingestID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for table, ids := range byTable {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE ingest_id = ANY($1)", table), pq.Array(ids)); err != nil {
+			return 0, err
+		}
+	}
+	if len(ingestIDs) > 0 {
+		if _, err := tx.Exec("DELETE FROM raw_messages WHERE ingest_id = ANY($1)", pq.Array(ingestIDs)); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("DELETE FROM locations WHERE ingest_id = ANY($1)", pq.Array(ingestIDs)); err != nil {
+			return 0, err
+		}
+	}
+	return count, tx.Commit()
+}
+
+// pruneLegacyRows deletes mqtt_data rows written before events carried an ingest ID.
+func pruneLegacyRows(db *sql.DB, cutoff time.Time) {
+	total := int64(0)
+	for retentionWindow.Contains(clock.Now()) {
+		res, err := db.Exec(`DELETE FROM mqtt_data WHERE id IN (
+                SELECT id FROM mqtt_data WHERE ingest_id IS NULL AND timestamp < $1 ORDER BY id LIMIT $2)`, cutoff, retentionBatch)
+		if err != nil {
+			log.Printf("Error pruning legacy mqtt_data rows: %v", err)
+			return
+		}
+		n, _ := res.RowsAffected()
+		total += n
+		if n < int64(retentionBatch) {
+			break
+		}
+		<-clock.After(retentionPause)
+	}
+	if total > 0 {
+		log.Printf("Retention deleted %d legacy mqtt_data rows older than %s", total, cutoff.Format(time.RFC3339))
+	}
+}
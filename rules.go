@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rules derive synthetic events from combinations of per-device conditions. A fact is
+// a condition that mapped events set and clear, such as "on backup power"; a rule
+// raises its event (value 1) when its facts hold and clears it (value 0) when they stop
+// holding. Only changes are published, so a clear is never sent for a rule that was not
+// raised. The built-in rules raise POWER_PLN while a device is on backup power and its
+// meter is unreachable, and INTRUSION while its door is open and its enclosure or meter
+// is tampered with; RULES_FILE replaces the built-in facts and rules with a JSON file:
+//
+//	{"facts": {"POWER_BACKUP_MODE": {"set": ["POWER_BACKUP_MODE"], "clear": ["POWER_RESTORE_MODE"]},
+//	           "ALARM_METER_DEVICE": {"set": ["ALARM_METER_DEVICE"], "clear": ["CLEAR_ALARM_METER_DEVICE"]}},
+//	 "rules": [{"event": "POWER_PLN", "tag": "power_pln_{sender}",
+//	            "all": ["POWER_BACKUP_MODE", "ALARM_METER_DEVICE"], "within": "10m",
+//	            "labels": {"customer": "PLN"}}]}
+//
+// Facts are kept in eventState as <sender>_<fact> with the time they were set, and a
+// raised rule as <sender>_RULE_<event>.
+type RuleSet struct {
+	Facts map[string]RuleFact `json:"facts"`
+	Rules []Rule              `json:"rules"`
+
+	inputs map[string]bool // events that set or clear a fact
+}
+
+// RuleFact lists the events that set and clear a fact.
+type RuleFact struct {
+	Set   []string `json:"set"`
+	Clear []string `json:"clear"`
+}
+
+// Rule is a condition over facts and the event it raises.
+type Rule struct {
+	// Event is the name of the synthetic event.
+	Event string `json:"event"`
+	// Tag is the datapoint tag; {sender} is replaced.
+	Tag string `json:"tag"`
+	// All facts must be set, and at least one of Any when it is not empty.
+	All []string `json:"all,omitempty"`
+	Any []string `json:"any,omitempty"`
+	// Within limits how far apart in time the All facts may have been set, e.g. "10m".
+	Within string `json:"within,omitempty"`
+	// Labels limits the rule to devices carrying every key=value registry label; on
+	// other devices it never holds.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	within time.Duration
+}
+
+// ruleChange is a rule that was raised or cleared by an event.
+type ruleChange struct {
+	rule   Rule
+	raised bool
+}
+
+// rules is the active rule set; loadRules replaces it at startup.
+var rules = defaultRules()
+
+func defaultRules() *RuleSet {
+	rs := &RuleSet{
+		Facts: map[string]RuleFact{
+			"POWER_BACKUP_MODE":  {Set: []string{"POWER_BACKUP_MODE"}, Clear: []string{"POWER_RESTORE_MODE"}},
+			"ALARM_METER_DEVICE": {Set: []string{"ALARM_METER_DEVICE"}, Clear: []string{"CLEAR_ALARM_METER_DEVICE"}},
+			"ALARM_METER_TEMPER": {Set: []string{"ALARM_METER_TEMPER"}, Clear: []string{"CLEAR_ALARM_METER_TEMPER"}},
+			"DOOR_OPEN":          {Set: []string{"DOOR_OPEN"}, Clear: []string{"DOOR_CLOSE"}},
+			"ENCLOSURE_TAMPER":   {Set: []string{"ENCLOSURE_TAMPER"}, Clear: []string{"CLEAR_ENCLOSURE_TAMPER"}},
+		},
+		Rules: []Rule{
+			{Event: "POWER_PLN", Tag: "power_pln_{sender}", All: []string{"POWER_BACKUP_MODE", "ALARM_METER_DEVICE"}},
+			{Event: "INTRUSION", Tag: "intrusion_{sender}", All: []string{"DOOR_OPEN"}, Any: []string{"ENCLOSURE_TAMPER", "ALARM_METER_TEMPER"}},
+		},
+	}
+	if err := rs.compile(); err != nil {
+		panic(err)
+	}
+	return rs
+}
+
+// loadRules returns the rule set in path, or the built-in one when path is empty.
+func loadRules(path string) (*RuleSet, error) {
+	if path == "" {
+		return defaultRules(), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rs RuleSet
+	if err := json.Unmarshal(data, &rs); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	if err := rs.compile(); err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
+
+// compile validates the rule set and indexes its input events.
+func (rs *RuleSet) compile() error {
+	rs.inputs = map[string]bool{}
+	for name, fact := range rs.Facts {
+		if len(fact.Set) == 0 {
+			return fmt.Errorf("fact %s: set is required", name)
+		}
+		for _, event := range fact.Set {
+			for _, clear := range fact.Clear {
+				if event == clear {
+					return fmt.Errorf("fact %s: %s both sets and clears it", name, event)
+				}
+			}
+			rs.inputs[event] = true
+		}
+		for _, event := range fact.Clear {
+			rs.inputs[event] = true
+		}
+	}
+	events := map[string]bool{}
+	for i := range rs.Rules {
+		r := &rs.Rules[i]
+		if r.Event == "" || r.Tag == "" {
+			return fmt.Errorf("rule %d: event and tag are required", i+1)
+		}
+		if events[r.Event] {
+			return fmt.Errorf("rule %s: defined twice", r.Event)
+		}
+		events[r.Event] = true
+		if len(r.All)+len(r.Any) == 0 {
+			return fmt.Errorf("rule %s: all or any is required", r.Event)
+		}
+		for _, name := range append(append([]string{}, r.All...), r.Any...) {
+			if _, ok := rs.Facts[name]; !ok {
+				return fmt.Errorf("rule %s: unknown fact %s", r.Event, name)
+			}
+		}
+		for key := range r.Labels {
+			if strings.TrimSpace(key) == "" {
+				return fmt.Errorf("rule %s: empty label key", r.Event)
+			}
+		}
+		if r.Within != "" {
+			d, err := time.ParseDuration(r.Within)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("rule %s: invalid within %q", r.Event, r.Within)
+			}
+			r.within = d
+		}
+	}
+	return nil
+}
+
+// unmapped returns the input events that have no mapping, and so never reach the rules.
+func (rs *RuleSet) unmapped(mappings map[string]EventMapping) []string {
+	var events []string
+	for event := range rs.inputs {
+		if _, ok := mappings[event]; !ok {
+			events = append(events, event)
+		}
+	}
+	sort.Strings(events)
+	return events
+}
+
+// holds reports whether r is met by facts, which maps each set fact to the time it was
+// set in epoch milliseconds, or 0 when that is unknown.
+func (r Rule) holds(facts map[string]int64) bool {
+	for _, name := range r.All {
+		if _, ok := facts[name]; !ok {
+			return false
+		}
+	}
+	if len(r.Any) > 0 {
+		found := false
+		for _, name := range r.Any {
+			if _, ok := facts[name]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.within > 0 {
+		var first, last int64
+		for _, name := range r.All {
+			if at := facts[name]; at > 0 {
+				if first == 0 || at < first {
+					first = at
+				}
+				last = max(last, at)
+			}
+		}
+		if time.Duration(last-first)*time.Millisecond > r.within {
+			return false
+		}
+	}
+	return true
+}
+
+// appliesTo reports whether the device labels satisfy the rule's label selector.
+func (r Rule) appliesTo(labels map[string]string) bool {
+	for key, value := range r.Labels {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// evaluate applies event to the facts of the device in state and returns the rules it
+// raised or cleared; their state is updated in state too. labels returns the device's
+// registry labels; it is only called when a rule selects on them.
+func (rs *RuleSet) evaluate(state stateStore, senderID, event string, timestamp int64, labels func() map[string]string) []ruleChange {
+	changed := map[string]bool{}
+	for name, fact := range rs.Facts {
+		key := senderID + "_" + name
+		for _, set := range fact.Set {
+			if set == event {
+				// A repeated set keeps the time the fact was first set.
+				if _, ok := loadFact(state, key); !ok {
+					state.Store(key, timestamp)
+					changed[name] = true
+				}
+			}
+		}
+		for _, clear := range fact.Clear {
+			if clear == event {
+				if _, ok := loadFact(state, key); ok {
+					state.Delete(key)
+					changed[name] = true
+				}
+			}
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	facts := map[string]int64{}
+	for name := range rs.Facts {
+		if at, ok := loadFact(state, senderID+"_"+name); ok {
+			facts[name] = at
+		}
+	}
+	var deviceLabels map[string]string
+	labelsLoaded := false
+	var changes []ruleChange
+	for _, r := range rs.Rules {
+		if !r.uses(changed) {
+			continue
+		}
+		key := senderID + "_RULE_" + r.Event
+		_, raised := state.Load(key)
+		holds := r.holds(facts)
+		if holds && len(r.Labels) > 0 {
+			if !labelsLoaded {
+				deviceLabels, labelsLoaded = labels(), true
+			}
+			holds = r.appliesTo(deviceLabels)
+		}
+		if holds == raised {
+			continue
+		}
+		if holds {
+			state.Store(key, true)
+		} else {
+			state.Delete(key)
+		}
+		changes = append(changes, ruleChange{rule: r, raised: holds})
+	}
+	return changes
+}
+
+// uses reports whether r depends on one of the facts.
+func (r Rule) uses(facts map[string]bool) bool {
+	for _, name := range append(append([]string{}, r.All...), r.Any...) {
+		if facts[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// loadFact returns the time a fact was set. Flags stored as plain true before facts
+// had times count as set at an unknown time.
+func loadFact(state stateStore, key string) (int64, bool) {
+	value, ok := state.Load(key)
+	if !ok {
+		return 0, false
+	}
+	switch v := value.(type) {
+	case int64:
+		return v, true
+	case bool:
+		return 0, v
+	}
+	return 0, false
+}
+
+// message is the datapoint of the change, caused by the message of an event.
+func (c ruleChange) message(senderID, message, ingestID string, timestamp int64) EventMessage {
+	value, verb := 0, "cleared"
+	if c.raised {
+		value, verb = 1, "raised"
+	}
+	log.Printf("[%s] Rule %s %s for %s", ingestID, c.rule.Event, verb, senderID)
+	return EventMessage{
+		EventName: c.rule.Event,
+		Tag:       strings.ReplaceAll(c.rule.Tag, "{sender}", senderID),
+		Value:     value,
+		Status:    true,
+		Msg:       message,
+		Time:      timestamp,
+		Sumber:    senderID,
+		IngestID:  ingestID,
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// ruleStep is an event received after wait, with the rule changes it should cause
+// written as +EVENT for raised and -EVENT for cleared.
+type ruleStep struct {
+	wait   time.Duration
+	sender string // m-1 when empty
+	labels map[string]string
+	event  string
+	want   []string
+}
+
+func labelRules(t *testing.T) *RuleSet {
+	t.Helper()
+	rs := &RuleSet{
+		Facts: map[string]RuleFact{
+			"POWER_BACKUP_MODE":  {Set: []string{"POWER_BACKUP_MODE"}, Clear: []string{"POWER_RESTORE_MODE"}},
+			"ALARM_METER_DEVICE": {Set: []string{"ALARM_METER_DEVICE"}, Clear: []string{"CLEAR_ALARM_METER_DEVICE"}},
+			"ALARM_METER_TEMPER": {Set: []string{"ALARM_METER_TEMPER"}, Clear: []string{"CLEAR_ALARM_METER_TEMPER"}},
+		},
+		Rules: []Rule{{Event: "POWER_PLN", Tag: "power_pln_{sender}", All: []string{"POWER_BACKUP_MODE"},
+			Any: []string{"ALARM_METER_DEVICE", "ALARM_METER_TEMPER"}, Labels: map[string]string{"customer": "PLN"}}},
+	}
+	if err := rs.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return rs
+}
+
+func withinRules(t *testing.T) *RuleSet {
+	t.Helper()
+	rs := &RuleSet{
+		Facts: map[string]RuleFact{
+			"POWER_BACKUP_MODE":  {Set: []string{"POWER_BACKUP_MODE"}, Clear: []string{"POWER_RESTORE_MODE"}},
+			"ALARM_METER_DEVICE": {Set: []string{"ALARM_METER_DEVICE"}, Clear: []string{"CLEAR_ALARM_METER_DEVICE"}},
+		},
+		Rules: []Rule{{Event: "POWER_PLN", Tag: "power_pln_{sender}", All: []string{"POWER_BACKUP_MODE", "ALARM_METER_DEVICE"}, Within: "10m"}},
+	}
+	if err := rs.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return rs
+}
+
+func TestRuleSetEvaluate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules func(*testing.T) *RuleSet // defaultRules when nil
+		ttl   time.Duration
+		steps []ruleStep
+	}{
+		{name: "set raises when all facts hold", steps: []ruleStep{
+			{event: "POWER_BACKUP_MODE"},
+			{event: "ALARM_METER_DEVICE", want: []string{"+POWER_PLN"}},
+		}},
+		{name: "clear clears a raised rule", steps: []ruleStep{
+			{event: "POWER_BACKUP_MODE"},
+			{event: "ALARM_METER_DEVICE", want: []string{"+POWER_PLN"}},
+			{event: "POWER_RESTORE_MODE", want: []string{"-POWER_PLN"}},
+			{event: "POWER_BACKUP_MODE", want: []string{"+POWER_PLN"}},
+		}},
+		{name: "repeated set publishes nothing", steps: []ruleStep{
+			{event: "POWER_BACKUP_MODE"},
+			{event: "ALARM_METER_DEVICE", want: []string{"+POWER_PLN"}},
+			{event: "ALARM_METER_DEVICE"},
+			{event: "POWER_BACKUP_MODE"},
+		}},
+		{name: "clear of a rule that was not raised publishes nothing", steps: []ruleStep{
+			{event: "POWER_BACKUP_MODE"},
+			{event: "POWER_RESTORE_MODE"},
+			{event: "CLEAR_ALARM_METER_DEVICE"},
+			{event: "ALARM_METER_DEVICE"},
+		}},
+		{name: "any fact keeps the rule raised", steps: []ruleStep{
+			{event: "DOOR_OPEN"},
+			{event: "ENCLOSURE_TAMPER", want: []string{"+INTRUSION"}},
+			{event: "ALARM_METER_TEMPER"},
+			{event: "CLEAR_ENCLOSURE_TAMPER"},
+			{event: "CLEAR_ALARM_METER_TEMPER", want: []string{"-INTRUSION"}},
+		}},
+		{name: "events that are not facts", steps: []ruleStep{
+			{event: "TEMPERATURE"},
+			{event: "POWER_PLN"},
+		}},
+		{name: "facts are per device", steps: []ruleStep{
+			{sender: "m-1", event: "POWER_BACKUP_MODE"},
+			{sender: "m-2", event: "ALARM_METER_DEVICE"},
+			{sender: "m-2", event: "POWER_BACKUP_MODE", want: []string{"+POWER_PLN"}},
+			{sender: "m-1", event: "POWER_RESTORE_MODE"},
+		}},
+		{name: "fact within the state TTL", ttl: time.Hour, steps: []ruleStep{
+			{event: "POWER_BACKUP_MODE"},
+			{wait: time.Hour, event: "ALARM_METER_DEVICE", want: []string{"+POWER_PLN"}},
+		}},
+		{name: "fact expired by the state TTL", ttl: time.Hour, steps: []ruleStep{
+			{event: "POWER_BACKUP_MODE"},
+			{wait: time.Hour + time.Second, event: "ALARM_METER_DEVICE"},
+			{event: "POWER_BACKUP_MODE", want: []string{"+POWER_PLN"}},
+		}},
+		{name: "raised rule whose facts expired is raised again", ttl: time.Hour, steps: []ruleStep{
+			{event: "POWER_BACKUP_MODE"},
+			{event: "ALARM_METER_DEVICE", want: []string{"+POWER_PLN"}},
+			{wait: 2 * time.Hour, event: "POWER_BACKUP_MODE"},
+			{event: "ALARM_METER_DEVICE", want: []string{"+POWER_PLN"}},
+		}},
+		{name: "labels select the device", rules: labelRules, steps: []ruleStep{
+			{labels: map[string]string{"customer": "PLN", "site": "BDG"}, event: "POWER_BACKUP_MODE"},
+			{labels: map[string]string{"customer": "PLN", "site": "BDG"}, event: "ALARM_METER_DEVICE", want: []string{"+POWER_PLN"}},
+		}},
+		{name: "labels exclude the device", rules: labelRules, steps: []ruleStep{
+			{labels: map[string]string{"customer": "PDAM"}, event: "POWER_BACKUP_MODE"},
+			{labels: map[string]string{"customer": "PDAM"}, event: "ALARM_METER_DEVICE"},
+			{event: "POWER_RESTORE_MODE"},
+		}},
+		{name: "losing the label clears a raised rule", rules: labelRules, steps: []ruleStep{
+			{labels: map[string]string{"customer": "PLN"}, event: "POWER_BACKUP_MODE"},
+			{labels: map[string]string{"customer": "PLN"}, event: "ALARM_METER_DEVICE", want: []string{"+POWER_PLN"}},
+			{labels: map[string]string{"customer": "PDAM"}, event: "ALARM_METER_TEMPER", want: []string{"-POWER_PLN"}},
+			{labels: map[string]string{"customer": "PLN"}, event: "CLEAR_ALARM_METER_TEMPER", want: []string{"+POWER_PLN"}},
+		}},
+		{name: "facts set within the window", rules: withinRules, steps: []ruleStep{
+			{event: "POWER_BACKUP_MODE"},
+			{wait: 10 * time.Minute, event: "ALARM_METER_DEVICE", want: []string{"+POWER_PLN"}},
+		}},
+		{name: "facts set too far apart", rules: withinRules, steps: []ruleStep{
+			{event: "POWER_BACKUP_MODE"},
+			{wait: 11 * time.Minute, event: "ALARM_METER_DEVICE"},
+			{event: "POWER_RESTORE_MODE"},
+			{event: "POWER_BACKUP_MODE", want: []string{"+POWER_PLN"}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := useFakeClock(t)
+			useStateLimits(t, tt.ttl, 0)
+			rs := defaultRules()
+			if tt.rules != nil {
+				rs = tt.rules(t)
+			}
+			state := newMemoryState()
+			for i, step := range tt.steps {
+				c.Advance(step.wait)
+				sender := step.sender
+				if sender == "" {
+					sender = "m-1"
+				}
+				var got []string
+				labels := func() map[string]string { return step.labels }
+				for _, change := range rs.evaluate(state, sender, step.event, c.Now().UnixMilli(), labels) {
+					sign := "-"
+					if change.raised {
+						sign = "+"
+					}
+					got = append(got, sign+change.rule.Event)
+				}
+				if !reflect.DeepEqual(got, step.want) {
+					t.Errorf("step %d: %s from %s changed %v, want %v", i+1, step.event, sender, got, step.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRuleChangeMessage(t *testing.T) {
+	rule := defaultRules().Rules[0]
+	tests := []struct {
+		raised bool
+		value  int
+	}{
+		{true, 1},
+		{false, 0},
+	}
+	for _, tt := range tests {
+		got := ruleChange{rule: rule, raised: tt.raised}.message("m-1", `{"event":"ALARM_METER_DEVICE"}`, "i-1", 1700000000000)
+		want := EventMessage{EventName: "POWER_PLN", Tag: "power_pln_m-1", Value: tt.value, Status: true,
+			Msg: `{"event":"ALARM_METER_DEVICE"}`, Time: 1700000000000, Sumber: "m-1", IngestID: "i-1"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("message of raised=%v = %+v, want %+v", tt.raised, got, want)
+		}
+	}
+}
+
+func TestLoadRulesRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{"fact without set", `{"facts": {"A": {"clear": ["A_OFF"]}}, "rules": [{"event": "R", "tag": "r", "all": ["A"]}]}`},
+		{"event sets and clears", `{"facts": {"A": {"set": ["A"], "clear": ["A"]}}, "rules": [{"event": "R", "tag": "r", "all": ["A"]}]}`},
+		{"rule without tag", `{"facts": {"A": {"set": ["A"]}}, "rules": [{"event": "R", "all": ["A"]}]}`},
+		{"rule defined twice", `{"facts": {"A": {"set": ["A"]}}, "rules": [{"event": "R", "tag": "r", "all": ["A"]}, {"event": "R", "tag": "r2", "any": ["A"]}]}`},
+		{"rule without facts", `{"facts": {"A": {"set": ["A"]}}, "rules": [{"event": "R", "tag": "r"}]}`},
+		{"unknown fact", `{"facts": {"A": {"set": ["A"]}}, "rules": [{"event": "R", "tag": "r", "all": ["B"]}]}`},
+		{"invalid within", `{"facts": {"A": {"set": ["A"]}}, "rules": [{"event": "R", "tag": "r", "all": ["A"], "within": "-1m"}]}`},
+		{"label without key", `{"facts": {"A": {"set": ["A"]}}, "rules": [{"event": "R", "tag": "r", "all": ["A"], "labels": {"": "PLN"}}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.json")
+			if err := os.WriteFile(path, []byte(tt.json), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadRules(path); err == nil {
+				t.Errorf("loadRules accepted %s", tt.json)
+			}
+		})
+	}
+}
+
+func TestRulesPublishOnlyChanges(t *testing.T) {
+	c := useFakeClock(t)
+	useStateLimits(t, 0, 0)
+	savedState := eventState
+	eventState = newMemoryState()
+	t.Cleanup(func() { eventState = savedState })
+	b := captureBroker(t)
+
+	db, err := openSQLite(filepath.Join(t.TempDir(), "edge.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := setupEdgeStore(db, sqliteDialect{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, event := range []string{
+		"POWER_BACKUP_MODE",
+		"ALARM_METER_DEVICE", // raises POWER_PLN
+		"ALARM_METER_DEVICE",
+		"POWER_BACKUP_MODE",
+		"POWER_RESTORE_MODE", // clears POWER_PLN
+		"POWER_RESTORE_MODE",
+		"CLEAR_ALARM_METER_DEVICE",
+	} {
+		c.Advance(time.Second)
+		handleMappedEvent(store, eventMappings[event], "m-1", `{"event":"`+event+`"}`, event, fmt.Sprintf("i-%d", i+1), c.Now().UnixMilli())
+	}
+
+	var published []interface{}
+	for _, m := range b.Messages("DATAPOINTS") {
+		var payload map[string]interface{}
+		if err := json.Unmarshal(m.Payload, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload["event"] == "POWER_PLN" {
+			published = append(published, payload["value"])
+		}
+	}
+	if want := []interface{}{1.0, 0.0}; !reflect.DeepEqual(published, want) {
+		t.Errorf("published POWER_PLN values %v, want %v", published, want)
+	}
+
+	var stored []string
+	rows, err := db.Query("SELECT value FROM events WHERE event_name = 'POWER_PLN' ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			t.Fatal(err)
+		}
+		stored = append(stored, value)
+	}
+	if want := []string{"1", "0"}; !reflect.DeepEqual(stored, want) {
+		t.Errorf("stored POWER_PLN values %v, want %v", stored, want)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+// Datapoint schema validation modes.
+const (
+	schemaValidationOff     = "off"
+	schemaValidationLog     = "log"
+	schemaValidationEnforce = "enforce"
+
+	// datapointSchemaName is the current published version of the DATAPOINTS payload.
+	datapointSchemaName = "datapoint.v3.json"
+)
+
+var (
+	datapointSchemaMode string
+	datapointSchema     *jsonSchema
+
+	datapointSchemaViolations = newCounterVec("collector_datapoint_schema_violations_total", "Outgoing datapoints that did not match the published schema.", "mode")
+)
+
+// jsonSchema is the subset of JSON Schema the collector's schema files use:
+// type, required, properties, additionalProperties, enum, minLength, pattern, minimum and maximum.
+type jsonSchema struct {
+	Type                 interface{}            `json:"type"`
+	Required             []string               `json:"required"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Enum                 []interface{}          `json:"enum"`
+	MinLength            *int                   `json:"minLength"`
+	Pattern              string                 `json:"pattern"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+
+	pattern *regexp.Regexp
+}
+
+func parseJSONSchema(data []byte) (*jsonSchema, error) {
+	var s jsonSchema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid schema: %v", err)
+	}
+	if err := s.compile("$"); err != nil {
+		return nil, fmt.Errorf("invalid schema: %v", err)
+	}
+	return &s, nil
+}
+
+// compile prepares the patterns of s and its properties.
+func (s *jsonSchema) compile(path string) error {
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s: bad pattern: %v", path, err)
+		}
+		s.pattern = re
+	}
+	for key, prop := range s.Properties {
+		if err := prop.compile(path + "." + key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadEmbeddedSchema(name string) (*jsonSchema, error) {
+	data, err := schemaFiles.ReadFile("schemas/" + name)
+	if err != nil {
+		return nil, err
+	}
+	return parseJSONSchema(data)
+}
+
+// Validate checks a decoded JSON value and returns every violation found, or nil.
+func (s *jsonSchema) Validate(value interface{}) []string {
+	var errs []string
+	s.validate("$", value, &errs)
+	return errs
+}
+
+func (s *jsonSchema) validate(path string, value interface{}, errs *[]string) {
+	if s.Type != nil && !s.matchesType(value) {
+		*errs = append(*errs, fmt.Sprintf("%s: expected type %v, got %s", path, s.Type, jsonTypeOf(value)))
+		return
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, allowed := range s.Enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			*errs = append(*errs, fmt.Sprintf("%s: value %v is not one of %v", path, value, s.Enum))
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		if s.MinLength != nil && len(v) < *s.MinLength {
+			*errs = append(*errs, fmt.Sprintf("%s: length %d is below minLength %d", path, len(v), *s.MinLength))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			*errs = append(*errs, fmt.Sprintf("%s: %q does not match pattern %s", path, v, s.Pattern))
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			*errs = append(*errs, fmt.Sprintf("%s: %v is below minimum %v", path, v, *s.Minimum))
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			*errs = append(*errs, fmt.Sprintf("%s: %v is above maximum %v", path, v, *s.Maximum))
+		}
+	case map[string]interface{}:
+		for _, key := range s.Required {
+			if _, ok := v[key]; !ok {
+				*errs = append(*errs, fmt.Sprintf("%s: missing required property %q", path, key))
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if prop, ok := s.Properties[key]; ok {
+				prop.validate(path+"."+key, v[key], errs)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				*errs = append(*errs, fmt.Sprintf("%s: unexpected property %q", path, key))
+			}
+		}
+	}
+}
+
+func (s *jsonSchema) matchesType(value interface{}) bool {
+	switch t := s.Type.(type) {
+	case string:
+		return typeMatches(t, value)
+	case []interface{}:
+		for _, name := range t {
+			if n, ok := name.(string); ok && typeMatches(n, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func typeMatches(name string, value interface{}) bool {
+	actual := jsonTypeOf(value)
+	if name == "number" && actual == "integer" {
+		return true
+	}
+	return name == actual
+}
+
+func jsonTypeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// setupDatapointSchema loads the published datapoint schema for the configured validation mode.
+func setupDatapointSchema(mode string) error {
+	switch mode {
+	case schemaValidationOff:
+		return nil
+	case schemaValidationLog, schemaValidationEnforce:
+	default:
+		return fmt.Errorf("unknown validation mode %q", mode)
+	}
+	schema, err := loadEmbeddedSchema(datapointSchemaName)
+	if err != nil {
+		return err
+	}
+	datapointSchemaMode = mode
+	datapointSchema = schema
+	log.Printf("Validating outgoing datapoints against %s (%s mode)", datapointSchemaName, mode)
+	return nil
+}
+
+// checkDatapoint validates an encoded datapoint against the published schema. It reports
+// false only in enforce mode, where a non-conforming datapoint must not be published.
+func checkDatapoint(payload []byte) bool {
+	if datapointSchema == nil {
+		return true
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(payload, &decoded); err != nil {
+		log.Printf("Datapoint is not valid JSON: %v", err)
+		return datapointSchemaMode != schemaValidationEnforce
+	}
+	errs := datapointSchema.Validate(decoded)
+	if len(errs) == 0 {
+		return true
+	}
+	datapointSchemaViolations.Inc(datapointSchemaMode)
+	log.Printf("Datapoint does not match %s: %s\nPayload: %s", datapointSchemaName, strings.Join(errs, "; "), payload)
+	return datapointSchemaMode != schemaValidationEnforce
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// publishedMessage is a message sent through a recordingBroker.
+type publishedMessage struct {
+	Topic   string
+	Payload []byte
+	Expiry  time.Duration
+}
+
+// recordingBroker is a Broker that keeps what is published instead of sending it.
+type recordingBroker struct {
+	discardBroker
+
+	mu        sync.Mutex
+	published []publishedMessage
+}
+
+func (b *recordingBroker) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	return b.PublishWithExpiry(topic, qos, retained, payload, 0)
+}
+
+func (b *recordingBroker) PublishWithExpiry(topic string, qos byte, retained bool, payload []byte, expiry time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = append(b.published, publishedMessage{Topic: topic, Payload: append([]byte(nil), payload...), Expiry: expiry})
+	return nil
+}
+
+// Messages returns what was published on topic, in order.
+func (b *recordingBroker) Messages(topic string) []publishedMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []publishedMessage
+	for _, m := range b.published {
+		if m.Topic == topic {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// captureBroker replaces mqttClient with a recordingBroker for the test.
+func captureBroker(t *testing.T) *recordingBroker {
+	t.Helper()
+	b := &recordingBroker{}
+	saved := mqttClient
+	mqttClient = b
+	t.Cleanup(func() { mqttClient = saved })
+	return b
+}
+
+// enforceDatapointSchema turns on DATAPOINT_SCHEMA_VALIDATION=enforce for the test.
+func enforceDatapointSchema(t *testing.T) *jsonSchema {
+	t.Helper()
+	savedMode, savedSchema := datapointSchemaMode, datapointSchema
+	t.Cleanup(func() { datapointSchemaMode, datapointSchema = savedMode, savedSchema })
+	if err := setupDatapointSchema(schemaValidationEnforce); err != nil {
+		t.Fatal(err)
+	}
+	return datapointSchema
+}
+
+// publishedDatapoint runs message through sendDataPoint and returns the decoded payload,
+// or nil when nothing was published.
+func publishedDatapoint(t *testing.T, message EventMessage) map[string]interface{} {
+	t.Helper()
+	b := captureBroker(t)
+	sendDataPoint(message)
+	published := b.Messages("DATAPOINTS")
+	if len(published) == 0 {
+		return nil
+	}
+	if len(published) > 1 {
+		t.Fatalf("sendDataPoint published %d datapoints", len(published))
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(published[0].Payload, &payload); err != nil {
+		t.Fatalf("DATAPOINTS payload %s is not a JSON object: %v", published[0].Payload, err)
+	}
+	return payload
+}
+
+func TestSendDataPointMatchesSchema(t *testing.T) {
+	schema := enforceDatapointSchema(t)
+	rememberDeviceProperties("modem-v5", map[string]string{userPropertyDeviceType: "RUT955", userPropertyFirmware: "7.4.2"})
+
+	tests := []struct {
+		name    string
+		message EventMessage
+		want    map[string]interface{} // fields expected besides the EventMessage ones
+	}{
+		{"temperature", EventMessage{EventName: "TEMPERATURE", Tag: "temperature_modem-1", Value: 23.5, Status: true, Time: 1700000000000, Sumber: "modem-1", IngestID: "0b6c8f52-1f0e-4c2e-9a57-5d1c1f1b9d10"}, nil},
+		{"alarm", EventMessage{EventName: "ALARM_POWER_FAIL", Tag: "alarm_power_modem-1", Value: 1, Status: true, Time: 1700000000000, Sumber: "modem-1", IngestID: "c1"}, nil},
+		{"string value", EventMessage{EventName: "FIRMWARE_INFO", Tag: "firmware_modem-1", Value: "7.4.2", Time: 1700000000000, Sumber: "modem-1", IngestID: "c2"}, nil},
+		{"object value", EventMessage{EventName: "GPS", Tag: "geolocation_modem-1", Value: map[string]interface{}{"lat": -6.2, "lng": 106.8, "accuracy": 12}, Status: true, Time: 1700000000000, Sumber: "modem-1", IngestID: "c3"}, nil},
+		{"null value", EventMessage{EventName: "SIM_INFO", Tag: "sim_modem-1", Value: nil, Time: 1700000000000, Sumber: "modem-1", IngestID: "c4"}, nil},
+		{"collector metric without ingest ID", EventMessage{EventName: "COLLECTOR_METRIC", Tag: "collector_queue_depth", Value: 0, Time: 1700000000000, Sumber: "collector"}, nil},
+		{"MQTT v5 device properties", EventMessage{EventName: "TEMPERATURE", Tag: "temperature_modem-v5", Value: 21.0, Status: true, Time: 1700000000000, Sumber: "modem-v5", IngestID: "c5"},
+			map[string]interface{}{"device_type": "RUT955", "firmware": "7.4.2"}},
+		{"epoch time", EventMessage{EventName: "UPTIME", Tag: "uptime_modem-1", Value: 0, Time: 0, Sumber: "modem-1", IngestID: "c6"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := publishedDatapoint(t, tt.message)
+			if payload == nil {
+				t.Fatalf("sendDataPoint(%+v) published nothing", tt.message)
+			}
+			if errs := schema.Validate(payload); len(errs) > 0 {
+				t.Errorf("payload %v does not match %s: %s", payload, datapointSchemaName, strings.Join(errs, "; "))
+			}
+			for key, want := range tt.want {
+				if payload[key] != want {
+					t.Errorf("payload[%q] = %v, want %v", key, payload[key], want)
+				}
+			}
+		})
+	}
+}
+
+func TestDatapointSchemaRejects(t *testing.T) {
+	schema := enforceDatapointSchema(t)
+	valid := publishedDatapoint(t, EventMessage{EventName: "TEMPERATURE", Tag: "temperature_modem-1", Value: 23.5, Status: true, Time: 1700000000000, Sumber: "modem-1", IngestID: "r1"})
+	if errs := schema.Validate(valid); len(errs) > 0 {
+		t.Fatalf("baseline payload %v is invalid: %v", valid, errs)
+	}
+
+	tests := []struct {
+		name   string
+		change func(map[string]interface{})
+		want   string
+	}{
+		{"without event", func(p map[string]interface{}) { delete(p, "event") }, `missing required property "event"`},
+		{"without tag", func(p map[string]interface{}) { delete(p, "tag") }, `missing required property "tag"`},
+		{"without value", func(p map[string]interface{}) { delete(p, "value") }, `missing required property "value"`},
+		{"without time", func(p map[string]interface{}) { delete(p, "time") }, `missing required property "time"`},
+		{"without id_modem", func(p map[string]interface{}) { delete(p, "id_modem") }, `missing required property "id_modem"`},
+		{"event not a string", func(p map[string]interface{}) { p["event"] = 7.0 }, "$.event: expected type string"},
+		{"empty tag", func(p map[string]interface{}) { p["tag"] = "" }, "$.tag: length 0 is below minLength 1"},
+		{"fractional time", func(p map[string]interface{}) { p["time"] = 1700000000000.5 }, "$.time: expected type integer"},
+		{"negative time", func(p map[string]interface{}) { p["time"] = -1.0 }, "$.time: -1 is below minimum 0"},
+		{"empty id_modem", func(p map[string]interface{}) { p["id_modem"] = "" }, "$.id_modem: length 0 is below minLength 1"},
+		{"empty ingest_id", func(p map[string]interface{}) { p["ingest_id"] = "" }, "$.ingest_id: length 0 is below minLength 1"},
+		{"unknown property", func(p map[string]interface{}) { p["sumber"] = "modem-1" }, `unexpected property "sumber"`},
+	}
+	covered := map[string]bool{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := map[string]interface{}{}
+			for k, v := range valid {
+				payload[k] = v
+			}
+			tt.change(payload)
+			errs := strings.Join(schema.Validate(payload), "; ")
+			if !strings.Contains(errs, tt.want) {
+				t.Errorf("Validate(%v) = %q, want %q", payload, errs, tt.want)
+			}
+		})
+		if field, ok := strings.CutPrefix(tt.want, "missing required property "); ok {
+			covered[strings.Trim(field, `"`)] = true
+		}
+	}
+	for _, field := range schema.Required {
+		if !covered[field] {
+			t.Errorf("no case drops required field %q of %s", field, datapointSchemaName)
+		}
+	}
+}
+
+func TestSendDataPointEnforcesSchema(t *testing.T) {
+	enforceDatapointSchema(t)
+	tests := []struct {
+		name    string
+		message EventMessage
+	}{
+		{"empty tag", EventMessage{EventName: "TEMPERATURE", Value: 23.5, Time: 1700000000000, Sumber: "modem-1", IngestID: "e1"}},
+		{"empty sender", EventMessage{EventName: "TEMPERATURE", Tag: "temperature_", Value: 23.5, Time: 1700000000000, IngestID: "e2"}},
+		{"negative time", EventMessage{EventName: "TEMPERATURE", Tag: "temperature_modem-1", Value: 23.5, Time: -1, Sumber: "modem-1", IngestID: "e3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if payload := publishedDatapoint(t, tt.message); payload != nil {
+				t.Errorf("sendDataPoint(%+v) published %v, want it rejected", tt.message, payload)
+			}
+		})
+	}
+}
+
+func TestSetTemperatureDatapointKeepsEmptyEvent(t *testing.T) {
+	saved := storageRoutes
+	storageRoutes = map[string]string{"SET_TEMPERATURE": ""}
+	t.Cleanup(func() { storageRoutes = saved })
+	b := captureBroker(t)
+
+	handleSetTemperatureEvents(nil, "modem-1", `{"event":"SET_TEMPERATURE","message":"18.5,24.0"}`, "c1", 1700000000000)
+	published := b.Messages("DATAPOINTS")
+	if len(published) != 2 {
+		t.Fatalf("published %d datapoints, want the setpoint and its upper bound", len(published))
+	}
+	for _, m := range published {
+		var payload map[string]interface{}
+		if err := json.Unmarshal(m.Payload, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload["event"] != "" {
+			t.Errorf("%v datapoint event = %q, want empty", payload["tag"], payload["event"])
+		}
+	}
+}
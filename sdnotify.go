@@ -0,0 +1,89 @@
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// startService does nothing outside Windows; systemd needs no registration.
+func startService() {}
+
+// serviceReady tells systemd that the collector is up and starts the watchdog pings.
+func serviceReady(status string, healthy func() bool) {
+	sdNotify("READY=1\nSTATUS=" + status)
+	startSystemdWatchdog(healthy)
+}
+
+// notifyStop relays SIGINT and SIGTERM to stop.
+func notifyStop(stop chan<- os.Signal) {
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+}
+
+// serviceStopping tells systemd that the collector is shutting down.
+func serviceStopping() {
+	sdNotify("STOPPING=1")
+}
+
+// serviceStopped does nothing outside Windows.
+func serviceStopped() {}
+
+// sdNotify sends a state string such as "READY=1" to systemd when the collector runs
+// under a Type=notify unit. It is a no-op when NOTIFY_SOCKET is not set.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:] // abstract namespace socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Failed to connect to systemd notify socket: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+	}
+}
+
+// watchdogInterval returns half of the WatchdogSec systemd configured for this process,
+// or zero when the watchdog is not enabled.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// startSystemdWatchdog pings the systemd watchdog while healthy reports true, so systemd
+// restarts the collector when it loses its broker connection for longer than WatchdogSec.
+func startSystemdWatchdog(healthy func() bool) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	log.Printf("Pinging systemd watchdog every %v", interval)
+	go func() {
+		for {
+			<-clock.After(interval)
+			if healthy() {
+				sdNotify("WATCHDOG=1")
+			} else {
+				sdNotify("STATUS=MQTT connection lost, withholding watchdog ping")
+			}
+		}
+	}()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Self metrics (SELF_METRICS_INTERVAL): the collector publishes its own health as
+// COLLECTOR_HEALTH datapoints tagged collector_<instance>_<metric>, so sites whose only
+// monitoring is the SCADA trending of DATAPOINTS can watch the collector like a device.
+
+// errorDecisions are the processing decisions counted as errors in the error rate.
+var errorDecisions = []string{decisionQueueFull, decisionDecodeError, decisionInvalidTime, decisionPanic, decisionStoreFailed, decisionPublishFailed}
+
+var tagUnsafe = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// selfMetricsSample holds the counter values at the previous publication.
+type selfMetricsSample struct {
+	at       time.Time
+	received float64
+	errors   float64
+}
+
+func takeSelfMetricsSample(at time.Time) selfMetricsSample {
+	s := selfMetricsSample{at: at, received: processingDecisions.Value(decisionReceived)}
+	for _, decision := range errorDecisions {
+		s.errors += processingDecisions.Value(decision)
+	}
+	return s
+}
+
+// startSelfMetrics publishes queue depth, message rate and error rate every interval.
+func startSelfMetrics(instance string, pool *workerPool, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	prefix := "collector_" + strings.Trim(tagUnsafe.ReplaceAllString(strings.ToLower(instance), "_"), "_")
+	go func() {
+		previous := takeSelfMetricsSample(clock.Now())
+		for {
+			<-clock.After(interval)
+			current := takeSelfMetricsSample(clock.Now())
+			received := current.received - previous.received
+			errorRate := 0.0
+			if received > 0 {
+				errorRate = (current.errors - previous.errors) / received
+			}
+			values := []struct {
+				name  string
+				value float64
+			}{
+				{"queue_depth", float64(pool.Depth())},
+				{"msgs_per_sec", received / current.at.Sub(previous.at).Seconds()},
+				{"error_rate", errorRate},
+			}
+			for _, v := range values {
+				sendDataPoint(EventMessage{
+					EventName: "COLLECTOR_HEALTH",
+					Tag:       fmt.Sprintf("%s_%s", prefix, v.name),
+					Value:     v.value,
+					Status:    true,
+					Time:      current.at.UnixMilli(),
+					Sumber:    instance,
+				})
+			}
+			previous = current
+		}
+	}()
+}
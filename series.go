@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Series resolutions. Raw values come from the events table; the rollups are kept
+// up to date in metric_rollups as events are stored.
+var rollupResolutions = []time.Duration{5 * time.Minute, time.Hour}
+
+// Spans up to these limits are served at raw and 5-minute resolution respectively;
+// longer spans use hourly rollups.
+var (
+	seriesRawMaxSpan = 24 * time.Hour
+	series5mMaxSpan  = 14 * 24 * time.Hour
+)
+
+// SeriesPoint is one point of a chart series. Raw points have Count 1 and equal Min/Max.
+type SeriesPoint struct {
+	Time  time.Time `json:"t"`
+	Value float64   `json:"value"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Count int64     `json:"count"`
+}
+
+// Series is the uniform response of the series API.
+type Series struct {
+	SenderID   string        `json:"sender_id"`
+	Metric     string        `json:"metric"`
+	Resolution string        `json:"resolution"`
+	From       time.Time     `json:"from"`
+	To         time.Time     `json:"to"`
+	Points     []SeriesPoint `json:"points"`
+}
+
+// metricName is the series metric an event's values belong to, e.g. TEMPERATURE -> temperature.
+func metricName(event string) string {
+	return strings.ToLower(event)
+}
+
+// updateRollups adds a numeric event value to its 5-minute and hourly buckets.
+func updateRollups(db eventsExecer, data EventMessage) error {
+	value, ok := numericValue(data.Value)
+	if !ok || data.Time == 0 {
+		return nil
+	}
+	at := time.UnixMilli(data.Time)
+	for _, resolution := range rollupResolutions {
+		_, err := db.Exec(`INSERT INTO metric_rollups (sender_id, metric, resolution_s, bucket, count, sum, min, max)
+            VALUES ($1, $2, $3, $4, 1, $5, $5, $5)
+            ON CONFLICT (sender_id, metric, resolution_s, bucket) DO UPDATE SET
+                count = metric_rollups.count + 1, sum = metric_rollups.sum + EXCLUDED.sum,
+                min = LEAST(metric_rollups.min, EXCLUDED.min), max = GREATEST(metric_rollups.max, EXCLUDED.max)`,
+			data.Sumber, metricName(data.EventName), int(resolution.Seconds()), at.Truncate(resolution), value)
+		if err != nil {
+			return fmt.Errorf("failed to update %v rollup: %v", resolution, err)
+		}
+	}
+	return nil
+}
+
+// seriesResolution picks the coarsest resolution needed to keep a chart of span readable.
+func seriesResolution(span time.Duration) (string, time.Duration) {
+	switch {
+	case span <= seriesRawMaxSpan:
+		return "raw", 0
+	case span <= series5mMaxSpan:
+		return "5m", rollupResolutions[0]
+	default:
+		return "1h", rollupResolutions[1]
+	}
+}
+
+func querySeries(db *sql.DB, senderID, metric string, from, to time.Time, limit int) (Series, error) {
+	s := Series{SenderID: senderID, Metric: metric, From: from, To: to, Points: []SeriesPoint{}}
+	var resolution time.Duration
+	s.Resolution, resolution = seriesResolution(to.Sub(from))
+
+	var rows *sql.Rows
+	var err error
+	if resolution == 0 {
+		rows, err = db.Query(`SELECT event_time, value_num, value_num, value_num, 1 FROM events
+            WHERE sender_id = $1 AND event_name = $2 AND event_time >= $3 AND event_time < $4 AND value_num IS NOT NULL
+            ORDER BY event_time LIMIT $5`,
+			senderID, strings.ToUpper(metric), from, to, limit)
+	} else {
+		rows, err = db.Query(`SELECT bucket, sum / count, min, max, count FROM metric_rollups
+            WHERE sender_id = $1 AND metric = $2 AND resolution_s = $3 AND bucket >= $4 AND bucket < $5
+            ORDER BY bucket LIMIT $6`,
+			senderID, metric, int(resolution.Seconds()), from.Truncate(resolution), to, limit)
+	}
+	if err != nil {
+		return s, fmt.Errorf("failed to query %s series: %v", s.Resolution, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p SeriesPoint
+		if err := rows.Scan(&p.Time, &p.Value, &p.Min, &p.Max, &p.Count); err != nil {
+			return s, fmt.Errorf("failed to scan series point: %v", err)
+		}
+		s.Points = append(s.Points, p)
+	}
+	return s, rows.Err()
+}
+
+// handleDeviceSeries serves GET /api/v1/devices/{id}/series?metric=temperature&from=&to=
+// with RFC 3339 bounds. to defaults to now and from to 24 hours before to.
+func handleDeviceSeries(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	metric := strings.ToLower(q.Get("metric"))
+	if metric == "" {
+		writeError(w, http.StatusBadRequest, "metric is required")
+		return
+	}
+	to := clock.Now()
+	if value := q.Get("to"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid to time, expected RFC 3339")
+			return
+		}
+		to = t
+	}
+	from := to.Add(-24 * time.Hour)
+	if value := q.Get("from"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid from time, expected RFC 3339")
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		writeError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	series, err := querySeries(db, r.PathValue("id"), metric, from, to, queryLimit(r, 5000, 20000))
+	if err != nil {
+		log.Printf("Error querying series: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to query series")
+		return
+	}
+	writeCachedJSON(w, r, series)
+}
+
+type rollupKey struct {
+	senderID, metric string
+	resolution       int
+	bucket           time.Time
+}
+
+type rollupAgg struct {
+	count         int64
+	sum, min, max float64
+}
+
+// upsertRollups adds the numeric values of a batch to the rollups. Values falling in the
+// same bucket are combined first, since one statement cannot update a row twice.
+func upsertRollups(tx *sql.Tx, batch []EventMessage) error {
+	aggs := map[rollupKey]*rollupAgg{}
+	var keys []rollupKey
+	for _, data := range batch {
+		value, ok := numericValue(data.Value)
+		if !ok || data.Time == 0 {
+			continue
+		}
+		if _, stored := storageTable(data.EventName); !stored {
+			continue
+		}
+		at := time.UnixMilli(data.Time)
+		for _, resolution := range rollupResolutions {
+			key := rollupKey{data.Sumber, metricName(data.EventName), int(resolution.Seconds()), at.Truncate(resolution)}
+			agg, ok := aggs[key]
+			if !ok {
+				agg = &rollupAgg{min: value, max: value}
+				aggs[key] = agg
+				keys = append(keys, key)
+			}
+			agg.count++
+			agg.sum += value
+			agg.min = min(agg.min, value)
+			agg.max = max(agg.max, value)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	rows := make([][]interface{}, len(keys))
+	for i, key := range keys {
+		agg := aggs[key]
+		rows[i] = []interface{}{key.senderID, key.metric, key.resolution, key.bucket, agg.count, agg.sum, agg.min, agg.max}
+	}
+	err := insertMultiRow(tx, "INSERT INTO metric_rollups (sender_id, metric, resolution_s, bucket, count, sum, min, max) VALUES ",
+		"($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)", rows,
+		` ON CONFLICT (sender_id, metric, resolution_s, bucket) DO UPDATE SET
+            count = metric_rollups.count + EXCLUDED.count, sum = metric_rollups.sum + EXCLUDED.sum,
+            min = LEAST(metric_rollups.min, EXCLUDED.min), max = GREATEST(metric_rollups.max, EXCLUDED.max)`)
+	if err != nil {
+		return fmt.Errorf("failed to update rollups: %v", err)
+	}
+	return nil
+}
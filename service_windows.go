@@ -0,0 +1,108 @@
+//go:build windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// serviceName is the name the collector is registered under, e.g. with
+// `sc create datacollector binPath= C:\datacollector\main.exe`.
+const serviceName = "datacollector"
+
+// windowsService reports the collector's state to the service control manager and turns
+// its Stop and Shutdown requests into the same graceful shutdown as SIGTERM.
+type windowsService struct {
+	ready   chan struct{} // closed by serviceReady
+	stop    chan os.Signal
+	stopped chan struct{} // closed by serviceStopped, once shutdown has finished
+	exited  chan struct{} // closed when svc.Run returns
+}
+
+var service *windowsService // nil unless running as a Windows service
+
+// startService connects to the service control manager when the collector was started as
+// a Windows service. It runs first in main, since the manager only waits a few seconds
+// for a service to connect; the service stays start pending until serviceReady.
+func startService() {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		log.Fatalf("Error detecting Windows service: %v", err)
+	}
+	if !isService {
+		return
+	}
+	service = &windowsService{
+		ready:   make(chan struct{}),
+		stop:    make(chan os.Signal, 1),
+		stopped: make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+	go func() {
+		defer close(service.exited)
+		if err := svc.Run(serviceName, service); err != nil {
+			log.Fatalf("Error running Windows service: %v", err)
+		}
+	}()
+}
+
+// Execute implements svc.Handler.
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	ready := s.ready
+	for {
+		select {
+		case <-ready:
+			ready = nil
+			status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+		case <-s.stopped:
+			return false, 0
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				select {
+				case s.stop <- syscall.SIGTERM:
+				default: // a stop is already pending
+				}
+			}
+		}
+	}
+}
+
+// serviceReady reports the service as running. The watchdog is systemd only, so healthy
+// is not used.
+func serviceReady(status string, healthy func() bool) {
+	if service != nil {
+		log.Printf("Reporting Windows service %s running: %s", serviceName, status)
+		close(service.ready)
+	}
+}
+
+// notifyStop relays Ctrl+C and, when running as a service, Stop and Shutdown requests
+// to stop.
+func notifyStop(stop chan<- os.Signal) {
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	if service != nil {
+		go func() { stop <- <-service.stop }()
+	}
+}
+
+// serviceStopping does nothing on Windows; Execute reports stop pending as soon as the
+// request arrives.
+func serviceStopping() {}
+
+// serviceStopped reports the service as stopped once shutdown has finished.
+func serviceStopped() {
+	if service != nil {
+		close(service.stopped)
+		<-service.exited
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Accepted setpoint range in °C (SETPOINT_MIN, SETPOINT_MAX). Anything outside it is
+// almost certainly a parsing or device error rather than a real setpoint.
+var (
+	setpointMin = -40.0
+	setpointMax = 100.0
+)
+
+// setpointPattern matches a number with an optional unit, e.g. "25", "-5.5", "24,5 °C", "77F".
+var setpointPattern = regexp.MustCompile(`(?i)([-−]?)(\d+(?:[.,]\d+)?)(?:\s*(?:°|º|deg(?:rees)?)?\s*([CF])\b)?`)
+
+var valueSuffixPattern = regexp.MustCompile(`(?i)\d(?:\s*(?:°|º|deg(?:rees)?)?\s*[CF])?$`)
+
+// setpoints is a setpoint message parsed to °C. Min and Max are equal for a single setpoint.
+type setpoints struct {
+	Min, Max float64
+}
+
+func (s setpoints) isRange() bool { return s.Min != s.Max }
+
+// parseSetpoints reads one setpoint or a min/max pair from free text such as
+// "Set temperature 25", "setpoint 18.5-24 C" or "min 64F max 75F". Fahrenheit values
+// are converted to °C. Messages without a number, with more than two, or with a value
+// outside [setpointMin, setpointMax] are rejected. A value without a unit takes the unit
+// of the other one, so "64-75F" is a Fahrenheit range.
+func parseSetpoints(s string) (setpoints, error) {
+	var values []float64
+	var units []string
+	for _, m := range setpointPattern.FindAllStringSubmatchIndex(s, -1) {
+		sign, number, unit := s[m[2]:m[3]], strings.Replace(s[m[4]:m[5]], ",", ".", 1), ""
+		if m[6] >= 0 {
+			unit = strings.ToUpper(s[m[6]:m[7]])
+		}
+		value, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return setpoints{}, fmt.Errorf("invalid number %q", number)
+		}
+		// In "18-24" the dash separates a range; it is only a minus sign when it does not
+		// directly follow another value.
+		if sign != "" && !followsValue(s[:m[0]]) {
+			value = -value
+		}
+		values = append(values, value)
+		units = append(units, unit)
+	}
+	for i := range values {
+		unit := units[i]
+		if unit == "" && len(units) == 2 {
+			unit = units[1-i]
+		}
+		if unit == "F" {
+			values[i] = math.Round((values[i]-32)*5/9*10) / 10
+		}
+	}
+
+	var sp setpoints
+	switch len(values) {
+	case 0:
+		return sp, fmt.Errorf("no setpoint found in %q", s)
+	case 1:
+		sp = setpoints{Min: values[0], Max: values[0]}
+	case 2:
+		sp = setpoints{Min: math.Min(values[0], values[1]), Max: math.Max(values[0], values[1])}
+	default:
+		return sp, fmt.Errorf("ambiguous setpoint message %q: %d numbers", s, len(values))
+	}
+	for _, v := range []float64{sp.Min, sp.Max} {
+		if v < setpointMin || v > setpointMax {
+			return sp, fmt.Errorf("setpoint %v°C outside [%v, %v]", v, setpointMin, setpointMax)
+		}
+	}
+	return sp, nil
+}
+
+// followsValue reports whether prefix ends in a number, optionally with a unit.
+func followsValue(prefix string) bool {
+	return valueSuffixPattern.MatchString(strings.TrimRight(prefix, " "))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// DeviceShadow is the desired configuration of a device next to the configuration it last reported.
+type DeviceShadow struct {
+	SenderID   string                 `json:"sender_id"`
+	Desired    map[string]interface{} `json:"desired"`
+	Reported   map[string]interface{} `json:"reported"`
+	Delta      map[string]interface{} `json:"delta"`
+	DesiredAt  *time.Time             `json:"desired_at,omitempty"`
+	ReportedAt *time.Time             `json:"reported_at,omitempty"`
+}
+
+// shadowDelta returns the desired keys whose value differs from (or is missing in) the reported config.
+func shadowDelta(desired, reported map[string]interface{}) map[string]interface{} {
+	delta := map[string]interface{}{}
+	for key, want := range desired {
+		if have, ok := reported[key]; !ok || !reflect.DeepEqual(want, have) {
+			delta[key] = want
+		}
+	}
+	return delta
+}
+
+func loadShadow(db *sql.DB, senderID string) (DeviceShadow, error) {
+	shadow := DeviceShadow{SenderID: senderID, Desired: map[string]interface{}{}, Reported: map[string]interface{}{}}
+	var desired, reported []byte
+	err := db.QueryRow("SELECT desired, reported, desired_at, reported_at FROM device_shadows WHERE sender_id = $1", senderID).
+		Scan(&desired, &reported, &shadow.DesiredAt, &shadow.ReportedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return shadow, fmt.Errorf("failed to load shadow: %v", err)
+	}
+	if len(desired) > 0 {
+		if err := json.Unmarshal(desired, &shadow.Desired); err != nil {
+			return shadow, fmt.Errorf("invalid desired config: %v", err)
+		}
+	}
+	if len(reported) > 0 {
+		if err := json.Unmarshal(reported, &shadow.Reported); err != nil {
+			return shadow, fmt.Errorf("invalid reported config: %v", err)
+		}
+	}
+	shadow.Delta = shadowDelta(shadow.Desired, shadow.Reported)
+	return shadow, nil
+}
+
+// setDesiredConfig merges config into the desired state; a null value removes the key.
+func setDesiredConfig(db *sql.DB, senderID string, config map[string]interface{}) error {
+	payload, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to marshal desired config: %v", err)
+	}
+	_, err = db.Exec(`INSERT INTO device_shadows (sender_id, desired, desired_at) VALUES ($1, jsonb_strip_nulls($2::jsonb), CURRENT_TIMESTAMP)
+        ON CONFLICT (sender_id) DO UPDATE SET desired = jsonb_strip_nulls(device_shadows.desired || $2::jsonb), desired_at = CURRENT_TIMESTAMP`,
+		senderID, string(payload))
+	if err != nil {
+		return fmt.Errorf("failed to store desired config: %v", err)
+	}
+	return nil
+}
+
+// setReportedConfig replaces the reported state with the configuration the device sent.
+func setReportedConfig(db *sql.DB, senderID string, config map[string]interface{}) error {
+	payload, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to marshal reported config: %v", err)
+	}
+	_, err = db.Exec(`INSERT INTO device_shadows (sender_id, reported, reported_at) VALUES ($1, $2::jsonb, CURRENT_TIMESTAMP)
+        ON CONFLICT (sender_id) DO UPDATE SET reported = EXCLUDED.reported, reported_at = CURRENT_TIMESTAMP`,
+		senderID, string(payload))
+	if err != nil {
+		return fmt.Errorf("failed to store reported config: %v", err)
+	}
+	return nil
+}
+
+// syncShadow pushes the desired keys the device has not yet reported as a SET_CONFIG command.
+func syncShadow(db *sql.DB, senderID string) error {
+	shadow, err := loadShadow(db, senderID)
+	if err != nil {
+		return fmt.Errorf("failed to load shadow: %v", err)
+	}
+	if len(shadow.Delta) == 0 {
+		return nil
+	}
+	log.Printf("Pushing desired config delta to %s: %v", senderID, shadow.Delta)
+	_, err = sendCommand(db, senderID, "SET_CONFIG", shadow.Delta, "")
+	return err
+}
+
+func init() {
+	RegisterHandler(HandleEvents(func(ctx context.Context, store Store, m DeviceMessage) {
+		handleReportedConfigEvent(store, m.SenderID, string(m.Payload))
+	}, "REPORTED_CONFIG"))
+}
+
+// Handel Reported Config
+func handleReportedConfigEvent(store Store, senderID, message string) {
+	var msgData map[string]interface{}
+	if err := json.Unmarshal([]byte(message), &msgData); err != nil {
+		log.Printf("Error unmarshalling reported config event message: %v", err)
+		return
+	}
+
+	config, ok := msgData["config"].(map[string]interface{})
+	if !ok {
+		log.Println("Error: 'config' field not found or not an object in msgData")
+		return
+	}
+
+	if err := store.SetReportedConfig(senderID, config); err != nil && err != errUnsupported {
+		log.Printf("Error saving reported config for %s: %v", senderID, err)
+	}
+}
+
+func handleGetShadow(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	shadow, err := loadShadow(db, r.PathValue("id"))
+	if err != nil {
+		log.Printf("Error loading shadow: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load shadow")
+		return
+	}
+	writeCachedJSON(w, r, shadow)
+}
+
+func handlePutDesired(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var config map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be a JSON object")
+		return
+	}
+	senderID := r.PathValue("id")
+	if err := setDesiredConfig(db, senderID, config); err != nil {
+		log.Printf("Error saving desired config: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to save desired config")
+		return
+	}
+	if err := syncShadow(db, senderID); err != nil {
+		log.Printf("Error pushing desired config to %s: %v", senderID, err)
+	}
+	handleGetShadow(db, w, r)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// Device sharding (SHARD_INDEX, SHARD_COUNT): every instance subscribes to the same
+// topics and processes only the senders that hash to its shard, so ingest scales out
+// without a shared subscription and no message is processed twice. Changing the shard
+// count moves devices between instances, which loses their in-memory event state unless
+// STATE_BACKEND=postgres.
+var (
+	shardIndex = 0
+	shardCount = 1
+)
+
+var messagesOtherShard = newCounterVec("collector_messages_other_shard_total", "Inbound messages skipped because their sender belongs to another shard, by topic kind.", "kind")
+
+func validateSharding(index, count int, sharedGroup string) error {
+	if count < 1 || index < 0 || index >= count {
+		return fmt.Errorf("SHARD_INDEX must be between 0 and SHARD_COUNT-1, got %d of %d", index, count)
+	}
+	if count > 1 && sharedGroup != "" {
+		// The broker would hand a message to one instance of the group, which drops it
+		// unless it happens to own the sender.
+		return fmt.Errorf("sharding cannot be combined with MQTT_SHARED_GROUP")
+	}
+	return nil
+}
+
+// ownsSender reports whether senderID belongs to this instance's shard. It uses a
+// 64-bit hash so that shard assignment does not correlate with the worker pool's
+// 32-bit per-sender hash, which would leave workers idle.
+func ownsSender(senderID string) bool {
+	if shardCount <= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(senderID))
+	return h.Sum64()%uint64(shardCount) == uint64(shardIndex)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// SIGNAL_QUALITY events report the radio conditions of the modem:
+//
+//	{"event": "SIGNAL_QUALITY", "timestamp": "1718000000", "message": {"rssi": -71, "rsrp": -98, "rsrq": -12, "sinr": 6}}
+//	{"event": "SIGNAL_QUALITY", "timestamp": "1718000000", "message": "rssi=-71,rsrp=-98,rsrq=-12,sinr=6"}
+//
+// Each metric is published as signal_<metric>_<sender>. LOW_SIGNAL (tag
+// low_signal_<sender>) is raised when a reported metric is below its minimum and
+// cleared once every reported metric is at least signalHysteresis above it.
+var signalMetrics = []string{"rssi", "rsrp", "rsrq", "sinr"}
+
+// signalMin is the lowest acceptable value per metric (SIGNAL_MIN_RSSI, ...), in dBm for
+// RSSI and RSRP and dB for RSRQ and SINR.
+var signalMin = map[string]float64{
+	"rssi": -100,
+	"rsrp": -110,
+	"rsrq": -15,
+	"sinr": 0,
+}
+
+var signalHysteresis = 3.0
+
+func handleSignalQualityEvent(store Store, messageStr, senderID, event, ingestID string, timestamp int64) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(messageStr), &payload); err != nil {
+		log.Printf("Error unmarshalling %s event message: %v", event, err)
+		return
+	}
+	readings := parseReadings(payload["message"])
+	var reported []string
+	for _, metric := range signalMetrics {
+		if value, ok := readings[metric]; ok {
+			publishReading(store, event, fmt.Sprintf("signal_%s_%s", metric, senderID), value, senderID, messageStr, ingestID, timestamp)
+			reported = append(reported, metric)
+		}
+	}
+	if len(reported) == 0 {
+		log.Printf("[%s] Ignoring %s event from %s: no rssi, rsrp, rsrq or sinr in %v", ingestID, event, senderID, payload["message"])
+		return
+	}
+
+	_, low := eventState.Load(senderID + "_LOW_SIGNAL")
+	margin := 0.0
+	if low {
+		margin = signalHysteresis
+	}
+	var below []string
+	for _, metric := range reported {
+		if readings[metric] < signalMin[metric]+margin {
+			below = append(below, metric)
+		}
+	}
+	setDerivedAlarm(store, "LOW_SIGNAL", fmt.Sprintf("low_signal_%s", senderID), len(below) > 0,
+		map[string]interface{}{"readings": readings, "below": strings.Join(below, ",")}, senderID, ingestID, timestamp)
+}
+
+func init() {
+	RegisterHandler(HandleEvents(func(ctx context.Context, store Store, m DeviceMessage) {
+		handleSignalQualityEvent(store, string(m.Payload), m.SenderID, m.Event, m.IngestID, m.Timestamp)
+	}, "SIGNAL_QUALITY"))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Heartbeat watchdog. A dead modem sends nothing, so its silence has to be noticed by
+// the collector: every silentCheckInterval, devices whose device_state.last_seen is
+// older than silentAfter get DEVICE_SILENT (value 1, tag device_silent_<sender>), and
+// devices that were silent and have been seen again get the clear (value 0), stamped
+// with the time they were seen. device_state.silent_since records the raised alarm, and
+// each change is claimed by a single UPDATE so only one collector instance publishes it.
+// The datapoints go through the alarm debounce.
+var (
+	silentAfter         time.Duration // DEVICE_SILENT_AFTER, 0 disables the watchdog
+	silentCheckInterval = time.Minute // DEVICE_SILENT_CHECK_INTERVAL
+)
+
+var silenceChanges = newCounterVec("collector_device_silent_changes_total", "DEVICE_SILENT alarms published by the heartbeat watchdog, by change.", "change")
+
+func startSilenceWatchdog(db *sql.DB) {
+	if silentAfter <= 0 || silentCheckInterval <= 0 {
+		return
+	}
+	log.Printf("Raising DEVICE_SILENT for devices not seen for %v", silentAfter)
+	go func() {
+		for {
+			<-clock.After(silentCheckInterval)
+			checkSilentDevices(db)
+		}
+	}()
+}
+
+// checkSilentDevices clears the alarm of devices seen again, then raises it for devices
+// that went silent.
+func checkSilentDevices(db *sql.DB) {
+	now := clock.Now()
+	cleared, err := claimSilenceChanges(db, `UPDATE device_state SET silent_since = NULL
+        WHERE silent_since IS NOT NULL AND last_seen > silent_since RETURNING sender_id, last_seen`)
+	if err != nil {
+		log.Printf("Error clearing silent devices: %v", err)
+	}
+	for senderID, lastSeen := range cleared {
+		publishSilence(senderID, false, lastSeen, lastSeen)
+	}
+	raised, err := claimSilenceChanges(db, `UPDATE device_state SET silent_since = last_seen
+        WHERE silent_since IS NULL AND last_seen < $1 RETURNING sender_id, last_seen`, now.Add(-silentAfter))
+	if err != nil {
+		log.Printf("Error checking for silent devices: %v", err)
+	}
+	for senderID, lastSeen := range raised {
+		publishSilence(senderID, true, lastSeen, now)
+	}
+}
+
+// claimSilenceChanges runs an UPDATE of silent_since and returns the last_seen of each
+// device it changed.
+func claimSilenceChanges(db *sql.DB, query string, args ...interface{}) (map[string]time.Time, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changed := map[string]time.Time{}
+	for rows.Next() {
+		var senderID string
+		var lastSeen time.Time
+		if err := rows.Scan(&senderID, &lastSeen); err != nil {
+			return changed, err
+		}
+		changed[senderID] = lastSeen
+	}
+	return changed, rows.Err()
+}
+
+func publishSilence(senderID string, silent bool, lastSeen, at time.Time) {
+	value, change := 0, "cleared"
+	if silent {
+		value, change = 1, "raised"
+	}
+	detail, _ := json.Marshal(map[string]interface{}{"last_seen": lastSeen, "silent_after": silentAfter.String()})
+	data := EventMessage{
+		EventName: "DEVICE_SILENT",
+		Tag:       fmt.Sprintf("device_silent_%s", senderID),
+		Value:     value,
+		Status:    true,
+		Msg:       string(detail),
+		Time:      at.UnixMilli(),
+		Sumber:    senderID,
+		IngestID:  newUUID(),
+	}
+	log.Printf("[%s] DEVICE_SILENT %s for %s, last seen %s", data.IngestID, change, senderID, lastSeen.Format(time.RFC3339))
+	silenceChanges.Inc(change)
+	processAndSaveData(eventStore, data)
+	alarmGate.publish(data)
+}
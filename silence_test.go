@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// useSilenceWatchdog sets silentAfter, publishes straight to a recording broker and
+// does not store the DEVICE_SILENT events.
+func useSilenceWatchdog(t *testing.T, after time.Duration) *recordingBroker {
+	t.Helper()
+	savedAfter, savedRoutes, savedDebounce, savedFlap := silentAfter, storageRoutes, alarmDebounce, flapWindow
+	silentAfter, storageRoutes, alarmDebounce, flapWindow = after, map[string]string{"DEVICE_SILENT": ""}, 0, 0
+	t.Cleanup(func() { silentAfter, storageRoutes, alarmDebounce, flapWindow = savedAfter, savedRoutes, savedDebounce, savedFlap })
+	return captureBroker(t)
+}
+
+func TestCheckSilentDevices(t *testing.T) {
+	c := useFakeClock(t)
+	b := useSilenceWatchdog(t, 10*time.Minute)
+	db, mock := mockDB(t)
+	start := c.Now()
+	seenAgain := start.Add(-time.Minute)
+
+	// Nothing is old enough at first; the cutoff follows the clock.
+	mock.ExpectQuery(`UPDATE device_state SET silent_since = NULL`).
+		WillReturnRows(sqlmock.NewRows([]string{"sender_id", "last_seen"}))
+	mock.ExpectQuery(`UPDATE device_state SET silent_since = last_seen`).WithArgs(start.Add(-10 * time.Minute)).
+		WillReturnRows(sqlmock.NewRows([]string{"sender_id", "last_seen"}))
+	checkSilentDevices(db)
+	if got := b.Messages("DATAPOINTS"); len(got) != 0 {
+		t.Fatalf("published %d datapoints with no silent devices", len(got))
+	}
+
+	c.Advance(time.Hour)
+	now := c.Now()
+	mock.ExpectQuery(`UPDATE device_state SET silent_since = NULL`).
+		WillReturnRows(sqlmock.NewRows([]string{"sender_id", "last_seen"}).AddRow("modem-2", seenAgain))
+	mock.ExpectQuery(`UPDATE device_state SET silent_since = last_seen`).WithArgs(now.Add(-10 * time.Minute)).
+		WillReturnRows(sqlmock.NewRows([]string{"sender_id", "last_seen"}).AddRow("modem-1", start))
+	checkSilentDevices(db)
+
+	published := map[string]map[string]interface{}{}
+	for _, m := range b.Messages("DATAPOINTS") {
+		var payload map[string]interface{}
+		if err := json.Unmarshal(m.Payload, &payload); err != nil {
+			t.Fatal(err)
+		}
+		published[payload["tag"].(string)] = payload
+	}
+	tests := []struct {
+		tag   string
+		value float64
+		at    time.Time
+	}{
+		{"device_silent_modem-1", 1, now},
+		{"device_silent_modem-2", 0, seenAgain},
+	}
+	for _, tt := range tests {
+		p, ok := published[tt.tag]
+		if !ok {
+			t.Errorf("%s not published; got %v", tt.tag, published)
+			continue
+		}
+		if p["value"] != tt.value || p["event"] != "DEVICE_SILENT" {
+			t.Errorf("%s = %v %v, want DEVICE_SILENT %v", tt.tag, p["event"], p["value"], tt.value)
+		}
+		if p["time"] != float64(tt.at.UnixMilli()) {
+			t.Errorf("%s time = %v, want %d", tt.tag, p["time"], tt.at.UnixMilli())
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// SIM_INFO and NETWORK_STATUS events report the SIM in the modem and the network it is
+// registered on:
+//
+//	{"event": "SIM_INFO", "timestamp": "1718000000", "message": {"iccid": "8962100000000000001", "imsi": "510100000000001"}}
+//	{"event": "NETWORK_STATUS", "timestamp": "1718000000", "message": "operator=Telkomsel;rat=LTE;band=B3;cell_id=1A2B3C"}
+//
+// The latest values are kept in the devices registry, only replaced by a newer report,
+// so GET /api/v1/devices?iccid=... tells which modem a SIM is in. The events are also
+// stored and published on sim_<sender> and network_<sender>.
+
+// DeviceSIM is the SIM a device last reported.
+type DeviceSIM struct {
+	ICCID      string    `json:"iccid,omitempty"`
+	IMSI       string    `json:"imsi,omitempty"`
+	ReportedAt time.Time `json:"reported_at"`
+}
+
+// DeviceNetwork is the network registration a device last reported.
+type DeviceNetwork struct {
+	Operator   string    `json:"operator,omitempty"`
+	RAT        string    `json:"rat,omitempty"` // radio access technology, e.g. LTE
+	Band       string    `json:"band,omitempty"`
+	CellID     string    `json:"cell_id,omitempty"`
+	ReportedAt time.Time `json:"reported_at"`
+}
+
+// firstField returns the first of the names present in fields, or "".
+func firstField(fields map[string]string, names ...string) string {
+	for _, name := range names {
+		if v := fields[name]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// setDeviceSIM records the SIM a device reported at a time, unless a newer report is
+// already stored.
+func setDeviceSIM(db *sql.DB, senderID string, sim DeviceSIM, at time.Time) error {
+	_, err := db.Exec(`INSERT INTO devices (sender_id, iccid, imsi, sim_at) VALUES ($1, $2, $3, $4)
+        ON CONFLICT (sender_id) DO UPDATE SET iccid = COALESCE(EXCLUDED.iccid, devices.iccid),
+            imsi = COALESCE(EXCLUDED.imsi, devices.imsi), sim_at = EXCLUDED.sim_at
+        WHERE devices.sim_at IS NULL OR devices.sim_at <= EXCLUDED.sim_at`,
+		senderID, nullIfEmpty(sim.ICCID), nullIfEmpty(sim.IMSI), at)
+	if err != nil {
+		return err
+	}
+	knownDevices.Store(senderID, struct{}{})
+	return nil
+}
+
+// setDeviceNetwork records the network a device reported at a time, unless a newer
+// report is already stored.
+func setDeviceNetwork(db *sql.DB, senderID string, network DeviceNetwork, at time.Time) error {
+	_, err := db.Exec(`INSERT INTO devices (sender_id, operator, rat, band, cell_id, network_at) VALUES ($1, $2, $3, $4, $5, $6)
+        ON CONFLICT (sender_id) DO UPDATE SET operator = COALESCE(EXCLUDED.operator, devices.operator),
+            rat = COALESCE(EXCLUDED.rat, devices.rat), band = COALESCE(EXCLUDED.band, devices.band),
+            cell_id = COALESCE(EXCLUDED.cell_id, devices.cell_id), network_at = EXCLUDED.network_at
+        WHERE devices.network_at IS NULL OR devices.network_at <= EXCLUDED.network_at`,
+		senderID, nullIfEmpty(network.Operator), nullIfEmpty(network.RAT), nullIfEmpty(network.Band), nullIfEmpty(network.CellID), at)
+	if err != nil {
+		return err
+	}
+	knownDevices.Store(senderID, struct{}{})
+	return nil
+}
+
+func handleSIMEvent(store Store, messageStr, senderID, event, ingestID string, timestamp int64) {
+	dec := json.NewDecoder(strings.NewReader(messageStr))
+	dec.UseNumber() // ICCIDs and IMSIs sent as numbers do not fit a float64
+	var payload map[string]interface{}
+	if err := dec.Decode(&payload); err != nil {
+		log.Printf("Error unmarshalling %s event message: %v", event, err)
+		return
+	}
+	fields := parseFields(payload["message"])
+	at := time.UnixMilli(timestamp)
+
+	var tag string
+	var err error
+	switch event {
+	case "SIM_INFO":
+		sim := DeviceSIM{ICCID: firstField(fields, "iccid", "ccid"), IMSI: firstField(fields, "imsi")}
+		if sim.ICCID == "" && sim.IMSI == "" {
+			log.Printf("[%s] Ignoring %s event from %s: no iccid or imsi in %v", ingestID, event, senderID, payload["message"])
+			return
+		}
+		tag = "sim"
+		err = store.SetDeviceSIM(senderID, sim, at)
+	case "NETWORK_STATUS":
+		network := DeviceNetwork{
+			Operator: firstField(fields, "operator", "oper", "network"),
+			RAT:      firstField(fields, "rat", "act", "technology"),
+			Band:     firstField(fields, "band"),
+			CellID:   firstField(fields, "cell_id", "cellid", "ci", "cid"),
+		}
+		if network == (DeviceNetwork{}) {
+			log.Printf("[%s] Ignoring %s event from %s: no operator, rat, band or cell_id in %v", ingestID, event, senderID, payload["message"])
+			return
+		}
+		tag = "network"
+		err = store.SetDeviceNetwork(senderID, network, at)
+	}
+	if err != nil {
+		log.Printf("[%s] Error updating the registry with %s from %s: %v", ingestID, event, senderID, err)
+	}
+
+	data := EventMessage{
+		EventName: event,
+		Tag:       fmt.Sprintf("%s_%s", tag, senderID),
+		Value:     fields,
+		Status:    true,
+		Msg:       messageStr,
+		Time:      timestamp,
+		Sumber:    senderID,
+		IngestID:  ingestID,
+	}
+	processAndSaveData(store, data)
+	sendDataPoint(data)
+}
+
+func init() {
+	RegisterHandler(HandleEvents(func(ctx context.Context, store Store, m DeviceMessage) {
+		handleSIMEvent(store, string(m.Payload), m.SenderID, m.Event, m.IngestID, m.Timestamp)
+	}, "SIM_INFO", "NETWORK_STATUS"))
+}
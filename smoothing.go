@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// temperatureEMAAlpha is the weight of the newest reading in the smoothed temperature.
+// 0 disables the TEMPERATURE_SMOOTHED datapoint; 1 would publish the raw value again.
+var temperatureEMAAlpha float64
+
+// temperatureEMA holds the last smoothed temperature per sender ID.
+var temperatureEMA sync.Map
+
+// smoothTemperature folds value into the sender's exponential moving average and returns it.
+// The first reading of a device seeds the average.
+func smoothTemperature(senderID string, value float64) float64 {
+	smoothed := value
+	if prev, ok := temperatureEMA.Load(senderID); ok {
+		smoothed = temperatureEMAAlpha*value + (1-temperatureEMAAlpha)*prev.(float64)
+	}
+	temperatureEMA.Store(senderID, smoothed)
+	return smoothed
+}
+
+// numericValue converts a reading that devices send either as a JSON number or as a string.
+func numericValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// publishSmoothedTemperature publishes the EMA of a raw temperature datapoint alongside it.
+func publishSmoothedTemperature(raw EventMessage) {
+	if temperatureEMAAlpha <= 0 {
+		return
+	}
+	value, ok := numericValue(raw.Value)
+	if !ok {
+		return
+	}
+	smoothed := raw
+	smoothed.EventName = "TEMPERATURE_SMOOTHED"
+	smoothed.Tag = fmt.Sprintf("temperature_ema_%s", raw.Sumber)
+	smoothed.Value = smoothTemperature(raw.Sumber, value)
+	sendDataPoint(smoothed)
+}
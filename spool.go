@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Spool record kinds, one per sink.
+const (
+	spoolDatabase = "db"
+	spoolPublish  = "publish"
+)
+
+var spoolDropped = newCounterVec("collector_spool_dropped_total", "Records that could not be written to the store-and-forward spool.", "kind")
+
+// spoolRecord is one undelivered write, stored as a JSON line.
+type spoolRecord struct {
+	Kind     string          `json:"kind"`
+	IngestID string          `json:"ingest_id,omitempty"`
+	Event    *EventMessage   `json:"event,omitempty"`
+	Topic    string          `json:"topic,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+}
+
+// spool is an append-only file of writes that failed because the database or the broker
+// was unavailable. A background loop replays it in order once the sinks recover.
+type spool struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	store    Store
+}
+
+var outbox *spool // nil when store-and-forward is disabled
+
+func newSpool(dir string, maxBytes int64, store Store) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %v", err)
+	}
+	return &spool{path: filepath.Join(dir, "spool.jsonl"), maxBytes: maxBytes, store: store}, nil
+}
+
+// Append persists rec at the end of the spool. It is safe to call on a nil spool.
+func (s *spool) Append(rec spoolRecord) {
+	if s == nil {
+		spoolDropped.Inc(rec.Kind)
+		return
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Failed to marshal spool record: %v", err)
+		spoolDropped.Inc(rec.Kind)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if info, err := os.Stat(s.path); err == nil && s.maxBytes > 0 && info.Size()+int64(len(line)) > s.maxBytes {
+		log.Printf("Spool %s is full (%d bytes), dropping %s record", s.path, info.Size(), rec.Kind)
+		spoolDropped.Inc(rec.Kind)
+		return
+	}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("Failed to open spool: %v", err)
+		spoolDropped.Inc(rec.Kind)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write spool: %v", err)
+		spoolDropped.Inc(rec.Kind)
+		return
+	}
+	log.Printf("[%s] Spooled undelivered %s record", rec.IngestID, rec.Kind)
+}
+
+// Replay delivers spooled records in order and stops at the first one that still fails,
+// keeping it and everything after it for the next attempt.
+func (s *spool) Replay() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to open spool for replay: %v", err)
+		return
+	}
+
+	var remaining [][]byte
+	delivered := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := append([]byte(nil), scanner.Bytes()...)
+		if len(remaining) > 0 {
+			remaining = append(remaining, line)
+			continue
+		}
+		var rec spoolRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			log.Printf("Discarding corrupt spool record: %v", err)
+			continue
+		}
+		if err := s.deliver(rec); err != nil {
+			log.Printf("[%s] Spool replay paused, %s sink still failing: %v", rec.IngestID, rec.Kind, err)
+			remaining = append(remaining, line)
+			continue
+		}
+		delivered++
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		log.Printf("Failed to read spool: %v", err)
+		return
+	}
+	if delivered == 0 && len(remaining) > 0 {
+		return
+	}
+
+	if len(remaining) == 0 {
+		if err := os.Remove(s.path); err != nil {
+			log.Printf("Failed to remove drained spool: %v", err)
+		}
+	} else if err := writeLines(s.path, remaining); err != nil {
+		log.Printf("Failed to rewrite spool: %v", err)
+	}
+	log.Printf("Replayed %d spooled records, %d remaining", delivered, len(remaining))
+}
+
+func (s *spool) deliver(rec spoolRecord) error {
+	switch rec.Kind {
+	case spoolDatabase:
+		if rec.Event == nil {
+			return nil
+		}
+		// One attempt per replay round; the replay interval is the backoff.
+		err := withDBRetry(1, func() error { return s.store.SaveEvent(*rec.Event) })
+		if err != nil && permanentDBError(err) && deadLetterEvent(s.store, *rec.Event, err) {
+			return nil
+		}
+		return err
+	case spoolPublish:
+		// Only DATAPOINTS publishes are spooled.
+		return mqttClient.PublishWithExpiry(rec.Topic, mqttPublishQoS, mqttRetain, []byte(rec.Payload), datapointExpiry)
+	default:
+		log.Printf("Discarding spool record of unknown kind %q", rec.Kind)
+		return nil
+	}
+}
+
+// writeLines atomically replaces path with lines.
+func writeLines(path string, lines [][]byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, line := range lines {
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// startReplay retries the spool every interval for as long as the collector runs.
+func (s *spool) startReplay(interval time.Duration) {
+	go func() {
+		for {
+			<-clock.After(interval)
+			s.Replay()
+		}
+	}()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLite migrations mirror the Postgres ones for the tables an edgeStore keeps, in
+// SQLite types.
+//
+//go:embed migrations/sqlite/*.sql
+var sqliteMigrationFiles embed.FS
+
+// sqliteDialect is the SQL of DB_DRIVER=sqlite.
+type sqliteDialect struct{}
+
+func (sqliteDialect) migrations() (fs.FS, string) {
+	return sqliteMigrationFiles, "migrations/sqlite"
+}
+
+// lockMigrations does nothing: an SQLite file belongs to a single collector.
+func (sqliteDialect) lockMigrations(ctx context.Context, conn *sql.Conn) (func(), error) {
+	return func() {}, nil
+}
+
+func (sqliteDialect) insertIgnore(table string, columns ...string) string {
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT DO NOTHING",
+		table, strings.Join(columns, ", "), placeholders(len(columns)))
+}
+
+func (sqliteDialect) upsertDevice(at string, columns ...string) string {
+	set := make([]string, 0, len(columns)+1)
+	for _, c := range columns {
+		set = append(set, fmt.Sprintf("%s = COALESCE(excluded.%s, devices.%s)", c, c, c))
+	}
+	set = append(set, fmt.Sprintf("%s = excluded.%s", at, at))
+	all := append(append([]string{"sender_id"}, columns...), at)
+	return fmt.Sprintf(`INSERT INTO devices (%s) VALUES (%s)
+        ON CONFLICT (sender_id) DO UPDATE SET %s
+        WHERE devices.%s IS NULL OR devices.%s <= excluded.%s`,
+		strings.Join(all, ", "), placeholders(len(all)), strings.Join(set, ", "), at, at, at)
+}
+
+// openSQLite opens the database file at path in WAL mode, so that readers such as
+// --export do not block the pipeline's writes. Transactions take the write lock when
+// they begin and wait up to busy_timeout for it, instead of failing with SQLITE_BUSY
+// when two workers upgrade a read to a write at the same time.
+func openSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	var mode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if mode != "wal" {
+		db.Close()
+		return nil, fmt.Errorf("%s is in %s journal mode, WAL could not be enabled", path, mode)
+	}
+	log.Printf("Opened SQLite database %s", path)
+	return db, nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// stateStore holds the per-device event flags used by the combined-condition logic.
+// Values are bool flags, or int64 epoch milliseconds for rule facts (see rules.go).
+// Its method set matches sync.Map.
+type stateStore interface {
+	Load(key interface{}) (value interface{}, ok bool)
+	Store(key, value interface{})
+	Delete(key interface{})
+}
+
+// Entries not updated for stateTTL are treated as absent and swept, so flags of devices
+// that disappeared do not linger in combined conditions; at most stateMaxEntries are
+// kept, the least recently updated being evicted first. Zero disables either limit.
+var (
+	stateTTL        time.Duration
+	stateMaxEntries int
+)
+
+var stateEvictions = newCounterVec("collector_event_state_evictions_total", "Event state entries removed because they expired or the state was full, by reason.", "reason")
+
+func init() {
+	newGaugeFunc("collector_event_state_entries", "Event state entries held.", func() float64 {
+		switch s := eventState.(type) {
+		case *memoryState:
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return float64(len(s.entries))
+		case *postgresState:
+			var n int
+			if err := s.db.QueryRow("SELECT count(*) FROM event_state").Scan(&n); err != nil {
+				log.Printf("Error counting event state: %v", err)
+			}
+			return float64(n)
+		}
+		return 0
+	})
+}
+
+// stateCutoff is the update time before which entries have expired.
+func stateCutoff() time.Time {
+	if stateTTL <= 0 {
+		return time.Time{}
+	}
+	return clock.Now().Add(-stateTTL)
+}
+
+// memoryState keeps event flags in process memory. With a database (the cached
+// backend) it writes every change through to event_state and reloads the table on
+// startup, so a device that went on backup power before a restart still raises
+// POWER_PLN after it; only one instance may use it, since the others would not see its
+// changes.
+type memoryState struct {
+	mu      sync.Mutex
+	entries map[string]stateEntry
+	db      *sql.DB // nil for the memory backend
+}
+
+type stateEntry struct {
+	value   interface{}
+	updated time.Time
+}
+
+func newMemoryState() *memoryState {
+	return &memoryState{entries: map[string]stateEntry{}}
+}
+
+func newCachedState(db *sql.DB) (*memoryState, error) {
+	rows, err := db.Query("SELECT key, value, since_ms, updated_at FROM event_state WHERE updated_at > $1", stateCutoff())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load event state: %v", err)
+	}
+	defer rows.Close()
+	s := newMemoryState()
+	s.db = db
+	for rows.Next() {
+		var key string
+		var value bool
+		var since sql.NullInt64
+		var updated time.Time
+		if err := rows.Scan(&key, &value, &since, &updated); err != nil {
+			return nil, fmt.Errorf("failed to scan event state: %v", err)
+		}
+		entry := stateEntry{value: value, updated: updated}
+		if since.Valid {
+			entry.value = since.Int64
+		}
+		s.entries[key] = entry
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load event state: %v", err)
+	}
+	log.Printf("Loaded %d event state flags", len(s.entries))
+	if stateMaxEntries > 0 && len(s.entries) > stateMaxEntries {
+		s.forget(s.evictOldest(), "capacity")
+	}
+	return s, nil
+}
+
+func (s *memoryState) Load(key interface{}) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[fmt.Sprint(key)]
+	if !ok || entry.updated.Before(stateCutoff()) {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (s *memoryState) Store(key, value interface{}) {
+	s.cache(stateChange{key: fmt.Sprint(key), value: value})
+	if s.db != nil {
+		if err := storeEventState(s.db, fmt.Sprint(key), value); err != nil {
+			log.Printf("Error storing event state %v: %v", key, err)
+		}
+	}
+}
+
+func (s *memoryState) Delete(key interface{}) {
+	s.cache(stateChange{key: fmt.Sprint(key), delete: true})
+	if s.db != nil {
+		if err := deleteEventState(s.db, fmt.Sprint(key)); err != nil {
+			log.Printf("Error deleting event state %v: %v", key, err)
+		}
+	}
+}
+
+// cache applies a change to memory only; combined writes use it for changes they
+// already stored in event_state.
+func (s *memoryState) cache(c stateChange) {
+	s.mu.Lock()
+	if c.delete {
+		delete(s.entries, c.key)
+		s.mu.Unlock()
+		return
+	}
+	_, exists := s.entries[c.key]
+	s.entries[c.key] = stateEntry{value: c.value, updated: clock.Now()}
+	var evicted []string
+	if !exists && stateMaxEntries > 0 && len(s.entries) > stateMaxEntries {
+		evicted = s.evictOldest()
+	}
+	s.mu.Unlock()
+	s.forget(evicted, "capacity")
+}
+
+// evictOldest removes the least recently updated tenth of the entries, so a full state
+// does not sort on every store, but always keeps the newest one. s.mu must be held.
+func (s *memoryState) evictOldest() []string {
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return s.entries[keys[i]].updated.Before(s.entries[keys[j]].updated) })
+	keys = keys[:len(keys)-max(1, stateMaxEntries*9/10)]
+	for _, key := range keys {
+		delete(s.entries, key)
+	}
+	return keys
+}
+
+// forget counts removed entries and deletes them from event_state as well.
+func (s *memoryState) forget(keys []string, reason string) {
+	if len(keys) == 0 {
+		return
+	}
+	stateEvictions.Add(reason, float64(len(keys)))
+	log.Printf("Removed %d event state entries (%s)", len(keys), reason)
+	if s.db != nil {
+		if _, err := s.db.Exec("DELETE FROM event_state WHERE key = ANY($1)", pq.Array(keys)); err != nil {
+			log.Printf("Error deleting event state: %v", err)
+		}
+	}
+}
+
+func (s *memoryState) sweep() {
+	cutoff := stateCutoff()
+	var expired []string
+	s.mu.Lock()
+	for key, entry := range s.entries {
+		if entry.updated.Before(cutoff) {
+			delete(s.entries, key)
+			expired = append(expired, key)
+		}
+	}
+	s.mu.Unlock()
+	s.forget(expired, "expired")
+}
+
+// postgresState keeps event flags in the event_state table so that every collector
+// instance in a shared subscription group sees the same per-device state. Combined
+// writes lock the sender while they read and update its flags (see combinedWrite).
+type postgresState struct {
+	db *sql.DB
+}
+
+func (s *postgresState) Load(key interface{}) (interface{}, bool) {
+	return loadEventState(s.db, key)
+}
+
+// loadEventState reads a flag from event_state, in q's transaction if it is one.
+func loadEventState(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, key interface{}) (interface{}, bool) {
+	var value bool
+	var since sql.NullInt64
+	err := q.QueryRow("SELECT value, since_ms FROM event_state WHERE key = $1 AND updated_at > $2", fmt.Sprint(key), stateCutoff()).Scan(&value, &since)
+	if err == sql.ErrNoRows {
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error loading event state %v: %v", key, err)
+		return nil, false
+	}
+	if since.Valid {
+		return since.Int64, true
+	}
+	return value, true
+}
+
+func (s *postgresState) Store(key, value interface{}) {
+	if err := storeEventState(s.db, fmt.Sprint(key), value); err != nil {
+		log.Printf("Error storing event state %v: %v", key, err)
+	}
+}
+
+func (s *postgresState) Delete(key interface{}) {
+	if err := deleteEventState(s.db, fmt.Sprint(key)); err != nil {
+		log.Printf("Error deleting event state %v: %v", key, err)
+	}
+}
+
+func (s *postgresState) sweep() {
+	if stateTTL > 0 {
+		res, err := s.db.Exec("DELETE FROM event_state WHERE updated_at <= $1", stateCutoff())
+		if err != nil {
+			log.Printf("Error sweeping event state: %v", err)
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			stateEvictions.Add("expired", float64(n))
+			log.Printf("Removed %d event state entries (expired)", n)
+		}
+	}
+	if stateMaxEntries > 0 {
+		res, err := s.db.Exec(`DELETE FROM event_state WHERE key IN (
+            SELECT key FROM event_state ORDER BY updated_at DESC OFFSET $1)`, stateMaxEntries)
+		if err != nil {
+			log.Printf("Error evicting event state: %v", err)
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			stateEvictions.Add("capacity", float64(n))
+			log.Printf("Removed %d event state entries (capacity)", n)
+		}
+	}
+}
+
+// startStateSweep removes expired and excess entries every interval.
+func startStateSweep(state stateStore, interval time.Duration) {
+	s, ok := state.(interface{ sweep() })
+	if !ok || interval <= 0 || (stateTTL <= 0 && stateMaxEntries <= 0) {
+		return
+	}
+	go func() {
+		for {
+			<-clock.After(interval)
+			s.sweep()
+		}
+	}()
+}
+
+// storeEventState stores a bool flag, or an int64 rule fact as a true flag with its time.
+func storeEventState(db eventsExecer, key string, value interface{}) error {
+	var flag bool
+	var since sql.NullInt64
+	switch v := value.(type) {
+	case bool:
+		flag = v
+	case int64:
+		flag, since = true, sql.NullInt64{Int64: v, Valid: true}
+	default:
+		return fmt.Errorf("unsupported event state value %v (%T)", value, value)
+	}
+	_, err := db.Exec(`INSERT INTO event_state (key, value, since_ms, updated_at) VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
+        ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, since_ms = EXCLUDED.since_ms, updated_at = EXCLUDED.updated_at`, key, flag, since)
+	return err
+}
+
+func deleteEventState(db eventsExecer, key string) error {
+	_, err := db.Exec("DELETE FROM event_state WHERE key = $1", key)
+	return err
+}
+
+// persistedState reports whether eventState is stored in event_state, so that combined
+// writes store their state changes in their own transaction.
+func persistedState() bool {
+	switch s := eventState.(type) {
+	case *postgresState:
+		return true
+	case *memoryState:
+		return s.db != nil
+	}
+	return false
+}
+
+// newStateStore selects the event state backend; "postgres" is required when several instances share a subscription.
+func newStateStore(db *sql.DB, backend string) (stateStore, error) {
+	if db == nil && (backend == "cached" || backend == "postgres") {
+		return nil, fmt.Errorf("the %s state backend needs DB_DRIVER=postgres", backend)
+	}
+	switch backend {
+	case "memory":
+		return newMemoryState(), nil
+	case "cached":
+		return newCachedState(db)
+	case "postgres":
+		return &postgresState{db: db}, nil
+	default:
+		return nil, fmt.Errorf("unknown state backend %q", backend)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// useStateLimits sets stateTTL and stateMaxEntries for the test.
+func useStateLimits(t *testing.T, ttl time.Duration, maxEntries int) {
+	t.Helper()
+	savedTTL, savedMax := stateTTL, stateMaxEntries
+	stateTTL, stateMaxEntries = ttl, maxEntries
+	t.Cleanup(func() { stateTTL, stateMaxEntries = savedTTL, savedMax })
+}
+
+func TestMemoryStateTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		elapsed time.Duration
+		want    bool
+	}{
+		{"fresh", time.Hour, 0, true},
+		{"at the TTL", time.Hour, time.Hour, true},
+		{"after the TTL", time.Hour, time.Hour + time.Nanosecond, false},
+		{"no TTL", 0, 365 * 24 * time.Hour, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := useFakeClock(t)
+			useStateLimits(t, tt.ttl, 0)
+			s := newMemoryState()
+			s.Store("m-1_BACKUP_POWER", true)
+			c.Advance(tt.elapsed)
+			if _, got := s.Load("m-1_BACKUP_POWER"); got != tt.want {
+				t.Errorf("Load after %v = %v, want %v", tt.elapsed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryStateStoreRefreshesTTL(t *testing.T) {
+	c := useFakeClock(t)
+	useStateLimits(t, time.Hour, 0)
+	s := newMemoryState()
+	s.Store("m-1_BACKUP_POWER", true)
+	c.Advance(45 * time.Minute)
+	s.Store("m-1_BACKUP_POWER", true)
+	c.Advance(45 * time.Minute)
+	if _, ok := s.Load("m-1_BACKUP_POWER"); !ok {
+		t.Error("flag stored again within the TTL expired")
+	}
+}
+
+func TestStateSweepRemovesExpired(t *testing.T) {
+	c := useFakeClock(t)
+	useStateLimits(t, time.Hour, 0)
+	s := newMemoryState()
+	s.Store("m-1_BACKUP_POWER", true)
+	c.Advance(30 * time.Minute)
+	s.Store("m-2_BACKUP_POWER", true)
+
+	startStateSweep(s, 10*time.Minute)
+	size := func() int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.entries)
+	}
+	for i := 0; i < 3; i++ {
+		eventually(t, "the sweep to wait", func() bool { return c.timers() == 1 })
+		c.Advance(10 * time.Minute)
+	}
+	eventually(t, "the sweep to wait", func() bool { return c.timers() == 1 })
+	if n := size(); n != 2 {
+		t.Fatalf("sweep at the TTL left %d entries, want 2", n)
+	}
+
+	c.Advance(10 * time.Minute)
+	eventually(t, "the sweep to drop the expired flag", func() bool { return size() == 1 })
+	eventually(t, "the sweep to wait again", func() bool { return c.timers() == 1 })
+	if _, ok := s.Load("m-2_BACKUP_POWER"); !ok {
+		t.Error("sweep dropped the flag that had not expired")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const defaultEventTable = "mqtt_data"
+
+// storageRoutes maps an event name to the table it is stored in; an empty table means
+// the event is not stored at all. Events without a route go to the "*" route or mqtt_data.
+var storageRoutes = map[string]string{}
+
+var tableNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// parseStorageRoutes parses EVENT_STORAGE, a comma-separated list of EVENT=table pairs
+// where table "off" disables storage, e.g. "GEOLOCATION=off,TEMPERATURE=temperature_data,*=mqtt_data".
+func parseStorageRoutes(spec string) (map[string]string, error) {
+	routes := map[string]string{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		event, table, ok := strings.Cut(entry, "=")
+		event, table = strings.TrimSpace(event), strings.ToLower(strings.TrimSpace(table))
+		if !ok || event == "" || table == "" {
+			return nil, fmt.Errorf("invalid route %q, expected EVENT=table", entry)
+		}
+		if table == "off" {
+			routes[event] = ""
+			continue
+		}
+		if !tableNamePattern.MatchString(table) {
+			return nil, fmt.Errorf("invalid table name %q for %s", table, event)
+		}
+		routes[event] = table
+	}
+	return routes, nil
+}
+
+// storageTable returns the table an event is written to and false when storage is disabled for it.
+func storageTable(event string) (string, bool) {
+	table, ok := storageRoutes[event]
+	if !ok {
+		table, ok = storageRoutes["*"]
+	}
+	if !ok {
+		return defaultEventTable, true
+	}
+	return table, table != ""
+}
+
+// ensureRouteTables creates every routed table with the same layout as mqtt_data. The
+// tables depend on EVENT_STORAGE, so they cannot be embedded migrations; they are
+// created after the migrations, in one transaction under the migration lock so
+// collectors starting together do not race on the DDL. Tables created before
+// mqtt_data had its sender_id/timestamp index then get it, built concurrently.
+func ensureRouteTables(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("failed to lock schema: %v", err)
+	}
+	var routed, tables []string
+	for event, table := range storageRoutes {
+		if table == "" || table == defaultEventTable {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (LIKE %s INCLUDING ALL)", table, defaultEventTable)); err != nil {
+			return fmt.Errorf("failed to create table %s for %s: %v", table, event, err)
+		}
+		// Tables created before a column or index was added to mqtt_data need it too.
+		if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS ingest_id TEXT", table)); err != nil {
+			return fmt.Errorf("failed to migrate table %s for %s: %v", table, event, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_ingest_id_idx ON %s (ingest_id)", table, table)); err != nil {
+			return fmt.Errorf("failed to index table %s for %s: %v", table, event, err)
+		}
+		routed = append(routed, fmt.Sprintf("%s events in %s", event, table))
+		tables = append(tables, table)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, route := range routed {
+		log.Printf("Storing %s", route)
+	}
+	if dbIndexMode == indexesSkip || len(tables) == 0 {
+		return nil
+	}
+	return ensureRouteTableIndexes(db, tables)
+}
+
+// ensureRouteTableIndexes builds the sender_id/timestamp index of migration 0023 on
+// routed tables that lack it. The index is named the way CREATE TABLE ... LIKE names
+// the copy it makes, so tables created after 0023 already have it.
+func ensureRouteTableIndexes(db *sql.DB, tables []string) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("failed to lock schema: %v", err)
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	slices.Sort(tables)
+	for _, table := range slices.Compact(tables) {
+		index := table + "_sender_id_timestamp_idx"
+		if err := dropInvalidIndex(ctx, conn, index); err != nil {
+			return err
+		}
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf("CREATE INDEX CONCURRENTLY IF NOT EXISTS %s ON %s (sender_id, timestamp)", index, table)); err != nil {
+			return fmt.Errorf("failed to index table %s: %v", table, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Store is where the collector keeps device events. Handlers receive a Store instead of
+// a database handle, so another backend only has to implement these methods.
+type Store interface {
+	// SaveEvent stores data in its routed table and in the normalized events.
+	SaveEvent(data EventMessage) error
+	// SaveEvents stores events and the eventState changes in one transaction; changes
+	// is empty unless the state is kept in the same database.
+	SaveEvents(events []EventMessage, changes []stateChange) error
+	// LockSender starts a transaction holding a lock on senderID's event state.
+	LockSender(senderID string) (SenderTx, error)
+	// SaveRaw keeps the payload of msg exactly as received, under its ingest ID.
+	SaveRaw(msg inboundMessage) error
+	// QueryEvents calls fn for every stored event matching q, oldest first, and stops
+	// at the first error fn returns.
+	QueryEvents(q EventQuery, fn func(EventRecord) error) error
+	// LastState returns the latest stored event of each type sent by senderID.
+	LastState(senderID string) ([]EventRecord, error)
+	// DeadLetter records a message the pipeline gave up on at stage (see deadLetter).
+	DeadLetter(msg inboundMessage, stage string, cause error) error
+	// Quarantine records a message rejected as invalid.
+	Quarantine(msg inboundMessage, event, reason string) error
+	// SaveUnhandled keeps a message whose event type has no handler.
+	SaveUnhandled(msg inboundMessage, event string) error
+
+	DeviceRecords
+}
+
+// SenderTx is a transaction holding one sender's event state lock; Commit stores events
+// and state changes in it, Rollback releases the lock without writing.
+type SenderTx interface {
+	Load(key interface{}) (interface{}, bool)
+	Commit(events []EventMessage, changes []stateChange) error
+	Rollback()
+}
+
+// DeviceRecords are the per-device records handlers keep next to the events: registry
+// details, counters, alarm states, locations and shadows. A backend that does not keep
+// one returns errUnsupported, and the handler skips that feature.
+type DeviceRecords interface {
+	// RegisterDevice adds senderID to the registry unless it is there already.
+	RegisterDevice(senderID string) error
+	DeviceModel(senderID string) (string, error)
+	// DeviceLabels returns the registry labels of senderID, none when it has no entry.
+	DeviceLabels(senderID string) (map[string]string, error)
+	SetDeviceFirmware(senderID, version string, at time.Time) error
+	SetDeviceSIM(senderID string, sim DeviceSIM, at time.Time) error
+	SetDeviceNetwork(senderID string, network DeviceNetwork, at time.Time) error
+	RecordCampaignOTAStatus(senderID, campaignID, status, detail string) error
+	// RecordDataUsage adds traffic and returns the day's and month's totals.
+	RecordDataUsage(senderID string, at time.Time, sent, received int64) (day, month int64, err error)
+	DataQuota(senderID string) (int64, error)
+	RecordReboot(senderID string, at time.Time, reason, source string) (bool, error)
+	CountReboots(senderID string, until time.Time, length time.Duration) (int, error)
+	RecordThermalReading(senderID string, at time.Time, value float64) error
+	// TemperatureThresholds returns sql.ErrNoRows when the device has none.
+	TemperatureThresholds(senderID string) (TemperatureThresholds, error)
+	// SetTemperatureAlarm moves the threshold alarm to alarm unless a newer reading did;
+	// it reports whether it changed.
+	SetTemperatureAlarm(senderID, alarm string, at time.Time) (bool, error)
+	// LastPublishedLocation returns sql.ErrNoRows when the device has none.
+	LastPublishedLocation(senderID string) (Location, error)
+	SaveLocation(loc Location) error
+	Geofences(senderID string) ([]Geofence, error)
+	// SetGeofenceState records which side of a fence the device is on unless a newer
+	// location did; it reports whether it changed.
+	SetGeofenceState(senderID, name string, inside bool, at time.Time) (bool, error)
+	SetReportedConfig(senderID string, config map[string]interface{}) error
+	// SyncShadow sends a device the desired configuration it has not reported yet.
+	SyncShadow(senderID string) error
+}
+
+// errUnsupported is returned by stores that do not keep a kind of record.
+var errUnsupported = errors.New("not supported by this storage backend")
+
+// EventQuery selects stored events; zero fields do not restrict the result.
+type EventQuery struct {
+	SenderID string
+	Events   []string
+	Labels   map[string]string // only devices carrying every label
+	From, To time.Time         // received at or after From and before To
+	Limit    int
+}
+
+// EventRecord is a normalized event as kept by a Store.
+type EventRecord struct {
+	SenderID   string      `json:"sender_id"`
+	Event      string      `json:"event"`
+	Tag        string      `json:"tag"`
+	Value      interface{} `json:"value,omitempty"`
+	Status     bool        `json:"status"`
+	EventTime  *time.Time  `json:"event_time,omitempty"`
+	ReceivedAt time.Time   `json:"received_at"`
+	IngestID   string      `json:"ingest_id,omitempty"`
+}
+
+// eventStore is the Store the pipeline writes to, set once the database is ready.
+var eventStore Store
+
+// postgresStore keeps events in mqtt_data (or the routed tables) and events.
+type postgresStore struct {
+	db *sql.DB
+}
+
+func newPostgresStore(db *sql.DB) *postgresStore {
+	return &postgresStore{db: db}
+}
+
+func (s *postgresStore) SaveEvent(data EventMessage) error {
+	return insertEventRow(s.db, data)
+}
+
+func (s *postgresStore) SaveEvents(events []EventMessage, changes []stateChange) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	return commitEvents(tx, events, changes)
+}
+
+// commitEvents writes events and state changes in tx and commits it, or rolls it back
+// on error.
+func commitEvents(tx *sql.Tx, events []EventMessage, changes []stateChange) error {
+	var err error
+	for _, data := range events {
+		if err = insertEventRowTx(tx, data); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, c := range changes {
+		if c.delete {
+			err = deleteEventState(tx, c.key)
+		} else {
+			err = storeEventState(tx, c.key, c.value)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// senderStateLockClass is the first key of the per-sender advisory locks, the second
+// being a hash of the sender ID.
+const senderStateLockClass = 0x6d6f
+
+// postgresSenderTx holds a transaction-level advisory lock on one sender.
+type postgresSenderTx struct {
+	tx *sql.Tx
+}
+
+func (s *postgresStore) LockSender(senderID string) (SenderTx, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1, hashtext($2))", senderStateLockClass, senderID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return postgresSenderTx{tx}, nil
+}
+
+func (t postgresSenderTx) Load(key interface{}) (interface{}, bool) { return loadEventState(t.tx, key) }
+
+func (t postgresSenderTx) Commit(events []EventMessage, changes []stateChange) error {
+	return commitEvents(t.tx, events, changes)
+}
+
+func (t postgresSenderTx) Rollback() { t.tx.Rollback() }
+
+func (s *postgresStore) SaveRaw(msg inboundMessage) error {
+	_, err := s.db.Exec("INSERT INTO raw_messages (ingest_id, sender_id, topic, payload, received_at) VALUES ($1, $2, $3, $4, $5)",
+		msg.IngestID, msg.SenderID, msg.Topic, msg.Payload, msg.ReceivedAt)
+	return err
+}
+
+const storedEventColumns = "sender_id, event_name, tag, value, status, event_time, received_at, COALESCE(ingest_id, '')"
+
+func scanEventRecord(rows *sql.Rows) (EventRecord, error) {
+	var e EventRecord
+	var value []byte
+	if err := rows.Scan(&e.SenderID, &e.Event, &e.Tag, &value, &e.Status, &e.EventTime, &e.ReceivedAt, &e.IngestID); err != nil {
+		return EventRecord{}, err
+	}
+	if len(value) > 0 {
+		if err := json.Unmarshal(value, &e.Value); err != nil {
+			return EventRecord{}, fmt.Errorf("invalid value of %s event from %s: %v", e.Event, e.SenderID, err)
+		}
+	}
+	return e, nil
+}
+
+// eachEventRecord calls fn for every row of rows, stopping at the first error, and
+// closes rows.
+func eachEventRecord(rows *sql.Rows, fn func(EventRecord) error) error {
+	defer rows.Close()
+	for rows.Next() {
+		e, err := scanEventRecord(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *postgresStore) QueryEvents(q EventQuery, fn func(EventRecord) error) error {
+	query := "SELECT " + storedEventColumns + " FROM events WHERE true"
+	var args []interface{}
+	if q.SenderID != "" {
+		args = append(args, q.SenderID)
+		query += fmt.Sprintf(" AND sender_id = $%d", len(args))
+	}
+	if len(q.Events) > 0 {
+		args = append(args, pq.Array(q.Events))
+		query += fmt.Sprintf(" AND event_name = ANY($%d)", len(args))
+	}
+	if len(q.Labels) > 0 {
+		labels, err := json.Marshal(q.Labels)
+		if err != nil {
+			return fmt.Errorf("failed to encode labels: %v", err)
+		}
+		args = append(args, string(labels))
+		query += fmt.Sprintf(" AND sender_id IN (SELECT sender_id FROM devices WHERE labels @> $%d::jsonb)", len(args))
+	}
+	for _, bound := range []struct {
+		t  time.Time
+		op string
+	}{{q.From, ">="}, {q.To, "<"}} {
+		if bound.t.IsZero() {
+			continue
+		}
+		args = append(args, bound.t)
+		query += fmt.Sprintf(" AND received_at %s $%d", bound.op, len(args))
+	}
+	query += " ORDER BY id"
+	if q.Limit > 0 {
+		args = append(args, q.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	return eachEventRecord(rows, fn)
+}
+
+func (s *postgresStore) LastState(senderID string) ([]EventRecord, error) {
+	rows, err := s.db.Query(`SELECT DISTINCT ON (event_name) `+storedEventColumns+`
+        FROM events WHERE sender_id = $1
+        ORDER BY event_name, COALESCE(event_time, received_at) DESC, id DESC`, senderID)
+	if err != nil {
+		return nil, err
+	}
+	state := []EventRecord{}
+	err = eachEventRecord(rows, func(e EventRecord) error {
+		state = append(state, e)
+		return nil
+	})
+	return state, err
+}
+
+func (s *postgresStore) DeadLetter(msg inboundMessage, stage string, cause error) error {
+	_, err := s.db.Exec("INSERT INTO dead_letter (ingest_id, sender_id, topic, stage, payload, error, received_at) VALUES (NULLIF($1, ''), $2, $3, $4, $5, $6, $7)",
+		msg.IngestID, msg.SenderID, msg.Topic, stage, msg.Payload, cause.Error(), msg.ReceivedAt)
+	return err
+}
+
+func (s *postgresStore) Quarantine(msg inboundMessage, event, reason string) error {
+	_, err := s.db.Exec("INSERT INTO quarantine (ingest_id, sender_id, event_name, topic, payload, error, received_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		msg.IngestID, msg.SenderID, event, msg.Topic, string(msg.Payload), reason, msg.ReceivedAt)
+	return err
+}
+
+func (s *postgresStore) SaveUnhandled(msg inboundMessage, event string) error {
+	_, err := s.db.Exec("INSERT INTO raw_events (ingest_id, sender_id, event_name, topic, payload, received_at) VALUES ($1, $2, $3, $4, $5, $6)",
+		msg.IngestID, msg.SenderID, event, msg.Topic, string(msg.Payload), msg.ReceivedAt)
+	return err
+}
+
+func (s *postgresStore) RegisterDevice(senderID string) error {
+	_, err := s.db.Exec("INSERT INTO devices (sender_id) VALUES ($1) ON CONFLICT (sender_id) DO NOTHING", senderID)
+	return err
+}
+
+func (s *postgresStore) DeviceModel(senderID string) (string, error) {
+	var model sql.NullString
+	err := s.db.QueryRow("SELECT model FROM devices WHERE sender_id = $1", senderID).Scan(&model)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return model.String, err
+}
+
+func (s *postgresStore) DeviceLabels(senderID string) (map[string]string, error) {
+	var raw []byte
+	err := s.db.QueryRow("SELECT labels FROM devices WHERE sender_id = $1", senderID).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var labels map[string]string
+	if err := json.Unmarshal(raw, &labels); err != nil {
+		return nil, fmt.Errorf("failed to decode labels of %s: %v", senderID, err)
+	}
+	return labels, nil
+}
+
+func (s *postgresStore) SetDeviceFirmware(senderID, version string, at time.Time) error {
+	return setDeviceFirmware(s.db, senderID, version, at)
+}
+
+func (s *postgresStore) SetDeviceSIM(senderID string, sim DeviceSIM, at time.Time) error {
+	return setDeviceSIM(s.db, senderID, sim, at)
+}
+
+func (s *postgresStore) SetDeviceNetwork(senderID string, network DeviceNetwork, at time.Time) error {
+	return setDeviceNetwork(s.db, senderID, network, at)
+}
+
+func (s *postgresStore) RecordCampaignOTAStatus(senderID, campaignID, status, detail string) error {
+	return recordCampaignOTAStatus(s.db, senderID, campaignID, status, detail)
+}
+
+func (s *postgresStore) RecordDataUsage(senderID string, at time.Time, sent, received int64) (int64, int64, error) {
+	return recordDataUsage(s.db, senderID, at, sent, received)
+}
+
+func (s *postgresStore) DataQuota(senderID string) (int64, error) {
+	return effectiveDataQuota(s.db, senderID)
+}
+
+func (s *postgresStore) RecordReboot(senderID string, at time.Time, reason, source string) (bool, error) {
+	return recordReboot(s.db, senderID, at, reason, source)
+}
+
+func (s *postgresStore) CountReboots(senderID string, until time.Time, length time.Duration) (int, error) {
+	return countReboots(s.db, senderID, until, length)
+}
+
+func (s *postgresStore) RecordThermalReading(senderID string, at time.Time, value float64) error {
+	return recordThermalReading(s.db, senderID, at, value)
+}
+
+func (s *postgresStore) TemperatureThresholds(senderID string) (TemperatureThresholds, error) {
+	return loadTemperatureThresholds(s.db, senderID)
+}
+
+func (s *postgresStore) SetTemperatureAlarm(senderID, alarm string, at time.Time) (bool, error) {
+	return setTemperatureAlarm(s.db, senderID, alarm, at)
+}
+
+func (s *postgresStore) LastPublishedLocation(senderID string) (Location, error) {
+	return lastPublishedLocation(s.db, senderID)
+}
+
+func (s *postgresStore) SaveLocation(loc Location) error {
+	return saveLocation(s.db, loc)
+}
+
+func (s *postgresStore) Geofences(senderID string) ([]Geofence, error) {
+	return listGeofences(s.db, senderID)
+}
+
+func (s *postgresStore) SetGeofenceState(senderID, name string, inside bool, at time.Time) (bool, error) {
+	return setGeofenceState(s.db, senderID, name, inside, at)
+}
+
+func (s *postgresStore) SetReportedConfig(senderID string, config map[string]interface{}) error {
+	return setReportedConfig(s.db, senderID, config)
+}
+
+func (s *postgresStore) SyncShadow(senderID string) error {
+	return syncShadow(s.db, senderID)
+}
+
+// handleLatestEvents returns the latest event of each type a device has sent.
+func handleLatestEvents(store Store, w http.ResponseWriter, r *http.Request) {
+	state, err := store.LastState(r.PathValue("id"))
+	if err != nil {
+		log.Printf("Error loading device state: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load device state")
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
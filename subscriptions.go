@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// registrySubscriptions subscribes to one topic per registered device instead of a
+// broad wildcard, so that in a sharded deployment each collector only receives the
+// traffic of the devices it is responsible for. Devices are selected with a
+// DeviceFilter (typically a saved filter naming a device group) and the set is
+// re-read periodically: new devices are subscribed and removed ones unsubscribed.
+// A device must be registered (PUT /api/v1/devices/{id}) before its traffic arrives.
+type registrySubscriptions struct {
+	db          *sql.DB
+	topicFormat string // e.g. DATA/MODEM/%s
+	group       string
+	filter      DeviceFilter
+	handle      func(BrokerMessage)
+
+	subscribed map[string]bool // topic filters currently subscribed
+}
+
+var subscribedDevices = newGaugeVec("collector_subscribed_devices", "Device topics subscribed from the registry.", "source")
+
+func (s *registrySubscriptions) sync() error {
+	devices, err := queryDevices(s.db, s.filter)
+	if err != nil {
+		return fmt.Errorf("failed to load devices: %v", err)
+	}
+	want := map[string]bool{}
+	for _, d := range devices {
+		if !ownsSender(d.SenderID) {
+			continue
+		}
+		want[subscriptionTopic(fmt.Sprintf(s.topicFormat, d.SenderID), s.group)] = true
+	}
+
+	var added, removed []string
+	for topic := range want {
+		if !s.subscribed[topic] {
+			added = append(added, topic)
+		}
+	}
+	for topic := range s.subscribed {
+		if !want[topic] {
+			removed = append(removed, topic)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	for _, topic := range added {
+		if err := mqttClient.Subscribe(topic, mqttSubscribeQoS, s.handle); err != nil {
+			log.Printf("Failed to subscribe to %s: %v", topic, err)
+			continue
+		}
+		s.subscribed[topic] = true
+	}
+	for _, topic := range removed {
+		if err := mqttClient.Unsubscribe(topic); err != nil {
+			log.Printf("Failed to unsubscribe from %s: %v", topic, err)
+			continue
+		}
+		delete(s.subscribed, topic)
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		log.Printf("Registry subscriptions: %d added, %d removed, %d active", len(added), len(removed), len(s.subscribed))
+	}
+	subscribedDevices.Set("registry", float64(len(s.subscribed)))
+	return nil
+}
+
+// startRegistrySubscriptions subscribes to the registered devices now and then every
+// refresh interval.
+func startRegistrySubscriptions(db *sql.DB, topicFormat, group string, filter DeviceFilter, refresh time.Duration, handle func(BrokerMessage)) error {
+	s := &registrySubscriptions{db: db, topicFormat: topicFormat, group: group, filter: filter, handle: handle, subscribed: map[string]bool{}}
+	if err := s.sync(); err != nil {
+		return err
+	}
+	if refresh > 0 {
+		go func() {
+			for {
+				<-clock.After(refresh)
+				if err := s.sync(); err != nil {
+					log.Printf("Error refreshing registry subscriptions: %v", err)
+				}
+			}
+		}()
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Thermal stress aggregates. Every temperature reading closes the interval since the
+// device's previous reading, which is integrated at the previous value (sample and hold)
+// and credited to the calendar days it spans in thermalLocation.
+var (
+	thermalEnabled   bool
+	thermalBaseTemp  = 18.0      // THERMAL_BASE_TEMP, base of the cooling degree-days
+	thermalThreshold = 50.0      // THERMAL_STRESS_THRESHOLD, exposure is counted above it
+	thermalMaxGap    = time.Hour // THERMAL_MAX_GAP, longer gaps are not integrated
+	thermalLocation  = time.UTC  // THERMAL_TIMEZONE, where days start and end
+)
+
+// ThermalDay is the thermal stress of one device on one day.
+type ThermalDay struct {
+	Day                  string  `json:"day"`
+	CoolingDegreeDays    float64 `json:"cooling_degree_days"`
+	OverThresholdSeconds float64 `json:"over_threshold_seconds"`
+	Samples              int     `json:"samples"`
+}
+
+// recordThermalReading adds the interval ending at a new reading to the daily aggregates.
+// Readings older than the device's latest one only count as samples.
+func recordThermalReading(db *sql.DB, senderID string, at time.Time, value float64) error {
+	if !thermalEnabled {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin thermal transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var lastAt time.Time
+	var lastValue float64
+	err = tx.QueryRow("SELECT last_at, last_value FROM device_thermal_state WHERE sender_id = $1 FOR UPDATE", senderID).
+		Scan(&lastAt, &lastValue)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to load thermal state: %v", err)
+	}
+	hasPrevious := err == nil
+
+	if hasPrevious && !at.After(lastAt) {
+		if err := addThermalDay(tx, senderID, at, 0, 0, 1); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	if hasPrevious && at.Sub(lastAt) <= thermalMaxGap {
+		for start := lastAt; start.Before(at); {
+			y, m, d := start.In(thermalLocation).Date()
+			end := time.Date(y, m, d+1, 0, 0, 0, 0, thermalLocation)
+			if end.After(at) {
+				end = at
+			}
+			seconds := end.Sub(start).Seconds()
+			var overSeconds float64
+			if lastValue > thermalThreshold {
+				overSeconds = seconds
+			}
+			degreeDays := max(lastValue-thermalBaseTemp, 0) * seconds / 86400
+			if err := addThermalDay(tx, senderID, start, degreeDays, overSeconds, 0); err != nil {
+				return err
+			}
+			start = end
+		}
+	}
+	if err := addThermalDay(tx, senderID, at, 0, 0, 1); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO device_thermal_state (sender_id, last_at, last_value) VALUES ($1, $2, $3)
+        ON CONFLICT (sender_id) DO UPDATE SET last_at = EXCLUDED.last_at, last_value = EXCLUDED.last_value`,
+		senderID, at, value)
+	if err != nil {
+		return fmt.Errorf("failed to store thermal state: %v", err)
+	}
+	return tx.Commit()
+}
+
+func addThermalDay(tx *sql.Tx, senderID string, at time.Time, degreeDays, overSeconds float64, samples int) error {
+	_, err := tx.Exec(`INSERT INTO thermal_daily (sender_id, day, cooling_degree_days, over_threshold_seconds, samples)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (sender_id, day) DO UPDATE SET
+            cooling_degree_days = thermal_daily.cooling_degree_days + EXCLUDED.cooling_degree_days,
+            over_threshold_seconds = thermal_daily.over_threshold_seconds + EXCLUDED.over_threshold_seconds,
+            samples = thermal_daily.samples + EXCLUDED.samples`,
+		senderID, at.In(thermalLocation).Format(time.DateOnly), degreeDays, overSeconds, samples)
+	if err != nil {
+		return fmt.Errorf("failed to update thermal aggregates: %v", err)
+	}
+	return nil
+}
+
+// handleDeviceThermal lists a device's daily thermal aggregates, optionally between the
+// YYYY-MM-DD dates in the from and to query parameters (both inclusive).
+func handleDeviceThermal(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	query := "SELECT day, cooling_degree_days, over_threshold_seconds, samples FROM thermal_daily WHERE sender_id = $1"
+	args := []interface{}{r.PathValue("id")}
+	for _, bound := range []struct{ param, op string }{{"from", ">="}, {"to", "<="}} {
+		value := r.URL.Query().Get(bound.param)
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse(time.DateOnly, value); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s date, expected YYYY-MM-DD", bound.param))
+			return
+		}
+		args = append(args, value)
+		query += fmt.Sprintf(" AND day %s $%d", bound.op, len(args))
+	}
+	args = append(args, queryLimit(r, 366, 3660))
+	query += fmt.Sprintf(" ORDER BY day DESC LIMIT $%d", len(args))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error listing thermal aggregates: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list thermal aggregates")
+		return
+	}
+	defer rows.Close()
+	days := []ThermalDay{}
+	for rows.Next() {
+		var d ThermalDay
+		var day time.Time
+		if err := rows.Scan(&day, &d.CoolingDegreeDays, &d.OverThresholdSeconds, &d.Samples); err != nil {
+			log.Printf("Error scanning thermal aggregates: %v", err)
+			writeError(w, http.StatusInternalServerError, "failed to list thermal aggregates")
+			return
+		}
+		d.Day = day.Format(time.DateOnly)
+		days = append(days, d)
+	}
+	writeCachedJSON(w, r, days)
+}
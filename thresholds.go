@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// TemperatureThresholds lets the collector raise temperature alarms itself instead of
+// relying on ALARM_TEMPERATURE from the device. A reading above High raises
+// TEMPERATURE_HIGH (value 1, tag temperature_high_<sender>), which clears (value 0) only
+// once the temperature is back at High - Hysteresis or below; Low and TEMPERATURE_LOW
+// work the other way round. The datapoints go through the alarm debounce.
+type TemperatureThresholds struct {
+	SenderID   string     `json:"sender_id"`
+	High       *float64   `json:"high,omitempty"`
+	Low        *float64   `json:"low,omitempty"`
+	Hysteresis *float64   `json:"hysteresis,omitempty"` // °C, default 1
+	Alarm      *string    `json:"alarm"`
+	StateAt    *time.Time `json:"state_at,omitempty"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+const defaultHysteresis = 1.0
+
+func (t TemperatureThresholds) validate() error {
+	if t.High == nil && t.Low == nil {
+		return errors.New("high or low is required")
+	}
+	for _, v := range []*float64{t.High, t.Low} {
+		if v != nil && (*v < setpointMin || *v > setpointMax) {
+			return fmt.Errorf("thresholds must be within [%v, %v]", setpointMin, setpointMax)
+		}
+	}
+	h := t.hysteresis()
+	if h < 0 {
+		return errors.New("hysteresis must not be negative")
+	}
+	// The clear points must not overlap, or a reading could be both high and low.
+	if t.High != nil && t.Low != nil && *t.High-h <= *t.Low+h {
+		return errors.New("high - hysteresis must be above low + hysteresis")
+	}
+	return nil
+}
+
+func (t TemperatureThresholds) hysteresis() float64 {
+	if t.Hysteresis == nil {
+		return defaultHysteresis
+	}
+	return *t.Hysteresis
+}
+
+// next returns the alarm state after a reading: "high", "low" or "normal".
+func (t TemperatureThresholds) next(current string, value float64) string {
+	switch current {
+	case "high":
+		if t.High != nil && value > *t.High-t.hysteresis() {
+			return "high"
+		}
+	case "low":
+		if t.Low != nil && value < *t.Low+t.hysteresis() {
+			return "low"
+		}
+	}
+	if t.High != nil && value > *t.High {
+		return "high"
+	}
+	if t.Low != nil && value < *t.Low {
+		return "low"
+	}
+	return "normal"
+}
+
+// checkTemperatureThresholds evaluates a reading against the device's thresholds and
+// publishes the alarms it raises or clears.
+func checkTemperatureThresholds(store Store, senderID, ingestID string, value float64, at time.Time) {
+	t, err := store.TemperatureThresholds(senderID)
+	if err == sql.ErrNoRows || err == errUnsupported {
+		return
+	}
+	if err != nil {
+		log.Printf("[%s] Error loading temperature thresholds: %v", ingestID, err)
+		return
+	}
+	current := "normal"
+	if t.Alarm != nil {
+		current = *t.Alarm
+	}
+	next := t.next(current, value)
+	if t.Alarm != nil && next == current {
+		return
+	}
+	// Only the first reading to see the change publishes it, and older readings processed
+	// late do not overwrite newer ones.
+	changed, err := store.SetTemperatureAlarm(senderID, next, at)
+	if err != nil {
+		log.Printf("[%s] Error updating temperature alarm state: %v", ingestID, err)
+		return
+	}
+	if !changed || next == current {
+		return
+	}
+	log.Printf("[%s] Temperature of %s is %s (%v °C)", ingestID, senderID, next, value)
+	detail, _ := json.Marshal(map[string]interface{}{"temperature": value, "high": t.High, "low": t.Low, "hysteresis": t.hysteresis()})
+	publish := func(event, tag string, alarm int) {
+		message := EventMessage{
+			EventName: event,
+			Tag:       fmt.Sprintf("%s_%s", tag, senderID),
+			Value:     alarm,
+			Status:    true,
+			Msg:       string(detail),
+			Time:      at.UnixMilli(),
+			Sumber:    senderID,
+			IngestID:  ingestID,
+		}
+		processAndSaveData(store, message)
+		alarmGate.publish(message)
+	}
+	switch current {
+	case "high":
+		publish("TEMPERATURE_HIGH", "temperature_high", 0)
+	case "low":
+		publish("TEMPERATURE_LOW", "temperature_low", 0)
+	}
+	switch next {
+	case "high":
+		publish("TEMPERATURE_HIGH", "temperature_high", 1)
+	case "low":
+		publish("TEMPERATURE_LOW", "temperature_low", 1)
+	}
+}
+
+// setTemperatureAlarm records the threshold alarm of a device, unless it already was
+// that or a newer reading was recorded, and reports whether it changed.
+func setTemperatureAlarm(db *sql.DB, senderID, alarm string, at time.Time) (bool, error) {
+	res, err := db.Exec(`UPDATE temperature_thresholds SET alarm = $2, state_at = $3
+        WHERE sender_id = $1 AND alarm IS DISTINCT FROM $2 AND (state_at IS NULL OR state_at <= $3)`,
+		senderID, alarm, at)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func loadTemperatureThresholds(db *sql.DB, senderID string) (TemperatureThresholds, error) {
+	t := TemperatureThresholds{SenderID: senderID}
+	var hysteresis float64
+	err := db.QueryRow(`SELECT high, low, hysteresis, alarm, state_at, updated_at
+        FROM temperature_thresholds WHERE sender_id = $1`, senderID).
+		Scan(&t.High, &t.Low, &hysteresis, &t.Alarm, &t.StateAt, &t.UpdatedAt)
+	t.Hysteresis = &hysteresis
+	return t, err
+}
+
+func handleGetTemperatureThresholds(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	t, err := loadTemperatureThresholds(db, r.PathValue("id"))
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "no temperature thresholds for this device")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading temperature thresholds: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to load temperature thresholds")
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+// handlePutTemperatureThresholds creates or replaces the thresholds of a device. The
+// alarm state is kept, so the next reading clears a raised alarm the new thresholds no
+// longer warrant.
+func handlePutTemperatureThresholds(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var t TemperatureThresholds
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		writeError(w, http.StatusBadRequest, "body must be JSON thresholds")
+		return
+	}
+	if err := t.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	hysteresis := t.hysteresis()
+	t.SenderID, t.Hysteresis = r.PathValue("id"), &hysteresis
+	t.UpdatedAt = clock.Now()
+	err := db.QueryRow(`INSERT INTO temperature_thresholds (sender_id, high, low, hysteresis, updated_at) VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (sender_id) DO UPDATE SET high = EXCLUDED.high, low = EXCLUDED.low, hysteresis = EXCLUDED.hysteresis,
+            updated_at = EXCLUDED.updated_at
+        RETURNING alarm, state_at`,
+		t.SenderID, t.High, t.Low, hysteresis, t.UpdatedAt).Scan(&t.Alarm, &t.StateAt)
+	if err != nil {
+		log.Printf("Error saving temperature thresholds: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to save temperature thresholds")
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+func handleDeleteTemperatureThresholds(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	res, err := db.Exec("DELETE FROM temperature_thresholds WHERE sender_id = $1", r.PathValue("id"))
+	if err != nil {
+		log.Printf("Error deleting temperature thresholds: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to delete temperature thresholds")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeError(w, http.StatusNotFound, "no temperature thresholds for this device")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func float(v float64) *float64 { return &v }
+
+func TestTemperatureThresholdsNext(t *testing.T) {
+	both := TemperatureThresholds{High: float(30), Low: float(5), Hysteresis: float(2)}
+	highOnly := TemperatureThresholds{High: float(30)} // default hysteresis of 1
+	tests := []struct {
+		name       string
+		thresholds TemperatureThresholds
+		current    string
+		value      float64
+		want       string
+	}{
+		{"normal stays normal", both, "normal", 20, "normal"},
+		{"at high is not above it", both, "normal", 30, "normal"},
+		{"above high raises", both, "normal", 30.5, "high"},
+		{"below low raises", both, "normal", 4.5, "low"},
+		{"high within hysteresis stays", both, "high", 28.5, "high"},
+		{"high at the clear point clears", both, "high", 28, "normal"},
+		{"low within hysteresis stays", both, "low", 6.5, "low"},
+		{"low at the clear point clears", both, "low", 7, "normal"},
+		{"high straight to low", both, "high", 3, "low"},
+		{"low straight to high", both, "low", 35, "high"},
+		{"default hysteresis holds", highOnly, "high", 29.5, "high"},
+		{"default hysteresis clears", highOnly, "high", 29, "normal"},
+		{"no low threshold", highOnly, "normal", -40, "normal"},
+		{"removed threshold clears", TemperatureThresholds{Low: float(5)}, "high", 50, "normal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.thresholds.next(tt.current, tt.value); got != tt.want {
+				t.Errorf("next(%s, %v) = %s, want %s", tt.current, tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemperatureThresholdsValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		thresholds TemperatureThresholds
+		ok         bool
+	}{
+		{"high only", TemperatureThresholds{High: float(30)}, true},
+		{"both", TemperatureThresholds{High: float(30), Low: float(5), Hysteresis: float(2)}, true},
+		{"neither", TemperatureThresholds{}, false},
+		{"negative hysteresis", TemperatureThresholds{High: float(30), Hysteresis: float(-1)}, false},
+		{"overlapping clear points", TemperatureThresholds{High: float(10), Low: float(8), Hysteresis: float(1)}, false},
+		{"out of range", TemperatureThresholds{High: float(setpointMax + 1)}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.thresholds.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// thresholdStore holds the thresholds and alarm state of one device.
+type thresholdStore struct {
+	Store
+	thresholds TemperatureThresholds
+}
+
+func (s *thresholdStore) TemperatureThresholds(senderID string) (TemperatureThresholds, error) {
+	return s.thresholds, nil
+}
+
+func (s *thresholdStore) SetTemperatureAlarm(senderID, alarm string, at time.Time) (bool, error) {
+	if s.thresholds.Alarm != nil && *s.thresholds.Alarm == alarm {
+		return false, nil
+	}
+	s.thresholds.Alarm = &alarm
+	return true, nil
+}
+
+func TestCheckTemperatureThresholdsDebounced(t *testing.T) {
+	c := useFakeClock(t)
+	saved := alarmGate
+	alarmGate = useAlarmGate(t, time.Minute, 0, 5)
+	t.Cleanup(func() { alarmGate = saved })
+	savedRoutes := storageRoutes
+	storageRoutes = map[string]string{"TEMPERATURE_HIGH": "", "TEMPERATURE_LOW": ""}
+	t.Cleanup(func() { storageRoutes = savedRoutes })
+	b := captureBroker(t)
+	store := &thresholdStore{thresholds: TemperatureThresholds{SenderID: "modem-1", High: float(30), Low: float(5)}}
+
+	readings := []struct {
+		value   float64
+		advance time.Duration
+	}{
+		{31, 30 * time.Second}, // a spike shorter than the debounce
+		{25, time.Minute},
+		{31, 10 * time.Second}, // above, and within the hysteresis long enough
+		{29.5, time.Minute},
+		{29, time.Second}, // clears
+		{3, time.Minute},  // low
+	}
+	for _, r := range readings {
+		checkTemperatureThresholds(store, "modem-1", "c1", r.value, c.Now())
+		c.Advance(r.advance)
+	}
+	want := []string{"temperature_high_modem-1=1", "temperature_high_modem-1=0", "temperature_low_modem-1=1"}
+	if got := publishedAlarms(t, b); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("published %v, want %v", got, want)
+	}
+	if got := *store.thresholds.Alarm; got != "low" {
+		t.Errorf("alarm state = %s, want low", got)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Payload timestamps are epoch seconds, milliseconds, microseconds or nanoseconds, as a
+// JSON number or a string, or an RFC 3339 time. Times before minEventTime (a modem
+// whose clock reset to 1970) or more than timestampMaxSkew in the future (a 32-bit
+// counter that wrapped towards 2106) are rejected. With TIMESTAMP_FALLBACK=server a
+// missing or rejected timestamp is replaced by the time the message was received, and
+// the message is processed instead of dead-lettered.
+var (
+	minEventTime      = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	timestampMaxSkew  = 24 * time.Hour
+	timestampFallback = false
+)
+
+var timestampFallbacks = newCounterVec("collector_timestamp_fallbacks_total", "Messages stamped with the server time because their own timestamp was unusable, by reason.", "reason")
+
+var errNoTimestamp = errors.New("'timestamp' field not found")
+
+// parseTimestamp converts a payload timestamp to a time.
+func parseTimestamp(v interface{}) (time.Time, error) {
+	var epoch float64
+	switch ts := v.(type) {
+	case nil:
+		return time.Time{}, errNoTimestamp
+	case float64:
+		epoch = ts
+	case json.Number:
+		f, err := ts.Float64()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q", ts)
+		}
+		epoch = f
+	case string:
+		s := strings.TrimSpace(ts)
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			epoch = f
+			break
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q: not epoch or RFC 3339", ts)
+		}
+		return checkTimestamp(t)
+	default:
+		return time.Time{}, fmt.Errorf("invalid timestamp type %T", v)
+	}
+	if math.IsNaN(epoch) || math.IsInf(epoch, 0) || epoch <= 0 {
+		return time.Time{}, fmt.Errorf("invalid timestamp %v", v)
+	}
+	// Tell the units apart by magnitude: 1e11 seconds is the year 5138, 1e11
+	// milliseconds is 1973.
+	var t time.Time
+	switch {
+	case epoch < 1e11:
+		t = time.UnixMilli(int64(epoch * 1000))
+	case epoch < 1e14:
+		t = time.UnixMilli(int64(epoch))
+	case epoch < 1e17:
+		t = time.UnixMicro(int64(epoch))
+	default:
+		t = time.Unix(0, int64(epoch))
+	}
+	return checkTimestamp(t)
+}
+
+// checkTimestamp rejects implausible times.
+func checkTimestamp(t time.Time) (time.Time, error) {
+	if t.Before(minEventTime) {
+		return time.Time{}, fmt.Errorf("implausible timestamp %s: before %s", t.UTC().Format(time.RFC3339), minEventTime.Format("2006"))
+	}
+	if limit := clock.Now().Add(timestampMaxSkew); t.After(limit) {
+		return time.Time{}, fmt.Errorf("implausible timestamp %s: more than %v in the future", t.UTC().Format(time.RFC3339), timestampMaxSkew)
+	}
+	return t, nil
+}
+
+// eventTimestamp returns the event time of a decoded payload in epoch milliseconds, or
+// the server time when the timestamp is unusable and TIMESTAMP_FALLBACK=server;
+// fallback reports that it did.
+func eventTimestamp(msgData map[string]interface{}, receivedAt time.Time) (timestamp int64, fallback bool, err error) {
+	t, err := parseTimestamp(msgData["timestamp"])
+	if err == nil {
+		return t.UnixMilli(), false, nil
+	}
+	if !timestampFallback {
+		return 0, false, err
+	}
+	reason := "invalid"
+	if errors.Is(err, errNoTimestamp) {
+		reason = "missing"
+	}
+	timestampFallbacks.Inc(reason)
+	if receivedAt.IsZero() {
+		receivedAt = clock.Now()
+	}
+	return receivedAt.UnixMilli(), true, nil
+}
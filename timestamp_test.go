@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func FuzzParseTimestamp(f *testing.F) {
+	f.Add("1700000000", 1700000000.0)                   // seconds
+	f.Add("1700000000123", 1700000000123.0)             // milliseconds
+	f.Add("1700000000123456", 1700000000123456.0)       // microseconds
+	f.Add("1700000000123456789", 1700000000123456789.0) // nanoseconds
+	f.Add(" 1700000000.5 ", 1700000000.5)               // fractional seconds
+	f.Add("2023-11-14T22:13:20Z", 0.0)                  // RFC 3339
+	f.Add("2023-11-14T22:13:20.123456789+07:00", -1.0)  // RFC 3339 with offset
+	f.Add("1970-01-01T00:00:00Z", 86400.0)              // clock reset to 1970
+	f.Add("4294967295", 4294967295.0)                   // wrapped 32-bit counter
+	f.Add("NaN", 1e300)
+	f.Add("", 0.0)
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	saved := clock
+	clock = NewFakeClock(now)
+	f.Cleanup(func() { clock = saved })
+
+	f.Fuzz(func(t *testing.T, s string, epoch float64) {
+		for _, v := range []interface{}{s, epoch} {
+			got, err := parseTimestamp(v)
+			if err != nil {
+				continue
+			}
+			if got.Before(minEventTime) || got.After(now.Add(timestampMaxSkew)) {
+				t.Errorf("parseTimestamp(%#v) = %v, outside the accepted range", v, got)
+			}
+			again, err := parseTimestamp(got.Format(time.RFC3339Nano))
+			if err != nil || !again.Equal(got) {
+				t.Errorf("parseTimestamp(%#v) = %v, but its RFC 3339 form gives %v, %v", v, got, again, err)
+			}
+		}
+
+		// A number and its decimal string are the same timestamp.
+		fromNumber, numberErr := parseTimestamp(epoch)
+		fromString, stringErr := parseTimestamp(strconv.FormatFloat(epoch, 'f', -1, 64))
+		if (numberErr == nil) != (stringErr == nil) || !fromNumber.Equal(fromString) {
+			t.Errorf("parseTimestamp(%v) = %v, %v but as a string %v, %v", epoch, fromNumber, numberErr, fromString, stringErr)
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Processing decisions recorded per ingest ID.
+const (
+	decisionReceived        = "received"
+	decisionRateLimited     = "rate_limited"
+	decisionQueueFull       = "dropped_queue_full"
+	decisionDecodeError     = "decode_error"
+	decisionDuplicate       = "duplicate"
+	decisionQuarantined     = "quarantined"
+	decisionInvalidTime     = "invalid_timestamp"
+	decisionDispatched      = "dispatched"
+	decisionUnhandled       = "unhandled"
+	decisionPanic           = "panic"
+	decisionStored          = "stored"
+	decisionStorageDisabled = "storage_disabled"
+	decisionStoreFailed     = "store_failed_spooled"
+	decisionPublished       = "published"
+	decisionSchemaRejected  = "schema_rejected"
+	decisionPublishFailed   = "publish_failed_spooled"
+)
+
+// ProcessingDecision is one step of a message's journey through the collector.
+type ProcessingDecision struct {
+	IngestID  string    `json:"ingest_id"`
+	SenderID  string    `json:"sender_id"`
+	Decision  string    `json:"decision"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// processingLog writes decisions to processing_log from a background goroutine so the
+// message path never waits on it; decisions are dropped when the buffer is full.
+type processingLog struct {
+	db      *sql.DB
+	entries chan ProcessingDecision
+}
+
+var procLog *processingLog // nil when PROCESSING_LOG is disabled
+
+var processingDecisions = newCounterVec("collector_processing_decisions_total", "Processing decisions made for inbound messages, whether or not the processing log is enabled.", "decision")
+
+var processingLogDropped = newCounterVec("collector_processing_log_dropped_total", "Processing decisions not recorded because the write buffer was full.", "decision")
+
+func newProcessingLog(db *sql.DB, buffer int) *processingLog {
+	l := &processingLog{db: db, entries: make(chan ProcessingDecision, buffer)}
+	go func() {
+		for d := range l.entries {
+			_, err := l.db.Exec("INSERT INTO processing_log (ingest_id, sender_id, decision, detail, created_at) VALUES ($1, $2, $3, $4, $5)",
+				d.IngestID, d.SenderID, d.Decision, d.Detail, d.CreatedAt)
+			if err != nil {
+				log.Printf("[%s] Error recording %s decision: %v", d.IngestID, d.Decision, err)
+			}
+		}
+	}()
+	return l
+}
+
+// Record queues a decision for ingestID. It is safe to call on a nil log and ignores
+// messages without an ingest ID.
+func (l *processingLog) Record(ingestID, senderID, decision, detail string) {
+	if ingestID == "" {
+		return
+	}
+	processingDecisions.Inc(decision)
+	if l == nil {
+		return
+	}
+	select {
+	case l.entries <- ProcessingDecision{IngestID: ingestID, SenderID: senderID, Decision: decision, Detail: detail, CreatedAt: clock.Now()}:
+	default:
+		processingLogDropped.Inc(decision)
+	}
+}
+
+// MessageTrace reconstructs what happened to one inbound message from everything the
+// collector stored under its ingest ID.
+type MessageTrace struct {
+	IngestID  string               `json:"ingest_id"`
+	Raw       *RawMessage          `json:"raw,omitempty"`
+	Unhandled bool                 `json:"unhandled"`
+	Decisions []ProcessingDecision `json:"decisions"`
+	Events    []StoredEvent        `json:"events"`
+}
+
+// RawMessage is a payload kept in raw_messages.
+type RawMessage struct {
+	SenderID   string    `json:"sender_id"`
+	Topic      string    `json:"topic"`
+	Payload    string    `json:"payload"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// StoredEvent is a normalized row in events.
+type StoredEvent struct {
+	EventName string     `json:"event"`
+	Tag       string     `json:"tag"`
+	Value     *string    `json:"value"`
+	Status    bool       `json:"status"`
+	EventTime *time.Time `json:"event_time"`
+}
+
+func queryMessageTrace(db *sql.DB, ingestID string) (MessageTrace, error) {
+	trace := MessageTrace{IngestID: ingestID, Decisions: []ProcessingDecision{}, Events: []StoredEvent{}}
+
+	var raw RawMessage
+	var payload []byte
+	err := db.QueryRow("SELECT sender_id, topic, payload, received_at FROM raw_messages WHERE ingest_id = $1", ingestID).
+		Scan(&raw.SenderID, &raw.Topic, &payload, &raw.ReceivedAt)
+	switch {
+	case err == nil:
+		raw.Payload = string(payload)
+		trace.Raw = &raw
+	case err != sql.ErrNoRows:
+		return trace, fmt.Errorf("failed to query raw message: %v", err)
+	}
+
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM raw_events WHERE ingest_id = $1)", ingestID).Scan(&trace.Unhandled); err != nil {
+		return trace, fmt.Errorf("failed to query raw events: %v", err)
+	}
+
+	decisions, err := queryDecisions(db, "ingest_id = $1", []interface{}{ingestID}, "ASC", 1000)
+	if err != nil {
+		return trace, err
+	}
+	trace.Decisions = decisions
+
+	rows, err := db.Query("SELECT event_name, tag, value::text, status, event_time FROM events WHERE ingest_id = $1 ORDER BY id", ingestID)
+	if err != nil {
+		return trace, fmt.Errorf("failed to query events: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e StoredEvent
+		if err := rows.Scan(&e.EventName, &e.Tag, &e.Value, &e.Status, &e.EventTime); err != nil {
+			return trace, fmt.Errorf("failed to scan event: %v", err)
+		}
+		trace.Events = append(trace.Events, e)
+	}
+	return trace, rows.Err()
+}
+
+// queryDecisions lists processing_log rows matching where, ordered by time in order ("ASC" or "DESC").
+func queryDecisions(db *sql.DB, where string, args []interface{}, order string, limit int) ([]ProcessingDecision, error) {
+	args = append(args, limit)
+	rows, err := db.Query(fmt.Sprintf(`SELECT ingest_id, sender_id, decision, detail, created_at
+        FROM processing_log WHERE %s ORDER BY created_at %s, id %s LIMIT $%d`, where, order, order, len(args)), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query processing log: %v", err)
+	}
+	defer rows.Close()
+
+	decisions := []ProcessingDecision{}
+	for rows.Next() {
+		var d ProcessingDecision
+		if err := rows.Scan(&d.IngestID, &d.SenderID, &d.Decision, &d.Detail, &d.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan processing decision: %v", err)
+		}
+		decisions = append(decisions, d)
+	}
+	return decisions, rows.Err()
+}
+
+func handleMessageTrace(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	trace, err := queryMessageTrace(db, r.PathValue("id"))
+	if err != nil {
+		log.Printf("Error tracing message: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to trace message")
+		return
+	}
+	if trace.Raw == nil && len(trace.Decisions) == 0 && len(trace.Events) == 0 && !trace.Unhandled {
+		writeError(w, http.StatusNotFound, "no record of this ingest ID")
+		return
+	}
+	writeJSON(w, http.StatusOK, trace)
+}
+
+// handleDeviceProcessingLog lists the most recent decisions for one device, optionally
+// between the RFC 3339 times in the from and to query parameters.
+func handleDeviceProcessingLog(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	where := "sender_id = $1"
+	args := []interface{}{r.PathValue("id")}
+	for _, bound := range []struct{ param, op string }{{"from", ">="}, {"to", "<"}} {
+		value := r.URL.Query().Get(bound.param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s time, expected RFC 3339", bound.param))
+			return
+		}
+		args = append(args, t)
+		where += fmt.Sprintf(" AND created_at %s $%d", bound.op, len(args))
+	}
+
+	decisions, err := queryDecisions(db, where, args, "DESC", queryLimit(r, 100, 1000))
+	if err != nil {
+		log.Printf("Error listing processing log: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list processing log")
+		return
+	}
+	writeJSON(w, http.StatusOK, decisions)
+}
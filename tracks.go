@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Track exports of a device's location history (?format=geojson or ?format=gpx on
+// /api/v1/devices/{id}/locations) for mapping tools. Tracks run oldest first.
+
+// writeGeoJSONTrack writes locations as a GeoJSON FeatureCollection: one Point per fix,
+// with its time, accuracy and provider, and a LineString of the whole track.
+func writeGeoJSONTrack(w http.ResponseWriter, senderID string, locations []Location) {
+	features := make([]map[string]interface{}, 0, len(locations)+1)
+	line := make([][2]float64, 0, len(locations))
+	for _, loc := range locations {
+		// GeoJSON positions are [longitude, latitude].
+		position := [2]float64{loc.Lng, loc.Lat}
+		line = append(line, position)
+		properties := map[string]interface{}{"time": loc.ResolvedAt.UTC().Format(time.RFC3339), "provider": loc.Provider}
+		if loc.Accuracy != nil {
+			properties["accuracy"] = *loc.Accuracy
+		}
+		features = append(features, map[string]interface{}{
+			"type":       "Feature",
+			"geometry":   map[string]interface{}{"type": "Point", "coordinates": position},
+			"properties": properties,
+		})
+	}
+	if len(line) >= 2 {
+		features = append(features, map[string]interface{}{
+			"type":       "Feature",
+			"geometry":   map[string]interface{}{"type": "LineString", "coordinates": line},
+			"properties": map[string]interface{}{"sender_id": senderID},
+		})
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.geojson"`, senderID))
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"type": "FeatureCollection", "features": features}); err != nil {
+		log.Printf("Error encoding GeoJSON track: %v", err)
+	}
+}
+
+type gpxFile struct {
+	XMLName xml.Name `xml:"http://www.topografix.com/GPX/1/1 gpx"`
+	Version string   `xml:"version,attr"`
+	Creator string   `xml:"creator,attr"`
+	Track   gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Name    string     `xml:"name"`
+	Segment []gpxPoint `xml:"trkseg>trkpt"`
+}
+
+type gpxPoint struct {
+	Lat  float64  `xml:"lat,attr"`
+	Lon  float64  `xml:"lon,attr"`
+	Time string   `xml:"time"`
+	Src  string   `xml:"src,omitempty"` // GPX orders src before hdop
+	HDOP *float64 `xml:"hdop,omitempty"`
+}
+
+// writeGPXTrack writes locations as a GPX 1.1 track. GPX has no accuracy element, so
+// it is converted back to an HDOP the way GPS fixes get their accuracy from it.
+func writeGPXTrack(w http.ResponseWriter, senderID string, locations []Location) {
+	file := gpxFile{Version: "1.1", Creator: "modem_go " + version, Track: gpxTrack{Name: senderID}}
+	for _, loc := range locations {
+		point := gpxPoint{Lat: loc.Lat, Lon: loc.Lng, Time: loc.ResolvedAt.UTC().Format(time.RFC3339), Src: loc.Provider}
+		if loc.Accuracy != nil {
+			hdop := *loc.Accuracy / gnssUERE
+			point.HDOP = &hdop
+		}
+		file.Track.Segment = append(file.Track.Segment, point)
+	}
+	w.Header().Set("Content-Type", "application/gpx+xml")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.gpx"`, senderID))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(file); err != nil {
+		log.Printf("Error encoding GPX track: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// brokerURL applies MQTT_WS_PATH to ws:// and wss:// broker URLs that do not carry a path
+// themselves; other schemes are returned unchanged.
+func brokerURL(broker, wsPath string) (string, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return "", fmt.Errorf("invalid broker URL %q: %v", broker, err)
+	}
+	if !isWebsocketBroker(broker) {
+		return broker, nil
+	}
+	if (u.Path == "" || u.Path == "/") && wsPath != "" {
+		u.Path = "/" + strings.TrimPrefix(wsPath, "/")
+	}
+	return u.String(), nil
+}
+
+func isWebsocketBroker(broker string) bool {
+	return strings.HasPrefix(broker, "ws://") || strings.HasPrefix(broker, "wss://")
+}
+
+// configureWebsocket sets the proxy used for the WebSocket handshake. An empty proxyURL
+// falls back to HTTPS_PROXY/HTTP_PROXY/NO_PROXY from the environment.
+func configureWebsocket(opts *mqtt.ClientOptions, proxyURL string) error {
+	proxy := http.ProxyFromEnvironment
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return fmt.Errorf("invalid proxy URL %q: %v", proxyURL, err)
+		}
+		proxy = http.ProxyURL(u)
+		log.Printf("Using HTTP proxy %s for MQTT over WebSocket", u.Redacted())
+	}
+	opts.SetWebsocketOptions(&mqtt.WebsocketOptions{Proxy: proxy})
+	return nil
+}
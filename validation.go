@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// inboundSchemas maps an event name to the schema its payloads must match. Events
+// without a schema are not validated. Empty when INBOUND_SCHEMA_DIR is not set.
+var inboundSchemas = map[string]*jsonSchema{}
+
+var messagesQuarantined = newCounterVec("collector_messages_quarantined_total", "Inbound messages that failed schema validation, by event.", "event")
+
+// loadInboundSchemas reads one schema per event from dir, named after the event,
+// e.g. TEMPERATURE.json.
+func loadInboundSchemas(dir string) (map[string]*jsonSchema, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	schemas := map[string]*jsonSchema{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", file, err)
+		}
+		schema, err := parseJSONSchema(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		schemas[strings.TrimSuffix(filepath.Base(file), ".json")] = schema
+	}
+	return schemas, nil
+}
+
+// validateInbound checks a decoded payload against the schema for its event. Invalid
+// payloads are written to quarantine and validateInbound reports false.
+func validateInbound(store Store, msg inboundMessage, event string, msgData map[string]interface{}) bool {
+	schema, ok := inboundSchemas[event]
+	if !ok {
+		return true
+	}
+	errs := schema.Validate(msgData)
+	if len(errs) == 0 {
+		return true
+	}
+
+	quarantineMessage(store, msg, event, strings.Join(errs, "; "))
+	return false
+}
+
+// quarantineMessage records a message that was rejected as invalid so it can be inspected
+// and reprocessed later.
+func quarantineMessage(store Store, msg inboundMessage, event, reason string) {
+	log.Printf("[%s] Quarantining %s message from %s: %s", msg.IngestID, event, msg.SenderID, reason)
+	messagesQuarantined.Inc(event)
+	procLog.Record(msg.IngestID, msg.SenderID, decisionQuarantined, reason)
+	if err := store.Quarantine(msg, event, reason); err != nil {
+		log.Printf("[%s] Error saving quarantined message: %v", msg.IngestID, err)
+	}
+}
+
+// Oversize payload policies (MAX_PAYLOAD_POLICY).
+const (
+	oversizeQuarantine = "quarantine" // keep the first quarantinedPayloadBytes in quarantine
+	oversizeDrop       = "drop"
+)
+
+var (
+	maxPayloadBytes         = 256 << 10 // MAX_PAYLOAD_KB; 0 disables the check
+	oversizePolicy          = oversizeQuarantine
+	quarantinedPayloadBytes = 4096
+)
+
+var messagesOversize = newCounterVec("collector_messages_oversize_total", "Inbound messages rejected for exceeding MAX_PAYLOAD_KB, by policy.", "policy")
+
+// checkPayloadSize rejects a message larger than maxPayloadBytes before anything parses
+// it. Depending on the policy the start of the payload is quarantined for inspection.
+func checkPayloadSize(store Store, msg inboundMessage) bool {
+	if maxPayloadBytes <= 0 || len(msg.Payload) <= maxPayloadBytes {
+		return true
+	}
+	reason := fmt.Sprintf("payload of %d bytes exceeds the %d byte limit", len(msg.Payload), maxPayloadBytes)
+	messagesOversize.Inc(oversizePolicy)
+	if oversizePolicy == oversizeDrop {
+		log.Printf("[%s] Dropping message from %s on %s: %s", msg.IngestID, msg.SenderID, msg.Topic, reason)
+		procLog.Record(msg.IngestID, msg.SenderID, decisionQuarantined, reason)
+		return false
+	}
+	truncated := msg
+	truncated.Payload = msg.Payload[:min(len(msg.Payload), quarantinedPayloadBytes)]
+	// The quarantine payload column is TEXT, which rejects NUL bytes and invalid UTF-8.
+	truncated.Payload = []byte(strings.ReplaceAll(strings.ToValidUTF8(string(truncated.Payload), "�"), "\x00", ""))
+	quarantineMessage(store, truncated, "unknown", reason+" (truncated)")
+	return false
+}
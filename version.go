@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.gitSHA=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	gitSHA    = "unknown"
+	buildDate = "unknown"
+)
+
+var (
+	heartbeatTopic    string
+	heartbeatInterval time.Duration
+	startedAt         = time.Now()
+)
+
+// VersionInfo identifies the running collector build.
+type VersionInfo struct {
+	Version   string `json:"version"`
+	GitSHA    string `json:"git_sha"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+func versionInfo() VersionInfo {
+	return VersionInfo{Version: version, GitSHA: gitSHA, BuildDate: buildDate, GoVersion: runtime.Version()}
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, versionInfo())
+}
+
+// startHeartbeat periodically publishes the collector's identity and build so that
+// gateways running outdated collectors can be spotted from the broker.
+func startHeartbeat(clientID string) {
+	if heartbeatTopic == "" || heartbeatInterval <= 0 {
+		return
+	}
+	hostname, _ := os.Hostname()
+	go func() {
+		for {
+			info := versionInfo()
+			payload, err := json.Marshal(map[string]interface{}{
+				"client_id":  clientID,
+				"hostname":   hostname,
+				"version":    info.Version,
+				"git_sha":    info.GitSHA,
+				"build_date": info.BuildDate,
+				"uptime_s":   int64(clock.Now().Sub(startedAt).Seconds()),
+				"time":       getCurrentTimeMillis(),
+			})
+			if err != nil {
+				log.Printf("Failed to marshal heartbeat: %v", err)
+			} else {
+				if err := mqttClient.Publish(heartbeatTopic, mqttPublishQoS, false, payload); err != nil {
+					log.Printf("Failed to publish heartbeat: %v", err)
+				}
+			}
+			<-clock.After(heartbeatInterval)
+		}
+	}()
+}
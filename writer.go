@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// asyncWriter takes storing events off the handler path (DB_WRITERS > 0): handlers queue
+// an EventMessage and return, and dedicated writer goroutines store it. Like the worker
+// pool, each sender is hashed to one writer so a device's events are stored in the order
+// they were handled. When a writer's queue (DB_WRITE_QUEUE) is full, Add blocks, which
+// pushes back on the message workers instead of growing without bound.
+type asyncWriter struct {
+	store  Store
+	queues []chan EventMessage
+	wg     sync.WaitGroup
+	abort  chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+var dbWriter *asyncWriter
+
+var dbWriteWaits = newCounterVec("collector_db_write_queue_full_total", "Handlers that waited because a database writer queue was full.", "writer")
+
+func newAsyncWriter(store Store, writers, queueSize int) *asyncWriter {
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	w := &asyncWriter{store: store, queues: make([]chan EventMessage, writers), abort: make(chan struct{})}
+	for i := range w.queues {
+		queue := make(chan EventMessage, queueSize)
+		w.queues[i] = queue
+		w.wg.Add(1)
+		go w.run(queue)
+	}
+	newGaugeFunc("collector_db_write_queue_depth", "Events waiting for a database writer.", func() float64 {
+		return float64(w.Depth())
+	})
+	log.Printf("Started %d database writers with queue size %d", writers, queueSize)
+	return w
+}
+
+func (w *asyncWriter) run(queue chan EventMessage) {
+	defer w.wg.Done()
+	for data := range queue {
+		select {
+		case <-w.abort:
+			// The drain timed out; keep what is left for the spool replay.
+			outbox.Append(spoolRecord{Kind: spoolDatabase, IngestID: data.IngestID, Event: &data})
+		default:
+			processAndSaveDirect(w.store, data)
+		}
+	}
+}
+
+// Add queues data on its sender's writer. After Close it stores data directly.
+func (w *asyncWriter) Add(data EventMessage) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		processAndSaveDirect(w.store, data)
+		return
+	}
+	index := workerIndex(data.Sumber, len(w.queues))
+	select {
+	case w.queues[index] <- data:
+	default:
+		dbWriteWaits.Inc(fmt.Sprint(index))
+		w.queues[index] <- data
+	}
+}
+
+// Depth is the number of events queued across all writers.
+func (w *asyncWriter) Depth() int {
+	depth := 0
+	for _, queue := range w.queues {
+		depth += len(queue)
+	}
+	return depth
+}
+
+// Close stops accepting events and waits up to timeout for the queues to drain. Events
+// still queued after that are spooled rather than lost. It is safe to call on nil.
+func (w *asyncWriter) Close(timeout time.Duration) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	for _, queue := range w.queues {
+		close(queue)
+	}
+	w.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	log.Printf("Draining %d queued database writes", w.Depth())
+	select {
+	case <-done:
+	case <-clock.After(timeout):
+		log.Printf("Database writers did not drain within %v, spooling %d events", timeout, w.Depth())
+		close(w.abort)
+		<-done
+	}
+}